@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"sort"
+	"testing"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/cassette"
+	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+var record = flag.Bool("record", false, "record testdata/cassettes/discovery-apply.json with the ambient AWS credentials and OU_ID")
+
+const sessionCassette = "testdata/cassettes/discovery-apply.json"
+
+// TestCassetteSession replays a recorded discovery-plus-apply session through
+// AccountInOU, DiscoverALBs and UpsertPolicy. The replay fails when the calls, or the
+// request bodies, drift from the recording. Re-record it in a sandbox account with
+//
+//	OU_ID=ou-xxxx-xxxxxxxx go test ./cmd/lambda -run TestCassetteSession -record
+func TestCassetteSession(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+
+	ouID := os.Getenv("OU_ID")
+	var replayer *cassette.Replayer
+	if !*record {
+		c, err := cassette.Load(sessionCassette)
+		if err != nil {
+			t.Fatalf("load cassette: %v", err)
+		}
+		if ouID = recordedOU(c); ouID == "" {
+			t.Fatalf("the cassette has no OU membership check")
+		}
+		replayer = cassette.NewReplayer(c)
+	}
+	var opts []func(*awsconfig.LoadOptions) error
+	if replayer != nil {
+		// Offline, neither the shared config nor a credential source is needed.
+		opts = append(opts, awsconfig.WithRegion("us-west-2"),
+			awsconfig.WithSharedConfigFiles([]string{}), awsconfig.WithSharedCredentialsFiles([]string{}))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		t.Fatalf("load AWS config: %v", err)
+	}
+	if replayer != nil {
+		cassette.Replay(&awsCfg, replayer)
+	} else {
+		awsCfg.HTTPClient = cassette.NewRecorder(sessionCassette, awsCfg.HTTPClient)
+	}
+
+	inOU, err := discovery.AccountInOU(ctx, awsCfg, ouID, logger)
+	if err != nil || !inOU {
+		t.Fatalf("AccountInOU = %v, %v", inOU, err)
+	}
+	resources, err := discovery.DiscoverALBs(ctx, awsCfg, logger)
+	if err != nil || len(resources) == 0 {
+		t.Fatalf("DiscoverALBs = %d resource(s), %v", len(resources), err)
+	}
+
+	cfg, err := policyconfig.Load("testdata/config.yaml")
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	rendered, err := policy.BuildPolicies(resources, cfg, policy.Options{}, logger)
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	configHash, err := fmsapply.HashConfig(cfg)
+	if err != nil {
+		t.Fatalf("hash config: %v", err)
+	}
+	fmsClient := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, fmsClient, fmsapply.InventoryOptions{})
+	if err != nil {
+		t.Fatalf("load inventory: %v", err)
+	}
+	// Policies are applied in name order, the order the recording has them in.
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := rendered[name]
+		change, err := fmsapply.UpsertPolicy(ctx, fmsClient, inv, p, fmsapply.Options{OUID: ouID, ConfigHash: configHash}, logger)
+		if err != nil {
+			t.Fatalf("UpsertPolicy(%s): %v", p.Name, err)
+		}
+		t.Logf("%s: %s", p.Name, change.Action)
+	}
+
+	if replayer != nil {
+		if left := replayer.Remaining(); len(left) > 0 {
+			t.Fatalf("recorded calls not made: %v", left)
+		}
+	}
+}
+
+// recordedOU returns the OU whose membership the recorded session checked.
+func recordedOU(c *cassette.Cassette) string {
+	for _, in := range c.Interactions {
+		if in.Operation == "organizations:ListAccountsForParent" {
+			var body struct{ ParentId string }
+			if err := json.Unmarshal([]byte(in.Request.Body), &body); err == nil {
+				return body.ParentId
+			}
+		}
+	}
+	return ""
+}
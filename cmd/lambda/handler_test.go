@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/awsstub"
+)
+
+// handlerEnv are the environment variables the handler reads; each scenario starts with
+// them unset.
+var handlerEnv = []string{
+	"OU_ID", "CONFIG_SSM_PARAM", "CONFIG_PATH", "PRIMARY_TAG_KEY", "SECONDARY_TAG_KEY",
+	"DEFAULT_PRIMARY_RULES", "DEFAULT_SECONDARY_RULES", "TEMPLATE_DIR", "POLICY_HISTORY",
+}
+
+// TestHandlerScenarios runs the handler end to end against the AWS stand-in, once per
+// scenario in testdata/scenarios.
+func TestHandlerScenarios(t *testing.T) {
+	paths, err := filepath.Glob("testdata/scenarios/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no scenarios: %v", err)
+	}
+	for _, path := range paths {
+		scenario, err := awsstub.LoadScenario(path)
+		if err != nil {
+			t.Fatalf("load scenario: %v", err)
+		}
+		t.Run(scenario.Name, func(t *testing.T) {
+			runScenario(t, scenario)
+		})
+	}
+}
+
+func runScenario(t *testing.T, scenario *awsstub.Scenario) {
+	server := awsstub.NewServer(scenario.Responses)
+	defer server.Close()
+
+	// Every SDK client goes to the stand-in, with static credentials and no shared config.
+	none := filepath.Join(t.TempDir(), "none")
+	for key, value := range map[string]string{
+		"AWS_ENDPOINT_URL":            server.URL,
+		"AWS_REGION":                  "us-west-2",
+		"AWS_ACCESS_KEY_ID":           "AKIDSTUB",
+		"AWS_SECRET_ACCESS_KEY":       "stub",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+		"AWS_CONFIG_FILE":             none,
+		"AWS_SHARED_CREDENTIALS_FILE": none,
+		"AWS_EC2_METADATA_DISABLED":   "true",
+	} {
+		t.Setenv(key, value)
+	}
+	for _, key := range handlerEnv {
+		t.Setenv(key, "")
+	}
+	for key, value := range scenario.Env {
+		t.Setenv(key, value)
+	}
+
+	var event Event
+	data, err := json.Marshal(scenario.Event)
+	if err != nil {
+		t.Fatalf("marshal event: %v", err)
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("scenario event is not an Event: %v", err)
+	}
+
+	result, err := handler(context.Background(), event)
+	if unscripted := server.Unscripted(); len(unscripted) > 0 {
+		t.Errorf("unscripted calls: %s", strings.Join(unscripted, ", "))
+	}
+	want := scenario.Expect
+	switch {
+	case want.Error == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want.Error != "" && (err == nil || !strings.Contains(err.Error(), want.Error)):
+		t.Fatalf("expected an error containing %q, got %v", want.Error, err)
+	}
+	if result != want.Result {
+		t.Fatalf("unexpected result:\n got %q\nwant %q", result, want.Result)
+	}
+	for op, n := range want.Calls {
+		if got := server.Calls(op); got != n {
+			t.Errorf("%s called %d times, want %d", op, got, n)
+		}
+	}
+}
@@ -12,9 +12,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/configs"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/cassette"
 	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
 )
@@ -24,8 +26,28 @@ type Event struct {
 	DryRun bool `json:"dryRun"`
 	// Region allows overriding AWS region (optional).
 	Region string `json:"region"`
+	// Plan is a saved plan (from `renderer plan`) to execute instead of rendering.
+	Plan *fmsapply.Plan `json:"plan,omitempty"`
+	// PlanS3URI points at a saved plan in S3 (s3://bucket/key); used when Plan is empty.
+	PlanS3URI string `json:"planS3Uri,omitempty"`
+	// Adopt allows taking over same-named policies that lack the ownership tag.
+	Adopt bool `json:"adopt"`
+	// Mode selects what the invocation does: "" (or "apply") renders and applies the
+	// policies, "report" returns the compliance report of the owned policies.
+	Mode string `json:"mode,omitempty"`
+	// Format is the report format in report mode: json (default), csv or markdown.
+	Format string `json:"format,omitempty"`
+	// Force runs changes that exceed the config's safety limits.
+	Force bool `json:"force"`
+	// AcknowledgeBlock allows policies whose WAF default action becomes BLOCK.
+	AcknowledgeBlock bool `json:"acknowledgeBlock"`
 }
 
+const (
+	modeApply  = "apply"
+	modeReport = "report"
+)
+
 func main() {
 	lambda.Start(handler)
 }
@@ -39,11 +61,24 @@ func handler(ctx context.Context, event Event) (string, error) {
 		return "", err
 	}
 
+	switch event.Mode {
+	case "", modeApply:
+	case modeReport:
+		return complianceReport(ctx, awsCfg, event.Format, logger)
+	default:
+		return "", fmt.Errorf("unknown mode %q (want %s or %s)", event.Mode, modeApply, modeReport)
+	}
+
 	cfg, err := loadPolicyConfig(ctx, awsCfg, logger)
 	if err != nil {
 		logger.Errorf("load policy config: %v", err)
 		return "", err
 	}
+	checks, err := runPreflight(ctx, awsCfg, cfg, logger)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return "", err
+	}
 
 	ouID := os.Getenv("OU_ID")
 	inOU, err := discovery.AccountInOU(ctx, awsCfg, ouID, logger)
@@ -54,28 +89,131 @@ func handler(ctx context.Context, event Event) (string, error) {
 		return "account not in target OU; skipping", nil
 	}
 
-	resources, err := discovery.DiscoverALBs(ctx, awsCfg, logger)
+	resources, err := discoverResources(ctx, awsCfg, cfg, logger)
 	if err != nil {
-		return "", fmt.Errorf("discover resources: %w", err)
+		return "", err
+	}
+
+	if event.Plan != nil || event.PlanS3URI != "" {
+		return applyPlan(ctx, awsCfg, cfg, checks, resources, event, logger)
 	}
-	if len(resources) == 0 {
+
+	// With prune enabled an empty run still has to delete the policies of the resources
+	// that are gone, such as the last ALB in the account.
+	if len(resources) == 0 && len(cfg.SecurityGroupPolicies) == 0 && !cfg.Prune.Enabled {
 		logger.Warnf("no resources discovered; nothing to do")
 		return "no resources", nil
 	}
 
-	rendered, err := policy.BuildPolicies(resources, cfg, logger)
+	// TEMPLATE_DIR points at templates shipped alongside the binary in the Lambda package.
+	opts := policy.Options{TemplateDir: os.Getenv("TEMPLATE_DIR")}
+	rendered, err := policy.BuildPolicies(resources, cfg, opts, logger)
 	if err != nil {
 		return "", fmt.Errorf("build policies: %w", err)
 	}
 
+	configHash, err := fmsapply.HashConfig(cfg)
+	if err != nil {
+		return "", fmt.Errorf("hash config: %w", err)
+	}
+	// POLICY_HISTORY (a directory or s3://bucket/prefix) keeps the versions the run replaces.
+	versions, err := history.Open(awsCfg, os.Getenv("POLICY_HISTORY"))
+	if err != nil {
+		return "", fmt.Errorf("open version store: %w", err)
+	}
+	run := fmsapply.Options{OUID: ouID, DryRun: event.DryRun, Adopt: event.Adopt, ConfigHash: configHash, History: versions}
+
+	// The inventory lists the live policies once and serves both the upserts and the prune.
 	fmsClient := fms.NewFromConfig(awsCfg)
-	for _, p := range rendered {
-		if err := fmsapply.UpsertPolicy(ctx, fmsClient, p, ouID, event.DryRun, logger); err != nil {
-			return "", err
+	inv, err := fmsapply.LoadInventory(ctx, fmsClient, fmsapply.InventoryOptions{})
+	if err != nil {
+		return "", fmt.Errorf("load policy inventory: %w", err)
+	}
+
+	// The safety limits are checked against a plan of the whole run before anything is written.
+	plan, err := fmsapply.NewPlan(ctx, fmsClient, inv, rendered, "", run, fmsapply.PruneOptionsFor(cfg), logger)
+	if err != nil {
+		return "", fmt.Errorf("plan: %w", err)
+	}
+	if err := checkSafety(plan, cfg, event, logger); err != nil {
+		return "", err
+	}
+	if err := checkQuota(checks, plan, event, logger); err != nil {
+		return "", err
+	}
+
+	results, err := fmsapply.UpsertPolicies(ctx, fmsClient, inv, rendered, run, fmsapply.ApplyOptionsFor(cfg), logger)
+	counts := map[fmsapply.Action]int{}
+	canaries := map[fmsapply.CanaryOutcome]int{}
+	var changes []fmsapply.Change
+	for _, r := range results {
+		if r.Canary != "" {
+			canaries[r.Canary]++
+		}
+		if r.Err == nil {
+			counts[r.Change.Action]++
+			changes = append(changes, r.Change)
 		}
 	}
+	if err != nil {
+		return "", fmt.Errorf("apply policies (%d create, %d update, %d unchanged succeeded): %w",
+			counts[fmsapply.ActionCreate], counts[fmsapply.ActionUpdate], counts[fmsapply.ActionNoOp], err)
+	}
+
+	// Prune runs after the upserts so a failed render or apply never deletes anything.
+	orphans, err := fmsapply.Prune(ctx, fmsClient, inv, rendered, fmsapply.PruneOptionsFor(cfg), run, logger)
+	if err != nil {
+		return "", fmt.Errorf("prune: %w", err)
+	}
 
-	return fmt.Sprintf("processed %d resource(s)", len(rendered)), nil
+	summary := fmt.Sprintf("processed %d resource(s): %d create, %d update, %d delete, %d unchanged",
+		len(rendered), counts[fmsapply.ActionCreate], counts[fmsapply.ActionUpdate], len(orphans), counts[fmsapply.ActionNoOp])
+	if len(canaries) > 0 {
+		summary += fmt.Sprintf("; canary: %d started, %d waiting, %d promoted, %d reverted",
+			canaries[fmsapply.CanaryStarted], canaries[fmsapply.CanaryWaiting], canaries[fmsapply.CanaryPromoted], canaries[fmsapply.CanaryReverted])
+	}
+	if rollout := fmsapply.RolloutSummary(changes); rollout != "" {
+		summary += "; " + rollout
+	}
+	return summary, nil
+}
+
+// checkSafety enforces the config's safety limits on a plan. Dry runs only log the
+// violations.
+func checkSafety(plan *fmsapply.Plan, cfg *policyconfig.PolicyConfig, event Event, logger *util.Logger) error {
+	safety := fmsapply.SafetyOptionsFor(cfg)
+	safety.Force = event.Force
+	safety.AcknowledgeBlock = event.AcknowledgeBlock
+	err := fmsapply.EnforceSafety(plan, safety, logger)
+	if err != nil && event.DryRun {
+		logger.Warnf("dry run: %v", err)
+		return nil
+	}
+	return err
+}
+
+// discoverResources lists the ALBs, plus CloudFront distributions and tagged VPCs when the
+// config has entries that cover them.
+func discoverResources(ctx context.Context, awsCfg aws.Config, cfg *policyconfig.PolicyConfig, logger *util.Logger) ([]discovery.Resource, error) {
+	resources, err := discovery.DiscoverALBs(ctx, awsCfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("discover resources: %w", err)
+	}
+	if len(cfg.DefaultsFor(string(discovery.ResourceTypeCloudFront))) > 0 {
+		distributions, err := discovery.DiscoverCloudFront(ctx, awsCfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("discover CloudFront distributions: %w", err)
+		}
+		resources = append(resources, distributions...)
+	}
+	if len(cfg.DefaultsFor(string(discovery.ResourceTypeVPC))) > 0 {
+		vpcs, err := discovery.DiscoverVPCs(ctx, awsCfg, []string{cfg.TagKeys.Primary, cfg.TagKeys.Secondary}, logger)
+		if err != nil {
+			return nil, fmt.Errorf("discover VPCs: %w", err)
+		}
+		resources = append(resources, vpcs...)
+	}
+	return resources, nil
 }
 
 func loadPolicyConfig(ctx context.Context, awsCfg aws.Config, logger *util.Logger) (*policyconfig.PolicyConfig, error) {
@@ -143,5 +281,10 @@ func loadAWSConfig(ctx context.Context, region string) (awsCfg aws.Config, err e
 	} else {
 		awsCfg, err = awsconfig.LoadDefaultConfig(ctx)
 	}
+	if err != nil {
+		return
+	}
+	// AWS_CASSETTE records the session's API traffic, or replays a recording.
+	err = cassette.Attach(&awsCfg)
 	return
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	aws "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/preflight"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// applyPlan executes the saved plan from the event. The plan only runs when it was made
+// from the same config and discovered resources; with DryRun it is only checked and
+// logged.
+func applyPlan(ctx context.Context, awsCfg aws.Config, cfg *policyconfig.PolicyConfig, checks *preflight.Report, resources []discovery.Resource, event Event, logger *util.Logger) (string, error) {
+	plan := event.Plan
+	if plan == nil {
+		var err error
+		plan, err = loadPlanFromS3(ctx, awsCfg, event.PlanS3URI)
+		if err != nil {
+			return "", fmt.Errorf("load plan from %s: %w", event.PlanS3URI, err)
+		}
+	}
+
+	hash, err := fmsapply.HashInputs(cfg, resources)
+	if err != nil {
+		return "", fmt.Errorf("hash inputs: %w", err)
+	}
+	// A dry run fails on a stale plan too, so it shows whether the real run would apply.
+	if err := plan.CheckInputs(hash); err != nil {
+		return "", fmt.Errorf("apply plan: %w", err)
+	}
+	if err := checkSafety(plan, cfg, event, logger); err != nil {
+		return "", err
+	}
+	if err := checkQuota(checks, plan, event, logger); err != nil {
+		return "", err
+	}
+
+	counts := plan.Counts()
+	summary := fmt.Sprintf("%d create, %d update, %d delete, %d unchanged",
+		counts[fmsapply.ActionCreate], counts[fmsapply.ActionUpdate], counts[fmsapply.ActionDelete], counts[fmsapply.ActionNoOp])
+	if rollout := fmsapply.RolloutSummary(plan.Changes()); rollout != "" {
+		summary += "; " + rollout
+	}
+	if event.DryRun {
+		for _, planned := range plan.Policies {
+			logger.Infof("plan: %s", planned.Change)
+		}
+		return "dry-run plan: " + summary, nil
+	}
+
+	versions, err := history.Open(awsCfg, os.Getenv("POLICY_HISTORY"))
+	if err != nil {
+		return "", fmt.Errorf("open version store: %w", err)
+	}
+	fmsClient := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, fmsClient, fmsapply.InventoryOptions{})
+	if err != nil {
+		return "", fmt.Errorf("load policy inventory: %w", err)
+	}
+	if err := fmsapply.ApplyPlan(ctx, fmsClient, inv, plan, hash, versions, logger); err != nil {
+		return "", fmt.Errorf("apply plan: %w", err)
+	}
+	return "applied plan: " + summary, nil
+}
+
+func loadPlanFromS3(ctx context.Context, awsCfg aws.Config, uri string) (*fmsapply.Plan, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !strings.HasPrefix(uri, "s3://") || !ok || bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URI %q (want s3://bucket/key)", uri)
+	}
+
+	out, err := s3.NewFromConfig(awsCfg).GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read object: %w", err)
+	}
+	var plan fmsapply.Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("unmarshal plan: %w", err)
+	}
+	return &plan, nil
+}
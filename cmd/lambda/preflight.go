@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	aws "github.com/aws/aws-sdk-go-v2/aws"
+
+	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/preflight"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// runPreflight fails the run before discovery when the account is not the FMS
+// administrator or the role lacks a permission. The report it returns, nil when the checks
+// are disabled, holds the policy quota checkQuota tests the plan against.
+func runPreflight(ctx context.Context, awsCfg aws.Config, cfg *policyconfig.PolicyConfig, logger *util.Logger) (*preflight.Report, error) {
+	if cfg.Preflight.Disabled {
+		logger.Warnf("preflight checks disabled by config")
+		return nil, nil
+	}
+	report := preflight.Run(ctx, preflight.NewClients(awsCfg), preflight.Options{
+		Region:          awsCfg.Region,
+		PolicyQuota:     cfg.Preflight.EffectivePolicyQuota(),
+		ConfigParam:     os.Getenv("CONFIG_SSM_PARAM"),
+		HistoryLocation: os.Getenv("POLICY_HISTORY"),
+	})
+	for _, r := range report.Results {
+		switch {
+		case r.Warning:
+			logger.Warnf("preflight %s: %s", r.Check, r.Detail)
+		case r.OK:
+			logger.Infof("preflight %s: %s", r.Check, r.Detail)
+		}
+	}
+	return report, report.Err()
+}
+
+// checkQuota fails the run when the plan creates more policies than the quota has room
+// for. Dry runs only log it.
+func checkQuota(checks *preflight.Report, plan *fmsapply.Plan, event Event, logger *util.Logger) error {
+	if checks == nil {
+		return nil
+	}
+	err := checks.CheckCreates(plan.Counts()[fmsapply.ActionCreate])
+	if err != nil && event.DryRun {
+		logger.Warnf("dry run: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	aws "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/compliance"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// complianceReport implements `mode: report`: it returns the compliance report of the
+// owned policies, rendered in the requested format.
+func complianceReport(ctx context.Context, awsCfg aws.Config, format string, logger *util.Logger) (string, error) {
+	f, err := compliance.ParseFormat(format)
+	if err != nil {
+		return "", err
+	}
+	client := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, client, fmsapply.InventoryOptions{})
+	if err != nil {
+		return "", fmt.Errorf("load policy inventory: %w", err)
+	}
+	policies, err := fmsapply.OwnedPolicies(ctx, inv)
+	if err != nil {
+		return "", fmt.Errorf("list owned policies: %w", err)
+	}
+	report, err := compliance.Collect(ctx, client, policies)
+	if err != nil {
+		return "", fmt.Errorf("collect compliance: %w", err)
+	}
+	logger.Infof("compliance: %s", report.Summary())
+
+	var out strings.Builder
+	if err := report.Write(&out, f); err != nil {
+		return "", fmt.Errorf("write report: %w", err)
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/preflight"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// runDoctor implements `renderer doctor`: it runs the Lambda's preflight checks with the
+// current credentials and prints how to fix what fails.
+func runDoctor(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	for _, name := range []string{"config", "region"} {
+		f := flag.CommandLine.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	configParam := fs.String("config-param", os.Getenv("CONFIG_SSM_PARAM"), "SSM parameter the Lambda reads its config from. Defaults to $CONFIG_SSM_PARAM.")
+	location := historyFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := policyconfig.Load(*flagConfig)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	awsCfg, err := loadAWSConfig(ctx, *flagRegion)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	report := preflight.Run(ctx, preflight.NewClients(awsCfg), preflight.Options{
+		Region:          awsCfg.Region,
+		PolicyQuota:     cfg.Preflight.EffectivePolicyQuota(),
+		ConfigParam:     *configParam,
+		HistoryLocation: *location,
+	})
+	if err := report.Write(os.Stdout); err != nil {
+		return err
+	}
+	if err := report.Err(); err != nil {
+		return err
+	}
+	logger.Infof("all preflight checks passed")
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// runDrift implements `renderer drift`: it lists the owned policies that were edited
+// outside the tool since it last wrote them.
+func runDrift(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("drift", flag.ContinueOnError)
+	region := fs.String("region", "", "AWS region of the FMS administrator. If empty, uses default config.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, *region)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	inv, err := fmsapply.LoadInventory(ctx, fms.NewFromConfig(awsCfg), fmsapply.InventoryOptions{})
+	if err != nil {
+		return fmt.Errorf("load policy inventory: %w", err)
+	}
+	drifts, err := fmsapply.DetectDrift(ctx, inv)
+	if err != nil {
+		return fmt.Errorf("detect drift: %w", err)
+	}
+	if len(drifts) == 0 {
+		logger.Infof("no drift detected")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tID\tSOURCE")
+	for _, d := range drifts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Policy, d.PolicyID, d.Source)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%d policies drifted", len(drifts))
+}
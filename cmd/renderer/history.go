@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// historyFlag registers -history, the version store of replaced policies.
+func historyFlag(fs *flag.FlagSet) *string {
+	return fs.String("history", os.Getenv("POLICY_HISTORY"), "Version store for replaced policies: a directory or s3://bucket/prefix. Defaults to $POLICY_HISTORY; empty keeps no history.")
+}
+
+// parsePolicyArgs parses a subcommand that takes one policy name, accepting the flags
+// before or after it (`rollback <policy> --to 3`).
+func parsePolicyArgs(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() == 0 {
+		return "", fmt.Errorf("missing policy name")
+	}
+	name := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 0 {
+		return "", fmt.Errorf("unexpected arguments %s", strings.Join(fs.Args(), " "))
+	}
+	return name, nil
+}
+
+// runHistory implements `renderer history <policy>`: it lists the stored versions of a
+// policy.
+func runHistory(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	location := historyFlag(fs)
+	region := fs.String("region", "", "AWS region of the S3 version store. If empty, uses default config.")
+	name, err := parsePolicyArgs(fs, args)
+	if err != nil {
+		return fmt.Errorf("usage: renderer history [flags] <policy>: %w", err)
+	}
+	store, err := openHistory(ctx, *region, *location)
+	if err != nil {
+		return err
+	}
+
+	versions, err := store.List(ctx, name)
+	if err != nil {
+		return fmt.Errorf("list versions of %s: %w", name, err)
+	}
+	if len(versions) == 0 {
+		logger.Infof("no stored versions of %s", name)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSAVED AT\tPOLICY ID\tCONFIG HASH\tREMEDIATION")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\n", v.Number, v.SavedAt.Format(time.RFC3339), v.PolicyID, v.Tags[fmsapply.TagConfigHash], v.Policy.RemediationEnabled)
+	}
+	return w.Flush()
+}
+
+// runRollback implements `renderer rollback <policy> --to N`: it re-applies a stored
+// version of a policy.
+func runRollback(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	location := historyFlag(fs)
+	region := fs.String("region", "", "AWS region of the FMS administrator. If empty, uses default config.")
+	to := fs.Int("to", 0, "Version to restore, as listed by `renderer history`.")
+	dryRun := fs.Bool("dry-run", false, "Only print the change the rollback would make.")
+	name, err := parsePolicyArgs(fs, args)
+	if err != nil {
+		return fmt.Errorf("usage: renderer rollback [flags] <policy> -to N: %w", err)
+	}
+	if *to <= 0 {
+		return fmt.Errorf("usage: renderer rollback [flags] <policy> -to N: -to is required")
+	}
+	store, err := openHistory(ctx, *region, *location)
+	if err != nil {
+		return err
+	}
+	v, err := store.Get(ctx, name, *to)
+	if err != nil {
+		return err
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, *region)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	client := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, client, fmsapply.InventoryOptions{})
+	if err != nil {
+		return fmt.Errorf("load policy inventory: %w", err)
+	}
+	change, err := fmsapply.Rollback(ctx, client, inv, v, fmsapply.Options{DryRun: *dryRun, History: store}, logger)
+	if err != nil {
+		return fmt.Errorf("roll back %s to version %d: %w", name, v.Number, err)
+	}
+	fmt.Println(change)
+	if !*dryRun && change.Action != fmsapply.ActionNoOp {
+		logger.Infof("rolled back %s to version %d; the next run from the config overwrites it", name, v.Number)
+	}
+	return nil
+}
+
+// openHistory opens the version store at location, which must be set.
+func openHistory(ctx context.Context, region, location string) (history.Store, error) {
+	if location == "" {
+		return nil, fmt.Errorf("no version store: set -history or $POLICY_HISTORY")
+	}
+	awsCfg, err := loadAWSConfig(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return history.Open(awsCfg, location)
+}
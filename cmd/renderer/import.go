@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/importer"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// runImport implements `renderer import`: it reads the live FMS WAF policies and writes a
+// policy-variants.yaml that reproduces them, plus a report on stdout.
+func runImport(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	output := fs.String("output", "generated/imported-policy-variants.yaml", "Path to write the generated config.")
+	region := fs.String("region", "", "AWS region of the FMS administrator. If empty, uses default config.")
+	primaryKey := fs.String("primary-tag-key", "WafRulesetPrimary", "Tag key for the primary rule set in the generated config.")
+	secondaryKey := fs.String("secondary-tag-key", "WafRulesetSecondary", "Tag key for the secondary rule set in the generated config.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, *region)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+
+	logger.Infof("listing FMS policies")
+	policies, err := importer.FetchPolicies(ctx, fms.NewFromConfig(awsCfg))
+	if err != nil {
+		return fmt.Errorf("fetch policies: %w", err)
+	}
+	logger.Infof("fetched %d policies", len(policies))
+
+	tagKeys := policyconfig.TagKeys{Primary: *primaryKey, Secondary: *secondaryKey}
+	cfg, report, err := importer.Build(policies, tagKeys)
+	if report != nil {
+		if werr := report.Write(os.Stdout, tagKeys); werr != nil {
+			logger.Warnf("write report: %v", werr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("build config: %w", err)
+	}
+
+	data, err := importer.MarshalConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(*output), 0o755); err != nil {
+		return fmt.Errorf("ensure output dir: %w", err)
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		return fmt.Errorf("write output file: %w", err)
+	}
+
+	logger.Infof("wrote config for %d imported policies to %s", len(report.Mappings), *output)
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 
 	aws "github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/cassette"
 	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
@@ -16,18 +17,40 @@ import (
 )
 
 var (
-	flagDiscover = flag.Bool("discover", false, "Discover resources from AWS instead of reading -input JSON.")
-	flagInput    = flag.String("input", "resources.json", "Input resources JSON file when -discover=false.")
-	flagConfig   = flag.String("config", "configs/policy-variants.yaml", "Path to policy variants YAML config.")
-	flagOutput   = flag.String("output", "generated/policies.json", "Path to write rendered policies JSON.")
-	flagRegion   = flag.String("region", "", "AWS region for discovery (e.g. us-west-2). If empty, uses default config.")
+	flagDiscover  = flag.Bool("discover", false, "Discover resources from AWS instead of reading -input JSON.")
+	flagInput     = flag.String("input", "resources.json", "Input resources JSON file when -discover=false.")
+	flagConfig    = flag.String("config", "configs/policy-variants.yaml", "Path to policy variants YAML config.")
+	flagOutput    = flag.String("output", "generated/policies.json", "Path to write rendered policies JSON.")
+	flagRegion    = flag.String("region", "", "AWS region for discovery (e.g. us-west-2). If empty, uses default config.")
+	flagTemplates = flag.String("templates-dir", "", "Directory of custom templates (<type>.tmpl, fms_policy.tmpl). If empty, uses the typed builder.")
 )
 
 func main() {
-	flag.Parse()
-
 	logger := util.NewLogger()
 
+	// Subcommands come first; without one the renderer keeps its flag-only interface.
+	if len(os.Args) > 1 {
+		subcommands := map[string]func(context.Context, []string, *util.Logger) error{
+			"import":   runImport,
+			"plan":     runPlan,
+			"apply":    runApply,
+			"drift":    runDrift,
+			"report":   runReport,
+			"history":  runHistory,
+			"rollback": runRollback,
+			"doctor":   runDoctor,
+		}
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			if err := sub(context.Background(), os.Args[2:], logger); err != nil {
+				logger.Errorf("fatal error: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	flag.Parse()
+
 	if err := run(context.Background(), logger); err != nil {
 		logger.Errorf("fatal error: %v", err)
 		os.Exit(1)
@@ -43,39 +66,18 @@ func run(ctx context.Context, logger *util.Logger) error {
 		return fmt.Errorf("load config: %w", err)
 	}
 
-	var resources []discovery.Resource
-
-	if *flagDiscover {
-		logger.Infof("discovering resources from AWS")
-		awsCfg, err := loadAWSConfig(ctx, *flagRegion)
-		if err != nil {
-			return fmt.Errorf("load AWS config: %w", err)
-		}
-
-		resources, err = discovery.DiscoverALBs(ctx, awsCfg, logger)
-		if err != nil {
-			return fmt.Errorf("discover ALBs: %w", err)
-		}
-		logger.Infof("discovered %d ALB resources", len(resources))
-	} else {
-		logger.Infof("reading resources from %s", *flagInput)
-		data, err := os.ReadFile(*flagInput)
-		if err != nil {
-			return fmt.Errorf("read input: %w", err)
-		}
-		if err := json.Unmarshal(data, &resources); err != nil {
-			return fmt.Errorf("unmarshal input resources: %w", err)
-		}
-		logger.Infof("loaded %d resources from file", len(resources))
+	resources, err := loadResources(ctx, cfg, logger)
+	if err != nil {
+		return err
 	}
 
-	if len(resources) == 0 {
+	if len(resources) == 0 && len(cfg.SecurityGroupPolicies) == 0 {
 		logger.Warnf("no resources discovered or loaded; nothing to do")
 		return nil
 	}
 
 	logger.Infof("building policies from resources")
-	rendered, err := policy.BuildPolicies(resources, cfg, logger)
+	rendered, err := policy.BuildPolicies(resources, cfg, policy.Options{TemplateDir: *flagTemplates}, logger)
 	if err != nil {
 		return fmt.Errorf("build policies: %w", err)
 	}
@@ -97,6 +99,56 @@ func run(ctx context.Context, logger *util.Logger) error {
 	return nil
 }
 
+// loadResources discovers resources from AWS with -discover, or reads them from -input.
+func loadResources(ctx context.Context, cfg *policyconfig.PolicyConfig, logger *util.Logger) ([]discovery.Resource, error) {
+	if !*flagDiscover {
+		logger.Infof("reading resources from %s", *flagInput)
+		data, err := os.ReadFile(*flagInput)
+		if err != nil {
+			return nil, fmt.Errorf("read input: %w", err)
+		}
+		var resources []discovery.Resource
+		if err := json.Unmarshal(data, &resources); err != nil {
+			return nil, fmt.Errorf("unmarshal input resources: %w", err)
+		}
+		logger.Infof("loaded %d resources from file", len(resources))
+		return resources, nil
+	}
+
+	logger.Infof("discovering resources from AWS")
+	awsCfg, err := loadAWSConfig(ctx, *flagRegion)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	resources, err := discovery.DiscoverALBs(ctx, awsCfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("discover ALBs: %w", err)
+	}
+	logger.Infof("discovered %d ALB resources", len(resources))
+
+	// CloudFront is only listed when the config has an entry that covers it.
+	if len(cfg.DefaultsFor(string(discovery.ResourceTypeCloudFront))) > 0 {
+		distributions, err := discovery.DiscoverCloudFront(ctx, awsCfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("discover CloudFront distributions: %w", err)
+		}
+		logger.Infof("discovered %d CloudFront distributions", len(distributions))
+		resources = append(resources, distributions...)
+	}
+
+	// VPCs are only listed for firewall entries, and only when they carry a selector tag.
+	if len(cfg.DefaultsFor(string(discovery.ResourceTypeVPC))) > 0 {
+		vpcs, err := discovery.DiscoverVPCs(ctx, awsCfg, []string{cfg.TagKeys.Primary, cfg.TagKeys.Secondary}, logger)
+		if err != nil {
+			return nil, fmt.Errorf("discover VPCs: %w", err)
+		}
+		logger.Infof("discovered %d tagged VPCs", len(vpcs))
+		resources = append(resources, vpcs...)
+	}
+	return resources, nil
+}
+
 // loadAWSConfig wraps aws-sdk-go-v2's loader so that callers can optionally pin a region.
 // Keeping this logic in one place makes it easier to add credentials/profile support later.
 func loadAWSConfig(ctx context.Context, region string) (awsCfg aws.Config, err error) {
@@ -105,5 +157,10 @@ func loadAWSConfig(ctx context.Context, region string) (awsCfg aws.Config, err e
 	} else {
 		awsCfg, err = awsconfig.LoadDefaultConfig(ctx)
 	}
+	if err != nil {
+		return
+	}
+	// AWS_CASSETTE records the session's API traffic, or replays a recording.
+	err = cassette.Attach(&awsCfg)
 	return
 }
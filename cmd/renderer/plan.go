@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	policyconfig "github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// inputFlags registers the top-level flags that select the config and the resources on a
+// subcommand's flag set, so plan and apply read their inputs the same way as rendering.
+func inputFlags(fs *flag.FlagSet) {
+	for _, name := range []string{"discover", "input", "config", "region", "templates-dir"} {
+		f := flag.CommandLine.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// loadInputs loads the config and the resources and returns their hash.
+func loadInputs(ctx context.Context, logger *util.Logger) (*policyconfig.PolicyConfig, []discovery.Resource, string, error) {
+	logger.Infof("loading policy config from %s", *flagConfig)
+	cfg, err := policyconfig.Load(*flagConfig)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("load config: %w", err)
+	}
+	resources, err := loadResources(ctx, cfg, logger)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	hash, err := fmsapply.HashInputs(cfg, resources)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("hash inputs: %w", err)
+	}
+	return cfg, resources, hash, nil
+}
+
+// runPlan implements `renderer plan`: it renders the policies, diffs them against FMS and
+// saves the result for `renderer apply`.
+func runPlan(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	inputFlags(fs)
+	out := fs.String("out", "generated/plan.json", "Path to write the plan.")
+	ouID := fs.String("ou-id", os.Getenv("OU_ID"), "OU to scope the policies to (FMS IncludeMap). Defaults to $OU_ID.")
+	adopt := fs.Bool("adopt", false, "Take over same-named policies that lack the ownership tag.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, resources, hash, err := loadInputs(ctx, logger)
+	if err != nil {
+		return err
+	}
+	rendered, err := policy.BuildPolicies(resources, cfg, policy.Options{TemplateDir: *flagTemplates}, logger)
+	if err != nil {
+		return fmt.Errorf("build policies: %w", err)
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, *flagRegion)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	configHash, err := fmsapply.HashConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("hash config: %w", err)
+	}
+	run := fmsapply.Options{OUID: *ouID, Adopt: *adopt, ConfigHash: configHash}
+	client := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, client, fmsapply.InventoryOptions{})
+	if err != nil {
+		return fmt.Errorf("load policy inventory: %w", err)
+	}
+	plan, err := fmsapply.NewPlan(ctx, client, inv, rendered, hash, run, fmsapply.PruneOptionsFor(cfg), logger)
+	if err != nil {
+		return fmt.Errorf("plan: %w", err)
+	}
+
+	for _, planned := range plan.Policies {
+		fmt.Println(planned.Change)
+	}
+	counts := plan.Counts()
+	fmt.Printf("\nPlan: %d to create, %d to update, %d to delete, %d unchanged.\n",
+		counts[fmsapply.ActionCreate], counts[fmsapply.ActionUpdate], counts[fmsapply.ActionDelete], counts[fmsapply.ActionNoOp])
+	if rollout := fmsapply.RolloutSummary(plan.Changes()); rollout != "" {
+		fmt.Printf("Staged %s.\n", rollout)
+	}
+	if violations := fmsapply.CheckSafety(plan, fmsapply.SafetyOptionsFor(cfg)); len(violations) > 0 {
+		fmt.Println("\nSafety limits exceeded; apply needs -force (or -acknowledge-block for BLOCK):")
+		for _, v := range violations {
+			fmt.Printf("  - %s\n", v)
+		}
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal plan: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*out), 0o755); err != nil {
+		return fmt.Errorf("ensure output dir: %w", err)
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		return fmt.Errorf("write plan: %w", err)
+	}
+	logger.Infof("wrote plan for %d policies to %s", len(plan.Policies), *out)
+	return nil
+}
+
+// runApply implements `renderer apply plan.json`: it executes a saved plan, refusing to
+// run when the config, the resources or a live policy changed since planning.
+func runApply(ctx context.Context, args []string, logger *util.Logger) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	inputFlags(fs)
+	location := historyFlag(fs)
+	force := fs.Bool("force", false, "Apply even if the plan exceeds the config's safety limits.")
+	acknowledgeBlock := fs.Bool("acknowledge-block", false, "Allow policies whose WAF default action becomes BLOCK.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: renderer apply [flags] plan.json")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("read plan: %w", err)
+	}
+	var plan fmsapply.Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("unmarshal plan: %w", err)
+	}
+
+	cfg, _, hash, err := loadInputs(ctx, logger)
+	if err != nil {
+		return err
+	}
+	safety := fmsapply.SafetyOptionsFor(cfg)
+	safety.Force, safety.AcknowledgeBlock = *force, *acknowledgeBlock
+	if err := fmsapply.EnforceSafety(&plan, safety, logger); err != nil {
+		return err
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, *flagRegion)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	versions, err := history.Open(awsCfg, *location)
+	if err != nil {
+		return fmt.Errorf("open version store: %w", err)
+	}
+	client := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, client, fmsapply.InventoryOptions{})
+	if err != nil {
+		return fmt.Errorf("load policy inventory: %w", err)
+	}
+	if err := fmsapply.ApplyPlan(ctx, client, inv, &plan, hash, versions, logger); err != nil {
+		return fmt.Errorf("apply plan: %w", err)
+	}
+
+	counts := plan.Counts()
+	logger.Infof("applied plan: %d created, %d updated, %d deleted, %d unchanged",
+		counts[fmsapply.ActionCreate], counts[fmsapply.ActionUpdate], counts[fmsapply.ActionDelete], counts[fmsapply.ActionNoOp])
+	return nil
+}
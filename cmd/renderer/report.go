@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/compliance"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// runReport implements `renderer report compliance`: it reports, per member account and
+// per resource, where the owned policies are violated.
+func runReport(ctx context.Context, args []string, logger *util.Logger) error {
+	if len(args) == 0 || args[0] != "compliance" {
+		return fmt.Errorf("usage: renderer report compliance [-format json|csv|markdown] [-output file]")
+	}
+	fs := flag.NewFlagSet("report compliance", flag.ContinueOnError)
+	format := fs.String("format", "json", "Output format: json, csv or markdown.")
+	output := fs.String("output", "", "Path to write the report. If empty, writes to stdout.")
+	region := fs.String("region", "", "AWS region of the FMS administrator. If empty, uses default config.")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	f, err := compliance.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, *region)
+	if err != nil {
+		return fmt.Errorf("load AWS config: %w", err)
+	}
+	client := fms.NewFromConfig(awsCfg)
+	inv, err := fmsapply.LoadInventory(ctx, client, fmsapply.InventoryOptions{})
+	if err != nil {
+		return fmt.Errorf("load policy inventory: %w", err)
+	}
+	policies, err := fmsapply.OwnedPolicies(ctx, inv)
+	if err != nil {
+		return fmt.Errorf("list owned policies: %w", err)
+	}
+	logger.Infof("reading compliance of %d owned policies", len(policies))
+	report, err := compliance.Collect(ctx, client, policies)
+	if err != nil {
+		return fmt.Errorf("collect compliance: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := report.Write(w, f); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	logger.Infof("compliance: %s", report.Summary())
+	return nil
+}
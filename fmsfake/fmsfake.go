@@ -0,0 +1,613 @@
+// Package fmsfake is an in-memory AWS Firewall Manager for tests. FMS implements the
+// client methods the tool calls, with the semantics the tool relies on: paginated
+// listings, update tokens that change on every write and reject stale writes, not-found
+// errors for unknown IDs, tags and compliance. Tests seed and inspect its state through
+// the methods below, and can queue errors for PutPolicy.
+//
+// FMS is safe for concurrent use. It satisfies fmsapply.API and compliance.API.
+package fmsfake
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+)
+
+// Account and Region appear in the ARNs the fake returns.
+const (
+	Account = "123456789012"
+	Region  = "us-west-2"
+)
+
+// DefaultPageSize is the page size of the list operations when neither FMS.PageSize nor
+// the request's MaxResults is set.
+const DefaultPageSize = 100
+
+// Operation names, as counted by Calls.
+const (
+	OpListPolicies              = "ListPolicies"
+	OpGetPolicy                 = "GetPolicy"
+	OpPutPolicy                 = "PutPolicy"
+	OpDeletePolicy              = "DeletePolicy"
+	OpListComplianceStatus      = "ListComplianceStatus"
+	OpGetComplianceDetail       = "GetComplianceDetail"
+	OpGetViolationDetails       = "GetViolationDetails"
+	OpListTagsForResource       = "ListTagsForResource"
+	OpTagResource               = "TagResource"
+	OpUntagResource             = "UntagResource"
+	OpListResourceSets          = "ListResourceSets"
+	OpGetResourceSet            = "GetResourceSet"
+	OpPutResourceSet            = "PutResourceSet"
+	OpDeleteResourceSet         = "DeleteResourceSet"
+	OpListResourceSetResources  = "ListResourceSetResources"
+	OpBatchAssociateResource    = "BatchAssociateResource"
+	OpBatchDisassociateResource = "BatchDisassociateResource"
+)
+
+// FMS is an in-memory Firewall Manager. The zero value is not usable; call New.
+type FMS struct {
+	// PageSize bounds the items per page of the list operations. A request's smaller
+	// MaxResults wins. Zero means DefaultPageSize.
+	PageSize int
+
+	mu           sync.Mutex
+	nextID       int
+	policies     map[string]fmstypes.Policy
+	tags         map[string]map[string]string // keyed by ARN
+	compliance   map[string][]fmstypes.PolicyComplianceStatus
+	details      map[string]map[string]fmstypes.PolicyComplianceDetail // policy ID, then account
+	violations   map[string]fmstypes.ViolationDetail                   // keyed by resource ID
+	resourceSets map[string]fmstypes.ResourceSet
+	members      map[string]map[string]bool
+	deleted      map[string]bool
+	putErrors    map[string][]error // keyed by policy name
+	tagErrors    map[string][]error // keyed by ARN
+	calls        map[string]int
+}
+
+// New returns an empty FMS.
+func New() *FMS {
+	return &FMS{
+		policies:     map[string]fmstypes.Policy{},
+		tags:         map[string]map[string]string{},
+		compliance:   map[string][]fmstypes.PolicyComplianceStatus{},
+		details:      map[string]map[string]fmstypes.PolicyComplianceDetail{},
+		violations:   map[string]fmstypes.ViolationDetail{},
+		resourceSets: map[string]fmstypes.ResourceSet{},
+		members:      map[string]map[string]bool{},
+		deleted:      map[string]bool{},
+		putErrors:    map[string][]error{},
+		tagErrors:    map[string][]error{},
+		calls:        map[string]int{},
+	}
+}
+
+// PolicyARN returns the ARN of a policy ID.
+func PolicyARN(id string) string {
+	return fmt.Sprintf("arn:aws:fms:%s:%s:policy/%s", Region, Account, id)
+}
+
+// ResourceSetARN returns the ARN of a resource set ID.
+func ResourceSetARN(id string) string {
+	return fmt.Sprintf("arn:aws:fms:%s:%s:resource-set/%s", Region, Account, id)
+}
+
+// id returns a new identifier. IDs are zero-padded so they sort in creation order.
+func (f *FMS) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%04d", prefix, f.nextID)
+}
+
+// AddPolicy stores a policy as if it were created outside the tool, e.g. in the console,
+// and tags it. Missing IDs and update tokens are assigned. It returns the policy ID.
+func (f *FMS) AddPolicy(p fmstypes.Policy, tags map[string]string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p.PolicyId == nil {
+		p.PolicyId = aws.String(f.id("policy"))
+	}
+	if p.PolicyUpdateToken == nil {
+		p.PolicyUpdateToken = aws.String(f.id("token"))
+	}
+	f.policies[*p.PolicyId] = p
+	for k, v := range tags {
+		f.tag(PolicyARN(*p.PolicyId), k, v)
+	}
+	return *p.PolicyId
+}
+
+// EditPolicy changes a policy as if it were edited outside the tool. Like any write, it
+// gives the policy a new update token. It reports whether the policy exists.
+func (f *FMS) EditPolicy(id string, edit func(*fmstypes.Policy)) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.policies[id]
+	if !ok {
+		return false
+	}
+	edit(&p)
+	p.PolicyId = aws.String(id)
+	p.PolicyUpdateToken = aws.String(f.id("token"))
+	f.policies[id] = p
+	return true
+}
+
+// RemovePolicy deletes a policy as if it were deleted outside the tool.
+func (f *FMS) RemovePolicy(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.policies, id)
+}
+
+// Policy returns a stored policy.
+func (f *FMS) Policy(id string) (fmstypes.Policy, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.policies[id]
+	return p, ok
+}
+
+// PolicyIDs returns the IDs of the stored policies in creation order.
+func (f *FMS) PolicyIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.policyIDs()
+}
+
+func (f *FMS) policyIDs() []string {
+	ids := make([]string, 0, len(f.policies))
+	for id := range f.policies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// PolicyID returns the ID of the policy with a name.
+func (f *FMS) PolicyID(name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range f.policyIDs() {
+		if aws.ToString(f.policies[id].PolicyName) == name {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// Tags returns a copy of the tags of a policy.
+func (f *FMS) Tags(id string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]string{}
+	for k, v := range f.tags[PolicyARN(id)] {
+		out[k] = v
+	}
+	return out
+}
+
+// Deleted reports whether DeletePolicy deleted a policy, and with which
+// DeleteAllPolicyResources.
+func (f *FMS) Deleted(id string) (deleteAllPolicyResources, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleteAllPolicyResources, ok = f.deleted[id]
+	return deleteAllPolicyResources, ok
+}
+
+// SetCompliance sets the compliance status FMS reports for a policy, one entry per member
+// account.
+func (f *FMS) SetCompliance(policyID string, statuses ...fmstypes.PolicyComplianceStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.compliance[policyID] = statuses
+}
+
+// SetComplianceDetail sets the compliance detail of a policy in one member account.
+func (f *FMS) SetComplianceDetail(policyID, account string, detail fmstypes.PolicyComplianceDetail) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.details[policyID] == nil {
+		f.details[policyID] = map[string]fmstypes.PolicyComplianceDetail{}
+	}
+	f.details[policyID][account] = detail
+}
+
+// SetViolationDetail sets the violation detail of a resource.
+func (f *FMS) SetViolationDetail(resourceID string, detail fmstypes.ViolationDetail) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.violations[resourceID] = detail
+}
+
+// FailPut queues errors for the next PutPolicy calls of a policy, one per call, before
+// the call has any effect.
+func (f *FMS) FailPut(policyName string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.putErrors[policyName] = append(f.putErrors[policyName], errs...)
+}
+
+// FailTag queues errors for the next TagResource calls on an ARN, one per call, before
+// the call has any effect.
+func (f *FMS) FailTag(arn string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tagErrors[arn] = append(f.tagErrors[arn], errs...)
+}
+
+// Calls returns how often an operation was called, e.g. Calls(OpPutPolicy).
+func (f *FMS) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// ResourceSets returns the stored resource sets in creation order.
+func (f *FMS) ResourceSets() []fmstypes.ResourceSet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.resourceSets))
+	for id := range f.resourceSets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := make([]fmstypes.ResourceSet, len(ids))
+	for i, id := range ids {
+		out[i] = f.resourceSets[id]
+	}
+	return out
+}
+
+// ResourceSetMembers returns the sorted resource URIs of a resource set.
+func (f *FMS) ResourceSetMembers(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.memberList(id)
+}
+
+func (f *FMS) memberList(id string) []string {
+	uris := make([]string, 0, len(f.members[id]))
+	for uri := range f.members[id] {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+// call counts an operation and locks the fake; the caller unlocks it.
+func (f *FMS) call(op string) {
+	f.mu.Lock()
+	f.calls[op]++
+}
+
+func (f *FMS) tag(arn, key, value string) {
+	if f.tags[arn] == nil {
+		f.tags[arn] = map[string]string{}
+	}
+	f.tags[arn][key] = value
+}
+
+func notFound(what string) error {
+	return &fmstypes.ResourceNotFoundException{Message: aws.String(what + " not found")}
+}
+
+// page returns the bounds of the page that token starts, and the token of the next page.
+func (f *FMS) page(n int, token *string, maxResults *int32) (start, end int, next *string, err error) {
+	if token != nil {
+		start, err = strconv.Atoi(*token)
+		if err != nil || start < 0 || start > n {
+			return 0, 0, nil, &fmstypes.InvalidInputException{Message: aws.String("invalid NextToken")}
+		}
+	}
+	size := f.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	if maxResults != nil && int(*maxResults) > 0 && int(*maxResults) < size {
+		size = int(*maxResults)
+	}
+	end = min(start+size, n)
+	if end < n {
+		next = aws.String(strconv.Itoa(end))
+	}
+	return start, end, next, nil
+}
+
+// ListPolicies pages through the policies in creation order.
+func (f *FMS) ListPolicies(_ context.Context, in *fms.ListPoliciesInput, _ ...func(*fms.Options)) (*fms.ListPoliciesOutput, error) {
+	f.call(OpListPolicies)
+	defer f.mu.Unlock()
+	ids := f.policyIDs()
+	start, end, next, err := f.page(len(ids), in.NextToken, in.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	out := &fms.ListPoliciesOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		p := f.policies[id]
+		out.PolicyList = append(out.PolicyList, fmstypes.PolicySummary{
+			PolicyId:            aws.String(id),
+			PolicyArn:           aws.String(PolicyARN(id)),
+			PolicyName:          p.PolicyName,
+			RemediationEnabled:  p.RemediationEnabled,
+			ResourceType:        p.ResourceType,
+			SecurityServiceType: securityServiceType(p),
+		})
+	}
+	return out, nil
+}
+
+func securityServiceType(p fmstypes.Policy) fmstypes.SecurityServiceType {
+	if p.SecurityServicePolicyData == nil {
+		return ""
+	}
+	return p.SecurityServicePolicyData.Type
+}
+
+// GetPolicy returns a policy, or a ResourceNotFoundException.
+func (f *FMS) GetPolicy(_ context.Context, in *fms.GetPolicyInput, _ ...func(*fms.Options)) (*fms.GetPolicyOutput, error) {
+	f.call(OpGetPolicy)
+	defer f.mu.Unlock()
+	id := aws.ToString(in.PolicyId)
+	p, ok := f.policies[id]
+	if !ok {
+		return nil, notFound("policy")
+	}
+	return &fms.GetPolicyOutput{Policy: &p, PolicyArn: aws.String(PolicyARN(id))}, nil
+}
+
+// PutPolicy creates a policy without an ID and updates one with an ID. An update needs
+// the policy's current update token: an unknown ID fails with ResourceNotFoundException,
+// a stale token with InvalidOperationException, as FMS reports it. Every write assigns a
+// new token. Tags are applied on create only, like FMS does.
+func (f *FMS) PutPolicy(_ context.Context, in *fms.PutPolicyInput, _ ...func(*fms.Options)) (*fms.PutPolicyOutput, error) {
+	f.call(OpPutPolicy)
+	defer f.mu.Unlock()
+	if in.Policy == nil {
+		return nil, &fmstypes.InvalidInputException{Message: aws.String("policy is required")}
+	}
+	name := aws.ToString(in.Policy.PolicyName)
+	if errs := f.putErrors[name]; len(errs) > 0 {
+		f.putErrors[name] = errs[1:]
+		return nil, errs[0]
+	}
+	p := *in.Policy
+	if p.PolicyId != nil {
+		live, ok := f.policies[*p.PolicyId]
+		if !ok {
+			return nil, notFound("policy")
+		}
+		if aws.ToString(live.PolicyUpdateToken) != aws.ToString(p.PolicyUpdateToken) {
+			return nil, &fmstypes.InvalidOperationException{Message: aws.String("policy update token is stale")}
+		}
+	} else {
+		p.PolicyId = aws.String(f.id("policy"))
+		for _, t := range in.TagList {
+			f.tag(PolicyARN(*p.PolicyId), aws.ToString(t.Key), aws.ToString(t.Value))
+		}
+	}
+	p.PolicyUpdateToken = aws.String(f.id("token"))
+	f.policies[*p.PolicyId] = p
+	return &fms.PutPolicyOutput{Policy: &p, PolicyArn: aws.String(PolicyARN(*p.PolicyId))}, nil
+}
+
+// DeletePolicy deletes a policy, or fails with ResourceNotFoundException.
+func (f *FMS) DeletePolicy(_ context.Context, in *fms.DeletePolicyInput, _ ...func(*fms.Options)) (*fms.DeletePolicyOutput, error) {
+	f.call(OpDeletePolicy)
+	defer f.mu.Unlock()
+	id := aws.ToString(in.PolicyId)
+	if _, ok := f.policies[id]; !ok {
+		return nil, notFound("policy")
+	}
+	delete(f.policies, id)
+	delete(f.tags, PolicyARN(id))
+	f.deleted[id] = in.DeleteAllPolicyResources
+	return &fms.DeletePolicyOutput{}, nil
+}
+
+// ListComplianceStatus pages through the compliance set with SetCompliance.
+func (f *FMS) ListComplianceStatus(_ context.Context, in *fms.ListComplianceStatusInput, _ ...func(*fms.Options)) (*fms.ListComplianceStatusOutput, error) {
+	f.call(OpListComplianceStatus)
+	defer f.mu.Unlock()
+	statuses := f.compliance[aws.ToString(in.PolicyId)]
+	start, end, next, err := f.page(len(statuses), in.NextToken, in.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	out := &fms.ListComplianceStatusOutput{NextToken: next}
+	for _, s := range statuses[start:end] {
+		s.PolicyId = in.PolicyId
+		out.PolicyComplianceStatusList = append(out.PolicyComplianceStatusList, s)
+	}
+	return out, nil
+}
+
+// GetComplianceDetail returns the detail set with SetComplianceDetail, or an empty detail.
+func (f *FMS) GetComplianceDetail(_ context.Context, in *fms.GetComplianceDetailInput, _ ...func(*fms.Options)) (*fms.GetComplianceDetailOutput, error) {
+	f.call(OpGetComplianceDetail)
+	defer f.mu.Unlock()
+	detail := f.details[aws.ToString(in.PolicyId)][aws.ToString(in.MemberAccount)]
+	detail.PolicyId, detail.MemberAccount = in.PolicyId, in.MemberAccount
+	return &fms.GetComplianceDetailOutput{PolicyComplianceDetail: &detail}, nil
+}
+
+// GetViolationDetails returns the detail set with SetViolationDetail, or an empty detail.
+func (f *FMS) GetViolationDetails(_ context.Context, in *fms.GetViolationDetailsInput, _ ...func(*fms.Options)) (*fms.GetViolationDetailsOutput, error) {
+	f.call(OpGetViolationDetails)
+	defer f.mu.Unlock()
+	detail := f.violations[aws.ToString(in.ResourceId)]
+	detail.PolicyId, detail.MemberAccount = in.PolicyId, in.MemberAccount
+	detail.ResourceId, detail.ResourceType = in.ResourceId, in.ResourceType
+	return &fms.GetViolationDetailsOutput{ViolationDetail: &detail}, nil
+}
+
+// ListTagsForResource returns the tags of a policy or resource set ARN.
+func (f *FMS) ListTagsForResource(_ context.Context, in *fms.ListTagsForResourceInput, _ ...func(*fms.Options)) (*fms.ListTagsForResourceOutput, error) {
+	f.call(OpListTagsForResource)
+	defer f.mu.Unlock()
+	tags := f.tags[aws.ToString(in.ResourceArn)]
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := &fms.ListTagsForResourceOutput{}
+	for _, k := range keys {
+		out.TagList = append(out.TagList, fmstypes.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out, nil
+}
+
+// TagResource adds or overwrites tags of an ARN.
+func (f *FMS) TagResource(_ context.Context, in *fms.TagResourceInput, _ ...func(*fms.Options)) (*fms.TagResourceOutput, error) {
+	f.call(OpTagResource)
+	defer f.mu.Unlock()
+	arn := aws.ToString(in.ResourceArn)
+	if errs := f.tagErrors[arn]; len(errs) > 0 {
+		f.tagErrors[arn] = errs[1:]
+		return nil, errs[0]
+	}
+	for _, t := range in.TagList {
+		f.tag(arn, aws.ToString(t.Key), aws.ToString(t.Value))
+	}
+	return &fms.TagResourceOutput{}, nil
+}
+
+// UntagResource removes tags of an ARN. Keys the ARN does not have are ignored.
+func (f *FMS) UntagResource(_ context.Context, in *fms.UntagResourceInput, _ ...func(*fms.Options)) (*fms.UntagResourceOutput, error) {
+	f.call(OpUntagResource)
+	defer f.mu.Unlock()
+	for _, k := range in.TagKeys {
+		delete(f.tags[aws.ToString(in.ResourceArn)], k)
+	}
+	return &fms.UntagResourceOutput{}, nil
+}
+
+// ListResourceSets pages through the resource sets in creation order.
+func (f *FMS) ListResourceSets(_ context.Context, in *fms.ListResourceSetsInput, _ ...func(*fms.Options)) (*fms.ListResourceSetsOutput, error) {
+	f.call(OpListResourceSets)
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.resourceSets))
+	for id := range f.resourceSets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start, end, next, err := f.page(len(ids), in.NextToken, in.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	out := &fms.ListResourceSetsOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		rs := f.resourceSets[id]
+		out.ResourceSets = append(out.ResourceSets, fmstypes.ResourceSetSummary{Id: aws.String(id), Name: rs.Name, Description: rs.Description})
+	}
+	return out, nil
+}
+
+// GetResourceSet returns a resource set and its ARN, or fails with
+// ResourceNotFoundException.
+func (f *FMS) GetResourceSet(_ context.Context, in *fms.GetResourceSetInput, _ ...func(*fms.Options)) (*fms.GetResourceSetOutput, error) {
+	f.call(OpGetResourceSet)
+	defer f.mu.Unlock()
+	rs, ok := f.resourceSets[aws.ToString(in.Identifier)]
+	if !ok {
+		return nil, notFound("resource set")
+	}
+	return &fms.GetResourceSetOutput{ResourceSet: &rs, ResourceSetArn: aws.String(ResourceSetARN(*rs.Id))}, nil
+}
+
+// PutResourceSet creates a resource set without an ID and updates one with an ID. Tags
+// are applied on create only, like for policies.
+func (f *FMS) PutResourceSet(_ context.Context, in *fms.PutResourceSetInput, _ ...func(*fms.Options)) (*fms.PutResourceSetOutput, error) {
+	f.call(OpPutResourceSet)
+	defer f.mu.Unlock()
+	rs := *in.ResourceSet
+	if rs.Id == nil {
+		rs.Id = aws.String(f.id("rs"))
+		f.members[*rs.Id] = map[string]bool{}
+		for _, t := range in.TagList {
+			f.tag(ResourceSetARN(*rs.Id), aws.ToString(t.Key), aws.ToString(t.Value))
+		}
+	} else if _, ok := f.resourceSets[*rs.Id]; !ok {
+		return nil, notFound("resource set")
+	}
+	rs.UpdateToken = aws.String(f.id("token"))
+	f.resourceSets[*rs.Id] = rs
+	return &fms.PutResourceSetOutput{ResourceSet: &rs, ResourceSetArn: aws.String(ResourceSetARN(*rs.Id))}, nil
+}
+
+// DeleteResourceSet deletes a resource set, its members and its tags. Like FMS, it fails
+// while a policy is scoped to the set.
+func (f *FMS) DeleteResourceSet(_ context.Context, in *fms.DeleteResourceSetInput, _ ...func(*fms.Options)) (*fms.DeleteResourceSetOutput, error) {
+	f.call(OpDeleteResourceSet)
+	defer f.mu.Unlock()
+	id := aws.ToString(in.Identifier)
+	if _, ok := f.resourceSets[id]; !ok {
+		return nil, notFound("resource set")
+	}
+	for _, p := range f.policies {
+		if slices.Contains(p.ResourceSetIds, id) {
+			return nil, &fmstypes.InvalidOperationException{Message: aws.String("resource set is in use by policy " + aws.ToString(p.PolicyName))}
+		}
+	}
+	delete(f.resourceSets, id)
+	delete(f.members, id)
+	delete(f.tags, ResourceSetARN(id))
+	return &fms.DeleteResourceSetOutput{}, nil
+}
+
+// ListResourceSetResources pages through the sorted members of a resource set.
+func (f *FMS) ListResourceSetResources(_ context.Context, in *fms.ListResourceSetResourcesInput, _ ...func(*fms.Options)) (*fms.ListResourceSetResourcesOutput, error) {
+	f.call(OpListResourceSetResources)
+	defer f.mu.Unlock()
+	id := aws.ToString(in.Identifier)
+	if _, ok := f.members[id]; !ok {
+		return nil, notFound("resource set")
+	}
+	uris := f.memberList(id)
+	start, end, next, err := f.page(len(uris), in.NextToken, in.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	out := &fms.ListResourceSetResourcesOutput{NextToken: next}
+	for _, uri := range uris[start:end] {
+		out.Items = append(out.Items, fmstypes.Resource{URI: aws.String(uri)})
+	}
+	return out, nil
+}
+
+// BatchAssociateResource adds resource URIs to a resource set.
+func (f *FMS) BatchAssociateResource(_ context.Context, in *fms.BatchAssociateResourceInput, _ ...func(*fms.Options)) (*fms.BatchAssociateResourceOutput, error) {
+	f.call(OpBatchAssociateResource)
+	defer f.mu.Unlock()
+	members, ok := f.members[aws.ToString(in.ResourceSetIdentifier)]
+	if !ok {
+		return nil, notFound("resource set")
+	}
+	for _, uri := range in.Items {
+		members[uri] = true
+	}
+	return &fms.BatchAssociateResourceOutput{ResourceSetIdentifier: in.ResourceSetIdentifier}, nil
+}
+
+// BatchDisassociateResource removes resource URIs from a resource set.
+func (f *FMS) BatchDisassociateResource(_ context.Context, in *fms.BatchDisassociateResourceInput, _ ...func(*fms.Options)) (*fms.BatchDisassociateResourceOutput, error) {
+	f.call(OpBatchDisassociateResource)
+	defer f.mu.Unlock()
+	members, ok := f.members[aws.ToString(in.ResourceSetIdentifier)]
+	if !ok {
+		return nil, notFound("resource set")
+	}
+	for _, uri := range in.Items {
+		delete(members, uri)
+	}
+	return &fms.BatchDisassociateResourceOutput{ResourceSetIdentifier: in.ResourceSetIdentifier}, nil
+}
@@ -0,0 +1,124 @@
+package fmsfake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+)
+
+func TestListPolicies_Paginates(t *testing.T) {
+	f := New()
+	f.PageSize = 2
+	var want []string
+	for i := 0; i < 5; i++ {
+		f.AddPolicy(fmstypes.Policy{PolicyName: aws.String(fmt.Sprintf("policy-%d", i))}, nil)
+		want = append(want, fmt.Sprintf("policy-%d", i))
+	}
+
+	var got []string
+	pager := fms.NewListPoliciesPaginator(f, &fms.ListPoliciesInput{})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			t.Fatalf("list policies: %v", err)
+		}
+		for _, p := range page.PolicyList {
+			got = append(got, aws.ToString(p.PolicyName))
+		}
+	}
+	if !reflect.DeepEqual(got, want) || f.Calls(OpListPolicies) != 3 {
+		t.Fatalf("listed %v in %d calls", got, f.Calls(OpListPolicies))
+	}
+
+	out, err := f.ListPolicies(context.Background(), &fms.ListPoliciesInput{MaxResults: aws.Int32(1)})
+	if err != nil || len(out.PolicyList) != 1 || aws.ToString(out.NextToken) != "1" {
+		t.Fatalf("MaxResults not honored: %+v %v", out, err)
+	}
+	if _, err := f.ListPolicies(context.Background(), &fms.ListPoliciesInput{NextToken: aws.String("bogus")}); err == nil {
+		t.Fatalf("expected an error for an invalid token")
+	}
+}
+
+func TestPutPolicy(t *testing.T) {
+	ctx := context.Background()
+	f := New()
+	created, err := f.PutPolicy(ctx, &fms.PutPolicyInput{
+		Policy:  &fmstypes.Policy{PolicyName: aws.String("p")},
+		TagList: []fmstypes.Tag{{Key: aws.String("owner"), Value: aws.String("me")}},
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	id := aws.ToString(created.Policy.PolicyId)
+	if aws.ToString(created.PolicyArn) != PolicyARN(id) || f.Tags(id)["owner"] != "me" {
+		t.Fatalf("unexpected create %+v, tags %v", created, f.Tags(id))
+	}
+
+	var (
+		stale    *fmstypes.InvalidOperationException
+		notFound *fmstypes.ResourceNotFoundException
+	)
+	// The cases run in order: the first update makes the created token stale.
+	tests := []struct {
+		name    string
+		policy  fmstypes.Policy
+		wantErr any
+	}{
+		{name: "current token", policy: *created.Policy},
+		{name: "stale token", policy: *created.Policy, wantErr: &stale},
+		{name: "unknown policy", policy: fmstypes.Policy{PolicyId: aws.String("policy-9999"), PolicyName: aws.String("p")}, wantErr: &notFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			before, _ := f.Policy(id)
+			out, err := f.PutPolicy(ctx, &fms.PutPolicyInput{Policy: &tc.policy})
+			after, _ := f.Policy(id)
+			if tc.wantErr != nil {
+				if !errors.As(err, tc.wantErr) || !reflect.DeepEqual(before, after) {
+					t.Fatalf("expected %T without a write, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			if aws.ToString(out.Policy.PolicyUpdateToken) == aws.ToString(before.PolicyUpdateToken) {
+				t.Fatalf("update kept the token %s", aws.ToString(before.PolicyUpdateToken))
+			}
+		})
+	}
+
+	f.FailPut("p", errors.New("boom"))
+	if _, err := f.PutPolicy(ctx, &fms.PutPolicyInput{Policy: &fmstypes.Policy{PolicyName: aws.String("p")}}); err == nil || err.Error() != "boom" {
+		t.Fatalf("queued error not returned: %v", err)
+	}
+}
+
+func TestDeletePolicy(t *testing.T) {
+	ctx := context.Background()
+	f := New()
+	id := f.AddPolicy(fmstypes.Policy{PolicyName: aws.String("p")}, map[string]string{"owner": "me"})
+
+	if _, err := f.DeletePolicy(ctx, &fms.DeletePolicyInput{PolicyId: aws.String(id), DeleteAllPolicyResources: true}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if deleteAll, ok := f.Deleted(id); !ok || !deleteAll {
+		t.Fatalf("delete not recorded")
+	}
+	if _, ok := f.Policy(id); ok || len(f.Tags(id)) != 0 {
+		t.Fatalf("policy or tags left after delete")
+	}
+	var notFound *fmstypes.ResourceNotFoundException
+	if _, err := f.DeletePolicy(ctx, &fms.DeletePolicyInput{PolicyId: aws.String(id)}); !errors.As(err, &notFound) {
+		t.Fatalf("expected ResourceNotFoundException, got %v", err)
+	}
+	if _, err := f.GetPolicy(ctx, &fms.GetPolicyInput{PolicyId: aws.String(id)}); !errors.As(err, &notFound) {
+		t.Fatalf("expected ResourceNotFoundException, got %v", err)
+	}
+}
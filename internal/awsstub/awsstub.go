@@ -0,0 +1,256 @@
+// Package awsstub is an in-process HTTP stand-in for the AWS APIs the binaries call. It
+// serves the responses a scenario scripts, so a handler runs end to end without network
+// access or an AWS account. Point the SDK at the server with the AWS_ENDPOINT_URL
+// environment variable, which LoadDefaultConfig applies to every service client.
+//
+// Requests are keyed by "<service>:<operation>", with the service's SigV4 signing name,
+// e.g. "fms:PutPolicy", "sts:GetCallerIdentity" or "elasticloadbalancing:DescribeTags".
+// JSON protocol operations are read from X-Amz-Target, query protocol operations from
+// the Action form field. Requests of other protocols are keyed "<service>:<METHOD> <path>".
+package awsstub
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UnscriptedCode is the error code of the response to a request the scenario does not
+// script. It is a client error, so the SDK does not retry it.
+const UnscriptedCode = "UnscriptedOperation"
+
+// Scenario is one scripted run: the environment and event of the handler, the responses
+// of the AWS APIs, and what the run should produce.
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Env sets environment variables for the run.
+	Env map[string]string `yaml:"env"`
+	// Event is the handler's event, as its JSON fields.
+	Event map[string]any `yaml:"event"`
+	// Responses are keyed by operation. Each call takes the next response; the last one
+	// repeats.
+	Responses map[string][]Response `yaml:"responses"`
+	Expect    Expect                `yaml:"expect"`
+}
+
+// Response is one scripted response. Body is sent as is; JSON is marshaled for JSON
+// protocol services; Error renders an error in the service's protocol.
+type Response struct {
+	// Status defaults to 200, or 400 for an Error.
+	Status  int    `yaml:"status"`
+	Body    string `yaml:"body"`
+	JSON    any    `yaml:"json"`
+	Error   string `yaml:"error"`
+	Message string `yaml:"message"`
+}
+
+// Expect is the outcome a scenario expects.
+type Expect struct {
+	// Result is the handler's exact return value.
+	Result string `yaml:"result"`
+	// Error is a substring of the handler's error. Empty expects no error.
+	Error string `yaml:"error"`
+	// Calls are exact call counts per operation; 0 asserts an operation is not called.
+	Calls map[string]int `yaml:"calls"`
+}
+
+// LoadScenario reads a scenario file. The name defaults to the file name.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parse scenario %s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return &s, nil
+}
+
+// Request is a request the server received.
+type Request struct {
+	Operation string
+	Body      string
+}
+
+// Server serves scripted responses. It is safe for concurrent use.
+type Server struct {
+	// URL is the endpoint to point the SDK at.
+	URL string
+
+	srv       *httptest.Server
+	mu        sync.Mutex
+	responses map[string][]Response
+	requests  []Request
+}
+
+// NewServer starts a server scripted with responses keyed by operation.
+func NewServer(responses map[string][]Response) *Server {
+	s := &Server{responses: map[string][]Response{}}
+	for op, rs := range responses {
+		s.responses[op] = append([]Response(nil), rs...)
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Requests returns the requests received so far, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Calls returns how often an operation was called.
+func (s *Server) Calls(op string) int {
+	var n int
+	for _, r := range s.Requests() {
+		if r.Operation == op {
+			n++
+		}
+	}
+	return n
+}
+
+// Unscripted returns the sorted operations that were called without a scripted response.
+func (s *Server) Unscripted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := map[string]bool{}
+	var out []string
+	for _, r := range s.requests {
+		if _, ok := s.responses[r.Operation]; !ok && !seen[r.Operation] {
+			seen[r.Operation] = true
+			out = append(out, r.Operation)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// protocol is how a service encodes requests and errors.
+type protocol int
+
+const (
+	protocolJSON protocol = iota
+	protocolQuery
+	protocolOther
+)
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, proto := operation(r, body)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Operation: op, Body: string(body)})
+	var resp Response
+	scripted, ok := s.responses[op]
+	switch {
+	case !ok:
+		resp = Response{Error: UnscriptedCode, Message: "no response scripted for " + op}
+	case len(scripted) > 1:
+		resp, s.responses[op] = scripted[0], scripted[1:]
+	case len(scripted) == 1:
+		resp = scripted[0]
+	}
+	s.mu.Unlock()
+
+	write(w, resp, proto)
+}
+
+// signingService reads the service name from the SigV4 credential scope.
+var signingService = regexp.MustCompile(`Credential=[^/]+/[^/]+/[^/]+/([^/]+)/aws4_request`)
+
+func operation(r *http.Request, body []byte) (string, protocol) {
+	service := "unknown"
+	if m := signingService.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		service = m[1]
+	}
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		_, op, _ := strings.Cut(target, ".")
+		return service + ":" + op, protocolJSON
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Get("Action") != "" {
+			return service + ":" + form.Get("Action"), protocolQuery
+		}
+	}
+	return service + ":" + r.Method + " " + r.URL.Path, protocolOther
+}
+
+func write(w http.ResponseWriter, resp Response, proto protocol) {
+	status := resp.Status
+	body := resp.Body
+	switch {
+	case resp.Error != "":
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		body = errorBody(resp.Error, resp.Message, proto)
+	case resp.JSON != nil:
+		data, err := json.Marshal(resp.JSON)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = string(data)
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	switch proto {
+	case protocolJSON:
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if body == "" {
+			body = "{}"
+		}
+	default:
+		w.Header().Set("Content-Type", "text/xml")
+	}
+	w.Header().Set("X-Amzn-RequestId", "awsstub")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+func errorBody(code, message string, proto protocol) string {
+	if proto == protocolJSON {
+		data, _ := json.Marshal(map[string]string{"__type": code, "message": message})
+		return string(data)
+	}
+	var b strings.Builder
+	b.WriteString("<ErrorResponse><Error><Type>Sender</Type><Code>")
+	xml.EscapeText(&b, []byte(code))
+	b.WriteString("</Code><Message>")
+	xml.EscapeText(&b, []byte(message))
+	b.WriteString("</Message></Error><RequestId>awsstub</RequestId></ErrorResponse>")
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package awsstub
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+func stubConfig(url string) aws.Config {
+	return aws.Config{
+		Region:       "us-west-2",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKIDSTUB", "stub", ""),
+		BaseEndpoint: aws.String(url),
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	server := NewServer(map[string][]Response{
+		"fms:GetAdminAccount": {
+			{JSON: map[string]string{"AdminAccount": "111111111111"}},
+			{JSON: map[string]string{"AdminAccount": "222222222222"}},
+		},
+		"fms:GetPolicy": {{Error: "ResourceNotFoundException", Message: "gone"}},
+		"sts:GetCallerIdentity": {{Body: `<GetCallerIdentityResponse><GetCallerIdentityResult>
+			<Account>111111111111</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`}},
+	})
+	defer server.Close()
+	cfg := stubConfig(server.URL)
+	fmsClient := fms.NewFromConfig(cfg)
+
+	// Each call takes the next response; the last one repeats.
+	for _, want := range []string{"111111111111", "222222222222", "222222222222"} {
+		out, err := fmsClient.GetAdminAccount(ctx, &fms.GetAdminAccountInput{})
+		if err != nil || aws.ToString(out.AdminAccount) != want {
+			t.Fatalf("GetAdminAccount = %+v, %v; want %s", out, err, want)
+		}
+	}
+
+	var apiErr smithy.APIError
+	if _, err := fmsClient.GetPolicy(ctx, &fms.GetPolicyInput{PolicyId: aws.String("p")}); !errors.As(err, &apiErr) || apiErr.ErrorCode() != "ResourceNotFoundException" {
+		t.Fatalf("expected ResourceNotFoundException, got %v", err)
+	}
+
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil || aws.ToString(out.Account) != "111111111111" {
+		t.Fatalf("GetCallerIdentity = %+v, %v", out, err)
+	}
+
+	if _, err := fmsClient.ListPolicies(ctx, &fms.ListPoliciesInput{}); !errors.As(err, &apiErr) || apiErr.ErrorCode() != UnscriptedCode {
+		t.Fatalf("expected %s, got %v", UnscriptedCode, err)
+	}
+	if got := server.Unscripted(); len(got) != 1 || got[0] != "fms:ListPolicies" {
+		t.Fatalf("unscripted %v", got)
+	}
+	if server.Calls("fms:GetAdminAccount") != 3 || server.Calls("fms:ListPolicies") != 1 || len(server.Requests()) != 6 {
+		t.Fatalf("unexpected requests %+v", server.Requests())
+	}
+}
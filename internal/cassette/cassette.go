@@ -0,0 +1,475 @@
+// Package cassette records the AWS API traffic of a run into a file and replays it
+// without network access. A session captured once in a sandbox account becomes an
+// offline regression test of the code that made the calls.
+//
+// Recording is opt-in through two environment variables, which both binaries read in
+// Attach when they load the AWS config:
+//
+//	AWS_CASSETTE=testdata/cassettes/session.json AWS_CASSETTE_MODE=record
+//
+// Cassettes are sanitized as they are written: no request headers are kept, credentials
+// in response bodies are replaced, and account IDs are replaced by placeholders numbered
+// in the order the cassette first saw them. Only account positions are redacted: the
+// account field of ARNs, plain or URL-encoded, and Account, AccountId, AdminAccount,
+// MemberAccount and Id values; other 12-digit numbers, like the tail of a UUID, are kept.
+// Replay serves the interactions of each operation in recorded order and fails a request
+// whose body differs from the recorded one, so a change in what the code sends shows up
+// as an error rather than a silently different response. Account IDs the replayed code
+// sends from outside the cassette, like those in a config file, match the placeholders
+// they were recorded as.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+const (
+	// EnvPath names the cassette file. Unset disables recording and replay.
+	EnvPath = "AWS_CASSETTE"
+	// EnvMode is ModeRecord or ModeReplay; it defaults to ModeReplay.
+	EnvMode = "AWS_CASSETTE_MODE"
+
+	ModeRecord = "record"
+	ModeReplay = "replay"
+)
+
+// Redacted replaces credentials in recorded bodies.
+const Redacted = "REDACTED"
+
+// ErrMismatch is returned on replay for a request the cassette does not hold: an
+// operation with no interactions left, or a body that differs from the recording.
+var ErrMismatch = errors.New("request does not match the cassette")
+
+// mismatchError wraps ErrMismatch and stops the SDK from retrying, which would only
+// consume more of the cassette.
+type mismatchError struct{ detail string }
+
+func (e *mismatchError) Error() string        { return ErrMismatch.Error() + ": " + e.detail }
+func (e *mismatchError) Unwrap() error        { return ErrMismatch }
+func (e *mismatchError) RetryableError() bool { return false }
+
+// Cassette is the file format: the interactions in the order they happened.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one sanitized request and its response.
+type Interaction struct {
+	// Operation is "<service>:<operation>", e.g. "fms:PutPolicy", with the service's
+	// SigV4 signing name. Requests that are neither JSON nor query protocol are keyed
+	// "<service>:<METHOD> <path>".
+	Operation string   `json:"operation"`
+	Request   Request  `json:"request"`
+	Response  Response `json:"response"`
+}
+
+// Request is the part of a request that identifies it; headers are not kept.
+type Request struct {
+	Method string `json:"method"`
+	// Path includes the query string.
+	Path string `json:"path"`
+	Body string `json:"body,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// Load reads a cassette file.
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the cassette, replacing the file atomically.
+func (c *Cassette) Save(path string) error {
+	// Bodies are XML and JSON; unescaped they stay readable in a diff.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// HTTPClient is the client interface of aws.Config.
+type HTTPClient = aws.HTTPClient
+
+// Recorder sends requests through an HTTP client and appends each sanitized interaction
+// to the cassette file as it completes, so a run that fails halfway keeps what it did.
+type Recorder struct {
+	path   string
+	client HTTPClient
+
+	mu       sync.Mutex
+	cassette Cassette
+	accounts redactor
+}
+
+// NewRecorder starts an empty cassette at path, sending requests through client.
+func NewRecorder(path string, client HTTPClient) *Recorder {
+	return &Recorder{path: path, client: client, accounts: redactor{}}
+}
+
+// Do sends the request and records it.
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	interaction := Interaction{
+		Operation: operation(req, reqBody),
+		Request: Request{
+			Method: req.Method,
+			Path:   r.accounts.sanitize(req.URL.RequestURI()),
+			Body:   r.accounts.sanitize(string(reqBody)),
+		},
+		Response: Response{
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        r.accounts.sanitize(string(respBody)),
+		},
+	}
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	if err := r.cassette.Save(r.path); err != nil {
+		return nil, fmt.Errorf("record %s: %w", interaction.Operation, err)
+	}
+	return resp, nil
+}
+
+// Replayer answers requests from a cassette without network access.
+type Replayer struct {
+	mu      sync.Mutex
+	pending map[string][]Interaction
+	// accounts binds the account IDs requests carry to the placeholders they were
+	// recorded as, learned as requests match.
+	accounts redactor
+}
+
+// NewReplayer replays the interactions of c.
+func NewReplayer(c *Cassette) *Replayer {
+	r := &Replayer{pending: map[string][]Interaction{}, accounts: redactor{}}
+	for _, in := range c.Interactions {
+		r.pending[in.Operation] = append(r.pending[in.Operation], in)
+	}
+	return r
+}
+
+// Do returns the next recorded response of the request's operation.
+func (r *Replayer) Do(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	op := operation(req, body)
+
+	r.mu.Lock()
+	queue := r.pending[op]
+	if len(queue) == 0 {
+		r.mu.Unlock()
+		return nil, &mismatchError{"no interaction left for " + op}
+	}
+	in := queue[0]
+	r.pending[op] = queue[1:]
+	matched := r.accounts.match(req.Header.Get("Content-Type"), string(body), in.Request.Body)
+	r.mu.Unlock()
+
+	if !matched {
+		return nil, &mismatchError{fmt.Sprintf("%s body\n got %s\nwant %s", op, redactSecrets(string(body)), in.Request.Body)}
+	}
+	header := http.Header{}
+	if in.Response.ContentType != "" {
+		header.Set("Content-Type", in.Response.ContentType)
+	}
+	header.Set("X-Amzn-RequestId", "cassette")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+		StatusCode:    in.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(in.Response.Body)),
+		ContentLength: int64(len(in.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Remaining returns the sorted operations of the interactions not replayed yet.
+func (r *Replayer) Remaining() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for op, queue := range r.pending {
+		for range queue {
+			out = append(out, op)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// clients keeps one recorder or replayer per mode and file, so a process that loads the
+// AWS config more than once records into, or replays from, a single cassette.
+var (
+	clientsMu sync.Mutex
+	clients   = map[string]HTTPClient{}
+)
+
+// Attach routes the API calls of cfg through the cassette named by the environment. It
+// does nothing when AWS_CASSETTE is unset. Recording wraps the config's own HTTP client,
+// so its transport settings, like a custom CA bundle, still apply.
+func Attach(cfg *aws.Config) error {
+	path := os.Getenv(EnvPath)
+	if path == "" {
+		return nil
+	}
+	mode := os.Getenv(EnvMode)
+	if mode == "" {
+		mode = ModeReplay
+	}
+	if mode != ModeRecord && mode != ModeReplay {
+		return fmt.Errorf("%s must be %s or %s, got %q", EnvMode, ModeRecord, ModeReplay, mode)
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	key := mode + ":" + path
+	client, ok := clients[key]
+	if !ok {
+		if mode == ModeRecord {
+			client = NewRecorder(path, cfg.HTTPClient)
+		} else {
+			c, err := Load(path)
+			if err != nil {
+				return fmt.Errorf("load cassette: %w", err)
+			}
+			client = NewReplayer(c)
+		}
+		clients[key] = client
+	}
+	if r, ok := client.(*Replayer); ok {
+		Replay(cfg, r)
+		return nil
+	}
+	cfg.HTTPClient = client
+	return nil
+}
+
+// Replay points cfg at r. It pins static credentials, so no credential source is
+// needed offline.
+func Replay(cfg *aws.Config, r *Replayer) {
+	cfg.HTTPClient = r
+	cfg.Credentials = aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider("AKIDCASSETTE", Redacted, ""))
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// signingService reads the service name from the SigV4 credential scope.
+var signingService = regexp.MustCompile(`Credential=[^/]+/[^/]+/[^/]+/([^/]+)/aws4_request`)
+
+func operation(req *http.Request, body []byte) string {
+	service := "unknown"
+	if m := signingService.FindStringSubmatch(req.Header.Get("Authorization")); m != nil {
+		service = m[1]
+	}
+	if target := req.Header.Get("X-Amz-Target"); target != "" {
+		_, op, _ := strings.Cut(target, ".")
+		return service + ":" + op
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Get("Action") != "" {
+			return service + ":" + form.Get("Action")
+		}
+	}
+	return service + ":" + req.Method + " " + req.URL.Path
+}
+
+var (
+	// Account IDs are redacted where they stand for an account: the account field of an
+	// ARN, with its colons plain or URL-encoded, and the values of account fields in JSON
+	// and XML. Each pattern captures the text before the ID, the ID and the text after it.
+	accountPositions = []*regexp.Regexp{
+		regexp.MustCompile(`(arn(?::|%3[Aa])[\w-]+(?::|%3[Aa])[\w-]*(?::|%3[Aa])[\w-]*(?::|%3[Aa]))(\d{12})(:|%3[Aa])`),
+		regexp.MustCompile(`("(?:Account|AccountId|AdminAccount|MemberAccount|Id)"\s*:\s*")(\d{12})(")`),
+		regexp.MustCompile(`(<(?:Account|AccountId|AdminAccount|MemberAccount|Id)>)(\d{12})(</)`),
+	}
+	// Credentials appear as XML elements (STS) or JSON fields (SSO, STS JSON).
+	xmlSecret  = regexp.MustCompile(`<(AccessKeyId|SecretAccessKey|SessionToken)>[^<]*</`)
+	jsonSecret = regexp.MustCompile(`"((?i)accessKeyId|secretAccessKey|sessionToken)"(\s*):(\s*)"[^"]*"`)
+)
+
+// placeholderPrefix starts every placeholder, followed by its 4-digit number. IDs that
+// carry it are left alone, so a replayed request that echoes a placeholder from a
+// recorded response matches the recorded request.
+const placeholderPrefix = "00000000"
+
+func isPlaceholder(id string) bool {
+	return strings.HasPrefix(id, placeholderPrefix)
+}
+
+// redactor maps account IDs to placeholders. A recorder numbers them in the order the
+// cassette first sees them, so an ID maps to the same placeholder throughout, and values
+// that match across calls, like the caller's account and an OU member, still match.
+type redactor map[string]string
+
+func redactSecrets(s string) string {
+	s = xmlSecret.ReplaceAllString(s, "<$1>"+Redacted+"</")
+	return jsonSecret.ReplaceAllString(s, `"$1"$2:$3"`+Redacted+`"`)
+}
+
+// replaceAccounts calls replace for the account ID at every account position of s and
+// puts in what it returns.
+func replaceAccounts(s string, replace func(id string) string) string {
+	for _, re := range accountPositions {
+		s = re.ReplaceAllStringFunc(s, func(m string) string {
+			parts := re.FindStringSubmatch(m)
+			return parts[1] + replace(parts[2]) + parts[3]
+		})
+	}
+	return s
+}
+
+// sanitize redacts credentials and account IDs.
+func (r redactor) sanitize(s string) string {
+	return replaceAccounts(redactSecrets(s), func(id string) string {
+		if isPlaceholder(id) {
+			return id
+		}
+		if p, ok := r[id]; ok {
+			return p
+		}
+		p := fmt.Sprintf("%s%04d", placeholderPrefix, len(r)+1)
+		r[id] = p
+		return p
+	})
+}
+
+// match reports whether a replayed request body is the recorded one, with the account
+// IDs it carries standing for the placeholders they were recorded as. An ID not seen yet
+// binds to the placeholder at its position, unless another ID already holds it; the
+// bindings are kept when the body matches.
+func (r redactor) match(contentType, got, want string) bool {
+	got = canonicalBody(contentType, redactSecrets(got))
+	want = canonicalBody(contentType, want)
+	var ids, placeholders []string
+	replaceAccounts(got, func(id string) string { ids = append(ids, id); return id })
+	replaceAccounts(want, func(p string) string { placeholders = append(placeholders, p); return p })
+	if len(ids) != len(placeholders) {
+		return false
+	}
+
+	bound := map[string]string{}
+	held := map[string]bool{}
+	for _, p := range r {
+		held[p] = true
+	}
+	for i, id := range ids {
+		p, ok := r[id]
+		if !ok {
+			p, ok = bound[id]
+		}
+		switch {
+		case isPlaceholder(id):
+			p = id
+		case !ok && held[placeholders[i]]:
+			return false
+		case !ok:
+			p = placeholders[i]
+			bound[id], held[p] = p, true
+		}
+		if p != placeholders[i] {
+			return false
+		}
+	}
+	next := 0
+	if replaceAccounts(got, func(string) string { next++; return placeholders[next-1] }) != want {
+		return false
+	}
+	for id, p := range bound {
+		r[id] = p
+	}
+	return true
+}
+
+// canonicalBody rewrites JSON and form bodies in a fixed order, since the SDK may encode
+// maps in any order: JSON with sorted keys, forms sorted by field.
+func canonicalBody(contentType, body string) string {
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		if form, err := url.ParseQuery(body); err == nil {
+			return form.Encode()
+		}
+	case strings.Contains(contentType, "json"):
+		dec := json.NewDecoder(strings.NewReader(body))
+		dec.UseNumber()
+		var v any
+		if dec.Decode(&v) == nil {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if enc.Encode(v) == nil {
+				return strings.TrimSuffix(buf.String(), "\n")
+			}
+		}
+	}
+	return body
+}
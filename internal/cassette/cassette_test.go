@@ -0,0 +1,134 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/awsstub"
+)
+
+func TestSanitize(t *testing.T) {
+	r := redactor{}
+	for _, tc := range []struct{ in, want string }{
+		{"arn:aws:iam::111122223333:role/x", "arn:aws:iam::000000000001:role/x"},
+		{"ResourceArns.member.1=arn%3Aaws%3Aelasticloadbalancing%3Aus-west-2%3A444455556666%3Aloadbalancer", "ResourceArns.member.1=arn%3Aaws%3Aelasticloadbalancing%3Aus-west-2%3A000000000002%3Aloadbalancer"},
+		{`{"Accounts":[{"Id":"111122223333"},{"Id": "444455556666"}],"MemberAccount":"777788889999"}`, `{"Accounts":[{"Id":"000000000001"},{"Id": "000000000002"}],"MemberAccount":"000000000003"}`},
+		{"<Account>111122223333</Account>", "<Account>000000000001</Account>"},
+		{`{"PolicyId":"cccccccc-dddd-eeee-ffff-111122223333","CreatedAt":1700000000123}`, `{"PolicyId":"cccccccc-dddd-eeee-ffff-111122223333","CreatedAt":1700000000123}`},
+		{"111122223333,444455556666", "111122223333,444455556666"},
+		{"<AccessKeyId>ASIAEXAMPLE</AccessKeyId><SessionToken>abc</SessionToken>", "<AccessKeyId>REDACTED</AccessKeyId><SessionToken>REDACTED</SessionToken>"},
+		{`{"accessKeyId": "ASIAEXAMPLE","secretAccessKey":"s"}`, `{"accessKeyId": "REDACTED","secretAccessKey":"REDACTED"}`},
+	} {
+		if got := r.sanitize(tc.in); got != tc.want {
+			t.Errorf("sanitize(%q)\n got %q\nwant %q", tc.in, got, tc.want)
+		}
+		if got := r.sanitize(tc.want); got != tc.want {
+			t.Errorf("sanitize is not idempotent on %q: %q", tc.want, got)
+		}
+	}
+}
+
+func TestRedactorMatch(t *testing.T) {
+	const form = "application/x-www-form-urlencoded"
+	r := redactor{}
+	// An ID the cassette never saw binds to the placeholder it was recorded as.
+	if !r.match("application/x-amz-json-1.1", `{"Arn":"arn:aws:fms:us-west-2:111122223333:x","Id":"000000000002"}`, `{"Id":"000000000002","Arn":"arn:aws:fms:us-west-2:000000000001:x"}`) {
+		t.Fatalf("expected a match binding 111122223333 to 000000000001")
+	}
+	if !r.match(form, "A=arn%3Aaws%3Aiam%3A%3A111122223333%3Arole", "A=arn%3Aaws%3Aiam%3A%3A000000000001%3Arole") {
+		t.Fatalf("expected the binding to hold in a form body")
+	}
+	// A bound ID stays bound, and a placeholder already held takes no other ID.
+	for _, tc := range []struct{ got, want string }{
+		{"A=arn%3Aaws%3Aiam%3A%3A111122223333%3Arole", "A=arn%3Aaws%3Aiam%3A%3A000000000002%3Arole"},
+		{"A=arn%3Aaws%3Aiam%3A%3A444455556666%3Arole", "A=arn%3Aaws%3Aiam%3A%3A000000000001%3Arole"},
+		{"A=arn%3Aaws%3Aiam%3A%3A444455556666%3Arole&B=1", "A=arn%3Aaws%3Aiam%3A%3A000000000003%3Arole&B=2"},
+	} {
+		if r.match(form, tc.got, tc.want) {
+			t.Errorf("match(%q, %q) = true", tc.got, tc.want)
+		}
+	}
+	// A body that failed to match binds nothing.
+	if !r.match(form, "A=arn%3Aaws%3Aiam%3A%3A444455556666%3Arole", "A=arn%3Aaws%3Aiam%3A%3A000000000003%3Arole") {
+		t.Fatalf("expected 444455556666 to be free after a failed match")
+	}
+}
+
+func stubConfig(client aws.HTTPClient, url string) aws.Config {
+	return aws.Config{
+		Region:       "us-west-2",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKIDSTUB", "stub", ""),
+		BaseEndpoint: aws.String(url),
+		HTTPClient:   client,
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	server := awsstub.NewServer(map[string][]awsstub.Response{
+		"sts:GetCallerIdentity": {{Body: `<GetCallerIdentityResponse><GetCallerIdentityResult>
+			<Account>111122223333</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`}},
+		"organizations:ListAccountsForParent": {{JSON: map[string]any{"Accounts": []map[string]string{{"Id": "111122223333"}}}}},
+	})
+	path := filepath.Join(t.TempDir(), "session.json")
+	cfg := stubConfig(NewRecorder(path, awshttp.NewBuildableClient()), server.URL)
+	session := func(cfg aws.Config, parent string) (string, string, error) {
+		identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return "", "", err
+		}
+		accounts, err := organizations.NewFromConfig(cfg).ListAccountsForParent(ctx, &organizations.ListAccountsForParentInput{ParentId: aws.String(parent)})
+		if err != nil {
+			return "", "", err
+		}
+		return aws.ToString(identity.Account), aws.ToString(accounts.Accounts[0].Id), nil
+	}
+	if _, _, err := session(cfg, "ou-abcd-11111111"); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	server.Close()
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(c.Interactions) != 2 || c.Interactions[0].Operation != "sts:GetCallerIdentity" || c.Interactions[1].Operation != "organizations:ListAccountsForParent" {
+		t.Fatalf("unexpected interactions %+v", c.Interactions)
+	}
+	for _, in := range c.Interactions {
+		if strings.Contains(in.Response.Body, "111122223333") {
+			t.Fatalf("account ID not redacted in %s", in.Response.Body)
+		}
+	}
+
+	// Replay needs no server, and the redacted IDs still match each other.
+	replayer := NewReplayer(c)
+	replayCfg := stubConfig(nil, server.URL)
+	Replay(&replayCfg, replayer)
+	caller, member, err := session(replayCfg, "ou-abcd-11111111")
+	if err != nil || caller != "000000000001" || caller != member {
+		t.Fatalf("replay = %q, %q, %v", caller, member, err)
+	}
+	if left := replayer.Remaining(); len(left) != 0 {
+		t.Fatalf("not replayed: %v", left)
+	}
+
+	// A request that differs from the recording fails instead of getting its response.
+	replayer = NewReplayer(c)
+	Replay(&replayCfg, replayer)
+	if _, _, err := session(replayCfg, "ou-abcd-22222222"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch for another OU, got %v", err)
+	}
+	if _, _, err := session(replayCfg, "ou-abcd-11111111"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch once the cassette is used up, got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+// Package compliance reports whether the policies the tool owns are working: which
+// member accounts FMS found non-compliant, and which resources violate the policies and
+// why.
+package compliance
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+)
+
+// API is the subset of the FMS client the report reads from.
+type API interface {
+	ListComplianceStatus(ctx context.Context, params *fms.ListComplianceStatusInput, optFns ...func(*fms.Options)) (*fms.ListComplianceStatusOutput, error)
+	GetComplianceDetail(ctx context.Context, params *fms.GetComplianceDetailInput, optFns ...func(*fms.Options)) (*fms.GetComplianceDetailOutput, error)
+	GetViolationDetails(ctx context.Context, params *fms.GetViolationDetailsInput, optFns ...func(*fms.Options)) (*fms.GetViolationDetailsOutput, error)
+}
+
+// Account compliance states. FMS reports COMPLIANT and NON_COMPLIANT; accounts in scope
+// that it has not evaluated yet are NOT_EVALUATED.
+const (
+	StatusCompliant    = string(fmstypes.PolicyComplianceStatusTypeCompliant)
+	StatusNonCompliant = string(fmstypes.PolicyComplianceStatusTypeNonCompliant)
+	StatusNotEvaluated = "NOT_EVALUATED"
+)
+
+// Report is the compliance of the owned policies, per member account and per violating
+// resource.
+type Report struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Accounts    []AccountStatus `json:"accounts"`
+	Violations  []Violation     `json:"violations"`
+}
+
+// AccountStatus is the compliance of one policy in one member account.
+type AccountStatus struct {
+	Policy   string `json:"policy"`
+	PolicyID string `json:"policy_id"`
+	Account  string `json:"account"`
+	Status   string `json:"status"`
+	// Violators counts the violating resources FMS reported for the account.
+	Violators int64 `json:"violators"`
+	// Issues lists dependent service issues as "<service>: <detail>", e.g. an AWS
+	// Config recorder that is not enabled.
+	Issues []string `json:"issues,omitempty"`
+	// EvaluationLimitExceeded means FMS stopped evaluating the account's resources, so
+	// the violations listed for it are incomplete.
+	EvaluationLimitExceeded bool `json:"evaluation_limit_exceeded,omitempty"`
+}
+
+// Violation is one resource that violates a policy.
+type Violation struct {
+	Policy       string `json:"policy"`
+	PolicyID     string `json:"policy_id"`
+	Account      string `json:"account"`
+	ResourceID   string `json:"resource_id"`
+	ResourceType string `json:"resource_type"`
+	// Reason is the FMS violation reason, e.g. RESOURCE_MISSING_WEB_ACL; Description
+	// says the same in words.
+	Reason      string `json:"reason"`
+	Description string `json:"description"`
+	// Detail adds what GetViolationDetails knows about the resource, for the policy
+	// and resource types it supports.
+	Detail string `json:"detail,omitempty"`
+}
+
+// reasonDescriptions words the violation reasons the tool's policies report most.
+// Reasons without an entry are lower-cased with spaces.
+var reasonDescriptions = map[fmstypes.ViolationReason]string{
+	fmstypes.ViolationReasonResourceMissingWebAcl:                   "web ACL missing",
+	fmstypes.ViolationReasonWebAclMissingRuleGroup:                  "rule group missing",
+	fmstypes.ViolationReasonResourceIncorrectWebAcl:                 "customer web ACL conflict",
+	fmstypes.ViolationReasonResourceMissingShieldProtection:         "Shield protection missing",
+	fmstypes.ViolationReasonResourceMissingWebaclOrShieldProtection: "web ACL or Shield protection missing",
+	fmstypes.ViolationReasonResourceMissingSecurityGroup:            "security group missing",
+	fmstypes.ViolationReasonResourceViolatesAuditSecurityGroup:      "violates the audit security group",
+	fmstypes.ViolationReasonFMSCreatedSecurityGroupEdited:           "FMS security group edited",
+	fmstypes.ViolationReasonMissingFirewall:                         "network firewall missing",
+	fmstypes.ViolationReasonNetworkFirewallPolicyModified:           "network firewall policy modified",
+	fmstypes.ViolationReasonResourceMissingDnsFirewall:              "DNS firewall missing",
+}
+
+// Describe words an FMS violation reason, e.g. "web ACL missing" for
+// RESOURCE_MISSING_WEB_ACL.
+func Describe(reason fmstypes.ViolationReason) string {
+	if d, ok := reasonDescriptions[reason]; ok {
+		return d
+	}
+	return strings.ToLower(strings.ReplaceAll(string(reason), "_", " "))
+}
+
+// detailPolicyTypes and detailResourceTypes are what GetViolationDetails supports;
+// violations of other policies are reported with their reason only.
+var (
+	detailPolicyTypes = map[string]bool{
+		string(fmstypes.SecurityServiceTypeDnsFirewall):                true,
+		string(fmstypes.SecurityServiceTypeNetworkFirewall):            true,
+		string(fmstypes.SecurityServiceTypeImportNetworkFirewall):      true,
+		string(fmstypes.SecurityServiceTypeSecurityGroupsContentAudit): true,
+		string(fmstypes.SecurityServiceTypeThirdPartyFirewall):         true,
+	}
+	detailResourceTypes = map[string]bool{
+		"AWS::EC2::Instance":                   true,
+		"AWS::EC2::NetworkInterface":           true,
+		"AWS::EC2::SecurityGroup":              true,
+		"AWS::NetworkFirewall::FirewallPolicy": true,
+		"AWS::EC2::Subnet":                     true,
+	}
+)
+
+// Collect reads the compliance of each policy: the status of every member account in
+// its scope, and for non-compliant accounts the violating resources. Accounts are sorted
+// by policy and account, violations additionally by resource.
+func Collect(ctx context.Context, client API, policies []fmsapply.OwnedPolicy) (*Report, error) {
+	report := &Report{GeneratedAt: time.Now().UTC()}
+	for _, p := range policies {
+		statuses, err := listStatus(ctx, client, p.PolicyID)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		for _, s := range statuses {
+			account := AccountStatus{
+				Policy:   p.Name,
+				PolicyID: p.PolicyID,
+				Account:  aws.ToString(s.MemberAccount),
+				Status:   accountStatus(s.EvaluationResults),
+				Issues:   issues(s.IssueInfoMap),
+			}
+			for _, r := range s.EvaluationResults {
+				account.Violators += r.ViolatorCount
+				account.EvaluationLimitExceeded = account.EvaluationLimitExceeded || r.EvaluationLimitExceeded
+			}
+			if account.Status == StatusNonCompliant {
+				violations, err := accountViolations(ctx, client, p, account.Account)
+				if err != nil {
+					return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+				}
+				report.Violations = append(report.Violations, violations...)
+			}
+			report.Accounts = append(report.Accounts, account)
+		}
+	}
+
+	sort.Slice(report.Accounts, func(i, j int) bool {
+		a, b := report.Accounts[i], report.Accounts[j]
+		if a.Policy != b.Policy {
+			return a.Policy < b.Policy
+		}
+		return a.Account < b.Account
+	})
+	sort.Slice(report.Violations, func(i, j int) bool {
+		a, b := report.Violations[i], report.Violations[j]
+		if a.Policy != b.Policy {
+			return a.Policy < b.Policy
+		}
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		return a.ResourceID < b.ResourceID
+	})
+	return report, nil
+}
+
+// Summary counts the report, e.g. "3 policies, 12 accounts (2 non-compliant), 5 violations".
+func (r *Report) Summary() string {
+	policies := map[string]bool{}
+	var nonCompliant int
+	for _, a := range r.Accounts {
+		policies[a.Policy] = true
+		if a.Status == StatusNonCompliant {
+			nonCompliant++
+		}
+	}
+	return fmt.Sprintf("%d policies, %d accounts (%d non-compliant), %d violations",
+		len(policies), len(r.Accounts), nonCompliant, len(r.Violations))
+}
+
+func listStatus(ctx context.Context, client API, policyID string) ([]fmstypes.PolicyComplianceStatus, error) {
+	var out []fmstypes.PolicyComplianceStatus
+	pager := fms.NewListComplianceStatusPaginator(client, &fms.ListComplianceStatusInput{PolicyId: aws.String(policyID)})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list compliance status: %w", err)
+		}
+		out = append(out, page.PolicyComplianceStatusList...)
+	}
+	return out, nil
+}
+
+// accountViolations lists the violating resources of a policy in one account.
+func accountViolations(ctx context.Context, client API, p fmsapply.OwnedPolicy, account string) ([]Violation, error) {
+	out, err := client.GetComplianceDetail(ctx, &fms.GetComplianceDetailInput{PolicyId: aws.String(p.PolicyID), MemberAccount: aws.String(account)})
+	if err != nil {
+		return nil, fmt.Errorf("get compliance detail for %s: %w", account, err)
+	}
+	if out.PolicyComplianceDetail == nil {
+		return nil, nil
+	}
+	var violations []Violation
+	for _, v := range out.PolicyComplianceDetail.Violators {
+		violation := Violation{
+			Policy:       p.Name,
+			PolicyID:     p.PolicyID,
+			Account:      account,
+			ResourceID:   aws.ToString(v.ResourceId),
+			ResourceType: aws.ToString(v.ResourceType),
+			Reason:       string(v.ViolationReason),
+			Description:  Describe(v.ViolationReason),
+		}
+		if detailPolicyTypes[p.Type] && detailResourceTypes[violation.ResourceType] {
+			detail, err := client.GetViolationDetails(ctx, &fms.GetViolationDetailsInput{
+				PolicyId:      aws.String(p.PolicyID),
+				MemberAccount: aws.String(account),
+				ResourceId:    v.ResourceId,
+				ResourceType:  v.ResourceType,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("get violation details for %s in %s: %w", violation.ResourceID, account, err)
+			}
+			violation.Detail = describeDetail(detail.ViolationDetail)
+		}
+		violations = append(violations, violation)
+	}
+	return violations, nil
+}
+
+// accountStatus folds the evaluation results of an account into one status.
+func accountStatus(results []fmstypes.EvaluationResult) string {
+	if len(results) == 0 {
+		return StatusNotEvaluated
+	}
+	for _, r := range results {
+		if r.ComplianceStatus == fmstypes.PolicyComplianceStatusTypeNonCompliant {
+			return StatusNonCompliant
+		}
+	}
+	return StatusCompliant
+}
+
+func issues(m map[string]string) []string {
+	var out []string
+	for service, detail := range m {
+		out = append(out, service+": "+detail)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// describeDetail summarizes a violation detail: the resource description and the kinds
+// of violation it lists, e.g. "web tier SG; AwsVPCSecurityGroup".
+func describeDetail(d *fmstypes.ViolationDetail) string {
+	if d == nil {
+		return ""
+	}
+	var kinds []string
+	for _, rv := range d.ResourceViolations {
+		v := reflect.ValueOf(rv)
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Kind() == reflect.Pointer && !f.IsNil() {
+				kinds = append(kinds, strings.TrimSuffix(v.Type().Field(i).Name, "Violation"))
+			}
+		}
+	}
+	var parts []string
+	if desc := aws.ToString(d.ResourceDescription); desc != "" {
+		parts = append(parts, desc)
+	}
+	if len(kinds) > 0 {
+		parts = append(parts, strings.Join(kinds, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
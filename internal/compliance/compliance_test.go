@@ -0,0 +1,188 @@
+package compliance
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/fmsapply"
+)
+
+var _ API = (*fmsfake.FMS)(nil)
+
+// fakeFMS serves compliance data keyed by policy ID, then member account.
+type fakeFMS struct {
+	statuses        map[string][]fmstypes.PolicyComplianceStatus
+	violators       map[string]map[string][]fmstypes.ComplianceViolator
+	details         map[string]fmstypes.ViolationDetail // keyed by resource ID
+	complianceCalls []string
+	violationCalls  []string
+}
+
+func (f *fakeFMS) ListComplianceStatus(_ context.Context, in *fms.ListComplianceStatusInput, _ ...func(*fms.Options)) (*fms.ListComplianceStatusOutput, error) {
+	return &fms.ListComplianceStatusOutput{PolicyComplianceStatusList: f.statuses[aws.ToString(in.PolicyId)]}, nil
+}
+
+func (f *fakeFMS) GetComplianceDetail(_ context.Context, in *fms.GetComplianceDetailInput, _ ...func(*fms.Options)) (*fms.GetComplianceDetailOutput, error) {
+	f.complianceCalls = append(f.complianceCalls, aws.ToString(in.MemberAccount))
+	return &fms.GetComplianceDetailOutput{PolicyComplianceDetail: &fmstypes.PolicyComplianceDetail{
+		Violators: f.violators[aws.ToString(in.PolicyId)][aws.ToString(in.MemberAccount)],
+	}}, nil
+}
+
+func (f *fakeFMS) GetViolationDetails(_ context.Context, in *fms.GetViolationDetailsInput, _ ...func(*fms.Options)) (*fms.GetViolationDetailsOutput, error) {
+	f.violationCalls = append(f.violationCalls, aws.ToString(in.ResourceId))
+	d := f.details[aws.ToString(in.ResourceId)]
+	return &fms.GetViolationDetailsOutput{ViolationDetail: &d}, nil
+}
+
+func evaluated(account string, status fmstypes.PolicyComplianceStatusType, violators int64) fmstypes.PolicyComplianceStatus {
+	return fmstypes.PolicyComplianceStatus{
+		MemberAccount:     aws.String(account),
+		EvaluationResults: []fmstypes.EvaluationResult{{ComplianceStatus: status, ViolatorCount: violators}},
+	}
+}
+
+func testClient() *fakeFMS {
+	return &fakeFMS{
+		statuses: map[string][]fmstypes.PolicyComplianceStatus{
+			"waf-1": {
+				evaluated("222222222222", fmstypes.PolicyComplianceStatusTypeNonCompliant, 2),
+				evaluated("111111111111", fmstypes.PolicyComplianceStatusTypeCompliant, 0),
+				{MemberAccount: aws.String("333333333333"), IssueInfoMap: map[string]string{"AWSCONFIG": "config is not enabled"}},
+			},
+			"sg-1": {evaluated("111111111111", fmstypes.PolicyComplianceStatusTypeNonCompliant, 1)},
+		},
+		violators: map[string]map[string][]fmstypes.ComplianceViolator{
+			"waf-1": {"222222222222": {
+				{ResourceId: aws.String("app/b"), ResourceType: aws.String("AWS::ElasticLoadBalancingV2::LoadBalancer"), ViolationReason: fmstypes.ViolationReasonResourceIncorrectWebAcl},
+				{ResourceId: aws.String("app/a"), ResourceType: aws.String("AWS::ElasticLoadBalancingV2::LoadBalancer"), ViolationReason: fmstypes.ViolationReasonResourceMissingWebAcl},
+			}},
+			"sg-1": {"111111111111": {
+				{ResourceId: aws.String("sg-0abc"), ResourceType: aws.String("AWS::EC2::SecurityGroup"), ViolationReason: fmstypes.ViolationReasonResourceViolatesAuditSecurityGroup},
+			}},
+		},
+		details: map[string]fmstypes.ViolationDetail{
+			"sg-0abc": {
+				ResourceDescription: aws.String("web tier"),
+				ResourceViolations:  []fmstypes.ResourceViolation{{AwsVPCSecurityGroupViolation: &fmstypes.AwsVPCSecurityGroupViolation{}}},
+			},
+		},
+	}
+}
+
+var testPolicies = []fmsapply.OwnedPolicy{
+	{Name: "auto-alb-edge", PolicyID: "waf-1", Type: "WAFV2"},
+	{Name: "auto-sg-audit", PolicyID: "sg-1", Type: "SECURITY_GROUPS_CONTENT_AUDIT"},
+}
+
+func TestCollect(t *testing.T) {
+	client := testClient()
+	report, err := Collect(context.Background(), client, testPolicies)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+
+	var accounts []string
+	for _, a := range report.Accounts {
+		accounts = append(accounts, a.Policy+"/"+a.Account+"="+a.Status)
+	}
+	wantAccounts := []string{
+		"auto-alb-edge/111111111111=COMPLIANT",
+		"auto-alb-edge/222222222222=NON_COMPLIANT",
+		"auto-alb-edge/333333333333=NOT_EVALUATED",
+		"auto-sg-audit/111111111111=NON_COMPLIANT",
+	}
+	if !reflect.DeepEqual(accounts, wantAccounts) {
+		t.Fatalf("unexpected accounts:\n got %v\nwant %v", accounts, wantAccounts)
+	}
+	if issues := report.Accounts[2].Issues; !reflect.DeepEqual(issues, []string{"AWSCONFIG: config is not enabled"}) {
+		t.Fatalf("unexpected issues %v", issues)
+	}
+
+	want := []Violation{
+		{Policy: "auto-alb-edge", PolicyID: "waf-1", Account: "222222222222", ResourceID: "app/a", ResourceType: "AWS::ElasticLoadBalancingV2::LoadBalancer", Reason: "RESOURCE_MISSING_WEB_ACL", Description: "web ACL missing"},
+		{Policy: "auto-alb-edge", PolicyID: "waf-1", Account: "222222222222", ResourceID: "app/b", ResourceType: "AWS::ElasticLoadBalancingV2::LoadBalancer", Reason: "RESOURCE_INCORRECT_WEB_ACL", Description: "customer web ACL conflict"},
+		{Policy: "auto-sg-audit", PolicyID: "sg-1", Account: "111111111111", ResourceID: "sg-0abc", ResourceType: "AWS::EC2::SecurityGroup", Reason: "RESOURCE_VIOLATES_AUDIT_SECURITY_GROUP", Description: "violates the audit security group", Detail: "web tier; AwsVPCSecurityGroup"},
+	}
+	if !reflect.DeepEqual(report.Violations, want) {
+		t.Fatalf("unexpected violations:\n got %+v\nwant %+v", report.Violations, want)
+	}
+
+	// Only non-compliant accounts are detailed, and only supported types get violation details.
+	if !reflect.DeepEqual(client.complianceCalls, []string{"222222222222", "111111111111"}) {
+		t.Fatalf("unexpected compliance detail calls %v", client.complianceCalls)
+	}
+	if !reflect.DeepEqual(client.violationCalls, []string{"sg-0abc"}) {
+		t.Fatalf("unexpected violation detail calls %v", client.violationCalls)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	if got := Describe(fmstypes.ViolationReasonWebAclMissingRuleGroup); got != "rule group missing" {
+		t.Fatalf("unexpected description %q", got)
+	}
+	if got := Describe(fmstypes.ViolationReasonBlackHoleRouteDetected); got != "black hole route detected" {
+		t.Fatalf("unexpected fallback description %q", got)
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	report, err := Collect(context.Background(), testClient(), testPolicies)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	report.GeneratedAt = time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	var out strings.Builder
+	if err := report.Write(&out, FormatJSON); err != nil {
+		t.Fatalf("write json: %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil || len(decoded.Violations) != 3 {
+		t.Fatalf("JSON does not round-trip (%v):\n%s", err, out.String())
+	}
+
+	out.Reset()
+	if err := report.Write(&out, FormatCSV); err != nil {
+		t.Fatalf("write csv: %v", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil || len(rows) != 4 || rows[1][6] != "web ACL missing" {
+		t.Fatalf("unexpected CSV (%v):\n%s", err, out.String())
+	}
+
+	out.Reset()
+	if err := report.Write(&out, FormatMarkdown); err != nil {
+		t.Fatalf("write markdown: %v", err)
+	}
+	for _, want := range []string{
+		"Generated 2026-10-18T09:00:00Z: 2 policies, 4 accounts (2 non-compliant), 3 violations.",
+		"| auto-alb-edge | 333333333333 | NOT_EVALUATED | 0 | AWSCONFIG: config is not enabled |",
+		"| auto-alb-edge | 222222222222 | AWS::ElasticLoadBalancingV2::LoadBalancer | app/b | customer web ACL conflict |  |",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("markdown is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]Format{"": FormatJSON, "CSV": FormatCSV, "markdown": FormatMarkdown} {
+		if got, err := ParseFormat(in); err != nil || got != want {
+			t.Fatalf("ParseFormat(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseFormat("html"); err == nil {
+		t.Fatalf("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,91 @@
+package compliance
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is an output format of the report.
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatCSV      Format = "csv"
+	FormatMarkdown Format = "markdown"
+)
+
+// ParseFormat checks an output format name; "" means JSON.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatCSV, FormatMarkdown:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown report format %q (want json, csv or markdown)", s)
+}
+
+// Write renders the report. JSON carries the whole report; CSV has one row per
+// violation; Markdown has a table of accounts and a table of violations.
+func (r *Report) Write(w io.Writer, format Format) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case FormatCSV:
+		return r.writeCSV(w)
+	case FormatMarkdown:
+		return r.writeMarkdown(w)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+func (r *Report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"policy", "policy_id", "account", "resource_type", "resource_id", "reason", "description", "detail"})
+	for _, v := range r.Violations {
+		_ = cw.Write([]string{v.Policy, v.PolicyID, v.Account, v.ResourceType, v.ResourceID, v.Reason, v.Description, v.Detail})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# FMS compliance report\n\nGenerated %s: %s.\n\n", r.GeneratedAt.Format(time.RFC3339), r.Summary())
+
+	b.WriteString("## Accounts\n\n| Policy | Account | Status | Violators | Issues |\n| --- | --- | --- | --- | --- |\n")
+	for _, a := range r.Accounts {
+		status := a.Status
+		if a.EvaluationLimitExceeded {
+			status += " (evaluation limit exceeded)"
+		}
+		markdownRow(&b, a.Policy, a.Account, status, strconv.FormatInt(a.Violators, 10), strings.Join(a.Issues, "; "))
+	}
+
+	b.WriteString("\n## Violations\n\n")
+	if len(r.Violations) == 0 {
+		b.WriteString("No violations.\n")
+	} else {
+		b.WriteString("| Policy | Account | Resource type | Resource | Reason | Detail |\n| --- | --- | --- | --- | --- | --- |\n")
+		for _, v := range r.Violations {
+			markdownRow(&b, v.Policy, v.Account, v.ResourceType, v.ResourceID, v.Description, v.Detail)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownRow writes one table row, escaping the cell separator.
+func markdownRow(b *strings.Builder, cells ...string) {
+	for i, c := range cells {
+		cells[i] = strings.ReplaceAll(c, "|", `\|`)
+	}
+	fmt.Fprintf(b, "| %s |\n", strings.Join(cells, " | "))
+}
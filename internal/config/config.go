@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -22,6 +25,266 @@ type PolicyConfig struct {
 
 	// Defaults define which rule set names to fall back to when a tag is missing.
 	Defaults RuleSetDefaults `yaml:"defaults"`
+
+	// Grouping controls how resources are mapped onto FMS policies.
+	Grouping Grouping `yaml:"grouping"`
+
+	// Naming controls how policy names are built.
+	Naming Naming `yaml:"naming"`
+
+	// SecurityGroupPolicies are rendered as-is, keyed by policy id, independent of discovery.
+	SecurityGroupPolicies map[string]SecurityGroupPolicy `yaml:"securityGroupPolicies"`
+
+	// Prune controls deletion of policies that no longer match a rendered policy.
+	Prune Prune `yaml:"prune"`
+
+	// Apply tunes how policies are written to FMS.
+	Apply Apply `yaml:"apply"`
+
+	// Canary tries changed policies on a few accounts before the whole scope.
+	Canary Canary `yaml:"canary"`
+
+	// Safety bounds what a single run may change; see Safety.
+	Safety Safety `yaml:"safety"`
+
+	// Preflight configures the checks the Lambda runs before discovery.
+	Preflight Preflight `yaml:"preflight"`
+}
+
+// DefaultMaxDeletions caps prune deletions when prune.maxDeletions is unset.
+const DefaultMaxDeletions = 10
+
+// Prune configures removal of orphaned policies: policies whose name carries the naming
+// prefix but that were not rendered in this run, e.g. because their ALB was deleted.
+type Prune struct {
+	// Enabled turns the prune phase on. Off by default.
+	Enabled bool `yaml:"enabled"`
+
+	// DeleteAllPolicyResources also removes the web ACLs and other resources FMS created
+	// for a deleted policy, and disassociates them from the protected resources.
+	DeleteAllPolicyResources bool `yaml:"deleteAllPolicyResources"`
+
+	// MaxDeletions aborts the run before deleting anything when more orphans are found.
+	// Defaults to DefaultMaxDeletions.
+	MaxDeletions int `yaml:"maxDeletions"`
+}
+
+// EffectiveMaxDeletions returns MaxDeletions, or DefaultMaxDeletions when unset.
+func (p Prune) EffectiveMaxDeletions() int {
+	if p.MaxDeletions == 0 {
+		return DefaultMaxDeletions
+	}
+	return p.MaxDeletions
+}
+
+// Defaults for the apply block.
+const (
+	DefaultApplyConcurrency = 4
+	DefaultApplyMaxAttempts = 5
+)
+
+// Apply configures the apply phase: how many policies are written at once and how often
+// a write that lost an update-token race is retried.
+type Apply struct {
+	// Concurrency is the number of policies written in parallel. Defaults to
+	// DefaultApplyConcurrency.
+	Concurrency int `yaml:"concurrency"`
+
+	// MaxAttempts bounds the tries per policy, including the first. Defaults to
+	// DefaultApplyMaxAttempts.
+	MaxAttempts int `yaml:"maxAttempts"`
+}
+
+// EffectiveConcurrency returns Concurrency, or DefaultApplyConcurrency when unset.
+func (a Apply) EffectiveConcurrency() int {
+	if a.Concurrency == 0 {
+		return DefaultApplyConcurrency
+	}
+	return a.Concurrency
+}
+
+// EffectiveMaxAttempts returns MaxAttempts, or DefaultApplyMaxAttempts when unset.
+func (a Apply) EffectiveMaxAttempts() int {
+	if a.MaxAttempts == 0 {
+		return DefaultApplyMaxAttempts
+	}
+	return a.MaxAttempts
+}
+
+// Safety limits what one run may change, so a bad config push cannot rewrite the whole
+// fleet. Runs exceeding a limit abort before writing anything, unless forced. Zero limits
+// are not enforced.
+type Safety struct {
+	// MaxCreates, MaxUpdates and MaxDeletes bound the policies created, updated and
+	// deleted per run.
+	MaxCreates int `yaml:"maxCreates"`
+	MaxUpdates int `yaml:"maxUpdates"`
+	MaxDeletes int `yaml:"maxDeletes"`
+
+	// MaxRuleSetChangePercent bounds the share of rendered resources, in percent, whose
+	// policy's managed_service_data changes in the run.
+	MaxRuleSetChangePercent float64 `yaml:"maxRuleSetChangePercent"`
+}
+
+// DefaultPolicyQuota is the FMS default quota of policies per administrator and Region.
+const DefaultPolicyQuota = 50
+
+// Preflight configures the checks run before discovery: that the account is the FMS
+// administrator, that the policy quota has room, and that the role holds the permissions
+// the run needs.
+type Preflight struct {
+	// Disabled skips the checks in the Lambda. `renderer doctor` always runs them.
+	Disabled bool `yaml:"disabled"`
+
+	// PolicyQuota is the account's FMS policy quota, for accounts with an increase.
+	// Defaults to DefaultPolicyQuota.
+	PolicyQuota int `yaml:"policyQuota"`
+}
+
+// EffectivePolicyQuota returns PolicyQuota, or DefaultPolicyQuota when unset.
+func (p Preflight) EffectivePolicyQuota() int {
+	if p.PolicyQuota == 0 {
+		return DefaultPolicyQuota
+	}
+	return p.PolicyQuota
+}
+
+// Defaults for the canary block.
+const (
+	DefaultCanaryWait         = 10 * time.Minute
+	DefaultCanaryPollInterval = time.Minute
+	DefaultCanaryPolls        = 3
+)
+
+// Canary configures canary updates: a policy whose managed_service_data changes is first
+// scoped to Accounts through its IncludeMap, and only widened back to its full scope when
+// the FMS compliance status of those accounts stays within the thresholds. Otherwise the
+// previous managed_service_data is restored. A canary spans runs, each run taking at most
+// one poll, so it needs scheduled runs and a policy history to revert from.
+//
+// While a canary runs, every other account in the policy's scope is out of it, new data
+// and old alike, so canaries must be enabled with AcceptCoverageGap.
+type Canary struct {
+	// Accounts are the canary account ids. Empty disables canary updates.
+	Accounts []string `yaml:"accounts"`
+
+	// AcceptCoverageGap acknowledges that accounts outside Accounts lose the policy while
+	// a canary runs. Required with Accounts.
+	AcceptCoverageGap bool `yaml:"acceptCoverageGap"`
+
+	// Wait is how long to let FMS apply the canary before the first poll, as a Go
+	// duration. The poll happens on the first run after it. Defaults to DefaultCanaryWait.
+	Wait string `yaml:"wait"`
+
+	// PollInterval is the least time between compliance polls. Defaults to
+	// DefaultCanaryPollInterval.
+	PollInterval string `yaml:"pollInterval"`
+
+	// Polls is the number of compliance polls that must all pass. Defaults to
+	// DefaultCanaryPolls.
+	Polls int `yaml:"polls"`
+
+	// MaxNonCompliantAccounts is the number of canary accounts that may report
+	// violations. Defaults to 0.
+	MaxNonCompliantAccounts int `yaml:"maxNonCompliantAccounts"`
+
+	// MaxIssues is the number of dependent service issues, such as AWS Config or WAF
+	// errors, the canary accounts may report. Defaults to 0.
+	MaxIssues int `yaml:"maxIssues"`
+}
+
+// Enabled reports whether canary updates are configured.
+func (c Canary) Enabled() bool {
+	return len(c.Accounts) > 0
+}
+
+// EffectiveWait returns Wait, or DefaultCanaryWait when unset.
+func (c Canary) EffectiveWait() time.Duration {
+	return durationOr(c.Wait, DefaultCanaryWait)
+}
+
+// EffectivePollInterval returns PollInterval, or DefaultCanaryPollInterval when unset.
+func (c Canary) EffectivePollInterval() time.Duration {
+	return durationOr(c.PollInterval, DefaultCanaryPollInterval)
+}
+
+// EffectivePolls returns Polls, or DefaultCanaryPolls when unset.
+func (c Canary) EffectivePolls() int {
+	if c.Polls == 0 {
+		return DefaultCanaryPolls
+	}
+	return c.Polls
+}
+
+// durationOr parses s, falling back to def when s is empty. Validate rejects values
+// that do not parse.
+func durationOr(s string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if s == "" || err != nil {
+		return def
+	}
+	return d
+}
+
+// Name components accepted in naming.components.
+const (
+	NameComponentAccount = "account"
+	NameComponentRegion  = "region"
+	NameComponentType    = "type"
+	NameComponentID      = "id"
+)
+
+// Naming configures policy names. The zero value keeps the historical
+// "auto-<type>-<id>" names.
+type Naming struct {
+	// Prefix starts every policy name. Defaults to "auto".
+	Prefix string `yaml:"prefix"`
+
+	// Components lists, in order, the parts joined after the prefix: account, region,
+	// type and id. Defaults to [type, id]. The id is the resource ID, or the rule-set
+	// combination under rule-set grouping. Account and region come from the resource ARN,
+	// so they cannot be used alongside securityGroupPolicies.
+	Components []string `yaml:"components"`
+
+	// MaxIDLength truncates the id component. 0 means no explicit limit; names are
+	// always kept within the FMS limit of 128 characters.
+	MaxIDLength int `yaml:"maxIdLength"`
+
+	// Hash appends a short hash of the unsanitized source so IDs that differ only in
+	// characters replaced by the sanitizer, or beyond the truncation point, stay distinct.
+	Hash bool `yaml:"hash"`
+}
+
+const (
+	// GroupingPerResource renders one policy per discovered resource (the default).
+	GroupingPerResource = "perResource"
+	// GroupingRuleSet renders one tag-scoped policy per resource type and rule-set combination.
+	GroupingRuleSet = "ruleSet"
+
+	// FallbackScopeUntagged covers resources that rely on defaults with a policy that
+	// excludes resources carrying both selector tags.
+	FallbackScopeUntagged = "scopeUntagged"
+	// FallbackSkip leaves resources that rely on defaults without a policy.
+	FallbackSkip = "skip"
+
+	// ScopeByTags scopes rule-set policies with FMS ResourceTags (the default).
+	ScopeByTags = "tags"
+	// ScopeByResourceSet scopes every policy to an FMS resource set holding exactly its ARNs.
+	ScopeByResourceSet = "resourceSet"
+)
+
+// Grouping selects the policy layout.
+type Grouping struct {
+	// Mode is "perResource" (default) or "ruleSet".
+	Mode string `yaml:"mode"`
+
+	// Fallback decides what happens to resources without an explicit, valid value for
+	// both selector tags when Mode is "ruleSet": "scopeUntagged" (default) or "skip".
+	Fallback string `yaml:"fallback"`
+
+	// ScopeBy is "tags" (default) or "resourceSet". Resource sets pin each policy to the
+	// exact ARNs grouped into it and are reconciled on every apply.
+	ScopeBy string `yaml:"scopeBy"`
 }
 
 // TagKeys controls the tag names used for rule selection.
@@ -42,25 +305,372 @@ type RuleSetDefaults struct {
 	Secondary string `yaml:"secondary"`
 }
 
+// FMS security service types supported in resourceDefaults.policyType.
+const (
+	PolicyTypeWAFV2          = "WAFV2"
+	PolicyTypeShieldAdvanced = "SHIELD_ADVANCED"
+
+	PolicyTypeNetworkFirewall = "NETWORK_FIREWALL"
+	PolicyTypeDNSFirewall     = "DNS_FIREWALL"
+
+	PolicyTypeSecurityGroupsCommon       = "SECURITY_GROUPS_COMMON"
+	PolicyTypeSecurityGroupsContentAudit = "SECURITY_GROUPS_CONTENT_AUDIT"
+)
+
 // ResourceDefaults describe default WAF/FMS settings for a resource type.
 type ResourceDefaults struct {
+	// AppliesTo is the discovered resource type ("alb", "cloudfront") the entry covers.
+	// Defaults to the resourceDefaults key, so several entries, e.g. a WAF and a Shield
+	// Advanced one, can cover the same resources under different keys.
+	AppliesTo string `yaml:"appliesTo"`
+
+	// PolicyType is the FMS security service type: "WAFV2" (default), "SHIELD_ADVANCED",
+	// "NETWORK_FIREWALL" or "DNS_FIREWALL".
+	PolicyType string `yaml:"policyType"`
+
 	// ResourceType is the FMS resource type string, e.g.
 	// "AWS::ElasticLoadBalancingV2::LoadBalancer"
 	ResourceType string `yaml:"resourceType"`
 
-	// Scope controls WAFv2 scope (REGIONAL vs CLOUDFRONT).
+	// Scope controls WAFv2 scope (REGIONAL vs CLOUDFRONT). Required for WAFV2 only.
 	Scope string `yaml:"scope"`
 
-	// DefaultAction is typically "ALLOW" or "BLOCK".
+	// DefaultAction is "ALLOW" or "BLOCK", in any case. Required for WAFV2 only.
 	DefaultAction string `yaml:"defaultAction"`
 
+	// ShieldAdvanced holds the baseline settings for SHIELD_ADVANCED entries. Resources
+	// only get a Shield Advanced policy when a selected rule set enables shieldAdvanced.
+	ShieldAdvanced *ShieldAdvancedConfig `yaml:"shieldAdvanced"`
+
+	// NetworkFirewall configures NETWORK_FIREWALL entries.
+	NetworkFirewall *NetworkFirewallConfig `yaml:"networkFirewall"`
+
+	// DNSFirewall configures DNS_FIREWALL entries.
+	DNSFirewall *DNSFirewallConfig `yaml:"dnsFirewall"`
+
+	// DefaultActionResponse optionally customizes the response sent when DefaultAction is "BLOCK".
+	DefaultActionResponse *CustomResponse `yaml:"defaultActionResponse"`
+
 	// ManagedRuleGroups always applied for this resource type.
 	ManagedRuleGroups []RuleGroupConfig `yaml:"managedRuleGroups"`
+
+	// PostProcessRuleGroups are always applied after any rule groups owned by the account.
+	PostProcessRuleGroups []RuleGroupConfig `yaml:"postProcessRuleGroups"`
+
+	// OverrideCustomerWebACLAssociation lets FMS replace web ACLs associated outside FMS.
+	OverrideCustomerWebACLAssociation bool `yaml:"overrideCustomerWebACLAssociation"`
+
+	// Logging configures WAF logging for the web ACLs FMS creates.
+	Logging *LoggingConfig `yaml:"logging"`
+
+	// CustomResponseBodies are referenced by key from custom responses.
+	CustomResponseBodies map[string]CustomResponseBody `yaml:"customResponseBodies"`
+
+	// TokenDomains lists the domains accepted in CAPTCHA/challenge tokens.
+	TokenDomains []string `yaml:"tokenDomains"`
+
+	// Template, when set, renders managed_service_data from the named template
+	// instead of the typed builder. The typed builder is the default.
+	Template string `yaml:"template"`
+
+	// PolicyScope selects the accounts, OUs and resource tags the entry's policies apply
+	// to. A rule set's policyScope replaces it for resources selecting that rule set.
+	PolicyScope *PolicyScope `yaml:"policyScope"`
+
+	// Rollout selects how the entry's new policies turn on remediation. A rule set's
+	// rollout replaces it for resources selecting that rule set.
+	Rollout *Rollout `yaml:"rollout"`
+}
+
+// Rollout modes accepted in rollout.mode.
+const (
+	// RolloutImmediate creates policies with remediation enabled (the default).
+	RolloutImmediate = "immediate"
+	// RolloutStaged creates policies in audit mode, with remediation disabled, and
+	// enables remediation once the soak period has passed and the compliance check holds.
+	RolloutStaged = "staged"
+)
+
+// DefaultSoakPeriod is how long staged policies stay in audit mode when
+// rollout.soakPeriod is unset.
+const DefaultSoakPeriod = 72 * time.Hour
+
+// Rollout configures how new policies move from audit to enforcement. Policies that are
+// already enforced stay enforced; the rollout only governs when remediation is first
+// switched on.
+type Rollout struct {
+	// Mode is "immediate" (default) or "staged".
+	Mode string `yaml:"mode"`
+
+	// SoakPeriod is how long a staged policy stays in audit mode after it was created,
+	// as a Go duration such as "72h". Defaults to DefaultSoakPeriod.
+	SoakPeriod string `yaml:"soakPeriod"`
+
+	// MaxNonCompliantAccounts holds enforcement while more member accounts report
+	// violations of the policy. Unset skips the violation count; FMS must still have
+	// evaluated the policy in at least one account without dependent service issues.
+	MaxNonCompliantAccounts *int `yaml:"maxNonCompliantAccounts"`
+}
+
+// Staged reports whether the rollout keeps new policies in audit mode.
+func (r Rollout) Staged() bool {
+	return r.Mode == RolloutStaged
+}
+
+// EffectiveSoakPeriod returns SoakPeriod, or DefaultSoakPeriod when unset. Validate
+// rejects values that do not parse.
+func (r Rollout) EffectiveSoakPeriod() time.Duration {
+	return durationOr(r.SoakPeriod, DefaultSoakPeriod)
+}
+
+// PolicyScope is the FMS policy scope: the IncludeMap or ExcludeMap of accounts and OUs,
+// and the ResourceTags filter. Without accounts or OUs the policy is scoped to the OU_ID
+// of the run.
+type PolicyScope struct {
+	// IncludeAccounts and IncludeOUs limit the policy to these accounts and OUs.
+	IncludeAccounts []string `yaml:"includeAccounts"`
+	IncludeOUs      []string `yaml:"includeOUs"`
+
+	// ExcludeAccounts and ExcludeOUs apply the policy everywhere except these accounts and
+	// OUs. FMS ignores exclusions when inclusions are set, so the two are exclusive.
+	ExcludeAccounts []string `yaml:"excludeAccounts"`
+	ExcludeOUs      []string `yaml:"excludeOUs"`
+
+	// ResourceTags selects resources carrying these tags; an empty value matches any.
+	ResourceTags map[string]string `yaml:"resourceTags"`
+
+	// ExcludeResourceTags turns ResourceTags into an exclusion list.
+	ExcludeResourceTags bool `yaml:"excludeResourceTags"`
+}
+
+// HasAccountScope reports whether the scope sets any accounts or OUs.
+func (s PolicyScope) HasAccountScope() bool {
+	return len(s.IncludeAccounts)+len(s.IncludeOUs)+len(s.ExcludeAccounts)+len(s.ExcludeOUs) > 0
+}
+
+// ShieldAdvancedConfig configures Shield Advanced protection and its automatic
+// application-layer DDoS mitigation.
+type ShieldAdvancedConfig struct {
+	// AutomaticResponse is "ENABLED", "IGNORED" or "DISABLED". Empty inherits.
+	AutomaticResponse string `yaml:"automaticResponse"`
+
+	// AutomaticResponseAction is "BLOCK" or "COUNT"; required when AutomaticResponse is ENABLED.
+	AutomaticResponseAction string `yaml:"automaticResponseAction"`
+
+	// OverrideCustomerWebACLClassic lets FMS replace WAF Classic web ACLs associated
+	// outside FMS. Only read from resourceDefaults.
+	OverrideCustomerWebACLClassic bool `yaml:"overrideCustomerWebACLClassic"`
+}
+
+// NetworkFirewallConfig describes the firewall FMS deploys into each in-scope VPC.
+type NetworkFirewallConfig struct {
+	StatelessRuleGroups []FirewallRuleGroupRef `yaml:"statelessRuleGroups"`
+
+	// StatelessDefaultActions and StatelessFragmentDefaultActions default to
+	// ["aws:forward_to_sfe"], handing traffic to the stateful engine.
+	StatelessDefaultActions         []string `yaml:"statelessDefaultActions"`
+	StatelessFragmentDefaultActions []string `yaml:"statelessFragmentDefaultActions"`
+
+	StatefulRuleGroups []FirewallRuleGroupRef `yaml:"statefulRuleGroups"`
+
+	// StatefulRuleOrder is DEFAULT_ACTION_ORDER (default) or STRICT_ORDER.
+	StatefulRuleOrder string `yaml:"statefulRuleOrder"`
+
+	// StatefulDefaultActions are only valid with STRICT_ORDER, e.g. ["aws:drop_established"].
+	StatefulDefaultActions []string `yaml:"statefulDefaultActions"`
+
+	Orchestration *FirewallOrchestration `yaml:"orchestration"`
+}
+
+// FirewallRuleGroupRef references a Network Firewall rule group.
+type FirewallRuleGroupRef struct {
+	ARN string `yaml:"arn"`
+	// Priority orders stateless groups, and stateful groups under STRICT_ORDER.
+	Priority int `yaml:"priority"`
+}
+
+// FirewallOrchestration controls how FMS places firewall endpoints and routes.
+type FirewallOrchestration struct {
+	SingleFirewallEndpointPerVPC bool     `yaml:"singleFirewallEndpointPerVPC"`
+	AllowedIPv4CidrList          []string `yaml:"allowedIPv4CidrList"`
+	// RouteManagementAction is OFF (default) or MONITOR.
+	RouteManagementAction      string   `yaml:"routeManagementAction"`
+	RouteManagementTargetTypes []string `yaml:"routeManagementTargetTypes"`
+}
+
+// DNSFirewallConfig lists the Route 53 Resolver DNS Firewall rule groups associated
+// with each in-scope VPC, before (priority 1-99) and after (9901-10000) the account's own.
+type DNSFirewallConfig struct {
+	PreProcessRuleGroups  []DNSFirewallRuleGroupRef `yaml:"preProcessRuleGroups"`
+	PostProcessRuleGroups []DNSFirewallRuleGroupRef `yaml:"postProcessRuleGroups"`
+}
+
+// DNSFirewallRuleGroupRef associates a DNS Firewall rule group at a priority.
+type DNSFirewallRuleGroupRef struct {
+	RuleGroupID string `yaml:"ruleGroupId"`
+	Priority    int    `yaml:"priority"`
+}
+
+// EffectivePolicyType returns PolicyType, defaulting to WAFV2.
+func (rd ResourceDefaults) EffectivePolicyType() string {
+	if rd.PolicyType == "" {
+		return PolicyTypeWAFV2
+	}
+	return rd.PolicyType
+}
+
+// EffectiveShield merges the Shield Advanced settings of the entry and the selected rule
+// sets. It returns nil when neither rule set opts into Shield Advanced.
+func (rd ResourceDefaults) EffectiveShield(primary, secondary RuleSet) *ShieldAdvancedConfig {
+	if primary.ShieldAdvanced == nil && secondary.ShieldAdvanced == nil {
+		return nil
+	}
+
+	var out ShieldAdvancedConfig
+	if rd.ShieldAdvanced != nil {
+		out = *rd.ShieldAdvanced
+	}
+	for _, rs := range []RuleSet{primary, secondary} {
+		if rs.ShieldAdvanced == nil {
+			continue
+		}
+		if status := rs.ShieldAdvanced.AutomaticResponse; status != "" {
+			out.AutomaticResponse = status
+			if status != "ENABLED" {
+				// IGNORED and DISABLED take no action, so drop the inherited one.
+				out.AutomaticResponseAction = ""
+			}
+		}
+		if rs.ShieldAdvanced.AutomaticResponseAction != "" {
+			out.AutomaticResponseAction = rs.ShieldAdvanced.AutomaticResponseAction
+		}
+	}
+	return &out
+}
+
+// EffectiveDefaultAction returns DefaultAction in upper case, as FMS expects it.
+func (rd ResourceDefaults) EffectiveDefaultAction() string {
+	return strings.ToUpper(rd.DefaultAction)
+}
+
+// DefaultsFor returns the sorted resourceDefaults keys that apply to a discovered resource type.
+func (c *PolicyConfig) DefaultsFor(resourceType string) []string {
+	var keys []string
+	for key, rd := range c.ResourceDefaults {
+		appliesTo := rd.AppliesTo
+		if appliesTo == "" {
+			appliesTo = key
+		}
+		if appliesTo == resourceType {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SecurityGroupPolicy describes a SECURITY_GROUPS_COMMON or SECURITY_GROUPS_CONTENT_AUDIT
+// policy. FMS selects the in-scope EC2 instances, ENIs or security groups by ResourceTags.
+type SecurityGroupPolicy struct {
+	// PolicyType is SECURITY_GROUPS_COMMON or SECURITY_GROUPS_CONTENT_AUDIT.
+	PolicyType string `yaml:"policyType"`
+
+	// ResourceTypes defaults to AWS::EC2::Instance and AWS::EC2::NetworkInterface for
+	// common policies and AWS::EC2::SecurityGroup for content audit policies.
+	ResourceTypes []string `yaml:"resourceTypes"`
+
+	// ResourceTags selects resources carrying all of these tags; an empty value matches any.
+	// Using the primary/secondary tag keys ties the policy to the same tags as the rule sets.
+	ResourceTags map[string]string `yaml:"resourceTags"`
+
+	// ExcludeResourceTags turns ResourceTags into an exclusion list.
+	ExcludeResourceTags bool `yaml:"excludeResourceTags"`
+
+	// SecurityGroups are the primary groups (common) or the audit reference groups (content audit).
+	SecurityGroups []string `yaml:"securityGroups"`
+
+	// Options for SECURITY_GROUPS_COMMON.
+	RevertManualSecurityGroupChanges         bool `yaml:"revertManualSecurityGroupChanges"`
+	ExclusiveResourceSecurityGroupManagement bool `yaml:"exclusiveResourceSecurityGroupManagement"`
+	ApplyToAllEC2InstanceENIs                bool `yaml:"applyToAllEC2InstanceENIs"`
+	IncludeSharedVPC                         bool `yaml:"includeSharedVPC"`
+
+	// Audit configures SECURITY_GROUPS_CONTENT_AUDIT rules.
+	Audit *SecurityGroupAudit `yaml:"audit"`
+}
+
+// SecurityGroupAudit holds the content audit rules.
+type SecurityGroupAudit struct {
+	// Action is ALLOW (rules must be within the reference groups, the default) or DENY
+	// (rules must not match the reference groups).
+	Action string `yaml:"action"`
+
+	// DenyProtocolAllValue flags rules that allow all protocols.
+	DenyProtocolAllValue bool `yaml:"denyProtocolAllValue"`
+
+	// Direction limits the managed audit rules to ALL, INGRESS or EGRESS rules.
+	Direction string `yaml:"direction"`
+}
+
+// EffectiveResourceTypes returns ResourceTypes or the default for the policy type.
+func (p SecurityGroupPolicy) EffectiveResourceTypes() []string {
+	if len(p.ResourceTypes) > 0 {
+		return p.ResourceTypes
+	}
+	if p.PolicyType == PolicyTypeSecurityGroupsContentAudit {
+		return []string{"AWS::EC2::SecurityGroup"}
+	}
+	return []string{"AWS::EC2::Instance", "AWS::EC2::NetworkInterface"}
+}
+
+// CustomResponse describes a custom HTTP response for a BLOCK action.
+type CustomResponse struct {
+	ResponseCode          int               `yaml:"responseCode"`
+	CustomResponseBodyKey string            `yaml:"customResponseBodyKey"`
+	ResponseHeaders       map[string]string `yaml:"responseHeaders"`
+}
+
+// CustomResponseBody is a response body that custom responses can reference by key.
+type CustomResponseBody struct {
+	// ContentType is one of TEXT_PLAIN, TEXT_HTML or APPLICATION_JSON.
+	ContentType string `yaml:"contentType"`
+	Content     string `yaml:"content"`
+}
+
+// LoggingConfig sends web ACL logs to one or more destinations.
+type LoggingConfig struct {
+	// LogDestinationConfigs are Firehose, S3 or CloudWatch Logs ARNs.
+	LogDestinationConfigs []string        `yaml:"logDestinationConfigs"`
+	RedactedFields        []RedactedField `yaml:"redactedFields"`
+}
+
+// RedactedField removes a request component from the logs.
+type RedactedField struct {
+	// Type is one of SingleHeader, Method, QueryString or UriPath.
+	Type string `yaml:"type"`
+	// Value names the header when Type is SingleHeader.
+	Value string `yaml:"value"`
 }
 
 // RuleSet represents a named collection of rule groups chosen by tag value.
 type RuleSet struct {
 	RuleGroups []RuleGroupConfig `yaml:"ruleGroups"`
+
+	// PostProcessRuleGroups are evaluated after the account's own rule groups.
+	PostProcessRuleGroups []RuleGroupConfig `yaml:"postProcessRuleGroups"`
+
+	// ShieldAdvanced opts resources selecting this rule set into the SHIELD_ADVANCED
+	// resourceDefaults entries. Non-empty fields override the entry's settings; the
+	// secondary rule set wins over the primary one.
+	ShieldAdvanced *ShieldAdvancedConfig `yaml:"shieldAdvanced"`
+
+	// PolicyScope replaces the resourceDefaults entry's policyScope for policies covering
+	// resources that select this rule set. The secondary rule set wins over the primary one.
+	PolicyScope *PolicyScope `yaml:"policyScope"`
+
+	// Rollout replaces the resourceDefaults entry's rollout for policies covering
+	// resources that select this rule set. The secondary rule set wins over the primary one.
+	Rollout *Rollout `yaml:"rollout"`
 }
 
 // RuleGroupConfig identifies either an AWS-managed rule group (vendor/name) or a customer-managed rule group (arn).
@@ -69,6 +679,25 @@ type RuleGroupConfig struct {
 	ARN    string `yaml:"arn"`
 	Vendor string `yaml:"vendor"`
 	Name   string `yaml:"name"`
+
+	// Version pins a managed rule group version; only valid with vendor/name.
+	Version string `yaml:"version"`
+
+	// OverrideAction is "NONE" (default) or "COUNT".
+	OverrideAction string `yaml:"overrideAction"`
+
+	// ExcludeRules lists rule names that are set to count.
+	ExcludeRules []string `yaml:"excludeRules"`
+
+	// RuleActionOverrides replace the action of individual rules in a managed rule group.
+	RuleActionOverrides []RuleActionOverride `yaml:"ruleActionOverrides"`
+}
+
+// RuleActionOverride replaces the action of a single rule inside a rule group.
+type RuleActionOverride struct {
+	Name string `yaml:"name"`
+	// Action is one of ALLOW, BLOCK, COUNT, CAPTCHA or CHALLENGE.
+	Action string `yaml:"action"`
 }
 
 // Load loads PolicyConfig from a YAML file.
@@ -103,16 +732,28 @@ func (c *PolicyConfig) Validate() error {
 		if rd.ResourceType == "" {
 			return fmt.Errorf("resourceDefaults[%s].resourceType is required", key)
 		}
-		if rd.Scope == "" {
-			return fmt.Errorf("resourceDefaults[%s].scope is required", key)
-		}
-		if rd.DefaultAction == "" {
-			return fmt.Errorf("resourceDefaults[%s].defaultAction is required", key)
-		}
-		for i, rg := range rd.ManagedRuleGroups {
-			if err := validateRuleGroup(fmt.Sprintf("resourceDefaults[%s].managedRuleGroups[%d]", key, i), rg); err != nil {
+		switch rd.EffectivePolicyType() {
+		case PolicyTypeWAFV2:
+			if rd.Scope == "" {
+				return fmt.Errorf("resourceDefaults[%s].scope is required", key)
+			}
+			if rd.DefaultAction == "" {
+				return fmt.Errorf("resourceDefaults[%s].defaultAction is required", key)
+			}
+		case PolicyTypeShieldAdvanced, PolicyTypeNetworkFirewall, PolicyTypeDNSFirewall:
+			if err := validateNonWAFDefaults(fmt.Sprintf("resourceDefaults[%s]", key), rd); err != nil {
 				return err
 			}
+			continue
+		default:
+			return fmt.Errorf("resourceDefaults[%s].policyType must be one of %s, %s, %s, %s; got %q", key,
+				PolicyTypeWAFV2, PolicyTypeShieldAdvanced, PolicyTypeNetworkFirewall, PolicyTypeDNSFirewall, rd.PolicyType)
+		}
+		if err := validateServiceBlocks(fmt.Sprintf("resourceDefaults[%s]", key), rd); err != nil {
+			return err
+		}
+		if err := validateResourceDefaults(fmt.Sprintf("resourceDefaults[%s]", key), rd); err != nil {
+			return err
 		}
 	}
 
@@ -138,21 +779,589 @@ func (c *PolicyConfig) Validate() error {
 		return fmt.Errorf("defaults.secondary %q not found in ruleSets.secondary", c.Defaults.Secondary)
 	}
 
+	switch c.Grouping.Mode {
+	case "", GroupingPerResource, GroupingRuleSet:
+	default:
+		return fmt.Errorf("grouping.mode must be %s or %s, got %q", GroupingPerResource, GroupingRuleSet, c.Grouping.Mode)
+	}
+	switch c.Grouping.Fallback {
+	case "", FallbackScopeUntagged, FallbackSkip:
+	default:
+		return fmt.Errorf("grouping.fallback must be %s or %s, got %q", FallbackScopeUntagged, FallbackSkip, c.Grouping.Fallback)
+	}
+	switch c.Grouping.ScopeBy {
+	case "", ScopeByTags, ScopeByResourceSet:
+	default:
+		return fmt.Errorf("grouping.scopeBy must be %s or %s, got %q", ScopeByTags, ScopeByResourceSet, c.Grouping.ScopeBy)
+	}
+
+	if err := validateNaming(c.Naming); err != nil {
+		return err
+	}
+	if c.Prune.MaxDeletions < 0 {
+		return fmt.Errorf("prune.maxDeletions must not be negative")
+	}
+	if c.Apply.Concurrency < 0 {
+		return fmt.Errorf("apply.concurrency must not be negative")
+	}
+	if c.Apply.MaxAttempts < 0 {
+		return fmt.Errorf("apply.maxAttempts must not be negative")
+	}
+
+	if err := validateCanary(c.Canary); err != nil {
+		return err
+	}
+	if err := validateSafety(c.Safety); err != nil {
+		return err
+	}
+	if err := validatePreflight(c.Preflight); err != nil {
+		return err
+	}
+
+	if len(c.SecurityGroupPolicies) > 0 {
+		// Security group policies come from the config, not a discovered ARN, so they
+		// have no account or region to name them by.
+		for _, comp := range c.Naming.Components {
+			if comp == NameComponentAccount || comp == NameComponentRegion {
+				return fmt.Errorf("naming.components must not include %s when securityGroupPolicies are configured", comp)
+			}
+		}
+	}
+	for name, sg := range c.SecurityGroupPolicies {
+		if err := validateSecurityGroupPolicy(fmt.Sprintf("securityGroupPolicies[%s]", name), sg); err != nil {
+			return err
+		}
+	}
+
 	for name, rs := range c.RuleSets.Primary {
-		for i, rg := range rs.RuleGroups {
-			if err := validateRuleGroup(fmt.Sprintf("ruleSets.primary[%s].ruleGroups[%d]", name, i), rg); err != nil {
-				return err
+		if err := validateRuleSet(fmt.Sprintf("ruleSets.primary[%s]", name), rs); err != nil {
+			return err
+		}
+	}
+	for name, rs := range c.RuleSets.Secondary {
+		if err := validateRuleSet(fmt.Sprintf("ruleSets.secondary[%s]", name), rs); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateShieldResponses(); err != nil {
+		return err
+	}
+	if err := c.validatePolicyScopes(); err != nil {
+		return err
+	}
+	return c.validateRollouts()
+}
+
+// validateShieldResponses checks that every Shield Advanced entry has an action wherever
+// automatic response is ENABLED. Rule sets inherit the action from the entry and from each
+// other, so each entry is merged with every primary and secondary pair a resource can select.
+func (c *PolicyConfig) validateShieldResponses() error {
+	primaries := sortedRuleSetNames(c.RuleSets.Primary)
+	secondaries := append([]string{""}, sortedRuleSetNames(c.RuleSets.Secondary)...)
+	for _, key := range sortedDefaultsKeys(c.ResourceDefaults) {
+		rd := c.ResourceDefaults[key]
+		if rd.EffectivePolicyType() != PolicyTypeShieldAdvanced {
+			continue
+		}
+		for _, p := range primaries {
+			for _, s := range secondaries {
+				primary, secondary := c.RuleSets.Primary[p], c.RuleSets.Secondary[s]
+				shield := rd.EffectiveShield(primary, secondary)
+				if shield == nil || shield.AutomaticResponse != "ENABLED" || shield.AutomaticResponseAction != "" {
+					continue
+				}
+				// Point at the block that turned automatic response on.
+				field := fmt.Sprintf("resourceDefaults[%s].shieldAdvanced", key)
+				if secondary.ShieldAdvanced != nil && secondary.ShieldAdvanced.AutomaticResponse == "ENABLED" {
+					field = fmt.Sprintf("ruleSets.secondary[%s].shieldAdvanced", s)
+				} else if primary.ShieldAdvanced != nil && primary.ShieldAdvanced.AutomaticResponse == "ENABLED" {
+					field = fmt.Sprintf("ruleSets.primary[%s].shieldAdvanced", p)
+				}
+				return fmt.Errorf("%s.automaticResponseAction is required when automaticResponse is ENABLED; none is set here or inherited from resourceDefaults[%s]", field, key)
 			}
 		}
 	}
+	return nil
+}
+
+func sortedRuleSetNames(m map[string]RuleSet) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedDefaultsKeys(m map[string]ResourceDefaults) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateRollouts checks every rollout block.
+func (c *PolicyConfig) validateRollouts() error {
+	check := func(prefix string, r *Rollout) error {
+		if r == nil {
+			return nil
+		}
+		return validateRollout(prefix+".rollout", *r)
+	}
+	for key, rd := range c.ResourceDefaults {
+		if err := check(fmt.Sprintf("resourceDefaults[%s]", key), rd.Rollout); err != nil {
+			return err
+		}
+	}
+	for name, rs := range c.RuleSets.Primary {
+		if err := check(fmt.Sprintf("ruleSets.primary[%s]", name), rs.Rollout); err != nil {
+			return err
+		}
+	}
 	for name, rs := range c.RuleSets.Secondary {
-		for i, rg := range rs.RuleGroups {
-			if err := validateRuleGroup(fmt.Sprintf("ruleSets.secondary[%s].ruleGroups[%d]", name, i), rg); err != nil {
-				return err
+		if err := check(fmt.Sprintf("ruleSets.secondary[%s]", name), rs.Rollout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRollout(prefix string, r Rollout) error {
+	switch r.Mode {
+	case "", RolloutImmediate, RolloutStaged:
+	default:
+		return fmt.Errorf("%s.mode must be %s or %s, got %q", prefix, RolloutImmediate, RolloutStaged, r.Mode)
+	}
+	if r.SoakPeriod != "" {
+		d, err := time.ParseDuration(r.SoakPeriod)
+		if err != nil {
+			return fmt.Errorf("%s.soakPeriod %q is not a duration: %w", prefix, r.SoakPeriod, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("%s.soakPeriod must not be negative", prefix)
+		}
+	}
+	if r.MaxNonCompliantAccounts != nil && *r.MaxNonCompliantAccounts < 0 {
+		return fmt.Errorf("%s.maxNonCompliantAccounts must not be negative", prefix)
+	}
+	if !r.Staged() && (r.SoakPeriod != "" || r.MaxNonCompliantAccounts != nil) {
+		return fmt.Errorf("%s: soakPeriod and maxNonCompliantAccounts require mode %s", prefix, RolloutStaged)
+	}
+	return nil
+}
+
+// validatePolicyScopes checks every policyScope block. Rule-set grouping and resource
+// sets already decide which resources a policy covers, so resourceTags are rejected there.
+func (c *PolicyConfig) validatePolicyScopes() error {
+	tagsAllowed := c.Grouping.Mode != GroupingRuleSet && c.Grouping.ScopeBy != ScopeByResourceSet
+	check := func(prefix string, s *PolicyScope) error {
+		if s == nil {
+			return nil
+		}
+		return validatePolicyScope(prefix+".policyScope", *s, tagsAllowed)
+	}
+	for key, rd := range c.ResourceDefaults {
+		if err := check(fmt.Sprintf("resourceDefaults[%s]", key), rd.PolicyScope); err != nil {
+			return err
+		}
+	}
+	for name, rs := range c.RuleSets.Primary {
+		if err := check(fmt.Sprintf("ruleSets.primary[%s]", name), rs.PolicyScope); err != nil {
+			return err
+		}
+	}
+	for name, rs := range c.RuleSets.Secondary {
+		if err := check(fmt.Sprintf("ruleSets.secondary[%s]", name), rs.PolicyScope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePolicyScope(prefix string, s PolicyScope, tagsAllowed bool) error {
+	if len(s.IncludeAccounts)+len(s.IncludeOUs) > 0 && len(s.ExcludeAccounts)+len(s.ExcludeOUs) > 0 {
+		return fmt.Errorf("%s: set either include or exclude accounts/OUs, not both", prefix)
+	}
+	for field, ids := range map[string][]string{"includeAccounts": s.IncludeAccounts, "excludeAccounts": s.ExcludeAccounts} {
+		for i, id := range ids {
+			if !isAccountID(id) {
+				return fmt.Errorf("%s.%s[%d] %q is not a 12-digit account id", prefix, field, i, id)
+			}
+		}
+	}
+	for field, ids := range map[string][]string{"includeOUs": s.IncludeOUs, "excludeOUs": s.ExcludeOUs} {
+		for i, id := range ids {
+			if !strings.HasPrefix(id, "ou-") || len(id) < len("ou-xxxx-xxxxxxxx") {
+				return fmt.Errorf("%s.%s[%d] %q is not an OU id (ou-...)", prefix, field, i, id)
 			}
 		}
 	}
 
+	if len(s.ResourceTags) > 0 && !tagsAllowed {
+		return fmt.Errorf("%s.resourceTags is not supported with grouping.mode %s or grouping.scopeBy %s", prefix, GroupingRuleSet, ScopeByResourceSet)
+	}
+	for key := range s.ResourceTags {
+		if key == "" {
+			return fmt.Errorf("%s.resourceTags has an empty key", prefix)
+		}
+	}
+	if s.ExcludeResourceTags && len(s.ResourceTags) == 0 {
+		return fmt.Errorf("%s.excludeResourceTags requires resourceTags", prefix)
+	}
+	return nil
+}
+
+func validateCanary(c Canary) error {
+	for i, id := range c.Accounts {
+		if !isAccountID(id) {
+			return fmt.Errorf("canary.accounts[%d] %q is not a 12-digit account id", i, id)
+		}
+	}
+	if len(c.Accounts) > 0 && !c.AcceptCoverageGap {
+		return fmt.Errorf("canary.acceptCoverageGap must be true with canary.accounts: while a canary runs, the policy only covers the canary accounts")
+	}
+	for field, v := range map[string]string{"wait": c.Wait, "pollInterval": c.PollInterval} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return fmt.Errorf("canary.%s %q is not a non-negative duration", field, v)
+		}
+	}
+	if c.Polls < 0 || c.MaxNonCompliantAccounts < 0 || c.MaxIssues < 0 {
+		return fmt.Errorf("canary.polls, canary.maxNonCompliantAccounts and canary.maxIssues must not be negative")
+	}
+	return nil
+}
+
+func validateSafety(s Safety) error {
+	if s.MaxCreates < 0 || s.MaxUpdates < 0 || s.MaxDeletes < 0 {
+		return fmt.Errorf("safety.maxCreates, safety.maxUpdates and safety.maxDeletes must not be negative")
+	}
+	if s.MaxRuleSetChangePercent < 0 || s.MaxRuleSetChangePercent > 100 {
+		return fmt.Errorf("safety.maxRuleSetChangePercent must be between 0 and 100, got %v", s.MaxRuleSetChangePercent)
+	}
+	return nil
+}
+
+func validatePreflight(p Preflight) error {
+	if p.PolicyQuota < 0 {
+		return fmt.Errorf("preflight.policyQuota must not be negative")
+	}
+	return nil
+}
+
+func isAccountID(id string) bool {
+	if len(id) != 12 {
+		return false
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func validateNaming(n Naming) error {
+	if len(n.Prefix) > 32 {
+		return fmt.Errorf("naming.prefix must be at most 32 characters")
+	}
+	for _, r := range n.Prefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("naming.prefix %q may only contain letters, digits, '-' and '_'", n.Prefix)
+		}
+	}
+
+	hasID := len(n.Components) == 0
+	seen := make(map[string]bool, len(n.Components))
+	for i, comp := range n.Components {
+		switch comp {
+		case NameComponentAccount, NameComponentRegion, NameComponentType:
+		case NameComponentID:
+			hasID = true
+		default:
+			return fmt.Errorf("naming.components[%d] %q must be one of account, region, type, id", i, comp)
+		}
+		if seen[comp] {
+			return fmt.Errorf("naming.components lists %q more than once", comp)
+		}
+		seen[comp] = true
+	}
+	if !hasID {
+		return fmt.Errorf("naming.components must include id")
+	}
+
+	if n.MaxIDLength < 0 {
+		return fmt.Errorf("naming.maxIdLength must not be negative")
+	}
+	return nil
+}
+
+func validateResourceDefaults(prefix string, rd ResourceDefaults) error {
+	switch rd.EffectiveDefaultAction() {
+	case "ALLOW", "BLOCK":
+	default:
+		return fmt.Errorf("%s.defaultAction must be ALLOW or BLOCK, got %q", prefix, rd.DefaultAction)
+	}
+	for i, rg := range rd.ManagedRuleGroups {
+		if err := validateRuleGroup(fmt.Sprintf("%s.managedRuleGroups[%d]", prefix, i), rg); err != nil {
+			return err
+		}
+	}
+	for i, rg := range rd.PostProcessRuleGroups {
+		if err := validateRuleGroup(fmt.Sprintf("%s.postProcessRuleGroups[%d]", prefix, i), rg); err != nil {
+			return err
+		}
+	}
+
+	for key, body := range rd.CustomResponseBodies {
+		switch body.ContentType {
+		case "TEXT_PLAIN", "TEXT_HTML", "APPLICATION_JSON":
+		default:
+			return fmt.Errorf("%s.customResponseBodies[%s].contentType must be TEXT_PLAIN, TEXT_HTML or APPLICATION_JSON", prefix, key)
+		}
+		if body.Content == "" {
+			return fmt.Errorf("%s.customResponseBodies[%s].content is required", prefix, key)
+		}
+	}
+
+	if cr := rd.DefaultActionResponse; cr != nil {
+		if rd.EffectiveDefaultAction() != "BLOCK" {
+			return fmt.Errorf("%s.defaultActionResponse requires defaultAction BLOCK", prefix)
+		}
+		if cr.ResponseCode < 200 || cr.ResponseCode > 599 {
+			return fmt.Errorf("%s.defaultActionResponse.responseCode must be between 200 and 599", prefix)
+		}
+		if cr.CustomResponseBodyKey != "" {
+			if _, ok := rd.CustomResponseBodies[cr.CustomResponseBodyKey]; !ok {
+				return fmt.Errorf("%s.defaultActionResponse.customResponseBodyKey %q not found in customResponseBodies", prefix, cr.CustomResponseBodyKey)
+			}
+		}
+	}
+
+	if lc := rd.Logging; lc != nil {
+		if len(lc.LogDestinationConfigs) == 0 {
+			return fmt.Errorf("%s.logging.logDestinationConfigs must not be empty", prefix)
+		}
+		for i, f := range lc.RedactedFields {
+			switch f.Type {
+			case "SingleHeader":
+				if f.Value == "" {
+					return fmt.Errorf("%s.logging.redactedFields[%d].value is required for SingleHeader", prefix, i)
+				}
+			case "Method", "QueryString", "UriPath":
+			default:
+				return fmt.Errorf("%s.logging.redactedFields[%d].type %q is not supported", prefix, i, f.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateNonWAFDefaults rejects WAF-only settings on entries of other policy types and
+// validates the settings block of the entry's type.
+func validateNonWAFDefaults(prefix string, rd ResourceDefaults) error {
+	policyType := rd.EffectivePolicyType()
+	if rd.DefaultAction != "" || len(rd.ManagedRuleGroups) > 0 || len(rd.PostProcessRuleGroups) > 0 ||
+		rd.Logging != nil || rd.DefaultActionResponse != nil || rd.Template != "" {
+		return fmt.Errorf("%s: WAF settings (defaultAction, rule groups, logging, template) are not valid for policyType %s", prefix, policyType)
+	}
+	if err := validateServiceBlocks(prefix, rd); err != nil {
+		return err
+	}
+
+	switch policyType {
+	case PolicyTypeShieldAdvanced:
+		if rd.ShieldAdvanced != nil {
+			return validateShieldAdvanced(prefix+".shieldAdvanced", *rd.ShieldAdvanced)
+		}
+	case PolicyTypeNetworkFirewall:
+		if rd.NetworkFirewall == nil {
+			return fmt.Errorf("%s.networkFirewall is required for policyType %s", prefix, policyType)
+		}
+		return validateNetworkFirewall(prefix+".networkFirewall", *rd.NetworkFirewall)
+	case PolicyTypeDNSFirewall:
+		if rd.DNSFirewall == nil {
+			return fmt.Errorf("%s.dnsFirewall is required for policyType %s", prefix, policyType)
+		}
+		return validateDNSFirewall(prefix+".dnsFirewall", *rd.DNSFirewall)
+	}
+	return nil
+}
+
+// validateServiceBlocks checks that only the settings block matching the policy type is set.
+func validateServiceBlocks(prefix string, rd ResourceDefaults) error {
+	policyType := rd.EffectivePolicyType()
+	blocks := []struct {
+		name       string
+		set        bool
+		policyType string
+	}{
+		{"shieldAdvanced", rd.ShieldAdvanced != nil, PolicyTypeShieldAdvanced},
+		{"networkFirewall", rd.NetworkFirewall != nil, PolicyTypeNetworkFirewall},
+		{"dnsFirewall", rd.DNSFirewall != nil, PolicyTypeDNSFirewall},
+	}
+	for _, b := range blocks {
+		if b.set && b.policyType != policyType {
+			return fmt.Errorf("%s.%s requires policyType %s", prefix, b.name, b.policyType)
+		}
+	}
+	return nil
+}
+
+func validateNetworkFirewall(prefix string, nf NetworkFirewallConfig) error {
+	if len(nf.StatelessRuleGroups) == 0 && len(nf.StatefulRuleGroups) == 0 {
+		return fmt.Errorf("%s must reference at least one stateless or stateful rule group", prefix)
+	}
+	for i, rg := range nf.StatelessRuleGroups {
+		if rg.ARN == "" {
+			return fmt.Errorf("%s.statelessRuleGroups[%d].arn is required", prefix, i)
+		}
+		if rg.Priority < 1 || rg.Priority > 65535 {
+			return fmt.Errorf("%s.statelessRuleGroups[%d].priority must be between 1 and 65535", prefix, i)
+		}
+	}
+
+	strict := false
+	switch nf.StatefulRuleOrder {
+	case "", "DEFAULT_ACTION_ORDER":
+	case "STRICT_ORDER":
+		strict = true
+	default:
+		return fmt.Errorf("%s.statefulRuleOrder must be DEFAULT_ACTION_ORDER or STRICT_ORDER, got %q", prefix, nf.StatefulRuleOrder)
+	}
+	for i, rg := range nf.StatefulRuleGroups {
+		if rg.ARN == "" {
+			return fmt.Errorf("%s.statefulRuleGroups[%d].arn is required", prefix, i)
+		}
+		if rg.Priority != 0 && !strict {
+			return fmt.Errorf("%s.statefulRuleGroups[%d].priority requires statefulRuleOrder STRICT_ORDER", prefix, i)
+		}
+	}
+	if len(nf.StatefulDefaultActions) > 0 && !strict {
+		return fmt.Errorf("%s.statefulDefaultActions requires statefulRuleOrder STRICT_ORDER", prefix)
+	}
+
+	if o := nf.Orchestration; o != nil {
+		switch o.RouteManagementAction {
+		case "", "OFF", "MONITOR":
+		default:
+			return fmt.Errorf("%s.orchestration.routeManagementAction must be OFF or MONITOR, got %q", prefix, o.RouteManagementAction)
+		}
+	}
+	return nil
+}
+
+func validateDNSFirewall(prefix string, dns DNSFirewallConfig) error {
+	if len(dns.PreProcessRuleGroups) == 0 && len(dns.PostProcessRuleGroups) == 0 {
+		return fmt.Errorf("%s must list at least one rule group", prefix)
+	}
+	for i, rg := range dns.PreProcessRuleGroups {
+		if rg.RuleGroupID == "" {
+			return fmt.Errorf("%s.preProcessRuleGroups[%d].ruleGroupId is required", prefix, i)
+		}
+		if rg.Priority < 1 || rg.Priority > 99 {
+			return fmt.Errorf("%s.preProcessRuleGroups[%d].priority must be between 1 and 99", prefix, i)
+		}
+	}
+	for i, rg := range dns.PostProcessRuleGroups {
+		if rg.RuleGroupID == "" {
+			return fmt.Errorf("%s.postProcessRuleGroups[%d].ruleGroupId is required", prefix, i)
+		}
+		if rg.Priority < 9901 || rg.Priority > 10000 {
+			return fmt.Errorf("%s.postProcessRuleGroups[%d].priority must be between 9901 and 10000", prefix, i)
+		}
+	}
+	return nil
+}
+
+func validateShieldAdvanced(prefix string, s ShieldAdvancedConfig) error {
+	switch s.AutomaticResponse {
+	case "", "ENABLED", "IGNORED", "DISABLED":
+	default:
+		return fmt.Errorf("%s.automaticResponse must be ENABLED, IGNORED or DISABLED, got %q", prefix, s.AutomaticResponse)
+	}
+	switch s.AutomaticResponseAction {
+	case "", "BLOCK", "COUNT":
+	default:
+		return fmt.Errorf("%s.automaticResponseAction must be BLOCK or COUNT, got %q", prefix, s.AutomaticResponseAction)
+	}
+	if s.AutomaticResponseAction != "" && s.AutomaticResponse != "" && s.AutomaticResponse != "ENABLED" {
+		return fmt.Errorf("%s.automaticResponseAction requires automaticResponse ENABLED", prefix)
+	}
+	return nil
+}
+
+func validateSecurityGroupPolicy(prefix string, p SecurityGroupPolicy) error {
+	for i, id := range p.SecurityGroups {
+		if !strings.HasPrefix(id, "sg-") {
+			return fmt.Errorf("%s.securityGroups[%d] %q is not a security group id", prefix, i, id)
+		}
+	}
+	for i, rt := range p.ResourceTypes {
+		switch rt {
+		case "AWS::EC2::Instance", "AWS::EC2::NetworkInterface", "AWS::EC2::SecurityGroup":
+		default:
+			return fmt.Errorf("%s.resourceTypes[%d] %q is not supported", prefix, i, rt)
+		}
+	}
+
+	switch p.PolicyType {
+	case PolicyTypeSecurityGroupsCommon:
+		if len(p.SecurityGroups) == 0 {
+			return fmt.Errorf("%s.securityGroups must list the primary security group", prefix)
+		}
+		if p.Audit != nil {
+			return fmt.Errorf("%s.audit requires policyType %s", prefix, PolicyTypeSecurityGroupsContentAudit)
+		}
+	case PolicyTypeSecurityGroupsContentAudit:
+		if p.RevertManualSecurityGroupChanges || p.ExclusiveResourceSecurityGroupManagement || p.ApplyToAllEC2InstanceENIs || p.IncludeSharedVPC {
+			return fmt.Errorf("%s: common policy options are not valid for policyType %s", prefix, PolicyTypeSecurityGroupsContentAudit)
+		}
+		audit := SecurityGroupAudit{}
+		if p.Audit != nil {
+			audit = *p.Audit
+		}
+		if len(p.SecurityGroups) == 0 && !audit.DenyProtocolAllValue && audit.Direction == "" {
+			return fmt.Errorf("%s needs securityGroups or managed audit rules", prefix)
+		}
+		switch audit.Action {
+		case "", "ALLOW", "DENY":
+		default:
+			return fmt.Errorf("%s.audit.action must be ALLOW or DENY, got %q", prefix, audit.Action)
+		}
+		switch audit.Direction {
+		case "", "ALL", "INGRESS", "EGRESS":
+		default:
+			return fmt.Errorf("%s.audit.direction must be ALL, INGRESS or EGRESS, got %q", prefix, audit.Direction)
+		}
+	default:
+		return fmt.Errorf("%s.policyType must be %s or %s, got %q", prefix, PolicyTypeSecurityGroupsCommon, PolicyTypeSecurityGroupsContentAudit, p.PolicyType)
+	}
+	return nil
+}
+
+func validateRuleSet(prefix string, rs RuleSet) error {
+	if rs.ShieldAdvanced != nil {
+		if err := validateShieldAdvanced(prefix+".shieldAdvanced", *rs.ShieldAdvanced); err != nil {
+			return err
+		}
+	}
+	for i, rg := range rs.RuleGroups {
+		if err := validateRuleGroup(fmt.Sprintf("%s.ruleGroups[%d]", prefix, i), rg); err != nil {
+			return err
+		}
+	}
+	for i, rg := range rs.PostProcessRuleGroups {
+		if err := validateRuleGroup(fmt.Sprintf("%s.postProcessRuleGroups[%d]", prefix, i), rg); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -164,10 +1373,29 @@ func validateRuleGroup(prefix string, rg RuleGroupConfig) error {
 	case hasARN && hasManaged:
 		return fmt.Errorf("%s: specify either arn OR vendor/name, not both", prefix)
 	case hasARN:
-		return nil
+		if rg.Version != "" {
+			return fmt.Errorf("%s: version is only valid for managed rule groups", prefix)
+		}
 	case rg.Vendor != "" && rg.Name != "":
-		return nil
 	default:
 		return fmt.Errorf("%s: must provide arn or vendor/name", prefix)
 	}
+
+	switch rg.OverrideAction {
+	case "", "NONE", "COUNT":
+	default:
+		return fmt.Errorf("%s: overrideAction must be NONE or COUNT, got %q", prefix, rg.OverrideAction)
+	}
+
+	for i, o := range rg.RuleActionOverrides {
+		if o.Name == "" {
+			return fmt.Errorf("%s.ruleActionOverrides[%d].name is required", prefix, i)
+		}
+		switch o.Action {
+		case "ALLOW", "BLOCK", "COUNT", "CAPTCHA", "CHALLENGE":
+		default:
+			return fmt.Errorf("%s.ruleActionOverrides[%d].action %q is not supported", prefix, i, o.Action)
+		}
+	}
+	return nil
 }
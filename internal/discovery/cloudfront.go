@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// DiscoverCloudFront discovers CloudFront distributions and their tags.
+//
+// CloudFront is a global service, so the configured region does not limit the result.
+func DiscoverCloudFront(ctx context.Context, cfg aws.Config, logger *util.Logger) ([]Resource, error) {
+	client := cloudfront.NewFromConfig(cfg)
+
+	var resources []Resource
+	pager := cloudfront.NewListDistributionsPaginator(client, &cloudfront.ListDistributionsInput{})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list distributions: %w", err)
+		}
+		if page.DistributionList == nil {
+			continue
+		}
+
+		for _, d := range page.DistributionList.Items {
+			if d.ARN == nil || d.Id == nil {
+				continue
+			}
+			tagOut, err := client.ListTagsForResource(ctx, &cloudfront.ListTagsForResourceInput{
+				Resource: d.ARN,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("list tags for distribution %s: %w", *d.Id, err)
+			}
+
+			tags := map[string]string{}
+			if tagOut.Tags != nil {
+				for _, t := range tagOut.Tags.Items {
+					if t.Key == nil || t.Value == nil {
+						continue
+					}
+					tags[*t.Key] = *t.Value
+				}
+			}
+			resources = append(resources, Resource{
+				ID:         *d.Id,
+				ARN:        *d.ARN,
+				Type:       ResourceTypeCloudFront,
+				Tags:       tags,
+				Attributes: distributionAttributes(d),
+			})
+		}
+	}
+
+	if len(resources) == 0 {
+		logger.Warnf("no CloudFront distributions found")
+	}
+	return resources, nil
+}
+
+// distributionAttributes collects the distribution fields that are useful in templates.
+func distributionAttributes(d cftypes.DistributionSummary) map[string]string {
+	attrs := map[string]string{}
+	if d.DomainName != nil {
+		attrs["domainName"] = *d.DomainName
+	}
+	if d.Status != nil {
+		attrs["status"] = *d.Status
+	}
+	if d.Enabled != nil {
+		attrs["enabled"] = strconv.FormatBool(*d.Enabled)
+	}
+	if d.WebACLId != nil && *d.WebACLId != "" {
+		attrs["webAclId"] = *d.WebACLId
+	}
+	if d.Aliases != nil && len(d.Aliases.Items) > 0 {
+		attrs["aliases"] = strings.Join(d.Aliases.Items, ",")
+	}
+	return attrs
+}
@@ -15,10 +15,11 @@ import (
 type ResourceType string
 
 const (
-	ResourceTypeALB ResourceType = "alb"
+	ResourceTypeALB        ResourceType = "alb"
+	ResourceTypeCloudFront ResourceType = "cloudfront"
+	ResourceTypeVPC        ResourceType = "vpc"
 	// In the future, extend with:
 	// ResourceTypeAPIGateway ResourceType = "apigw"
-	// ResourceTypeCloudFront ResourceType = "cloudfront"
 )
 
 // Resource is a simplified, taggable representation of a WAF-attachable resource.
@@ -27,6 +28,9 @@ type Resource struct {
 	ARN  string            `json:"arn"`
 	Type ResourceType      `json:"type"`
 	Tags map[string]string `json:"tags"`
+
+	// Attributes holds non-tag metadata (DNS name, scheme, VPC, ...) exposed to templates.
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 // DiscoverALBs discovers Application Load Balancers and their tags.
@@ -55,6 +59,7 @@ func DiscoverALBs(ctx context.Context, cfg aws.Config, logger *util.Logger) ([]R
 		}
 
 		albArns := make([]string, 0, len(out.LoadBalancers))
+		attrsByArn := make(map[string]map[string]string, len(out.LoadBalancers))
 		for _, lb := range out.LoadBalancers {
 			// We only care about application load balancers.
 			if lb.Type != types.LoadBalancerTypeEnumApplication {
@@ -64,6 +69,7 @@ func DiscoverALBs(ctx context.Context, cfg aws.Config, logger *util.Logger) ([]R
 				continue
 			}
 			albArns = append(albArns, *lb.LoadBalancerArn)
+			attrsByArn[*lb.LoadBalancerArn] = albAttributes(lb)
 		}
 
 		if len(albArns) > 0 {
@@ -88,10 +94,11 @@ func DiscoverALBs(ctx context.Context, cfg aws.Config, logger *util.Logger) ([]R
 					tags[*t.Key] = *t.Value
 				}
 				resources = append(resources, Resource{
-					ID:   id,
-					ARN:  arn,
-					Type: ResourceTypeALB,
-					Tags: tags,
+					ID:         id,
+					ARN:        arn,
+					Type:       ResourceTypeALB,
+					Tags:       tags,
+					Attributes: attrsByArn[arn],
 				})
 			}
 		}
@@ -105,6 +112,24 @@ func DiscoverALBs(ctx context.Context, cfg aws.Config, logger *util.Logger) ([]R
 	return resources, nil
 }
 
+// albAttributes collects the load balancer fields that are useful in templates.
+func albAttributes(lb types.LoadBalancer) map[string]string {
+	attrs := map[string]string{
+		"scheme":        string(lb.Scheme),
+		"ipAddressType": string(lb.IpAddressType),
+	}
+	if lb.LoadBalancerName != nil {
+		attrs["name"] = *lb.LoadBalancerName
+	}
+	if lb.DNSName != nil {
+		attrs["dnsName"] = *lb.DNSName
+	}
+	if lb.VpcId != nil {
+		attrs["vpcId"] = *lb.VpcId
+	}
+	return attrs
+}
+
 // lbNameFromArn extracts a human-readable LB identifier from an ARN.
 // Example ARN:
 //
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/service/organizations"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
@@ -44,8 +45,7 @@ func AccountInOU(ctx context.Context, cfg aws.Config, ouID string, logger *util.
 }
 
 func currentAccountID(ctx context.Context, cfg aws.Config) (string, error) {
-	stsClient := sts.NewFromConfig(cfg)
-	out, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	out, err := callerIdentity(ctx, cfg)
 	if err != nil {
 		return "", err
 	}
@@ -54,3 +54,20 @@ func currentAccountID(ctx context.Context, cfg aws.Config) (string, error) {
 	}
 	return *out.Account, nil
 }
+
+// currentPartition returns the partition of the caller's ARN, e.g. aws or aws-us-gov.
+func currentPartition(ctx context.Context, cfg aws.Config) (string, error) {
+	out, err := callerIdentity(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	caller, err := arn.Parse(aws.ToString(out.Arn))
+	if err != nil {
+		return "", fmt.Errorf("parse caller ARN: %w", err)
+	}
+	return caller.Partition, nil
+}
+
+func callerIdentity(ctx context.Context, cfg aws.Config) (*sts.GetCallerIdentityOutput, error) {
+	return sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+}
@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// DiscoverVPCs discovers VPCs that carry at least one of tagKeys. Untagged VPCs, such as
+// the default VPC, are left alone so firewall policies only reach opted-in networks.
+func DiscoverVPCs(ctx context.Context, cfg aws.Config, tagKeys []string, logger *util.Logger) ([]Resource, error) {
+	client := ec2.NewFromConfig(cfg)
+
+	input := &ec2.DescribeVpcsInput{}
+	if len(tagKeys) > 0 {
+		input.Filters = []ec2types.Filter{{Name: aws.String("tag-key"), Values: tagKeys}}
+	}
+
+	// VPC descriptions carry no ARN, so it is built in the caller's partition.
+	partition, err := currentPartition(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("get current partition: %w", err)
+	}
+
+	var resources []Resource
+	pager := ec2.NewDescribeVpcsPaginator(client, input)
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describe vpcs: %w", err)
+		}
+		for _, vpc := range page.Vpcs {
+			if vpc.VpcId == nil || vpc.OwnerId == nil {
+				continue
+			}
+			tags := make(map[string]string, len(vpc.Tags))
+			for _, t := range vpc.Tags {
+				if t.Key == nil || t.Value == nil {
+					continue
+				}
+				tags[*t.Key] = *t.Value
+			}
+			resources = append(resources, Resource{
+				ID: *vpc.VpcId,
+				ARN: arn.ARN{
+					Partition: partition,
+					Service:   "ec2",
+					Region:    cfg.Region,
+					AccountID: *vpc.OwnerId,
+					Resource:  "vpc/" + *vpc.VpcId,
+				}.String(),
+				Type:       ResourceTypeVPC,
+				Tags:       tags,
+				Attributes: vpcAttributes(vpc),
+			})
+		}
+	}
+
+	if len(resources) == 0 {
+		logger.Warnf("no tagged VPCs found in this region")
+	}
+	return resources, nil
+}
+
+// vpcAttributes collects the VPC fields that are useful in templates.
+func vpcAttributes(vpc ec2types.Vpc) map[string]string {
+	attrs := map[string]string{
+		"state": string(vpc.State),
+	}
+	if vpc.CidrBlock != nil {
+		attrs["cidrBlock"] = *vpc.CidrBlock
+	}
+	if vpc.IsDefault != nil {
+		attrs["isDefault"] = strconv.FormatBool(*vpc.IsDefault)
+	}
+	return attrs
+}
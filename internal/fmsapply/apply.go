@@ -0,0 +1,216 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// Backoff bounds used when ApplyOptions leaves them unset.
+const (
+	DefaultRetryBaseDelay = 500 * time.Millisecond
+	DefaultRetryMaxDelay  = 20 * time.Second
+)
+
+// ApplyOptions controls how UpsertPolicies writes policies. Zero values take the
+// defaults.
+type ApplyOptions struct {
+	// Concurrency is the number of policies written in parallel.
+	Concurrency int
+	// MaxAttempts bounds the PutPolicy tries per policy, including the first, when the
+	// update token changed underneath.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry; it doubles per attempt up to
+	// MaxDelay, with jitter.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Canary routes policies whose managed_service_data changes through CanaryUpsert.
+	Canary CanaryOptions
+}
+
+// ApplyOptionsFor derives the apply options from the config.
+func ApplyOptionsFor(cfg *config.PolicyConfig) ApplyOptions {
+	return ApplyOptions{
+		Concurrency: cfg.Apply.EffectiveConcurrency(),
+		MaxAttempts: cfg.Apply.EffectiveMaxAttempts(),
+		Canary:      CanaryOptionsFor(cfg),
+	}
+}
+
+func (o ApplyOptions) withDefaults() ApplyOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = config.DefaultApplyConcurrency
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = config.DefaultApplyMaxAttempts
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = DefaultRetryBaseDelay
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = DefaultRetryMaxDelay
+	}
+	return o
+}
+
+// backoff returns the delay before retry number attempt (1-based): exponential in
+// attempt, capped at MaxDelay, with the upper half jittered.
+func (o ApplyOptions) backoff(attempt int) time.Duration {
+	d := o.BaseDelay
+	for i := 1; i < attempt && d < o.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > o.MaxDelay {
+		d = o.MaxDelay
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Result is the outcome of writing one policy.
+type Result struct {
+	Policy string
+	Change Change
+	// Canary is set when the policy went through a canary update.
+	Canary CanaryOutcome
+	Err    error
+}
+
+// UpsertPolicies upserts every rendered policy with a pool of apply.Concurrency workers
+// sharing inv, going through a canary when apply.Canary has accounts. A policy that fails
+// does not stop the others: the results, sorted by name, carry the per-policy errors, and
+// the returned error joins them. Once ctx is done no further policies are handed out; the
+// ones not started fail with ctx.Err().
+func UpsertPolicies(ctx context.Context, client API, inv *Inventory, rendered map[string]policy.RenderedPolicy, opts Options, apply ApplyOptions, logger *util.Logger) ([]Result, error) {
+	apply = apply.withDefaults()
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := inv.Prefetch(ctx, names); err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(names))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < apply.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				change, canary, err := canaryUpsert(ctx, client, inv, rendered[names[i]], opts, apply.Canary, apply, logger)
+				results[i] = Result{Policy: names[i], Change: change, Canary: canary, Err: err}
+			}
+		}()
+	}
+feed:
+	for i := range names {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			for j := i; j < len(names); j++ {
+				results[j] = Result{Policy: names[j], Err: ctx.Err()}
+			}
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			logger.Errorf("policy %s: %v", r.Policy, r.Err)
+			errs = append(errs, r.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("%d of %d policies failed: %w", len(errs), len(names), errors.Join(errs...))
+	}
+	return results, nil
+}
+
+// putWithRetry writes a planned policy, retrying update-token conflicts with backoff;
+// throttled calls are retried by the SDK's retryer. On a conflict the current token is
+// re-fetched; if it did not change, the error is not a token race and is returned as is.
+// Otherwise another writer changed the policy, so its inventory entry is dropped and
+// replan plans the write again against the new version, saving that version too. A new
+// plan that changes more than the checked one fails with ErrUnsafeChange. putWithRetry
+// returns the plan it wrote.
+func putWithRetry(ctx context.Context, client API, inv *Inventory, planned PlannedPolicy, setID, configHash string, apply ApplyOptions, replan func() (PlannedPolicy, error), logger *util.Logger) (PlannedPolicy, error) {
+	checked := planned
+	for attempt := 1; ; attempt++ {
+		put, err := putPolicy(ctx, client, inv, planned, setID, configHash)
+		if err == nil {
+			if err := put.tag(ctx, client, inv); err != nil {
+				return PlannedPolicy{}, err
+			}
+			return planned, nil
+		}
+		if planned.PolicyID == "" || !isConflict(err) || attempt >= apply.MaxAttempts {
+			return PlannedPolicy{}, err
+		}
+		token, terr := currentToken(ctx, client, planned.PolicyID)
+		if terr != nil {
+			return PlannedPolicy{}, fmt.Errorf("%w (re-fetch update token: %v)", err, terr)
+		}
+		if token == planned.UpdateToken {
+			return PlannedPolicy{}, err
+		}
+		inv.invalidate(planned.PolicyID)
+
+		delay := apply.backoff(attempt)
+		logger.Warnf("attempt %d/%d for %s lost an update-token race, retrying in %s: %v", attempt, apply.MaxAttempts, planned.Policy.Name, delay, err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return PlannedPolicy{}, ctx.Err()
+		case <-t.C:
+		}
+
+		again, err := replan()
+		if err != nil {
+			return PlannedPolicy{}, err
+		}
+		if reason := escalation(checked, again); reason != "" {
+			return PlannedPolicy{}, fmt.Errorf("%w: %s changed while it was written and the new plan %s; run again to check it", ErrUnsafeChange, planned.Policy.Name, reason)
+		}
+		if again.Change.Action == ActionNoOp {
+			return again, nil
+		}
+		planned = again
+	}
+}
+
+// isConflict reports whether FMS rejected the write as an invalid operation, which is how
+// it reports a stale PolicyUpdateToken.
+func isConflict(err error) bool {
+	var ioe *fmstypes.InvalidOperationException
+	return errors.As(err, &ioe)
+}
+
+// currentToken reads the live update token of a policy.
+func currentToken(ctx context.Context, client API, id string) (string, error) {
+	gp, err := client.GetPolicy(ctx, &fms.GetPolicyInput{PolicyId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	if gp.Policy == nil {
+		return "", fmt.Errorf("empty response")
+	}
+	return aws.ToString(gp.Policy.PolicyUpdateToken), nil
+}
@@ -0,0 +1,217 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+var (
+	errThrottled = &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	fastRetries  = ApplyOptions{Concurrency: 4, MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+)
+
+func TestUpsertPolicies_CollectsPerPolicyErrors(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(fmsfake.New(), 3)
+	boom := errors.New("boom")
+	client.FailPut("auto-alb-0001", boom)
+
+	results, err := UpsertPolicies(ctx, client, inventory(t, client), rendered, Options{}, fastRetries, util.NewLogger())
+	if !errors.Is(err, boom) || !strings.Contains(err.Error(), "1 of 3 policies failed") {
+		t.Fatalf("expected a joined per-policy error, got %v", err)
+	}
+	if len(results) != 3 || !errors.Is(results[1].Err, boom) || results[0].Err != nil || results[2].Err != nil {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if len(client.PolicyIDs()) != 2 || client.Calls(fmsfake.OpPutPolicy) != 3 {
+		t.Fatalf("expected the other policies to be created without retrying the failure, got %d policies and %d calls",
+			len(client.PolicyIDs()), client.Calls(fmsfake.OpPutPolicy))
+	}
+}
+
+// Throttling is retried by the SDK's retryer, so a throttle that reaches UpsertPolicies
+// fails the policy without another attempt.
+func TestUpsertPolicies_LeavesThrottlingToTheSDK(t *testing.T) {
+	ctx := context.Background()
+	rendered := seedRendered(fmsfake.New(), 1)
+
+	client := fmsfake.New()
+	client.FailPut("auto-alb-0000", errThrottled)
+	_, err := UpsertPolicies(ctx, client, inventory(t, client), rendered, Options{}, fastRetries, util.NewLogger())
+	if !errors.Is(err, errThrottled) || client.Calls(fmsfake.OpPutPolicy) != 1 {
+		t.Fatalf("expected a single failed attempt, got %v after %d calls", err, client.Calls(fmsfake.OpPutPolicy))
+	}
+}
+
+// cancellingFMS cancels the run during the first PutPolicy and holds that call long
+// enough for the feeding loop to see the cancellation.
+type cancellingFMS struct {
+	*fmsfake.FMS
+	cancel context.CancelFunc
+}
+
+func (c cancellingFMS) PutPolicy(ctx context.Context, in *fms.PutPolicyInput, optFns ...func(*fms.Options)) (*fms.PutPolicyOutput, error) {
+	c.cancel()
+	time.Sleep(20 * time.Millisecond)
+	return c.FMS.PutPolicy(ctx, in, optFns...)
+}
+
+func TestUpsertPolicies_StopsFeedingOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := fmsfake.New()
+	rendered := seedRendered(fmsfake.New(), 3)
+	client := cancellingFMS{FMS: fake, cancel: cancel}
+	serial := fastRetries
+	serial.Concurrency = 1
+
+	results, err := UpsertPolicies(ctx, client, inventory(t, fake), rendered, Options{}, serial, util.NewLogger())
+	if !errors.Is(err, context.Canceled) || fake.Calls(fmsfake.OpPutPolicy) != 1 {
+		t.Fatalf("expected context.Canceled after one write, got %v after %d writes", err, fake.Calls(fmsfake.OpPutPolicy))
+	}
+	for _, r := range results[1:] {
+		if r.Policy == "" || !errors.Is(r.Err, context.Canceled) {
+			t.Fatalf("policies not handed out should report the cancellation, got %+v", results)
+		}
+	}
+}
+
+func TestUpsertPolicies_RefetchesStaleTokens(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 1)
+	inv := inventory(t, client)
+	if err := inv.Prefetch(ctx, inv.Names()); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+
+	// Another writer updates the policy after the inventory read it.
+	for _, id := range client.PolicyIDs() {
+		client.EditPolicy(id, func(*fmstypes.Policy) {})
+	}
+
+	results, err := UpsertPolicies(ctx, client, inv, rendered, Options{}, fastRetries, util.NewLogger())
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if results[0].Change.Action != ActionUpdate || client.Calls(fmsfake.OpPutPolicy) != 2 {
+		t.Fatalf("expected an update on the second attempt, got %s after %d calls", results[0].Change, client.Calls(fmsfake.OpPutPolicy))
+	}
+}
+
+func TestUpsertPolicies_ReplansAfterTokenConflict(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 1)
+	id := client.PolicyIDs()[0]
+	store := history.NewLocalStore(t.TempDir())
+	inv := inventory(t, client)
+	if err := inv.Prefetch(ctx, inv.Names()); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+
+	// Another writer changes the description after the inventory read the policy.
+	client.EditPolicy(id, func(p *fmstypes.Policy) { p.PolicyDescription = aws.String("edited by hand") })
+
+	results, err := UpsertPolicies(ctx, client, inv, rendered, Options{History: store}, fastRetries, util.NewLogger())
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	var described bool
+	for _, f := range results[0].Change.Fields {
+		described = described || (f.Field == "description" && f.Old == "edited by hand")
+	}
+	if !described || client.Calls(fmsfake.OpPutPolicy) != 2 {
+		t.Fatalf("expected the change to be planned against the edited policy, got %s after %d calls", results[0].Change, client.Calls(fmsfake.OpPutPolicy))
+	}
+	versions, err := store.List(ctx, "auto-alb-0000")
+	if err != nil || len(versions) != 2 || aws.ToString(versions[1].Policy.PolicyDescription) != "edited by hand" {
+		t.Fatalf("expected the edited policy to be saved before it was overwritten, got %d versions, %v", len(versions), err)
+	}
+}
+
+func TestUpsertPolicies_RefusesReplansThatChangeMore(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 1)
+	if _, err := UpsertPolicies(ctx, client, inventory(t, client), rendered, Options{}, fastRetries, util.NewLogger()); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	id := client.PolicyIDs()[0]
+
+	// The checked plan only changes the description; meanwhile another writer changes the
+	// rule set, which the new plan would overwrite.
+	p := rendered["auto-alb-0000"]
+	p.Description = "new description"
+	rendered["auto-alb-0000"] = p
+	inv := inventory(t, client)
+	if err := inv.Prefetch(ctx, inv.Names()); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+	client.EditPolicy(id, func(p *fmstypes.Policy) {
+		p.SecurityServicePolicyData = &fmstypes.SecurityServicePolicyData{
+			Type:               fmstypes.SecurityServiceTypeWafv2,
+			ManagedServiceData: aws.String(`{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`),
+		}
+	})
+
+	puts := client.Calls(fmsfake.OpPutPolicy)
+	_, err := UpsertPolicies(ctx, client, inv, rendered, Options{}, fastRetries, util.NewLogger())
+	if !errors.Is(err, ErrUnsafeChange) || client.Calls(fmsfake.OpPutPolicy) != puts+1 {
+		t.Fatalf("expected ErrUnsafeChange after the conflicting write, got %v after %d calls", err, client.Calls(fmsfake.OpPutPolicy)-puts)
+	}
+}
+
+func TestUpsertPolicies_DoesNotRewriteWhenTaggingFails(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 1)
+	id := client.PolicyIDs()[0]
+	client.FailTag(fmsfake.PolicyARN(id), errThrottled)
+
+	_, err := UpsertPolicies(ctx, client, inventory(t, client), rendered, Options{}, fastRetries, util.NewLogger())
+	if !errors.Is(err, errThrottled) {
+		t.Fatalf("expected the tagging error, got %v", err)
+	}
+	if client.Calls(fmsfake.OpPutPolicy) != 1 || client.Calls(fmsfake.OpTagResource) != 1 {
+		t.Fatalf("expected one write and one tagging, got %d PutPolicy and %d TagResource calls",
+			client.Calls(fmsfake.OpPutPolicy), client.Calls(fmsfake.OpTagResource))
+	}
+}
+
+func TestUpsertPolicies_DoesNotRetryOtherInvalidOperations(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 1)
+	invalid := &fmstypes.InvalidOperationException{Message: aws.String("policy type not supported")}
+	client.FailPut("auto-alb-0000", invalid)
+
+	_, err := UpsertPolicies(ctx, client, inventory(t, client), rendered, Options{}, fastRetries, util.NewLogger())
+	if !errors.As(err, &invalid) || client.Calls(fmsfake.OpPutPolicy) != 1 {
+		t.Fatalf("expected a single failed attempt, got %v after %d calls", err, client.Calls(fmsfake.OpPutPolicy))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	opts := ApplyOptions{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := opts.backoff(attempt); d < max/2 || d > max {
+				t.Fatalf("backoff(%d) = %s, want within [%s, %s]", attempt, d, max/2, max)
+			}
+		}
+	}
+}
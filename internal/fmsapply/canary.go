@@ -0,0 +1,365 @@
+package fmsapply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// ErrCanaryFailed is returned when a canary update exceeded its compliance thresholds
+// and was reverted.
+var ErrCanaryFailed = errors.New("canary failed")
+
+// CanaryOutcome is the canary stage of a policy after a run. A canary spans runs, and
+// each run moves it at most one step:
+//
+//	started --wait passed, poll passed--> waiting --Polls polls passed--> promoted
+//	started/waiting --poll failed-------------------------------------> reverted
+//	reverted --same data--> blocked        reverted --new data--> started
+type CanaryOutcome string
+
+const (
+	// CanaryStarted means the changed policy was written scoped to the canary accounts.
+	CanaryStarted CanaryOutcome = "started"
+	// CanaryWaiting means the canary is running and not yet due, or has polls left.
+	CanaryWaiting CanaryOutcome = "waiting"
+	// CanaryPromoted means the canary passed and the policy was widened to its full scope.
+	CanaryPromoted CanaryOutcome = "promoted"
+	// CanaryReverted means the canary failed and the previous managed_service_data was
+	// restored with the full scope.
+	CanaryReverted CanaryOutcome = "reverted"
+	// CanaryBlocked means the rendered managed_service_data is the data a reverted canary
+	// failed with, so it is not tried again until the rendered data changes.
+	CanaryBlocked CanaryOutcome = "blocked"
+	// CanaryCancelled means a policy in a canary was written outside one, e.g. with
+	// canary updates disabled or from a saved plan; the canary state is dropped.
+	CanaryCancelled CanaryOutcome = "cancelled"
+)
+
+// CanaryStatus is the canary state of a policy, kept in its Canary tag between runs. A
+// reverted canary keeps only FailedData there.
+type CanaryStatus struct {
+	Stage CanaryOutcome `json:"stage"`
+	// StartedAt is when the canary scope was written.
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// RevertVersion is the history version holding the policy from before the canary.
+	RevertVersion int `json:"revert_version,omitempty"`
+	// Polls counts the compliance polls that passed so far.
+	Polls int `json:"polls,omitempty"`
+	// Reason explains a reverted or cancelled canary.
+	Reason string `json:"reason,omitempty"`
+	// FailedData is the serviceDataHash of the managed_service_data a reverted canary
+	// failed with.
+	FailedData string `json:"failed_data,omitempty"`
+}
+
+// active reports whether the canary scope stays on the policy after this run.
+func (s *CanaryStatus) active() bool {
+	return s.Stage == CanaryStarted || s.Stage == CanaryWaiting
+}
+
+// String renders the status for plan output, e.g. "waiting, 1 poll passed".
+func (s *CanaryStatus) String() string {
+	switch {
+	case s.Reason != "":
+		return fmt.Sprintf("%s: %s", s.Stage, s.Reason)
+	case s.Stage == CanaryWaiting:
+		return fmt.Sprintf("%s, %d poll(s) passed", s.Stage, s.Polls)
+	}
+	return string(s.Stage)
+}
+
+// tagValue encodes an active canary for the Canary tag, e.g.
+// "started=2026-10-18T10:00:00Z revert=3 polls=1", and a reverted one as
+// "failed=<hash>". Other finished canaries clear the tag.
+func (s *CanaryStatus) tagValue() string {
+	switch {
+	case s.active():
+		return fmt.Sprintf("started=%s revert=%d polls=%d", s.StartedAt.UTC().Format(time.RFC3339), s.RevertVersion, s.Polls)
+	case s.Stage == CanaryReverted && s.FailedData != "":
+		return "failed=" + s.FailedData
+	}
+	return ""
+}
+
+// parseCanaryTag decodes the Canary tag of a policy. It returns nil when the policy is
+// not in a canary.
+func parseCanaryTag(v string) (*CanaryStatus, error) {
+	if v == "" {
+		return nil, nil
+	}
+	s := &CanaryStatus{Stage: CanaryWaiting}
+	for _, field := range strings.Fields(v) {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "started":
+			s.StartedAt, err = time.Parse(time.RFC3339, value)
+		case "revert":
+			s.RevertVersion, err = strconv.Atoi(value)
+		case "polls":
+			s.Polls, err = strconv.Atoi(value)
+		case "failed":
+			s.Stage, s.FailedData = CanaryReverted, value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag %q: %w", TagCanary, v, err)
+		}
+	}
+	if s.Stage == CanaryReverted {
+		return s, nil
+	}
+	if s.StartedAt.IsZero() || s.RevertVersion <= 0 {
+		return nil, fmt.Errorf("invalid %s tag %q", TagCanary, v)
+	}
+	return s, nil
+}
+
+// CanaryOptions controls canary updates. Without Accounts, policies are written directly.
+type CanaryOptions struct {
+	Accounts []string
+	// Wait precedes the first compliance poll; PollInterval separates the Polls polls.
+	// Both are minimums: a poll happens on the first run after it is due.
+	Wait         time.Duration
+	PollInterval time.Duration
+	Polls        int
+	// MaxNonCompliantAccounts and MaxIssues bound the canary accounts reporting
+	// violations and the dependent service issues they report, on every poll.
+	MaxNonCompliantAccounts int
+	MaxIssues               int
+}
+
+// CanaryOptionsFor derives the canary options from the config.
+func CanaryOptionsFor(cfg *config.PolicyConfig) CanaryOptions {
+	return CanaryOptions{
+		Accounts:                cfg.Canary.Accounts,
+		Wait:                    cfg.Canary.EffectiveWait(),
+		PollInterval:            cfg.Canary.EffectivePollInterval(),
+		Polls:                   cfg.Canary.EffectivePolls(),
+		MaxNonCompliantAccounts: cfg.Canary.MaxNonCompliantAccounts,
+		MaxIssues:               cfg.Canary.MaxIssues,
+	}
+}
+
+func (o CanaryOptions) enabled() bool {
+	return len(o.Accounts) > 0
+}
+
+// nextPoll is when the poll after polls passed ones is due.
+func (o CanaryOptions) nextPoll(s *CanaryStatus) time.Time {
+	return s.StartedAt.Add(o.Wait + time.Duration(s.Polls)*o.PollInterval)
+}
+
+// CanaryUpsert upserts a policy through a canary that spans runs. When the policy's
+// managed_service_data changes, the live version is saved to opts.History, which is
+// required, and the new version is written scoped to canary.Accounts through the
+// IncludeMap. The Canary tag records the start, the saved version and the polls passed.
+// Each later run polls the compliance status of the canary accounts once it is due:
+// after canary.Wait, then every canary.PollInterval. When canary.Polls polls stayed within
+// the thresholds the policy is widened to its full scope; a failed poll restores the
+// saved managed_service_data with the full scope and returns an error wrapping
+// ErrCanaryFailed. The Canary tag then records a hash of the failed data, and later runs
+// rendering the same data fail with ErrCanaryFailed without writing it, until the rendered
+// data changes. A policy whose rendered data changes during its canary restarts it.
+// Creates and unchanged service data go straight to UpsertPolicy.
+//
+// While the canary runs, accounts outside canary.Accounts leave the policy's scope, so they
+// are covered by neither the old nor the new data; FMS keeps the protections it applied
+// there unless the policy cleans up resources. The config only enables canaries with
+// canary.acceptCoverageGap set.
+func CanaryUpsert(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, opts Options, canary CanaryOptions, logger *util.Logger) (Change, CanaryOutcome, error) {
+	return canaryUpsert(ctx, client, inv, p, opts, canary, ApplyOptions{MaxAttempts: 1}.withDefaults(), logger)
+}
+
+func canaryUpsert(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, opts Options, canary CanaryOptions, apply ApplyOptions, logger *util.Logger) (Change, CanaryOutcome, error) {
+	live, err := inv.lookup(ctx, p.Name)
+	if err != nil {
+		return Change{}, "", fmt.Errorf("find existing policy %s: %w", p.Name, err)
+	}
+	var current *CanaryStatus
+	if live != nil {
+		if current, err = parseCanaryTag(live.Tags[TagCanary]); err != nil {
+			return Change{}, "", fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+	}
+	if current != nil && current.Stage == CanaryReverted {
+		if canary.enabled() {
+			hash, err := serviceDataHash(p.ManagedServiceData)
+			if err != nil {
+				return Change{}, "", fmt.Errorf("policy %s: %w", p.Name, err)
+			}
+			if hash == current.FailedData {
+				logger.Warnf("canary: %s renders the managed_service_data its last canary failed with; not retrying it", p.Name)
+				return Change{}, CanaryBlocked, fmt.Errorf("%w: %s: the rendered managed_service_data already failed a canary; change it to try again", ErrCanaryFailed, p.Name)
+			}
+		}
+		// Other data starts afresh; the next write drops the record of the failed data.
+		current = nil
+	}
+	if live == nil || !canary.enabled() {
+		// A canary left over from a config that no longer has one is cancelled by the
+		// full-scope write; see planPolicy.
+		change, err := upsertPolicy(ctx, client, inv, p, opts, apply, logger)
+		return change, outcomeOf(change), err
+	}
+	changed, err := serviceDataChanged(&live.Policy, p)
+	if err != nil {
+		return Change{}, "", fmt.Errorf("policy %s: %w", p.Name, err)
+	}
+
+	now := opts.now()
+	staged := p
+	staged.IncludeMap = map[string][]string{policy.ScopeAccount: canary.Accounts}
+	staged.ExcludeMap = nil
+
+	switch {
+	case current == nil && !changed:
+		change, err := upsertPolicy(ctx, client, inv, p, opts, apply, logger)
+		return change, outcomeOf(change), err
+
+	case changed:
+		// A new canary, or new data during one: the revert target stays the version from
+		// before the first canary write.
+		if opts.History == nil {
+			return Change{}, "", fmt.Errorf("canary update of %s needs a version store to revert from; set the policy history location", p.Name)
+		}
+		status := &CanaryStatus{Stage: CanaryStarted, StartedAt: now}
+		if current != nil {
+			status.RevertVersion = current.RevertVersion
+		}
+		logger.Infof("canary: scoping %s to %d account(s)", p.Name, len(canary.Accounts))
+		change, err := upsertCanary(ctx, client, inv, staged, opts, apply, status, logger)
+		return change, CanaryStarted, err
+
+	case now.Before(canary.nextPoll(current)):
+		logger.Infof("canary: %s waiting until %s", p.Name, canary.nextPoll(current).Format(time.RFC3339))
+		current.Stage = CanaryWaiting
+		change, err := upsertCanary(ctx, client, inv, staged, opts, apply, current, logger)
+		return change, CanaryWaiting, err
+	}
+
+	reason, err := pollCanary(ctx, inv, aws.ToString(live.Policy.PolicyId), canary, current.Polls+1 >= canary.Polls)
+	if err != nil {
+		return Change{}, "", fmt.Errorf("canary of %s: %w", p.Name, err)
+	}
+	if reason != "" {
+		logger.Warnf("canary: %s failed (%s); reverting managed_service_data", p.Name, reason)
+		v, err := opts.History.Get(ctx, p.Name, current.RevertVersion)
+		if err != nil {
+			return Change{}, "", fmt.Errorf("%w: %s: %s; load version %d to revert to: %v", ErrCanaryFailed, p.Name, reason, current.RevertVersion, err)
+		}
+		failed, err := serviceDataHash(p.ManagedServiceData)
+		if err != nil {
+			return Change{}, "", fmt.Errorf("%w: %s: %s; %v", ErrCanaryFailed, p.Name, reason, err)
+		}
+		previous := p
+		previous.ManagedServiceData = aws.ToString(serviceData(&v.Policy).ManagedServiceData)
+		status := &CanaryStatus{Stage: CanaryReverted, StartedAt: current.StartedAt, RevertVersion: current.RevertVersion, Polls: current.Polls, Reason: reason, FailedData: failed}
+		change, err := upsertCanary(ctx, client, inv, previous, opts, apply, status, logger)
+		if err != nil {
+			return Change{}, "", fmt.Errorf("%w: %s: %s; revert failed: %v", ErrCanaryFailed, p.Name, reason, err)
+		}
+		return change, CanaryReverted, fmt.Errorf("%w: %s: %s", ErrCanaryFailed, p.Name, reason)
+	}
+
+	current.Polls++
+	if current.Polls < canary.Polls {
+		logger.Infof("canary: %s passed poll %d of %d", p.Name, current.Polls, canary.Polls)
+		current.Stage = CanaryWaiting
+		change, err := upsertCanary(ctx, client, inv, staged, opts, apply, current, logger)
+		return change, CanaryWaiting, err
+	}
+	logger.Infof("canary: %s passed; widening to the full scope", p.Name)
+	current.Stage = CanaryPromoted
+	change, err := upsertCanary(ctx, client, inv, p, opts, apply, current, logger)
+	if err != nil {
+		return Change{}, "", fmt.Errorf("widen policy %s after canary: %w", p.Name, err)
+	}
+	return change, CanaryPromoted, nil
+}
+
+// outcomeOf returns the canary outcome a direct upsert had, if any.
+func outcomeOf(c Change) CanaryOutcome {
+	if c.Canary == nil {
+		return ""
+	}
+	return c.Canary.Stage
+}
+
+// pollCanary checks the compliance status of the canary accounts once. It returns why
+// the canary failed, or "" when the poll stayed within the thresholds. On the last poll
+// at least one canary account must have been evaluated.
+func pollCanary(ctx context.Context, inv *Inventory, policyID string, canary CanaryOptions, last bool) (string, error) {
+	accounts := make(map[string]bool, len(canary.Accounts))
+	for _, a := range canary.Accounts {
+		accounts[a] = true
+	}
+	statuses, err := inv.complianceStatus(ctx, policyID)
+	if err != nil {
+		return "", err
+	}
+	var nonCompliant, issues, evaluated int
+	for _, status := range statuses {
+		if !accounts[aws.ToString(status.MemberAccount)] {
+			continue
+		}
+		issues += len(status.IssueInfoMap)
+		if len(status.EvaluationResults) > 0 {
+			evaluated++
+		}
+		if nonCompliantStatus(status) {
+			nonCompliant++
+		}
+	}
+	switch {
+	case nonCompliant > canary.MaxNonCompliantAccounts:
+		return fmt.Sprintf("%d non-compliant canary accounts exceed %d", nonCompliant, canary.MaxNonCompliantAccounts), nil
+	case issues > canary.MaxIssues:
+		return fmt.Sprintf("%d dependent service issues exceed %d", issues, canary.MaxIssues), nil
+	case last && evaluated == 0:
+		return "no canary account was evaluated by FMS", nil
+	}
+	return "", nil
+}
+
+// serviceDataChanged reports whether the rendered managed_service_data differs from the
+// live one, compared the way Diff compares it.
+func serviceDataChanged(live *fmstypes.Policy, p policy.RenderedPolicy) (bool, error) {
+	var liveDoc, desiredDoc any
+	if err := decodeServiceData(serviceData(live), &liveDoc); err != nil {
+		return false, err
+	}
+	if err := decodeServiceData(fmstypes.SecurityServicePolicyData{ManagedServiceData: aws.String(p.ManagedServiceData)}, &desiredDoc); err != nil {
+		return false, err
+	}
+	var fields []FieldChange
+	diffJSON("managed_service_data", liveDoc, desiredDoc, &fields)
+	return len(fields) > 0, nil
+}
+
+// serviceDataHash fingerprints managed_service_data, normalized the way Diff compares it.
+func serviceDataHash(msd string) (string, error) {
+	var doc any
+	if err := decodeServiceData(fmstypes.SecurityServicePolicyData{ManagedServiceData: aws.String(msd)}, &doc); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(stripZeroJSON(doc))
+	if err != nil {
+		return "", fmt.Errorf("encode managed_service_data: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,267 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+const canaryAccount = "111111111111"
+
+var canaryStart = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+func canaryCompliance(status fmstypes.PolicyComplianceStatusType) []fmstypes.PolicyComplianceStatus {
+	return []fmstypes.PolicyComplianceStatus{
+		{MemberAccount: aws.String(canaryAccount), EvaluationResults: []fmstypes.EvaluationResult{{ComplianceStatus: status}}},
+		// Accounts outside the canary do not count.
+		{MemberAccount: aws.String("999999999999"), EvaluationResults: []fmstypes.EvaluationResult{{ComplianceStatus: fmstypes.PolicyComplianceStatusTypeNonCompliant}}},
+	}
+}
+
+// seedCanaryPolicy creates the policy the canary tests update and returns its id.
+func seedCanaryPolicy(t *testing.T, client *fmsfake.FMS) string {
+	t.Helper()
+	if _, err := UpsertPolicy(context.Background(), client, inventory(t, client), ownedTestPolicy(), Options{OUID: "ou-run"}, util.NewLogger()); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	id, _ := client.PolicyID(ownedTestPolicy().Name)
+	return id
+}
+
+// canaryRun is one run of a canary update at the given offset from canaryStart.
+func canaryRun(t *testing.T, client *fmsfake.FMS, store history.Store, p policy.RenderedPolicy, after time.Duration) (Change, CanaryOutcome, error) {
+	t.Helper()
+	canary := CanaryOptions{Accounts: []string{canaryAccount}, Wait: 10 * time.Minute, PollInterval: time.Minute, Polls: 2}
+	opts := Options{OUID: "ou-run", History: store, Now: canaryStart.Add(after)}
+	return CanaryUpsert(context.Background(), client, inventory(t, client), p, opts, canary, util.NewLogger())
+}
+
+func canaryScoped(t *testing.T, client *fmsfake.FMS, id string) bool {
+	t.Helper()
+	live, _ := client.Policy(id)
+	return reflect.DeepEqual(live.IncludeMap, map[string][]string{policy.ScopeAccount: {canaryAccount}})
+}
+
+func TestCanaryUpsert_SpansRuns(t *testing.T) {
+	updated := ownedTestPolicy()
+	updated.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+
+	tests := []struct {
+		name   string
+		status fmstypes.PolicyComplianceStatusType
+		// runs are the offsets from the canary start and the outcome of each run.
+		runs    []time.Duration
+		want    []CanaryOutcome
+		wantMSD string
+	}{
+		{
+			name:    "compliant canary is promoted",
+			status:  fmstypes.PolicyComplianceStatusTypeCompliant,
+			runs:    []time.Duration{0, 5 * time.Minute, 10 * time.Minute, 10*time.Minute + 30*time.Second, 11 * time.Minute},
+			want:    []CanaryOutcome{CanaryStarted, CanaryWaiting, CanaryWaiting, CanaryWaiting, CanaryPromoted},
+			wantMSD: updated.ManagedServiceData,
+		},
+		{
+			// Later runs rendering the same data do not start the canary again.
+			name:    "non-compliant canary is reverted and not retried",
+			status:  fmstypes.PolicyComplianceStatusTypeNonCompliant,
+			runs:    []time.Duration{0, 10 * time.Minute, 20 * time.Minute, 30 * time.Minute},
+			want:    []CanaryOutcome{CanaryStarted, CanaryReverted, CanaryBlocked, CanaryBlocked},
+			wantMSD: ownedTestPolicy().ManagedServiceData,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fmsfake.New()
+			id := seedCanaryPolicy(t, client)
+			client.SetCompliance(id, canaryCompliance(tc.status)...)
+			store := history.NewLocalStore(t.TempDir())
+
+			for i, after := range tc.runs {
+				_, outcome, err := canaryRun(t, client, store, updated, after)
+				if outcome != tc.want[i] {
+					t.Fatalf("run %d: expected %s, got %q (err %v)", i, tc.want[i], outcome, err)
+				}
+				failed := outcome == CanaryReverted || outcome == CanaryBlocked
+				if failed != errors.Is(err, ErrCanaryFailed) {
+					t.Fatalf("run %d: unexpected error for %s: %v", i, outcome, err)
+				}
+				active := outcome == CanaryStarted || outcome == CanaryWaiting
+				live, _ := client.Policy(id)
+				if canaryScoped(t, client, id) != active || (client.Tags(id)[TagCanary] != "") != (active || failed) {
+					t.Fatalf("run %d: %s policy has scope %v and tag %q", i, outcome, live.IncludeMap, client.Tags(id)[TagCanary])
+				}
+			}
+
+			live, _ := client.Policy(id)
+			if got := aws.ToString(live.SecurityServicePolicyData.ManagedServiceData); got != tc.wantMSD {
+				t.Fatalf("unexpected managed_service_data %s", got)
+			}
+			if !reflect.DeepEqual(live.IncludeMap, map[string][]string{policy.ScopeOrgUnit: {"ou-run"}}) {
+				t.Fatalf("policy not restored to its full scope: %v", live.IncludeMap)
+			}
+		})
+	}
+}
+
+func TestCanaryUpsert_RetriesFailedCanaryWithNewData(t *testing.T) {
+	client := fmsfake.New()
+	id := seedCanaryPolicy(t, client)
+	client.SetCompliance(id, canaryCompliance(fmstypes.PolicyComplianceStatusTypeNonCompliant)...)
+	store := history.NewLocalStore(t.TempDir())
+
+	bad := ownedTestPolicy()
+	bad.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	for _, after := range []time.Duration{0, 10 * time.Minute} {
+		canaryRun(t, client, store, bad, after)
+	}
+
+	fixed := ownedTestPolicy()
+	fixed.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"COUNT"}}`
+	_, outcome, err := canaryRun(t, client, store, fixed, 20*time.Minute)
+	if err != nil || outcome != CanaryStarted || !canaryScoped(t, client, id) {
+		t.Fatalf("expected new data to start a canary, got %q: %v", outcome, err)
+	}
+	status, err := parseCanaryTag(client.Tags(id)[TagCanary])
+	if err != nil || status.FailedData != "" || !status.StartedAt.Equal(canaryStart.Add(20*time.Minute)) {
+		t.Fatalf("unexpected canary tag %q: %v", client.Tags(id)[TagCanary], err)
+	}
+
+	// Going back to the live data drops the record of the failed data.
+	client = fmsfake.New()
+	id = seedCanaryPolicy(t, client)
+	client.SetCompliance(id, canaryCompliance(fmstypes.PolicyComplianceStatusTypeNonCompliant)...)
+	for _, after := range []time.Duration{0, 10 * time.Minute} {
+		canaryRun(t, client, store, bad, after)
+	}
+	change, outcome, err := canaryRun(t, client, store, ownedTestPolicy(), 20*time.Minute)
+	if err != nil || outcome != CanaryCancelled || change.Action != ActionUpdate || client.Tags(id)[TagCanary] != "" {
+		t.Fatalf("expected the failed record to be dropped, got %s %q: %v (tag %q)", change, outcome, err, client.Tags(id)[TagCanary])
+	}
+}
+
+func TestCanaryUpsert_FailsWhenCanaryDegrades(t *testing.T) {
+	client := fmsfake.New()
+	id := seedCanaryPolicy(t, client)
+	client.SetCompliance(id, canaryCompliance(fmstypes.PolicyComplianceStatusTypeCompliant)...)
+	store := history.NewLocalStore(t.TempDir())
+
+	p := ownedTestPolicy()
+	p.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	for _, after := range []time.Duration{0, 10 * time.Minute} {
+		if _, _, err := canaryRun(t, client, store, p, after); err != nil {
+			t.Fatalf("run at %s: %v", after, err)
+		}
+	}
+
+	// The canary account reports a dependent service issue at the second poll.
+	statuses := canaryCompliance(fmstypes.PolicyComplianceStatusTypeCompliant)
+	statuses[0].IssueInfoMap = map[string]string{"AWSWAF": "web ACL limit reached"}
+	client.SetCompliance(id, statuses...)
+	_, outcome, err := canaryRun(t, client, store, p, 11*time.Minute)
+	if outcome != CanaryReverted || !errors.Is(err, ErrCanaryFailed) || !strings.Contains(err.Error(), "1 dependent service issues exceed 0") {
+		t.Fatalf("expected a reverted canary, got %q: %v", outcome, err)
+	}
+}
+
+func TestCanaryUpsert_RestartsOnNewData(t *testing.T) {
+	client := fmsfake.New()
+	id := seedCanaryPolicy(t, client)
+	store := history.NewLocalStore(t.TempDir())
+
+	first := ownedTestPolicy()
+	first.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	if _, _, err := canaryRun(t, client, store, first, 0); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	startTag := client.Tags(id)[TagCanary]
+
+	second := ownedTestPolicy()
+	second.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"COUNT"}}`
+	_, outcome, err := canaryRun(t, client, store, second, 20*time.Minute)
+	if err != nil || outcome != CanaryStarted {
+		t.Fatalf("expected a restarted canary, got %q: %v", outcome, err)
+	}
+	status, err := parseCanaryTag(client.Tags(id)[TagCanary])
+	if err != nil || !status.StartedAt.Equal(canaryStart.Add(20*time.Minute)) {
+		t.Fatalf("canary not restarted: %q (was %q): %v", client.Tags(id)[TagCanary], startTag, err)
+	}
+	// The revert target is still the version from before the first canary.
+	v, err := store.Get(context.Background(), ownedTestPolicy().Name, status.RevertVersion)
+	if err != nil || aws.ToString(v.Policy.SecurityServicePolicyData.ManagedServiceData) != ownedTestPolicy().ManagedServiceData {
+		t.Fatalf("revert version %d is not the original policy: %v", status.RevertVersion, err)
+	}
+}
+
+func TestCanaryUpsert_CancelledOutsideCanary(t *testing.T) {
+	client := fmsfake.New()
+	id := seedCanaryPolicy(t, client)
+	p := ownedTestPolicy()
+	p.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	if _, _, err := canaryRun(t, client, history.NewLocalStore(t.TempDir()), p, 0); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	change, err := UpsertPolicy(context.Background(), client, inventory(t, client), p, Options{OUID: "ou-run"}, util.NewLogger())
+	if err != nil || change.Canary == nil || change.Canary.Stage != CanaryCancelled {
+		t.Fatalf("expected a cancelled canary, got %s: %v", change, err)
+	}
+	if _, tagged := client.Tags(id)[TagCanary]; canaryScoped(t, client, id) || tagged {
+		t.Fatalf("canary scope or tag left: %v", client.Tags(id))
+	}
+	if client.Calls(fmsfake.OpUntagResource) != 1 {
+		t.Fatalf("expected the Canary tag to be removed with UntagResource, got %d calls", client.Calls(fmsfake.OpUntagResource))
+	}
+}
+
+func TestCanaryUpsert_SkipsCreatesAndScopeOnlyChanges(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	canary := CanaryOptions{Accounts: []string{canaryAccount}, Polls: 1}
+
+	change, outcome, err := CanaryUpsert(ctx, client, inventory(t, client), ownedTestPolicy(), Options{OUID: "ou-run"}, canary, util.NewLogger())
+	if err != nil || outcome != "" || change.Action != ActionCreate {
+		t.Fatalf("expected a direct create, got %s %q: %v", change, outcome, err)
+	}
+
+	change, outcome, err = CanaryUpsert(ctx, client, inventory(t, client), ownedTestPolicy(), Options{OUID: "ou-other"}, canary, util.NewLogger())
+	if err != nil || outcome != "" || change.Action != ActionUpdate {
+		t.Fatalf("expected a direct scope update, got %s %q: %v", change, outcome, err)
+	}
+
+	// A data change needs a version store to revert from.
+	p := ownedTestPolicy()
+	p.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	if _, _, err := CanaryUpsert(ctx, client, inventory(t, client), p, Options{OUID: "ou-other"}, canary, util.NewLogger()); err == nil || !strings.Contains(err.Error(), "version store") {
+		t.Fatalf("expected an error without a version store, got %v", err)
+	}
+}
+
+func TestParseCanaryTag(t *testing.T) {
+	status := &CanaryStatus{Stage: CanaryWaiting, StartedAt: canaryStart, RevertVersion: 3, Polls: 1}
+	got, err := parseCanaryTag(tagValue(status.tagValue()))
+	if err != nil || !reflect.DeepEqual(got, status) {
+		t.Fatalf("round trip = %+v, %v", got, err)
+	}
+	if got, err := parseCanaryTag(""); got != nil || err != nil {
+		t.Fatalf("empty tag = %+v, %v", got, err)
+	}
+	failed := &CanaryStatus{Stage: CanaryReverted, FailedData: "abc123"}
+	if got, err := parseCanaryTag(failed.tagValue()); err != nil || !reflect.DeepEqual(got, failed) {
+		t.Fatalf("failed round trip = %+v, %v", got, err)
+	}
+	if _, err := parseCanaryTag("started=yesterday revert=1"); err == nil {
+		t.Fatalf("expected an error for a bad start time")
+	}
+}
@@ -0,0 +1,20 @@
+package fmsapply
+
+import (
+	"context"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+)
+
+var _ API = (*fmsfake.FMS)(nil)
+
+// inventory loads the fake's policies without a rate limit.
+func inventory(tb testing.TB, client *fmsfake.FMS) *Inventory {
+	tb.Helper()
+	inv, err := LoadInventory(context.Background(), client, InventoryOptions{RequestsPerSecond: -1})
+	if err != nil {
+		tb.Fatalf("load inventory: %v", err)
+	}
+	return inv
+}
@@ -3,6 +3,7 @@ package fmsapply
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/fms"
@@ -12,81 +13,335 @@ import (
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
 )
 
+// API is the subset of the FMS client used by this package. *fms.Client satisfies it,
+// and tests substitute an in-memory fake.
+type API interface {
+	ListPolicies(ctx context.Context, params *fms.ListPoliciesInput, optFns ...func(*fms.Options)) (*fms.ListPoliciesOutput, error)
+	GetPolicy(ctx context.Context, params *fms.GetPolicyInput, optFns ...func(*fms.Options)) (*fms.GetPolicyOutput, error)
+	PutPolicy(ctx context.Context, params *fms.PutPolicyInput, optFns ...func(*fms.Options)) (*fms.PutPolicyOutput, error)
+	DeletePolicy(ctx context.Context, params *fms.DeletePolicyInput, optFns ...func(*fms.Options)) (*fms.DeletePolicyOutput, error)
+	ListComplianceStatus(ctx context.Context, params *fms.ListComplianceStatusInput, optFns ...func(*fms.Options)) (*fms.ListComplianceStatusOutput, error)
+	ListTagsForResource(ctx context.Context, params *fms.ListTagsForResourceInput, optFns ...func(*fms.Options)) (*fms.ListTagsForResourceOutput, error)
+	TagResource(ctx context.Context, params *fms.TagResourceInput, optFns ...func(*fms.Options)) (*fms.TagResourceOutput, error)
+	UntagResource(ctx context.Context, params *fms.UntagResourceInput, optFns ...func(*fms.Options)) (*fms.UntagResourceOutput, error)
+
+	ListResourceSets(ctx context.Context, params *fms.ListResourceSetsInput, optFns ...func(*fms.Options)) (*fms.ListResourceSetsOutput, error)
+	GetResourceSet(ctx context.Context, params *fms.GetResourceSetInput, optFns ...func(*fms.Options)) (*fms.GetResourceSetOutput, error)
+	PutResourceSet(ctx context.Context, params *fms.PutResourceSetInput, optFns ...func(*fms.Options)) (*fms.PutResourceSetOutput, error)
+	DeleteResourceSet(ctx context.Context, params *fms.DeleteResourceSetInput, optFns ...func(*fms.Options)) (*fms.DeleteResourceSetOutput, error)
+	ListResourceSetResources(ctx context.Context, params *fms.ListResourceSetResourcesInput, optFns ...func(*fms.Options)) (*fms.ListResourceSetResourcesOutput, error)
+	BatchAssociateResource(ctx context.Context, params *fms.BatchAssociateResourceInput, optFns ...func(*fms.Options)) (*fms.BatchAssociateResourceOutput, error)
+	BatchDisassociateResource(ctx context.Context, params *fms.BatchDisassociateResourceInput, optFns ...func(*fms.Options)) (*fms.BatchDisassociateResourceOutput, error)
+}
+
+var _ API = (*fms.Client)(nil)
+
 // UpsertPolicy ensures the FMS policy exists (create or update) for the provided managed_service_data payload.
-// If dryRun is true, it only logs the intended change.
-func UpsertPolicy(ctx context.Context, client *fms.Client, p policy.RenderedPolicy, ouID string, dryRun bool, logger *util.Logger) error {
-	includeMap := map[string][]string{}
-	if ouID != "" {
-		includeMap["ORG_UNIT"] = []string{ouID}
+// It compares the rendered policy with the live one and skips PutPolicy when nothing differs.
+// Policies without the ownership tag are only updated with opts.Adopt.
+// The live policy is read from inv, which is updated after the write.
+// If opts.DryRun is true, it only logs the planned change. PutPolicy is tried once; see
+// UpsertPolicies for retries.
+func UpsertPolicy(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, opts Options, logger *util.Logger) (Change, error) {
+	return upsertPolicy(ctx, client, inv, p, opts, ApplyOptions{MaxAttempts: 1}.withDefaults(), logger)
+}
+
+// upsertPolicy is UpsertPolicy with the retry settings of apply.
+func upsertPolicy(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, opts Options, apply ApplyOptions, logger *util.Logger) (Change, error) {
+	return upsertCanary(ctx, client, inv, p, opts, apply, nil, logger)
+}
+
+// upsertCanary is upsertPolicy writing the canary state canary to the Canary tag. Nil
+// writes the policy outside a canary.
+func upsertCanary(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, opts Options, apply ApplyOptions, canary *CanaryStatus, logger *util.Logger) (Change, error) {
+	var set *ResourceSetChange
+	if p.ResourceSet != "" {
+		var err error
+		set, err = planResourceSet(ctx, client, inv, p, opts.Adopt)
+		if err != nil {
+			return Change{}, fmt.Errorf("resource set for policy %s: %w", p.Name, err)
+		}
 	}
+	return writePolicy(ctx, client, inv, p, set, opts, apply, canary, logger)
+}
 
-	policyInput := fmstypes.Policy{
-		ExcludeResourceTags: false,
-		RemediationEnabled:  true,
-		ResourceTypeList:    []string{p.ResourceType},
-		PolicyName:          aws.String(p.Name),
-		PolicyDescription:   aws.String(p.Description),
-		SecurityServicePolicyData: &fmstypes.SecurityServicePolicyData{
-			Type:               fmstypes.SecurityServiceTypeWafv2,
-			ManagedServiceData: aws.String(p.ManagedServiceData),
-		},
-		IncludeMap: includeMap,
+// writePolicy plans a policy scoped to setID, if any, in the canary state canary, and
+// writes it unless it is unchanged or opts.DryRun is set. The live version of an updated
+// policy is saved to opts.History first; a starting canary reverts to that version.
+func writePolicy(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, set *ResourceSetChange, opts Options, apply ApplyOptions, canary *CanaryStatus, logger *util.Logger) (Change, error) {
+	// A started canary reverts to the version this write replaces; after a token conflict
+	// that is the version the policy is planned against again.
+	revertToSaved := canary != nil && canary.Stage == CanaryStarted && canary.RevertVersion == 0
+	prepare := func() (PlannedPolicy, error) {
+		planned, err := planPolicy(ctx, inv, p, opts, set, canary)
+		if err != nil {
+			return PlannedPolicy{}, err
+		}
+		logger.Infof("plan: %s", planned.Change)
+		if !planned.Change.writesPolicy() || opts.DryRun {
+			return planned, nil
+		}
+		saved, err := saveVersion(ctx, opts.History, inv, planned, opts.now(), logger)
+		if err != nil {
+			return PlannedPolicy{}, err
+		}
+		if revertToSaved {
+			canary.RevertVersion = saved
+		}
+		return planned, nil
 	}
 
-	existingID, updateToken, err := findPolicyByName(ctx, client, p.Name)
+	planned, err := prepare()
 	if err != nil {
-		return fmt.Errorf("find existing policy %s: %w", p.Name, err)
+		return Change{}, err
+	}
+	if planned.Change.Action == ActionNoOp {
+		return planned.Change, nil
+	}
+	if opts.DryRun {
+		logger.Infof("dry-run enabled; skipping PutPolicy for %s", p.Name)
+		return planned.Change, nil
 	}
-	if existingID != nil {
-		if updateToken == nil {
-			return fmt.Errorf("existing policy %s missing update token", p.Name)
+	// The set is only changed once the policy passed the ownership check of planPolicy.
+	if set.changed() {
+		if err := applyResourceSet(ctx, client, inv, p, set, logger); err != nil {
+			return Change{}, fmt.Errorf("resource set for policy %s: %w", p.Name, err)
 		}
-		policyInput.PolicyId = existingID
-		policyInput.PolicyUpdateToken = updateToken
-		logger.Infof("updating existing policy %s", p.Name)
-	} else {
-		logger.Infof("creating new policy %s", p.Name)
 	}
+	if !planned.Change.writesPolicy() {
+		return planned.Change, nil
+	}
+	planned, err = putWithRetry(ctx, client, inv, planned, set.id(), opts.ConfigHash, apply, prepare, logger)
+	if err != nil {
+		return Change{}, err
+	}
+	return planned.Change, nil
+}
 
-	if dryRun {
-		logger.Infof("dry-run enabled; skipping PutPolicy for %s", p.Name)
-		return nil
+// planPolicy looks up the live policy in inv and diffs it against the rendered one. set
+// is the plan for the resource set the policy is scoped to, if any, and canary the canary
+// state to write; nil cancels a canary the live policy is in. Membership changes of the
+// set are fields of the change, and make an otherwise unchanged policy an update.
+func planPolicy(ctx context.Context, inv *Inventory, p policy.RenderedPolicy, opts Options, set *ResourceSetChange, canary *CanaryStatus) (PlannedPolicy, error) {
+	planned := PlannedPolicy{Policy: p, OUID: opts.OUID}
+	setID := set.id()
+	if set != nil && setID == "" {
+		// The set is created before the policy is written; its ID is not known yet.
+		setID = "(new " + set.Name + ")"
 	}
+	desired := desiredPolicy(p, opts.OUID, setID)
 
-	if _, err := client.PutPolicy(ctx, &fms.PutPolicyInput{Policy: &policyInput}); err != nil {
-		return fmt.Errorf("put policy %s: %w", p.Name, err)
+	existing, err := inv.lookup(ctx, p.Name)
+	if err != nil {
+		return PlannedPolicy{}, fmt.Errorf("find existing policy %s: %w", p.Name, err)
+	}
+	var live *fmstypes.Policy
+	if existing != nil {
+		if !existing.owned() && !opts.Adopt {
+			return PlannedPolicy{}, fmt.Errorf("%w: %s lacks the %s=%s tag; adopt it explicitly to update it",
+				ErrUnmanagedPolicy, p.Name, TagManagedBy, ManagedByValue)
+		}
+		if existing.Policy.PolicyUpdateToken == nil {
+			return PlannedPolicy{}, fmt.Errorf("existing policy %s missing update token", p.Name)
+		}
+		planned.PolicyID = aws.ToString(existing.Policy.PolicyId)
+		planned.PolicyARN = existing.ARN
+		planned.UpdateToken = aws.ToString(existing.Policy.PolicyUpdateToken)
+		live = &existing.Policy
 	}
-	return nil
-}
 
-func findPolicyByName(ctx context.Context, client *fms.Client, name string) (*string, *string, error) {
-	pager := fms.NewListPoliciesPaginator(client, &fms.ListPoliciesInput{})
+	rollout, err := planRollout(ctx, inv, p.Rollout, existing, opts.now())
+	if err != nil {
+		return PlannedPolicy{}, fmt.Errorf("rollout of policy %s: %w", p.Name, err)
+	}
+	if rollout != nil {
+		desired.RemediationEnabled = rollout.RemediationEnabled()
+	}
 
-	for pager.HasMorePages() {
-		page, err := pager.NextPage(ctx)
-		if err != nil {
-			return nil, nil, fmt.Errorf("list policies: %w", err)
-		}
-		for _, summary := range page.PolicyList {
-			if summary.PolicyName != nil && *summary.PolicyName == name {
-				if summary.PolicyId == nil {
-					return nil, nil, fmt.Errorf("policy %s found without id", name)
-				}
-
-				policyID := summary.PolicyId
-				gp, err := client.GetPolicy(ctx, &fms.GetPolicyInput{PolicyId: policyID})
-				if err != nil {
-					return nil, nil, fmt.Errorf("get policy %s: %w", name, err)
-				}
-
-				var updateToken *string
-				if gp.Policy != nil {
-					updateToken = gp.Policy.PolicyUpdateToken
-				}
-				return policyID, updateToken, nil
+	planned.Change, err = Diff(live, &desired)
+	if err != nil {
+		return PlannedPolicy{}, fmt.Errorf("diff policy %s: %w", p.Name, err)
+	}
+	planned.Change.Rollout = rollout
+	if existing != nil && rollout != nil && rollout.StartedAt != nil {
+		// An audited policy without a readable start tag starts its soak period now, which
+		// only counts once the tag is written.
+		started := rollout.StartedAt.UTC().Format(time.RFC3339)
+		if existing.Tags[TagRolloutStarted] != started {
+			planned.Change.Fields = append(planned.Change.Fields, FieldChange{Field: "tags." + TagRolloutStarted, Old: existing.Tags[TagRolloutStarted], New: started})
+			planned.Change.Action = ActionUpdate
+		}
+	}
+	if existing != nil {
+		if canary == nil && existing.Tags[TagCanary] != "" {
+			reason := "written outside a canary"
+			if prior, _ := parseCanaryTag(existing.Tags[TagCanary]); prior != nil && prior.Stage == CanaryReverted {
+				reason = "record of the failed data dropped"
+			}
+			canary = &CanaryStatus{Stage: CanaryCancelled, Reason: reason}
+		}
+		if canary != nil {
+			planned.Change.Canary = canary
+			if old, want := existing.Tags[TagCanary], canary.tagValue(); old != want {
+				planned.Change.Fields = append(planned.Change.Fields, FieldChange{Field: "tags." + TagCanary, Old: old, New: want})
+				planned.Change.Action = ActionUpdate
+			}
+		}
+		planned.Change.Adopt = !existing.owned()
+		planned.Change.Drift = existing.drifted()
+		if planned.Change.Action == ActionNoOp && planned.Change.Adopt {
+			// Adopting writes the ownership tags even when the policy itself is unchanged.
+			planned.Change.Action = ActionUpdate
+		}
+	}
+	if set != nil {
+		planned.Change.ResourceSet = set
+		if set.changed() {
+			planned.Change.Fields = append(planned.Change.Fields, set.fields()...)
+			if planned.Change.Action == ActionNoOp {
+				planned.Change.Action = ActionUpdate
 			}
 		}
 	}
+	return planned, nil
+}
+
+// putPlanned writes a planned create or update with PutPolicy, tags it as owned and
+// records the result in inv.
+func putPlanned(ctx context.Context, client API, inv *Inventory, planned PlannedPolicy, setID, configHash string) error {
+	w, err := putPolicy(ctx, client, inv, planned, setID, configHash)
+	if err != nil {
+		return err
+	}
+	return w.tag(ctx, client, inv)
+}
+
+// written is a policy PutPolicy accepted. An update still needs its ownership tags, which
+// TagList only sets on creates, and the removal of the tags in untag.
+type written struct {
+	name   string
+	arn    string
+	policy *fmstypes.Policy
+	tags   []fmstypes.Tag
+	untag  []string
+	retag  bool
+}
+
+// putPolicy writes a planned create or update with PutPolicy and records it in inv.
+func putPolicy(ctx context.Context, client API, inv *Inventory, planned PlannedPolicy, setID, configHash string) (*written, error) {
+	name := planned.Policy.Name
+	input := desiredPolicy(planned.Policy, planned.OUID, setID)
+	if rollout := planned.Change.Rollout; rollout != nil {
+		input.RemediationEnabled = rollout.RemediationEnabled()
+	}
+	tags, untag, err := ownershipTags(planned.Policy, &input, configHash, planned.Change.Rollout, planned.Change.Canary)
+	if err != nil {
+		return nil, fmt.Errorf("ownership tags for %s: %w", name, err)
+	}
+	if planned.PolicyID != "" {
+		input.PolicyId = aws.String(planned.PolicyID)
+		input.PolicyUpdateToken = aws.String(planned.UpdateToken)
+	}
+
+	out, err := client.PutPolicy(ctx, &fms.PutPolicyInput{Policy: &input, TagList: tags})
+	if err != nil {
+		return nil, fmt.Errorf("put policy %s: %w", name, err)
+	}
+	w := &written{name: name, arn: planned.PolicyARN, policy: out.Policy, tags: tags, untag: untag, retag: planned.PolicyID != ""}
+	if out.PolicyArn != nil {
+		w.arn = *out.PolicyArn
+	}
+	if w.policy != nil {
+		// The new update token is recorded even if the tagging fails.
+		var applied []fmstypes.Tag
+		if !w.retag {
+			applied = tags
+		}
+		inv.record(*w.policy, w.arn, applied, nil)
+	}
+	return w, nil
+}
+
+// tag sets the ownership tags of an updated policy with TagResource, removes the untag
+// keys with UntagResource, and records both in inv. Created policies were tagged by
+// PutPolicy.
+func (w *written) tag(ctx context.Context, client API, inv *Inventory) error {
+	if !w.retag {
+		return nil
+	}
+	if _, err := client.TagResource(ctx, &fms.TagResourceInput{ResourceArn: aws.String(w.arn), TagList: w.tags}); err != nil {
+		return fmt.Errorf("tag policy %s: %w", w.name, err)
+	}
+	if len(w.untag) > 0 {
+		if _, err := client.UntagResource(ctx, &fms.UntagResourceInput{ResourceArn: aws.String(w.arn), TagKeys: w.untag}); err != nil {
+			return fmt.Errorf("untag policy %s: %w", w.name, err)
+		}
+	}
+	if w.policy != nil {
+		inv.record(*w.policy, w.arn, w.tags, w.untag)
+	}
+	return nil
+}
+
+// desiredPolicy builds the FMS policy for a rendered policy, without ID or update token.
+// Remediation is enabled unless the policy disables it; planPolicy turns it off for
+// staged policies still in audit.
+func desiredPolicy(p policy.RenderedPolicy, ouID, setID string) fmstypes.Policy {
+	serviceType := fmstypes.SecurityServiceTypeWafv2
+	if p.PolicyType != "" {
+		serviceType = fmstypes.SecurityServiceType(p.PolicyType)
+	}
+
+	// A configured policyScope is sent as is; otherwise the policy covers the run's OU.
+	includeMap := map[string][]string{}
+	for k, v := range p.IncludeMap {
+		includeMap[k] = v
+	}
+	if len(p.IncludeMap) == 0 && len(p.ExcludeMap) == 0 && ouID != "" {
+		includeMap[policy.ScopeOrgUnit] = []string{ouID}
+	}
+
+	out := fmstypes.Policy{
+		ExcludeResourceTags: p.ExcludeResourceTags,
+		ResourceTags:        resourceTags(p.ResourceTags),
+		RemediationEnabled:  !p.RemediationDisabled,
+		ResourceType:        aws.String(p.ResourceType),
+		ResourceTypeList:    resourceTypeList(p),
+		PolicyName:          aws.String(p.Name),
+		PolicyDescription:   aws.String(p.Description),
+		SecurityServicePolicyData: &fmstypes.SecurityServicePolicyData{
+			Type:               serviceType,
+			ManagedServiceData: aws.String(p.ManagedServiceData),
+		},
+		IncludeMap: includeMap,
+		ExcludeMap: p.ExcludeMap,
+	}
+	if setID != "" {
+		out.ResourceSetIds = []string{setID}
+	}
+	return out
+}
 
-	return nil, nil, nil
+// resourceTypeList returns the FMS ResourceTypeList for the policy.
+func resourceTypeList(p policy.RenderedPolicy) []string {
+	if len(p.ResourceTypes) > 0 {
+		return p.ResourceTypes
+	}
+	return []string{p.ResourceType}
+}
+
+// resourceTags converts the rendered tag scope into FMS ResourceTags.
+func resourceTags(tags []policy.ResourceTag) []fmstypes.ResourceTag {
+	if len(tags) == 0 {
+		return nil
+	}
+	out := make([]fmstypes.ResourceTag, 0, len(tags))
+	for _, t := range tags {
+		rt := fmstypes.ResourceTag{Key: aws.String(t.Key)}
+		if t.Value != "" {
+			rt.Value = aws.String(t.Value)
+		}
+		out = append(out, rt)
+	}
+	return out
 }
@@ -0,0 +1,124 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestUpsertPolicy(t *testing.T) {
+	const (
+		allow = `{"type":"WAFV2","defaultAction":{"type":"ALLOW"}}`
+		block = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	)
+	var (
+		stale    *fmstypes.InvalidOperationException
+		notFound *fmstypes.ResourceNotFoundException
+	)
+	tests := []struct {
+		name string
+		// live is the managed_service_data of the owned policy already in FMS, if any.
+		live string
+		// race runs between reading the live policy and writing it.
+		race       func(client *fmsfake.FMS, id string)
+		wantAction Action
+		wantErr    any
+		wantMSD    string
+	}{
+		{name: "create", wantAction: ActionCreate, wantMSD: block},
+		{name: "update", live: allow, wantAction: ActionUpdate, wantMSD: block},
+		{name: "unchanged", live: block, wantAction: ActionNoOp, wantMSD: block},
+		{
+			name: "stale update token",
+			live: allow,
+			race: func(client *fmsfake.FMS, id string) {
+				client.EditPolicy(id, func(*fmstypes.Policy) {})
+			},
+			wantErr: &stale,
+			wantMSD: allow,
+		},
+		{
+			name: "policy deleted",
+			live: allow,
+			race: func(client *fmsfake.FMS, id string) {
+				client.RemovePolicy(id)
+			},
+			wantErr: &notFound,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := util.NewLogger()
+			client := fmsfake.New()
+			p := ownedTestPolicy()
+			if tc.live != "" {
+				p.ManagedServiceData = tc.live
+				if _, err := UpsertPolicy(ctx, client, inventory(t, client), p, Options{}, logger); err != nil {
+					t.Fatalf("seed: %v", err)
+				}
+			}
+			inv := inventory(t, client)
+			if err := inv.Prefetch(ctx, inv.Names()); err != nil {
+				t.Fatalf("prefetch: %v", err)
+			}
+			id, _ := client.PolicyID(p.Name)
+			if tc.race != nil {
+				tc.race(client, id)
+			}
+
+			p.ManagedServiceData = block
+			change, err := UpsertPolicy(ctx, client, inv, p, Options{}, logger)
+			if tc.wantErr != nil {
+				if !errors.As(err, tc.wantErr) {
+					t.Fatalf("expected %T, got %v", tc.wantErr, err)
+				}
+			} else if err != nil || change.Action != tc.wantAction {
+				t.Fatalf("expected %s, got %s: %v", tc.wantAction, change, err)
+			}
+
+			id, _ = client.PolicyID(p.Name)
+			live, ok := client.Policy(id)
+			if tc.wantMSD == "" {
+				if ok {
+					t.Fatalf("policy recreated: %+v", live)
+				}
+				return
+			}
+			if got := aws.ToString(live.SecurityServicePolicyData.ManagedServiceData); got != tc.wantMSD {
+				t.Fatalf("unexpected managed_service_data %s", got)
+			}
+			if tags := client.Tags(id); tags[TagManagedBy] != ManagedByValue {
+				t.Fatalf("policy not tagged as owned: %v", tags)
+			}
+		})
+	}
+}
+
+func TestDesiredPolicy_Scope(t *testing.T) {
+	p := policy.RenderedPolicy{Name: "auto-alb-a", ResourceType: "AWS::ElasticLoadBalancingV2::LoadBalancer"}
+
+	got := desiredPolicy(p, "ou-run", "")
+	if !reflect.DeepEqual(got.IncludeMap, map[string][]string{policy.ScopeOrgUnit: {"ou-run"}}) || got.ExcludeMap != nil {
+		t.Fatalf("expected the run's OU without a policyScope, got include=%v exclude=%v", got.IncludeMap, got.ExcludeMap)
+	}
+
+	p.ExcludeMap = map[string][]string{policy.ScopeAccount: {"111111111111"}}
+	p.ResourceTags = []policy.ResourceTag{{Key: "fms", Value: "off"}}
+	p.ExcludeResourceTags = true
+	got = desiredPolicy(p, "ou-run", "")
+	if len(got.IncludeMap) != 0 || !reflect.DeepEqual(got.ExcludeMap, p.ExcludeMap) {
+		t.Fatalf("policyScope not sent as configured: include=%v exclude=%v", got.IncludeMap, got.ExcludeMap)
+	}
+	if !got.ExcludeResourceTags || len(got.ResourceTags) != 1 {
+		t.Fatalf("resource tags not sent: %+v", got.ResourceTags)
+	}
+}
@@ -0,0 +1,86 @@
+package fmsapply
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// saveVersion stores the live version of a policy that planned updates and returns its
+// number. Creates have no prior version, and a nil store keeps no history; both return 0.
+// A failed save stops the write, so every update can be rolled back.
+func saveVersion(ctx context.Context, store history.Store, inv *Inventory, planned PlannedPolicy, now time.Time, logger *util.Logger) (int, error) {
+	if store == nil || planned.PolicyID == "" {
+		return 0, nil
+	}
+	name := planned.Policy.Name
+	live, err := inv.lookup(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("find existing policy %s: %w", name, err)
+	}
+	if live == nil {
+		return 0, nil
+	}
+	v, err := store.Save(ctx, history.Version{
+		PolicyName:  name,
+		PolicyID:    aws.ToString(live.Policy.PolicyId),
+		PolicyARN:   live.ARN,
+		SavedAt:     now.UTC(),
+		UpdateToken: aws.ToString(live.Policy.PolicyUpdateToken),
+		Tags:        live.Tags,
+		Policy:      live.Policy,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("save version of %s: %w", name, err)
+	}
+	logger.Infof("history: saved %s version %d", name, v.Number)
+	return v.Number, nil
+}
+
+// Rollback re-applies a stored version of a policy through the upsert path: the live
+// policy is diffed against the version and only written if they differ, and with
+// opts.DryRun only the change is logged. The policy keeps its resource set and is
+// written with the ConfigHash of the version. The version being replaced is saved to
+// opts.History like any update, so a rollback can itself be rolled back.
+//
+// The next run from the config overwrites the rollback; fix the config before then.
+func Rollback(ctx context.Context, client API, inv *Inventory, v history.Version, opts Options, logger *util.Logger) (Change, error) {
+	var set *ResourceSetChange
+	if len(v.Policy.ResourceSetIds) > 0 {
+		set = &ResourceSetChange{ID: v.Policy.ResourceSetIds[0]}
+	}
+	opts.OUID = ""
+	opts.ConfigHash = v.Tags[TagConfigHash]
+	return writePolicy(ctx, client, inv, restoredPolicy(v), set, opts, ApplyOptions{}.withDefaults(), nil, logger)
+}
+
+// restoredPolicy turns a stored version back into the rendered policy that reproduces it.
+func restoredPolicy(v history.Version) policy.RenderedPolicy {
+	p := v.Policy
+	data := serviceData(&p)
+	out := policy.RenderedPolicy{
+		Name:                v.PolicyName,
+		Description:         aws.ToString(p.PolicyDescription),
+		ResourceType:        aws.ToString(p.ResourceType),
+		ManagedServiceData:  aws.ToString(data.ManagedServiceData),
+		PolicyType:          string(data.Type),
+		ExcludeResourceTags: p.ExcludeResourceTags,
+		IncludeMap:          p.IncludeMap,
+		ExcludeMap:          p.ExcludeMap,
+		RemediationDisabled: !p.RemediationEnabled,
+		Source:              v.Tags[TagSource],
+	}
+	if len(p.ResourceTypeList) > 1 || (len(p.ResourceTypeList) == 1 && p.ResourceTypeList[0] != out.ResourceType) {
+		out.ResourceTypes = p.ResourceTypeList
+	}
+	for _, t := range p.ResourceTags {
+		out.ResourceTags = append(out.ResourceTags, policy.ResourceTag{Key: aws.ToString(t.Key), Value: aws.ToString(t.Value)})
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package fmsapply
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestUpsertPolicy_SavesHistoryAndRollsBack(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+	store := history.NewLocalStore(t.TempDir())
+	opts := Options{OUID: "ou-run", ConfigHash: "good", History: store}
+
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), opts, logger); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if versions, _ := store.List(ctx, "auto-alb-a"); len(versions) != 0 {
+		t.Fatalf("a create has no prior version, got %d", len(versions))
+	}
+
+	bad := ownedTestPolicy()
+	bad.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	opts.ConfigHash = "bad"
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), bad, opts, logger); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	v, err := store.Get(ctx, "auto-alb-a", 1)
+	if err != nil {
+		t.Fatalf("get version 1: %v", err)
+	}
+	if got := aws.ToString(v.Policy.SecurityServicePolicyData.ManagedServiceData); got != ownedTestPolicy().ManagedServiceData {
+		t.Fatalf("version 1 is not the policy before the update: %s", got)
+	}
+	if v.UpdateToken == "" || v.Tags[TagConfigHash] != "good" {
+		t.Fatalf("version 1 lacks its metadata: %+v", v)
+	}
+
+	live := func() string {
+		for _, id := range client.PolicyIDs() {
+			p, _ := client.Policy(id)
+			if !p.RemediationEnabled {
+				t.Fatalf("rollback disabled remediation")
+			}
+			return aws.ToString(p.SecurityServicePolicyData.ManagedServiceData) + " " + client.Tags(id)[TagConfigHash]
+		}
+		return ""
+	}
+
+	dry := Options{DryRun: true, History: store}
+	change, err := Rollback(ctx, client, inventory(t, client), v, dry, logger)
+	if err != nil || change.Action != ActionUpdate {
+		t.Fatalf("expected a planned update, got %s: %v", change, err)
+	}
+	if got, want := live(), bad.ManagedServiceData+" bad"; got != want {
+		t.Fatalf("dry-run rollback wrote the policy: %s", got)
+	}
+
+	if _, err := Rollback(ctx, client, inventory(t, client), v, Options{History: store}, logger); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got, want := live(), ownedTestPolicy().ManagedServiceData+" good"; got != want {
+		t.Fatalf("policy not rolled back: %s", got)
+	}
+	versions, err := store.List(ctx, "auto-alb-a")
+	if err != nil || len(versions) != 2 || versions[1].Tags[TagConfigHash] != "bad" {
+		t.Fatalf("the rolled-back version was not saved: %+v %v", versions, err)
+	}
+
+	// Rolling back again is a no-op, and the restored policy does not read as drifted.
+	change, err = Rollback(ctx, client, inventory(t, client), v, Options{History: store}, logger)
+	if err != nil || change.Action != ActionNoOp {
+		t.Fatalf("expected a no-op, got %s: %v", change, err)
+	}
+	if drifts, err := DetectDrift(ctx, inventory(t, client)); err != nil || len(drifts) != 0 {
+		t.Fatalf("unexpected drift after rollback: %v %v", drifts, err)
+	}
+}
+
+func TestRestoredPolicy_KeepsAuditMode(t *testing.T) {
+	client := fmsfake.New()
+	id := seedCanaryPolicy(t, client)
+	p, _ := client.Policy(id)
+	p.RemediationEnabled = false
+	restored := restoredPolicy(history.Version{PolicyName: "auto-alb-a", Policy: p})
+	if !restored.RemediationDisabled || restored.ResourceTypes != nil {
+		t.Fatalf("unexpected restored policy %+v", restored)
+	}
+	if got := desiredPolicy(restored, "", ""); got.RemediationEnabled {
+		t.Fatalf("restored audit-mode policy would enable remediation")
+	}
+}
@@ -0,0 +1,406 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+)
+
+// Inventory defaults, sized to stay well below the FMS per-account request quotas.
+const (
+	DefaultInventoryConcurrency       = 4
+	DefaultInventoryRequestsPerSecond = 5
+)
+
+// InventoryOptions tunes how the inventory reads policy details. Zero values take the
+// defaults; a negative RequestsPerSecond disables the rate limit.
+type InventoryOptions struct {
+	Concurrency       int
+	RequestsPerSecond float64
+}
+
+// ErrDuplicatePolicyName is returned when several live policies share a name the tool
+// writes or prunes, so it cannot tell which of them it owns.
+var ErrDuplicatePolicyName = errors.New("policy name is not unique")
+
+// Inventory is the set of live FMS policies, listed once per run and indexed by name and
+// ID. Policy details and tags are fetched lazily, at most once per policy, and every FMS
+// read goes through a shared rate limiter. Writes made through this package update it, so
+// one inventory serves all the upserts and the prune of a run. The resource sets are
+// listed once too, on first use, and indexed by name.
+type Inventory struct {
+	client      API
+	limiter     *limiter
+	concurrency int
+
+	mu     sync.Mutex
+	byName map[string]*inventoryEntry
+	byID   map[string]*inventoryEntry
+	// shared holds every entry of a name that more than one live policy has; byName
+	// holds the first of them.
+	shared map[string][]*inventoryEntry
+
+	setsMu sync.Mutex
+	sets   map[string]string // resource set name to ID; nil until listed
+}
+
+type inventoryEntry struct {
+	summary fmstypes.PolicySummary
+
+	mu   sync.Mutex
+	live *livePolicy
+}
+
+// LoadInventory lists the live policies. Details are only read on first use or by Prefetch.
+func LoadInventory(ctx context.Context, client API, opts InventoryOptions) (*Inventory, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultInventoryConcurrency
+	}
+	if opts.RequestsPerSecond == 0 {
+		opts.RequestsPerSecond = DefaultInventoryRequestsPerSecond
+	}
+	inv := &Inventory{
+		client:      client,
+		limiter:     newLimiter(opts.RequestsPerSecond),
+		concurrency: opts.Concurrency,
+		byName:      map[string]*inventoryEntry{},
+		byID:        map[string]*inventoryEntry{},
+		shared:      map[string][]*inventoryEntry{},
+	}
+
+	pager := fms.NewListPoliciesPaginator(client, &fms.ListPoliciesInput{})
+	for pager.HasMorePages() {
+		if err := inv.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list policies: %w", err)
+		}
+		for _, summary := range page.PolicyList {
+			name := aws.ToString(summary.PolicyName)
+			if summary.PolicyId == nil {
+				return nil, fmt.Errorf("policy %s found without id", name)
+			}
+			entry := &inventoryEntry{summary: summary}
+			inv.byID[*summary.PolicyId] = entry
+			// Names are not unique in FMS. Lookups of a shared name fail rather than pick
+			// one of the policies.
+			if first, ok := inv.byName[name]; ok {
+				if inv.shared[name] == nil {
+					inv.shared[name] = []*inventoryEntry{first}
+				}
+				inv.shared[name] = append(inv.shared[name], entry)
+				continue
+			}
+			inv.byName[name] = entry
+		}
+	}
+	return inv, nil
+}
+
+// Names returns the names of the live policies, sorted.
+func (inv *Inventory) Names() []string {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	names := make([]string, 0, len(inv.byName))
+	for name := range inv.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the live policy with the given name, with its tags, or nil if none
+// exists. It fails with ErrDuplicatePolicyName when several live policies have the name.
+func (inv *Inventory) lookup(ctx context.Context, name string) (*livePolicy, error) {
+	inv.mu.Lock()
+	entry, shared := inv.byName[name], inv.shared[name]
+	inv.mu.Unlock()
+	if len(shared) > 1 {
+		ids := make([]string, 0, len(shared))
+		for _, e := range shared {
+			ids = append(ids, aws.ToString(e.summary.PolicyId))
+		}
+		return nil, fmt.Errorf("%w: policies %s are all named %s; delete or rename all but one", ErrDuplicatePolicyName, strings.Join(ids, ", "), name)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return entry.load(ctx, inv)
+}
+
+// lookupAll returns every live policy with the given name, with its tags, for reports
+// that list policies rather than write them.
+func (inv *Inventory) lookupAll(ctx context.Context, name string) ([]*livePolicy, error) {
+	inv.mu.Lock()
+	entries := inv.shared[name]
+	if entries == nil && inv.byName[name] != nil {
+		entries = []*inventoryEntry{inv.byName[name]}
+	}
+	inv.mu.Unlock()
+	lives := make([]*livePolicy, 0, len(entries))
+	for _, e := range entries {
+		live, err := e.load(ctx, inv)
+		if err != nil {
+			return nil, err
+		}
+		lives = append(lives, live)
+	}
+	return lives, nil
+}
+
+// Prefetch loads the details of the named policies concurrently. Names without a live
+// policy are ignored.
+func (inv *Inventory) Prefetch(ctx context.Context, names []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan string)
+	errs := make(chan error, inv.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < inv.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				if _, err := inv.lookupAll(ctx, name); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, name := range names {
+		select {
+		case work <- name:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	if err, ok := <-errs; ok {
+		return err
+	}
+	return ctx.Err()
+}
+
+// load reads the policy and its tags on first use.
+func (e *inventoryEntry) load(ctx context.Context, inv *Inventory) (*livePolicy, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.live != nil {
+		return e.live, nil
+	}
+
+	name := aws.ToString(e.summary.PolicyName)
+	if err := inv.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	gp, err := inv.client.GetPolicy(ctx, &fms.GetPolicyInput{PolicyId: e.summary.PolicyId})
+	if err != nil {
+		return nil, fmt.Errorf("get policy %s: %w", name, err)
+	}
+	if gp.Policy == nil {
+		return nil, fmt.Errorf("get policy %s: empty response", name)
+	}
+	live := &livePolicy{Policy: *gp.Policy, ARN: aws.ToString(e.summary.PolicyArn)}
+	if live.Policy.PolicyId == nil {
+		live.Policy.PolicyId = e.summary.PolicyId
+	}
+	if gp.PolicyArn != nil {
+		live.ARN = *gp.PolicyArn
+	}
+
+	if err := inv.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	live.Tags, err = fetchTags(ctx, inv.client, live.ARN)
+	if err != nil {
+		return nil, err
+	}
+	e.live = live
+	return live, nil
+}
+
+// record stores a policy this run just wrote, merging tags into the known ones and
+// dropping the untagged keys.
+func (inv *Inventory) record(p fmstypes.Policy, arn string, tags []fmstypes.Tag, untagged []string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	id := aws.ToString(p.PolicyId)
+	entry := inv.byID[id]
+	if entry == nil {
+		entry = &inventoryEntry{summary: fmstypes.PolicySummary{PolicyId: p.PolicyId, PolicyName: p.PolicyName, PolicyArn: aws.String(arn)}}
+		inv.byID[id] = entry
+		inv.byName[aws.ToString(p.PolicyName)] = entry
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	merged := map[string]string{}
+	if entry.live != nil {
+		for k, v := range entry.live.Tags {
+			merged[k] = v
+		}
+	}
+	for _, t := range tags {
+		merged[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	for _, k := range untagged {
+		delete(merged, k)
+	}
+	entry.live = &livePolicy{Policy: p, ARN: arn, Tags: merged}
+}
+
+// invalidate forgets the details read of a policy, which another writer changed, so the
+// next lookup reads them again.
+func (inv *Inventory) invalidate(id string) {
+	inv.mu.Lock()
+	entry := inv.byID[id]
+	inv.mu.Unlock()
+	if entry == nil {
+		return
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.live = nil
+}
+
+// remove drops a policy this run just deleted.
+func (inv *Inventory) remove(id string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	entry := inv.byID[id]
+	if entry == nil {
+		return
+	}
+	delete(inv.byID, id)
+	name := aws.ToString(entry.summary.PolicyName)
+	if shared := inv.shared[name]; shared != nil {
+		shared = slices.DeleteFunc(slices.Clone(shared), func(e *inventoryEntry) bool { return e == entry })
+		if len(shared) > 1 {
+			inv.shared[name] = shared
+		} else {
+			delete(inv.shared, name)
+		}
+		if inv.byName[name] == entry {
+			inv.byName[name] = shared[0]
+		}
+		return
+	}
+	if inv.byName[name] == entry {
+		delete(inv.byName, name)
+	}
+}
+
+// resourceSetID returns the ID of the resource set with the given name, or "" if none
+// exists. The first call lists the resource sets.
+func (inv *Inventory) resourceSetID(ctx context.Context, name string) (string, error) {
+	inv.setsMu.Lock()
+	defer inv.setsMu.Unlock()
+	if inv.sets == nil {
+		sets := map[string]string{}
+		var next *string
+		for {
+			if err := inv.limiter.wait(ctx); err != nil {
+				return "", err
+			}
+			out, err := inv.client.ListResourceSets(ctx, &fms.ListResourceSetsInput{NextToken: next})
+			if err != nil {
+				return "", fmt.Errorf("list resource sets: %w", err)
+			}
+			for _, rs := range out.ResourceSets {
+				setName := aws.ToString(rs.Name)
+				if rs.Id == nil {
+					return "", fmt.Errorf("resource set %s found without id", setName)
+				}
+				if _, ok := sets[setName]; !ok {
+					sets[setName] = *rs.Id
+				}
+			}
+			if out.NextToken == nil || *out.NextToken == "" {
+				break
+			}
+			next = out.NextToken
+		}
+		inv.sets = sets
+	}
+	return inv.sets[name], nil
+}
+
+// recordResourceSet stores a resource set this run just created. Sets created before the
+// sets were listed are found by the listing.
+func (inv *Inventory) recordResourceSet(name, id string) {
+	inv.setsMu.Lock()
+	defer inv.setsMu.Unlock()
+	if inv.sets != nil {
+		inv.sets[name] = id
+	}
+}
+
+// removeResourceSet drops a resource set this run just deleted.
+func (inv *Inventory) removeResourceSet(name string) {
+	inv.setsMu.Lock()
+	defer inv.setsMu.Unlock()
+	delete(inv.sets, name)
+}
+
+// limiter spaces requests evenly at a fixed rate. A nil limiter does not limit.
+type limiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newLimiter(perSecond float64) *limiter {
+	if perSecond < 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next request may be sent or ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
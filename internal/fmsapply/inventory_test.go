@@ -0,0 +1,141 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// seedRendered stores n owned policies and returns rendered policies for all of them.
+func seedRendered(client *fmsfake.FMS, n int) map[string]policy.RenderedPolicy {
+	rendered := map[string]policy.RenderedPolicy{}
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("auto-alb-%04d", i)
+		names = append(names, name)
+		rendered[name] = policy.RenderedPolicy{
+			Name:               name,
+			ResourceType:       "AWS::ElasticLoadBalancingV2::LoadBalancer",
+			ManagedServiceData: `{"type":"WAFV2"}`,
+		}
+	}
+	seedPolicies(client, names...)
+	return rendered
+}
+
+func TestInventory_ReadsEachPolicyOnce(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 20)
+	seedPolicies(client, "auto-alb-orphan")
+
+	prune := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	plan, err := NewPlan(ctx, client, inventory(t, client), rendered, "hash", Options{}, prune, util.NewLogger())
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Counts()[ActionDelete] != 1 {
+		t.Fatalf("expected the orphan to be planned for deletion, got %v", plan.Counts())
+	}
+	if client.Calls(fmsfake.OpListPolicies) != 1 || client.Calls(fmsfake.OpGetPolicy) != 21 {
+		t.Fatalf("expected 1 ListPolicies and 21 GetPolicy calls, got %d and %d", client.Calls(fmsfake.OpListPolicies), client.Calls(fmsfake.OpGetPolicy))
+	}
+}
+
+func TestInventory_TracksWrites(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+	inv := inventory(t, client)
+
+	for i, want := range []Action{ActionCreate, ActionNoOp} {
+		change, err := UpsertPolicy(ctx, client, inv, ownedTestPolicy(), Options{}, logger)
+		if err != nil {
+			t.Fatalf("upsert %d: %v", i, err)
+		}
+		if change.Action != want {
+			t.Fatalf("upsert %d: expected %s, got %s", i, want, change)
+		}
+	}
+
+	prune := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	if _, err := Prune(ctx, client, inv, nil, prune, Options{}, logger); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(client.PolicyIDs()) != 0 || len(inv.Names()) != 0 {
+		t.Fatalf("policy written this run was not pruned: %v", inv.Names())
+	}
+	if client.Calls(fmsfake.OpListPolicies) != 1 || client.Calls(fmsfake.OpGetPolicy) != 0 {
+		t.Fatalf("expected a single ListPolicies and no GetPolicy, got %d and %d", client.Calls(fmsfake.OpListPolicies), client.Calls(fmsfake.OpGetPolicy))
+	}
+}
+
+func TestInventory_RefusesSharedNames(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 2)
+	seedPolicies(client, "auto-alb-0001", "auto-alb-orphan", "auto-alb-orphan")
+	inv := inventory(t, client)
+
+	// Only the policy with a unique name is written.
+	results, err := UpsertPolicies(ctx, client, inv, rendered, Options{}, fastRetries, util.NewLogger())
+	if !errors.Is(err, ErrDuplicatePolicyName) || results[0].Err != nil || !errors.Is(results[1].Err, ErrDuplicatePolicyName) || client.Calls(fmsfake.OpPutPolicy) != 1 {
+		t.Fatalf("expected ErrDuplicatePolicyName for auto-alb-0001 only, got %v after %d writes", err, client.Calls(fmsfake.OpPutPolicy))
+	}
+
+	prune := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	if _, err := FindOrphans(ctx, inv, rendered, prune, false, util.NewLogger()); !errors.Is(err, ErrDuplicatePolicyName) {
+		t.Fatalf("expected the shared orphan name to stop the prune, got %v", err)
+	}
+
+	// Reports list every policy of a shared name.
+	owned, err := OwnedPolicies(ctx, inv)
+	if err != nil {
+		t.Fatalf("owned policies: %v", err)
+	}
+	if len(owned) != 5 {
+		t.Fatalf("expected all 5 owned policies, got %+v", owned)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(200)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("5 requests at 200/s took only %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newLimiter(1)
+	_ = l.wait(ctx) // the first request is never delayed
+	if err := l.wait(ctx); err == nil {
+		t.Fatalf("expected a cancelled wait to fail")
+	}
+}
+
+func BenchmarkNewPlan_500Policies(b *testing.B) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := seedRendered(client, 500)
+	prune := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 10}
+	logger := util.NewLogger()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewPlan(ctx, client, inventory(b, client), rendered, "hash", Options{}, prune, logger); err != nil {
+			b.Fatalf("plan: %v", err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package fmsapply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+)
+
+// Ownership tags written to every policy this tool creates or updates.
+const (
+	// TagManagedBy marks the policy as owned by this tool; its value is ManagedByValue.
+	TagManagedBy = "ManagedBy"
+	// TagConfigHash holds the hash of the config the policy was last written from.
+	TagConfigHash = "ConfigHash"
+	// TagSource identifies what the policy was rendered from (RenderedPolicy.Source).
+	TagSource = "Source"
+	// TagPolicyHash fingerprints the policy as written, so edits made outside the tool
+	// can be detected.
+	TagPolicyHash = "PolicyHash"
+	// TagRolloutStarted records, in RFC 3339, when a staged policy was created in audit
+	// mode; the soak period counts from it.
+	TagRolloutStarted = "RolloutStartedAt"
+	// TagCanary holds the state of a canary update in progress; it is empty otherwise.
+	TagCanary = "Canary"
+
+	ManagedByValue = "aws-fms-secpolicy-learning"
+
+	maxTagValueLength = 256
+)
+
+// ErrUnmanagedPolicy is returned when a policy without the ownership tag would be
+// updated and adoption was not requested.
+var ErrUnmanagedPolicy = errors.New("policy is not managed by this tool")
+
+// Options carries the per-run settings for writing policies.
+type Options struct {
+	// OUID scopes policies to an organizational unit through the FMS IncludeMap.
+	OUID string
+	// DryRun only logs the planned changes.
+	DryRun bool
+	// Adopt allows updating and deleting policies that lack the ownership tag; they are
+	// tagged as owned on the next write.
+	Adopt bool
+	// ConfigHash is written to the ConfigHash tag; see HashConfig.
+	ConfigHash string
+	// Now is the time staged rollouts are evaluated at. Zero means the current time.
+	Now time.Time
+	// History receives the live version of every policy before it is updated. Nil keeps
+	// no history.
+	History history.Store
+}
+
+func (o Options) now() time.Time {
+	if o.Now.IsZero() {
+		return time.Now().UTC()
+	}
+	return o.Now
+}
+
+// livePolicy is a policy read from FMS together with its ARN and tags.
+type livePolicy struct {
+	Policy fmstypes.Policy
+	ARN    string
+	Tags   map[string]string
+}
+
+func (l *livePolicy) owned() bool {
+	return l.Tags[TagManagedBy] == ManagedByValue
+}
+
+// drifted reports whether an owned policy was changed since this tool last wrote it.
+func (l *livePolicy) drifted() bool {
+	want := l.Tags[TagPolicyHash]
+	if !l.owned() || want == "" {
+		return false
+	}
+	got, err := fingerprint(&l.Policy)
+	return err != nil || got != want
+}
+
+// ownershipTags returns the tags for a policy about to be written as desired, including
+// the rollout start of a staged policy and the canary state, and the tag keys to remove:
+// the Canary tag of a finished canary.
+func ownershipTags(p policy.RenderedPolicy, desired *fmstypes.Policy, configHash string, rollout *RolloutStatus, canary *CanaryStatus) ([]fmstypes.Tag, []string, error) {
+	hash, err := fingerprint(desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags := map[string]string{
+		TagManagedBy:  ManagedByValue,
+		TagConfigHash: configHash,
+		TagSource:     p.Source,
+		TagPolicyHash: hash,
+	}
+	if rollout != nil && rollout.StartedAt != nil {
+		tags[TagRolloutStarted] = rollout.StartedAt.UTC().Format(time.RFC3339)
+	}
+	keys := make([]string, 0, len(tags)+1)
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	var untag []string
+	if canary != nil {
+		if tags[TagCanary] = canary.tagValue(); tags[TagCanary] != "" {
+			keys = append(keys, TagCanary)
+		} else {
+			untag = append(untag, TagCanary)
+		}
+	}
+	sort.Strings(keys)
+	out := make([]fmstypes.Tag, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, fmstypes.Tag{Key: aws.String(k), Value: aws.String(tagValue(tags[k]))})
+	}
+	return out, untag, nil
+}
+
+// tagValue replaces characters FMS does not accept in tag values and truncates to the
+// tag value limit.
+func tagValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" _.:/=+-@", r):
+			return r
+		}
+		return '_'
+	}, v)
+	if len(v) > maxTagValueLength {
+		v = v[:maxTagValueLength]
+	}
+	return v
+}
+
+// fetchTags reads the tags of the policy with the given ARN.
+func fetchTags(ctx context.Context, client API, arn string) (map[string]string, error) {
+	out, err := client.ListTagsForResource(ctx, &fms.ListTagsForResourceInput{ResourceArn: aws.String(arn)})
+	if err != nil {
+		return nil, fmt.Errorf("list tags for %s: %w", arn, err)
+	}
+	tags := make(map[string]string, len(out.TagList))
+	for _, t := range out.TagList {
+		tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	return tags, nil
+}
+
+// fingerprint hashes the fields this tool manages, normalized the same way Diff compares
+// them, so a policy hashes identically before it is written and after it is read back.
+func fingerprint(p *fmstypes.Policy) (string, error) {
+	var doc any
+	if err := decodeServiceData(serviceData(p), &doc); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal([]any{
+		string(serviceData(p).Type),
+		aws.ToString(p.PolicyDescription),
+		strconv.FormatBool(p.RemediationEnabled),
+		aws.ToString(p.ResourceType),
+		formatList(p.ResourceTypeList),
+		formatTags(p.ResourceTags),
+		strconv.FormatBool(p.ExcludeResourceTags),
+		formatMap(p.IncludeMap),
+		formatMap(p.ExcludeMap),
+		formatList(p.ResourceSetIds),
+		stripZeroJSON(doc),
+	})
+	if err != nil {
+		return "", fmt.Errorf("encode policy fingerprint: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// stripZeroJSON drops object members that isZeroJSON treats as absent.
+func stripZeroJSON(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, e := range t {
+			if !isZeroJSON(e) {
+				out[k] = stripZeroJSON(e)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, e := range t {
+			out[i] = stripZeroJSON(e)
+		}
+		return out
+	}
+	return v
+}
+
+// Drift describes a policy whose live state no longer matches what the tool wrote.
+type Drift struct {
+	Policy   string
+	PolicyID string
+	Source   string
+}
+
+// DetectDrift lists the owned policies in inv that were edited outside the tool since it
+// last wrote them, sorted by name.
+func DetectDrift(ctx context.Context, inv *Inventory) ([]Drift, error) {
+	names := inv.Names()
+	if err := inv.Prefetch(ctx, names); err != nil {
+		return nil, err
+	}
+	var drifts []Drift
+	for _, name := range names {
+		lives, err := inv.lookupAll(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, live := range lives {
+			if live.drifted() {
+				drifts = append(drifts, Drift{Policy: name, PolicyID: aws.ToString(live.Policy.PolicyId), Source: live.Tags[TagSource]})
+			}
+		}
+	}
+	return drifts, nil
+}
+
+// OwnedPolicy identifies a live policy the tool owns.
+type OwnedPolicy struct {
+	Name     string
+	PolicyID string
+	// Type is the security service type, e.g. WAFV2 or NETWORK_FIREWALL.
+	Type string
+}
+
+// OwnedPolicies lists the policies in inv that the tool owns, sorted by name.
+func OwnedPolicies(ctx context.Context, inv *Inventory) ([]OwnedPolicy, error) {
+	names := inv.Names()
+	if err := inv.Prefetch(ctx, names); err != nil {
+		return nil, err
+	}
+	var owned []OwnedPolicy
+	for _, name := range names {
+		lives, err := inv.lookupAll(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, live := range lives {
+			if !live.owned() {
+				continue
+			}
+			owned = append(owned, OwnedPolicy{
+				Name:     name,
+				PolicyID: aws.ToString(live.Policy.PolicyId),
+				Type:     string(serviceData(&live.Policy).Type),
+			})
+		}
+	}
+	return owned, nil
+}
@@ -0,0 +1,168 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func ownedTestPolicy() policy.RenderedPolicy {
+	return policy.RenderedPolicy{
+		Name:               "auto-alb-a",
+		ResourceType:       "AWS::ElasticLoadBalancingV2::LoadBalancer",
+		ManagedServiceData: `{"type":"WAFV2","defaultAction":{"type":"ALLOW"}}`,
+		Source:             "alb arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/a/1",
+	}
+}
+
+func TestUpsertPolicy_TagsOwnership(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), Options{ConfigHash: "cfg1"}, util.NewLogger()); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	id, _ := client.PolicyID("auto-alb-a")
+	tags := client.Tags(id)
+	if tags[TagManagedBy] != ManagedByValue || tags[TagConfigHash] != "cfg1" || tags[TagPolicyHash] == "" {
+		t.Fatalf("missing ownership tags: %v", tags)
+	}
+	if tags[TagSource] != ownedTestPolicy().Source {
+		t.Fatalf("unexpected source tag %q", tags[TagSource])
+	}
+
+	p := ownedTestPolicy()
+	p.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), p, Options{ConfigHash: "cfg2"}, util.NewLogger()); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if tags = client.Tags(id); tags[TagConfigHash] != "cfg2" {
+		t.Fatalf("update did not retag the policy: %v", tags)
+	}
+}
+
+func TestUpsertPolicy_RefusesUnmanagedPolicies(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+	ids := seedPolicies(client, "hand-made")
+	// A hand-made policy that happens to share the rendered name.
+	client.EditPolicy(ids["hand-made"], func(p *fmstypes.Policy) { p.PolicyName = aws.String("auto-alb-a") })
+
+	_, err := UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), Options{}, logger)
+	if !errors.Is(err, ErrUnmanagedPolicy) {
+		t.Fatalf("expected ErrUnmanagedPolicy, got %v", err)
+	}
+	if client.Calls(fmsfake.OpPutPolicy) != 0 {
+		t.Fatalf("unmanaged policy was overwritten")
+	}
+
+	change, err := UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), Options{Adopt: true}, logger)
+	if err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if tags := client.Tags(ids["hand-made"]); !change.Adopt || tags[TagManagedBy] != ManagedByValue {
+		t.Fatalf("policy not adopted: %s %v", change, tags)
+	}
+
+	// Once adopted, it is owned and unchanged.
+	change, err = UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), Options{}, logger)
+	if err != nil || change.Action != ActionNoOp {
+		t.Fatalf("expected a no-op for the adopted policy, got %s %v", change, err)
+	}
+}
+
+func TestPrune_AdoptsUntaggedOrphansOnlyWhenAsked(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+	ids := seedPolicies(client, "hand-made")
+	client.EditPolicy(ids["hand-made"], func(p *fmstypes.Policy) { p.PolicyName = aws.String("auto-alb-old") })
+
+	opts := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	if orphans, err := Prune(ctx, client, inventory(t, client), nil, opts, Options{}, logger); err != nil || len(orphans) != 0 {
+		t.Fatalf("untagged policy treated as orphan: %v %v", orphans, err)
+	}
+	if _, err := Prune(ctx, client, inventory(t, client), nil, opts, Options{Adopt: true}, logger); err != nil {
+		t.Fatalf("prune with adopt: %v", err)
+	}
+	if len(client.PolicyIDs()) != 0 {
+		t.Fatalf("adopted orphan not deleted")
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	seedPolicies(client, "hand-made")
+
+	id, _ := client.PolicyID("auto-alb-a")
+
+	// FMS echoing zero-valued fields back is not drift.
+	client.EditPolicy(id, func(p *fmstypes.Policy) {
+		p.SecurityServicePolicyData = &fmstypes.SecurityServicePolicyData{
+			Type:               fmstypes.SecurityServiceTypeWafv2,
+			ManagedServiceData: aws.String(`{"defaultAction":{"type":"ALLOW"},"type":"WAFV2","overrideCustomerWebACLAssociation":false}`),
+		}
+	})
+	if drifts, err := DetectDrift(ctx, inventory(t, client)); err != nil || len(drifts) != 0 {
+		t.Fatalf("unexpected drift: %v %v", drifts, err)
+	}
+
+	// An edit in the console is.
+	client.EditPolicy(id, func(p *fmstypes.Policy) { p.RemediationEnabled = false })
+	drifts, err := DetectDrift(ctx, inventory(t, client))
+	if err != nil {
+		t.Fatalf("detect drift: %v", err)
+	}
+	if len(drifts) != 1 || drifts[0].Policy != "auto-alb-a" || drifts[0].Source != ownedTestPolicy().Source {
+		t.Fatalf("unexpected drift report: %+v", drifts)
+	}
+
+	change, err := UpsertPolicy(ctx, client, inventory(t, client), ownedTestPolicy(), Options{DryRun: true}, logger)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if !change.Drift || change.Action != ActionUpdate {
+		t.Fatalf("expected a drifted update, got %s", change)
+	}
+}
+
+func TestOwnedPolicies(t *testing.T) {
+	client := fmsfake.New()
+	ids := seedPolicies(client, "auto-alb-b", "hand-made", "auto-alb-a")
+	client.EditPolicy(ids["auto-alb-a"], func(p *fmstypes.Policy) {
+		p.SecurityServicePolicyData = &fmstypes.SecurityServicePolicyData{Type: fmstypes.SecurityServiceTypeWafv2}
+	})
+
+	owned, err := OwnedPolicies(context.Background(), inventory(t, client))
+	if err != nil {
+		t.Fatalf("owned policies: %v", err)
+	}
+	want := []OwnedPolicy{
+		{Name: "auto-alb-a", PolicyID: ids["auto-alb-a"], Type: "WAFV2"},
+		{Name: "auto-alb-b", PolicyID: ids["auto-alb-b"]},
+	}
+	if !reflect.DeepEqual(owned, want) {
+		t.Fatalf("unexpected owned policies:\n got %+v\nwant %+v", owned, want)
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	if got := tagValue("alb primary=edge (3 resource(s))"); got != "alb primary=edge _3 resource_s__" {
+		t.Fatalf("unexpected sanitized value %q", got)
+	}
+}
@@ -0,0 +1,272 @@
+package fmsapply
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+)
+
+// Action classifies what applying a rendered policy does to FMS.
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionNoOp   Action = "no-op"
+	ActionDelete Action = "delete"
+)
+
+// FieldChange is one difference between the live and the desired policy. Old is empty
+// for added fields and New is empty for removed ones.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// Change is the planned action for one policy.
+type Change struct {
+	Action Action        `json:"action"`
+	Policy string        `json:"policy"`
+	Fields []FieldChange `json:"fields,omitempty"`
+	// Adopt is set when the live policy lacks the ownership tag and is taken over.
+	Adopt bool `json:"adopt,omitempty"`
+	// Drift is set when the live policy was edited outside the tool since it was written.
+	Drift bool `json:"drift,omitempty"`
+	// Rollout is the rollout stage of a staged policy; nil for immediate rollouts.
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+	// Canary is the canary state the write leaves; nil outside canary updates.
+	Canary *CanaryStatus `json:"canary,omitempty"`
+	// ResourceSet is the plan for the policy's resource set; nil without one.
+	ResourceSet *ResourceSetChange `json:"resource_set,omitempty"`
+}
+
+// writesPolicy reports whether the change needs PutPolicy, rather than only changes to
+// the policy's resource set.
+func (c Change) writesPolicy() bool {
+	if c.Action == ActionCreate || c.Adopt {
+		return true
+	}
+	for _, f := range c.Fields {
+		if f.Field != resourceSetField && !strings.HasPrefix(f.Field, resourceSetField+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the change as a readable, field-level diff.
+func (c Change) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", c.Action, c.Policy)
+	if c.Adopt {
+		b.WriteString(" (adopting unmanaged policy)")
+	}
+	if c.Drift {
+		b.WriteString(" (edited outside the tool)")
+	}
+	if c.Rollout != nil {
+		fmt.Fprintf(&b, " [rollout %s]", c.Rollout)
+	}
+	if c.Canary != nil {
+		fmt.Fprintf(&b, " [canary %s]", c.Canary)
+	}
+	for _, f := range c.Fields {
+		switch {
+		case f.Old == "":
+			fmt.Fprintf(&b, "\n  + %s: %s", f.Field, f.New)
+		case f.New == "":
+			fmt.Fprintf(&b, "\n  - %s: %s", f.Field, f.Old)
+		default:
+			fmt.Fprintf(&b, "\n  ~ %s: %s -> %s", f.Field, f.Old, f.New)
+		}
+	}
+	return b.String()
+}
+
+// Diff compares the live policy with the desired one. A nil live policy plans a create.
+// ManagedServiceData is compared after JSON normalization, so key order, whitespace and
+// fields FMS fills in with zero values do not count as changes.
+func Diff(live, desired *fmstypes.Policy) (Change, error) {
+	change := Change{Policy: aws.ToString(desired.PolicyName)}
+	if live == nil {
+		change.Action = ActionCreate
+		return change, nil
+	}
+
+	for _, f := range []struct {
+		name     string
+		old, new string
+	}{
+		{"policy_type", string(serviceData(live).Type), string(serviceData(desired).Type)},
+		{"description", aws.ToString(live.PolicyDescription), aws.ToString(desired.PolicyDescription)},
+		{"remediation_enabled", strconv.FormatBool(live.RemediationEnabled), strconv.FormatBool(desired.RemediationEnabled)},
+		{"resource_type", aws.ToString(live.ResourceType), aws.ToString(desired.ResourceType)},
+		{"resource_type_list", formatList(live.ResourceTypeList), formatList(desired.ResourceTypeList)},
+		{"resource_tags", formatTags(live.ResourceTags), formatTags(desired.ResourceTags)},
+		{"exclude_resource_tags", strconv.FormatBool(live.ExcludeResourceTags), strconv.FormatBool(desired.ExcludeResourceTags)},
+		{"include_map", formatMap(live.IncludeMap), formatMap(desired.IncludeMap)},
+		{"exclude_map", formatMap(live.ExcludeMap), formatMap(desired.ExcludeMap)},
+		{"resource_set_ids", formatList(live.ResourceSetIds), formatList(desired.ResourceSetIds)},
+	} {
+		if f.old != f.new {
+			change.Fields = append(change.Fields, FieldChange{Field: f.name, Old: f.old, New: f.new})
+		}
+	}
+
+	var liveDoc, desiredDoc any
+	if err := decodeServiceData(serviceData(live), &liveDoc); err != nil {
+		return Change{}, fmt.Errorf("live policy %s: %w", change.Policy, err)
+	}
+	if err := decodeServiceData(serviceData(desired), &desiredDoc); err != nil {
+		return Change{}, fmt.Errorf("desired policy %s: %w", change.Policy, err)
+	}
+	diffJSON("managed_service_data", liveDoc, desiredDoc, &change.Fields)
+
+	change.Action = ActionNoOp
+	if len(change.Fields) > 0 {
+		change.Action = ActionUpdate
+	}
+	return change, nil
+}
+
+func serviceData(p *fmstypes.Policy) fmstypes.SecurityServicePolicyData {
+	if p.SecurityServicePolicyData == nil {
+		return fmstypes.SecurityServicePolicyData{}
+	}
+	return *p.SecurityServicePolicyData
+}
+
+func decodeServiceData(d fmstypes.SecurityServicePolicyData, out *any) error {
+	if d.ManagedServiceData == nil {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(*d.ManagedServiceData), out); err != nil {
+		return fmt.Errorf("decode managed_service_data: %w", err)
+	}
+	return nil
+}
+
+// diffJSON appends the differences between two decoded JSON documents, one entry per
+// leaf, with paths such as managed_service_data.preProcessRuleGroups[1].priority.
+func diffJSON(path string, old, new any, out *[]FieldChange) {
+	if isZeroJSON(old) && isZeroJSON(new) {
+		return
+	}
+
+	switch o := old.(type) {
+	case map[string]any:
+		if n, ok := new.(map[string]any); ok {
+			keys := make(map[string]bool, len(o)+len(n))
+			for k := range o {
+				keys[k] = true
+			}
+			for k := range n {
+				keys[k] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				diffJSON(path+"."+k, o[k], n[k], out)
+			}
+			return
+		}
+	case []any:
+		if n, ok := new.([]any); ok {
+			for i := 0; i < len(o) || i < len(n); i++ {
+				var ov, nv any
+				if i < len(o) {
+					ov = o[i]
+				}
+				if i < len(n) {
+					nv = n[i]
+				}
+				diffJSON(fmt.Sprintf("%s[%d]", path, i), ov, nv, out)
+			}
+			return
+		}
+	}
+
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+	change := FieldChange{Field: path}
+	if !isZeroJSON(old) {
+		change.Old = compactJSON(old)
+	}
+	if !isZeroJSON(new) {
+		change.New = compactJSON(new)
+	}
+	*out = append(*out, change)
+}
+
+// isZeroJSON reports whether v is absent or the zero value of its JSON type, which FMS
+// treats the same as an omitted field.
+func isZeroJSON(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !t
+	case string:
+		return t == ""
+	case float64:
+		return t == 0
+	case []any:
+		return len(t) == 0
+	case map[string]any:
+		for _, e := range t {
+			if !isZeroJSON(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func compactJSON(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func formatList(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func formatTags(tags []fmstypes.ResourceTag) string {
+	parts := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t.Value == nil {
+			parts = append(parts, aws.ToString(t.Key))
+			continue
+		}
+		parts = append(parts, aws.ToString(t.Key)+"="+aws.ToString(t.Value))
+	}
+	return formatList(parts)
+}
+
+func formatMap(m map[string][]string) string {
+	parts := make([]string, 0, len(m))
+	for k, v := range m {
+		if len(v) > 0 {
+			parts = append(parts, k+"="+formatList(v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
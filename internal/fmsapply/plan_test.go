@@ -0,0 +1,145 @@
+package fmsapply
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func wafPolicy(msd string) *fmstypes.Policy {
+	return &fmstypes.Policy{
+		PolicyName:         aws.String("auto-alb-a"),
+		RemediationEnabled: true,
+		ResourceType:       aws.String("AWS::ElasticLoadBalancingV2::LoadBalancer"),
+		ResourceTypeList:   []string{"AWS::ElasticLoadBalancingV2::LoadBalancer"},
+		SecurityServicePolicyData: &fmstypes.SecurityServicePolicyData{
+			Type:               fmstypes.SecurityServiceTypeWafv2,
+			ManagedServiceData: aws.String(msd),
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	const desiredMSD = `{"type":"WAFV2","defaultAction":{"type":"ALLOW"},"preProcessRuleGroups":[{"ruleGroupArn":"arn:a","priority":1}]}`
+
+	tests := []struct {
+		name   string
+		live   *fmstypes.Policy
+		want   Action
+		fields []string
+	}{
+		{
+			name: "missing policy is created",
+			want: ActionCreate,
+		},
+		{
+			name: "key order, whitespace and zero-valued fields are ignored",
+			live: wafPolicy(`{
+				"preProcessRuleGroups": [{"priority": 1, "ruleGroupArn": "arn:a", "excludeRules": []}],
+				"defaultAction": {"type": "ALLOW"},
+				"type": "WAFV2",
+				"overrideCustomerWebACLAssociation": false,
+				"loggingConfiguration": null
+			}`),
+			want: ActionNoOp,
+		},
+		{
+			name: "document changes are reported per field",
+			live: wafPolicy(`{"type":"WAFV2","defaultAction":{"type":"BLOCK"},"preProcessRuleGroups":[{"ruleGroupArn":"arn:a","priority":1},{"ruleGroupArn":"arn:b","priority":2}]}`),
+			want: ActionUpdate,
+			fields: []string{
+				"managed_service_data.defaultAction.type",
+				"managed_service_data.preProcessRuleGroups[1]",
+			},
+		},
+		{
+			name: "scope and remediation changes are reported",
+			live: func() *fmstypes.Policy {
+				p := wafPolicy(desiredMSD)
+				p.RemediationEnabled = false
+				p.IncludeMap = map[string][]string{"ORG_UNIT": {"ou-old"}}
+				p.ResourceTags = []fmstypes.ResourceTag{{Key: aws.String("team")}}
+				return p
+			}(),
+			want:   ActionUpdate,
+			fields: []string{"remediation_enabled", "resource_tags", "include_map"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			change, err := Diff(tc.live, wafPolicy(desiredMSD))
+			if err != nil {
+				t.Fatalf("diff: %v", err)
+			}
+			if change.Action != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, change)
+			}
+			var fields []string
+			for _, f := range change.Fields {
+				fields = append(fields, f.Field)
+			}
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Fatalf("unexpected fields:\n got %v\nwant %v", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	c := Change{Action: ActionUpdate, Policy: "auto-alb-a", Fields: []FieldChange{
+		{Field: "managed_service_data.defaultAction.type", Old: `"BLOCK"`, New: `"ALLOW"`},
+		{Field: "managed_service_data.preProcessRuleGroups[1]", Old: `{"priority":2}`},
+	}}
+	want := "update auto-alb-a\n" +
+		"  ~ managed_service_data.defaultAction.type: \"BLOCK\" -> \"ALLOW\"\n" +
+		"  - managed_service_data.preProcessRuleGroups[1]: {\"priority\":2}"
+	if got := c.String(); got != want {
+		t.Fatalf("unexpected diff:\n%s", got)
+	}
+}
+
+func TestUpsertPolicy_SkipsUnchangedPolicies(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	logger := util.NewLogger()
+
+	p := policy.RenderedPolicy{
+		Name:               "auto-alb-a",
+		ResourceType:       "AWS::ElasticLoadBalancingV2::LoadBalancer",
+		ManagedServiceData: `{"type":"WAFV2","defaultAction":{"type":"ALLOW"}}`,
+	}
+
+	for i, want := range []Action{ActionCreate, ActionNoOp} {
+		change, err := UpsertPolicy(ctx, client, inventory(t, client), p, Options{OUID: "ou-1"}, logger)
+		if err != nil {
+			t.Fatalf("upsert %d: %v", i, err)
+		}
+		if change.Action != want {
+			t.Fatalf("upsert %d: expected %s, got %s", i, want, change)
+		}
+	}
+	if client.Calls(fmsfake.OpPutPolicy) != 1 {
+		t.Fatalf("expected PutPolicy only for the create, got %d calls", client.Calls(fmsfake.OpPutPolicy))
+	}
+
+	p.ManagedServiceData = `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	change, err := UpsertPolicy(ctx, client, inventory(t, client), p, Options{OUID: "ou-1", DryRun: true}, logger)
+	if err != nil {
+		t.Fatalf("dry-run upsert: %v", err)
+	}
+	if change.Action != ActionUpdate || !strings.Contains(change.String(), "defaultAction.type") {
+		t.Fatalf("expected an update of defaultAction.type, got %s", change)
+	}
+	if client.Calls(fmsfake.OpPutPolicy) != 1 {
+		t.Fatalf("dry-run called PutPolicy")
+	}
+}
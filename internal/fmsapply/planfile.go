@@ -0,0 +1,256 @@
+package fmsapply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/history"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// PlanVersion is the format version written to saved plans.
+const PlanVersion = 1
+
+// ErrStalePlan is returned by ApplyPlan when the config, the inputs or a live policy
+// changed after the plan was made.
+var ErrStalePlan = errors.New("plan is stale")
+
+// Plan is a saved set of policy changes that ApplyPlan executes as recorded.
+type Plan struct {
+	Version    int             `json:"version"`
+	CreatedAt  time.Time       `json:"created_at"`
+	InputHash  string          `json:"input_hash"`
+	ConfigHash string          `json:"config_hash"`
+	Policies   []PlannedPolicy `json:"policies"`
+}
+
+// PlannedPolicy is one rendered policy with the live state it was diffed against.
+// PolicyID and UpdateToken are empty for creates; deletes only carry the policy name.
+type PlannedPolicy struct {
+	Policy                   policy.RenderedPolicy `json:"policy"`
+	OUID                     string                `json:"ou_id,omitempty"`
+	PolicyID                 string                `json:"policy_id,omitempty"`
+	PolicyARN                string                `json:"policy_arn,omitempty"`
+	UpdateToken              string                `json:"update_token,omitempty"`
+	DeleteAllPolicyResources bool                  `json:"delete_all_policy_resources,omitempty"`
+	Change                   Change                `json:"change"`
+}
+
+// HashConfig fingerprints the effective config for the ConfigHash ownership tag.
+func HashConfig(cfg *config.PolicyConfig) (string, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("encode config: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// inputResource is the part of a discovered resource that decides which policy renders it
+// and how that policy is named and scoped.
+type inputResource struct {
+	ID   string                 `json:"id"`
+	ARN  string                 `json:"arn"`
+	Type discovery.ResourceType `json:"type"`
+	Tags map[string]string      `json:"tags,omitempty"`
+}
+
+// HashInputs fingerprints the effective config and the discovered resources, so a plan
+// can only be applied against the inputs it was made from. Of each resource only its ID,
+// ARN, type and rule-set selector tags count: attributes and other tags change without
+// changing the plan, so a plan made from a resources file matches what the Lambda
+// discovers.
+func HashInputs(cfg *config.PolicyConfig, resources []discovery.Resource) (string, error) {
+	inputs := make([]inputResource, 0, len(resources))
+	for _, r := range resources {
+		in := inputResource{ID: r.ID, ARN: r.ARN, Type: r.Type}
+		for _, key := range []string{cfg.TagKeys.Primary, cfg.TagKeys.Secondary} {
+			if v, ok := r.Tags[key]; ok {
+				if in.Tags == nil {
+					in.Tags = map[string]string{}
+				}
+				in.Tags[key] = v
+			}
+		}
+		inputs = append(inputs, in)
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].ARN < inputs[j].ARN })
+
+	data, err := json.Marshal(struct {
+		Config    *config.PolicyConfig `json:"config"`
+		Resources []inputResource      `json:"resources"`
+	}{cfg, inputs})
+	if err != nil {
+		return "", fmt.Errorf("encode inputs: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// NewPlan diffs every rendered policy against the live ones in inv without writing
+// anything; opts.DryRun is ignored. When prune is enabled, orphaned policies are planned
+// for deletion.
+func NewPlan(ctx context.Context, client API, inv *Inventory, rendered map[string]policy.RenderedPolicy, inputHash string, opts Options, prune PruneOptions, logger *util.Logger) (*Plan, error) {
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := inv.Prefetch(ctx, names); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Version: PlanVersion, CreatedAt: time.Now().UTC(), InputHash: inputHash, ConfigHash: opts.ConfigHash}
+	for _, name := range names {
+		p := rendered[name]
+		var set *ResourceSetChange
+		if p.ResourceSet != "" {
+			var err error
+			set, err = planResourceSet(ctx, client, inv, p, opts.Adopt)
+			if err != nil {
+				return nil, fmt.Errorf("resource set for policy %s: %w", p.Name, err)
+			}
+		}
+		planned, err := planPolicy(ctx, inv, p, opts, set, nil)
+		if err != nil {
+			return nil, err
+		}
+		plan.Policies = append(plan.Policies, planned)
+	}
+
+	orphans, err := FindOrphans(ctx, inv, rendered, prune, opts.Adopt, logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orphans {
+		change := Change{Action: ActionDelete, Policy: o.Name, ResourceSet: o.ResourceSet}
+		if o.ResourceSet != nil {
+			change.Fields = []FieldChange{{Field: resourceSetField, Old: o.ResourceSet.Name}}
+		}
+		plan.Policies = append(plan.Policies, PlannedPolicy{
+			Policy:                   policy.RenderedPolicy{Name: o.Name},
+			PolicyID:                 o.PolicyID,
+			PolicyARN:                o.PolicyARN,
+			UpdateToken:              o.UpdateToken,
+			DeleteAllPolicyResources: prune.DeleteAllPolicyResources,
+			Change:                   change,
+		})
+	}
+	return plan, nil
+}
+
+// CheckInputs returns an error wrapping ErrStalePlan when inputHash, see HashInputs,
+// differs from the hash the plan was made from.
+func (p *Plan) CheckInputs(inputHash string) error {
+	if p.InputHash != inputHash {
+		return fmt.Errorf("%w: config or inputs changed since planning", ErrStalePlan)
+	}
+	return nil
+}
+
+// Counts returns the number of planned policies per action.
+func (p *Plan) Counts() map[Action]int {
+	counts := map[Action]int{}
+	for _, planned := range p.Policies {
+		counts[planned.Change.Action]++
+	}
+	return counts
+}
+
+// Changes returns the planned changes in plan order.
+func (p *Plan) Changes() []Change {
+	changes := make([]Change, 0, len(p.Policies))
+	for _, planned := range p.Policies {
+		changes = append(changes, planned.Change)
+	}
+	return changes
+}
+
+// ApplyPlan executes a saved plan. It refuses to run, returning an error wrapping
+// ErrStalePlan, when inputHash differs from the plan's or when any live policy in inv was
+// created, deleted or updated since planning. The live version of every updated policy is
+// saved to versions first, unless it is nil.
+func ApplyPlan(ctx context.Context, client API, inv *Inventory, plan *Plan, inputHash string, versions history.Store, logger *util.Logger) error {
+	if plan.Version != PlanVersion {
+		return fmt.Errorf("unsupported plan version %d (want %d)", plan.Version, PlanVersion)
+	}
+	if err := plan.CheckInputs(inputHash); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(plan.Policies))
+	for _, planned := range plan.Policies {
+		names = append(names, planned.Policy.Name)
+	}
+	if err := inv.Prefetch(ctx, names); err != nil {
+		return err
+	}
+	for _, planned := range plan.Policies {
+		if err := checkLive(ctx, inv, planned); err != nil {
+			return err
+		}
+	}
+
+	for _, planned := range plan.Policies {
+		p := planned.Policy
+		if set := planned.Change.ResourceSet; set.changed() {
+			if err := applyResourceSet(ctx, client, inv, p, set, logger); err != nil {
+				return fmt.Errorf("resource set for policy %s: %w", p.Name, err)
+			}
+		}
+		switch planned.Change.Action {
+		case ActionNoOp:
+		case ActionDelete:
+			logger.Infof("apply: %s %s", planned.Change.Action, p.Name)
+			if err := deletePolicy(ctx, client, inv, p.Name, planned.PolicyID, planned.DeleteAllPolicyResources); err != nil {
+				return err
+			}
+			if set := planned.Change.ResourceSet; set != nil {
+				if err := deleteResourceSet(ctx, client, inv, set); err != nil {
+					return err
+				}
+			}
+		default:
+			logger.Infof("apply: %s %s", planned.Change.Action, p.Name)
+			if !planned.Change.writesPolicy() {
+				continue
+			}
+			if _, err := saveVersion(ctx, versions, inv, planned, time.Now(), logger); err != nil {
+				return err
+			}
+			if err := putPlanned(ctx, client, inv, planned, planned.Change.ResourceSet.id(), plan.ConfigHash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkLive verifies that the live policy is still in the state the plan recorded.
+func checkLive(ctx context.Context, inv *Inventory, planned PlannedPolicy) error {
+	name := planned.Policy.Name
+	live, err := inv.lookup(ctx, name)
+	if err != nil {
+		return fmt.Errorf("find existing policy %s: %w", name, err)
+	}
+	switch {
+	case planned.PolicyID == "" && live != nil:
+		return fmt.Errorf("%w: policy %s was created after planning", ErrStalePlan, name)
+	case planned.PolicyID != "" && live == nil:
+		return fmt.Errorf("%w: policy %s was deleted after planning", ErrStalePlan, name)
+	case live != nil && aws.ToString(live.Policy.PolicyUpdateToken) != planned.UpdateToken:
+		return fmt.Errorf("%w: policy %s was updated after planning", ErrStalePlan, name)
+	}
+	return nil
+}
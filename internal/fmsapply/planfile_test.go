@@ -0,0 +1,164 @@
+package fmsapply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func renderedPolicies(msd string) map[string]policy.RenderedPolicy {
+	return map[string]policy.RenderedPolicy{
+		"auto-alb-a": {
+			Name:               "auto-alb-a",
+			ResourceType:       "AWS::ElasticLoadBalancingV2::LoadBalancer",
+			ManagedServiceData: msd,
+		},
+	}
+}
+
+// roundTrip saves and reloads the plan the way `renderer plan`/`apply` do.
+func roundTrip(t *testing.T, plan *Plan) *Plan {
+	t.Helper()
+	data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("marshal plan: %v", err)
+	}
+	var out Plan
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal plan: %v", err)
+	}
+	return &out
+}
+
+func TestApplyPlan(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+
+	client := fmsfake.New()
+	plan, err := NewPlan(ctx, client, inventory(t, client), renderedPolicies(`{"type":"WAFV2"}`), "hash", Options{OUID: "ou-1"}, PruneOptions{}, logger)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if client.Calls(fmsfake.OpPutPolicy) != 0 {
+		t.Fatalf("planning wrote to FMS")
+	}
+	if got := plan.Counts()[ActionCreate]; got != 1 {
+		t.Fatalf("expected 1 create, got %v", plan.Counts())
+	}
+
+	if err := ApplyPlan(ctx, client, inventory(t, client), roundTrip(t, plan), "hash", nil, logger); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(client.PolicyIDs()) != 1 {
+		t.Fatalf("expected the policy to be created, got %d", len(client.PolicyIDs()))
+	}
+
+	// The same plan cannot be applied twice: the policy now exists.
+	err = ApplyPlan(ctx, client, inventory(t, client), roundTrip(t, plan), "hash", nil, logger)
+	if !errors.Is(err, ErrStalePlan) {
+		t.Fatalf("expected a stale plan error, got %v", err)
+	}
+}
+
+func TestApplyPlan_RefusesStalePlans(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+
+	tests := []struct {
+		name   string
+		hash   string
+		mutate func(client *fmsfake.FMS)
+	}{
+		{name: "config or inputs changed", hash: "other"},
+		{
+			name: "live policy updated",
+			hash: "hash",
+			mutate: func(client *fmsfake.FMS) {
+				for _, id := range client.PolicyIDs() {
+					p, _ := client.Policy(id)
+					client.PutPolicy(ctx, &fms.PutPolicyInput{Policy: &p})
+				}
+			},
+		},
+		{
+			name: "live policy deleted",
+			hash: "hash",
+			mutate: func(client *fmsfake.FMS) {
+				for _, id := range client.PolicyIDs() {
+					client.RemovePolicy(id)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fmsfake.New()
+			if _, err := UpsertPolicy(ctx, client, inventory(t, client), renderedPolicies(`{"type":"WAFV2"}`)["auto-alb-a"], Options{}, logger); err != nil {
+				t.Fatalf("seed: %v", err)
+			}
+			plan, err := NewPlan(ctx, client, inventory(t, client), renderedPolicies(`{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`), "hash", Options{}, PruneOptions{}, logger)
+			if err != nil {
+				t.Fatalf("plan: %v", err)
+			}
+			if plan.Policies[0].Change.Action != ActionUpdate || plan.Policies[0].UpdateToken == "" {
+				t.Fatalf("expected an update with a token, got %+v", plan.Policies[0])
+			}
+			if tc.mutate != nil {
+				tc.mutate(client)
+			}
+
+			calls := client.Calls(fmsfake.OpPutPolicy)
+			err = ApplyPlan(ctx, client, inventory(t, client), roundTrip(t, plan), tc.hash, nil, logger)
+			if !errors.Is(err, ErrStalePlan) {
+				t.Fatalf("expected a stale plan error, got %v", err)
+			}
+			if client.Calls(fmsfake.OpPutPolicy) != calls {
+				t.Fatalf("stale plan wrote to FMS")
+			}
+		})
+	}
+}
+
+func TestHashInputs(t *testing.T) {
+	cfg := &config.PolicyConfig{TagKeys: config.TagKeys{Primary: "P", Secondary: "S"}}
+	a := discovery.Resource{ARN: "arn:a", Tags: map[string]string{"P": "edge"}}
+	b := discovery.Resource{ARN: "arn:b"}
+
+	h1, err := HashInputs(cfg, []discovery.Resource{a, b})
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	h2, _ := HashInputs(cfg, []discovery.Resource{b, a})
+	if h1 != h2 {
+		t.Fatalf("hash depends on discovery order")
+	}
+
+	a.Tags = map[string]string{"P": "app"}
+	h3, _ := HashInputs(cfg, []discovery.Resource{a, b})
+	if h1 == h3 {
+		t.Fatalf("retagging a resource did not change the hash")
+	}
+
+	// Attributes and tags that select no rule set do not count.
+	a.Attributes = map[string]string{"dnsName": "a-123.elb.amazonaws.com"}
+	a.Tags["Owner"] = "team-a"
+	if h, _ := HashInputs(cfg, []discovery.Resource{a, b}); h != h3 {
+		t.Fatalf("attributes or unrelated tags changed the hash")
+	}
+
+	cfg.Defaults.Primary = "edge"
+	h4, _ := HashInputs(cfg, []discovery.Resource{a, b})
+	if h3 == h4 {
+		t.Fatalf("changing the config did not change the hash")
+	}
+}
@@ -0,0 +1,150 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// ErrTooManyDeletions is returned when pruning would delete more policies than allowed.
+var ErrTooManyDeletions = errors.New("too many policy deletions")
+
+// PruneOptions controls the prune phase. The zero value disables it.
+type PruneOptions struct {
+	Enabled bool
+	// Prefix selects the policies owned by this tool.
+	Prefix                   string
+	DeleteAllPolicyResources bool
+	MaxDeletions             int
+}
+
+// PruneOptionsFor derives the prune options from the config.
+func PruneOptionsFor(cfg *config.PolicyConfig) PruneOptions {
+	return PruneOptions{
+		Enabled:                  cfg.Prune.Enabled,
+		Prefix:                   policy.NamePrefix(cfg.Naming),
+		DeleteAllPolicyResources: cfg.Prune.DeleteAllPolicyResources,
+		MaxDeletions:             cfg.Prune.EffectiveMaxDeletions(),
+	}
+}
+
+// Orphan is an owned live policy that no rendered policy corresponds to.
+type Orphan struct {
+	Name        string
+	PolicyID    string
+	PolicyARN   string
+	UpdateToken string
+	// ResourceSet is the owned resource set the policy is scoped to, deleted with it.
+	ResourceSet *ResourceSetChange
+}
+
+// FindOrphans lists the live policies in inv that are not in rendered, have a name
+// starting with opts.Prefix and either carry the ownership tag or, with adopt, are
+// untagged. The prefix scopes ownership to this deployment: a tagged policy under another
+// prefix belongs to another deployment and is never deleted. Untagged policies with the
+// prefix are skipped with a warning unless adopt is set. An orphan scoped to a resource
+// set this tool owns carries it, so the set goes with the policy. The result is sorted by
+// name; ErrTooManyDeletions is returned when it holds more than opts.MaxDeletions.
+func FindOrphans(ctx context.Context, inv *Inventory, rendered map[string]policy.RenderedPolicy, opts PruneOptions, adopt bool, logger *util.Logger) ([]Orphan, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	if opts.Prefix == "" {
+		return nil, fmt.Errorf("prune requires a policy name prefix")
+	}
+
+	var candidates []string
+	for _, name := range inv.Names() {
+		if _, ok := rendered[name]; !ok && strings.HasPrefix(name, opts.Prefix) {
+			candidates = append(candidates, name)
+		}
+	}
+	if err := inv.Prefetch(ctx, candidates); err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, name := range candidates {
+		live, err := inv.lookup(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if live == nil {
+			continue
+		}
+		if !live.owned() {
+			if !adopt {
+				logger.Warnf("policy %s looks orphaned but lacks the %s tag; not deleting it without adopt", name, TagManagedBy)
+				continue
+			}
+		}
+		set, err := ownedResourceSet(ctx, inv, live)
+		if err != nil {
+			return nil, fmt.Errorf("resource set of policy %s: %w", name, err)
+		}
+		orphans = append(orphans, Orphan{
+			Name:        name,
+			PolicyID:    aws.ToString(live.Policy.PolicyId),
+			PolicyARN:   live.ARN,
+			UpdateToken: aws.ToString(live.Policy.PolicyUpdateToken),
+			ResourceSet: set,
+		})
+	}
+
+	if len(orphans) > opts.MaxDeletions {
+		return nil, fmt.Errorf("%w: %d orphaned policies exceed prune.maxDeletions %d", ErrTooManyDeletions, len(orphans), opts.MaxDeletions)
+	}
+	return orphans, nil
+}
+
+// Prune deletes the orphaned policies and the resource sets they own. With run.DryRun it
+// only logs them. It returns the orphans it found.
+func Prune(ctx context.Context, client API, inv *Inventory, rendered map[string]policy.RenderedPolicy, opts PruneOptions, run Options, logger *util.Logger) ([]Orphan, error) {
+	orphans, err := FindOrphans(ctx, inv, rendered, opts, run.Adopt, logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orphans {
+		logger.Infof("plan: %s %s", ActionDelete, o.Name)
+		if o.ResourceSet != nil {
+			logger.Infof("plan: %s resource set %s", ActionDelete, o.ResourceSet.Name)
+		}
+		if run.DryRun {
+			continue
+		}
+		if err := deletePolicy(ctx, client, inv, o.Name, o.PolicyID, opts.DeleteAllPolicyResources); err != nil {
+			return nil, err
+		}
+		// FMS only deletes sets no policy uses, so the set goes after its policy.
+		if o.ResourceSet != nil {
+			if err := deleteResourceSet(ctx, client, inv, o.ResourceSet); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if run.DryRun && len(orphans) > 0 {
+		logger.Infof("dry-run enabled; skipping DeletePolicy for %d orphaned policies", len(orphans))
+	}
+	return orphans, nil
+}
+
+// deletePolicy deletes a policy and drops it from inv.
+func deletePolicy(ctx context.Context, client API, inv *Inventory, name, id string, deleteAll bool) error {
+	_, err := client.DeletePolicy(ctx, &fms.DeletePolicyInput{
+		PolicyId:                 aws.String(id),
+		DeleteAllPolicyResources: deleteAll,
+	})
+	if err != nil {
+		return fmt.Errorf("delete policy %s: %w", name, err)
+	}
+	inv.remove(id)
+	return nil
+}
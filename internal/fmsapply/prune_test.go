@@ -0,0 +1,123 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// seedPolicies stores live policies with the given names and returns their IDs by name.
+// Names starting with "auto-" are tagged as owned.
+func seedPolicies(client *fmsfake.FMS, names ...string) map[string]string {
+	ids := map[string]string{}
+	for _, name := range names {
+		var tags map[string]string
+		if strings.HasPrefix(name, "auto-") {
+			tags = map[string]string{TagManagedBy: ManagedByValue}
+		}
+		ids[name] = client.AddPolicy(fmstypes.Policy{PolicyName: aws.String(name)}, tags)
+	}
+	return ids
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	rendered := map[string]policy.RenderedPolicy{"auto-alb-a": {Name: "auto-alb-a"}}
+	opts := PruneOptions{Enabled: true, Prefix: "auto-", DeleteAllPolicyResources: true, MaxDeletions: 5}
+
+	client := fmsfake.New()
+	ids := seedPolicies(client, "auto-alb-a", "auto-alb-b", "auto-alb-c", "hand-made")
+
+	orphans, err := Prune(ctx, client, inventory(t, client), rendered, opts, Options{DryRun: true}, logger)
+	if err != nil {
+		t.Fatalf("dry-run prune: %v", err)
+	}
+	if len(orphans) != 2 || orphans[0].Name != "auto-alb-b" || orphans[1].Name != "auto-alb-c" {
+		t.Fatalf("unexpected orphans: %+v", orphans)
+	}
+	if len(client.PolicyIDs()) != 4 {
+		t.Fatalf("dry-run deleted policies")
+	}
+
+	if _, err := Prune(ctx, client, inventory(t, client), rendered, opts, Options{}, logger); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(client.PolicyIDs()) != 2 {
+		t.Fatalf("expected the rendered and the unowned policy to remain, got %d", len(client.PolicyIDs()))
+	}
+	if deleteAll, ok := client.Deleted(ids["auto-alb-b"]); !ok || !deleteAll {
+		t.Fatalf("auto-alb-b not deleted with DeleteAllPolicyResources")
+	}
+}
+
+func TestPrune_KeepsOwnedPoliciesOfOtherPrefixes(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	seedPolicies(client, "auto-alb-a")
+	// Another deployment of the tool, with its own prefix, owns this one.
+	client.AddPolicy(fmstypes.Policy{PolicyName: aws.String("edge-alb-a")}, map[string]string{TagManagedBy: ManagedByValue})
+
+	opts := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	orphans, err := Prune(ctx, client, inventory(t, client), nil, opts, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].Name != "auto-alb-a" {
+		t.Fatalf("unexpected orphans: %+v", orphans)
+	}
+	if len(client.PolicyIDs()) != 1 {
+		t.Fatalf("expected the other prefix's policy to remain, got %d policies", len(client.PolicyIDs()))
+	}
+}
+
+func TestPrune_MaxDeletions(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	seedPolicies(client, "auto-alb-a", "auto-alb-b")
+
+	opts := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 1}
+	_, err := Prune(ctx, client, inventory(t, client), nil, opts, Options{}, util.NewLogger())
+	if !errors.Is(err, ErrTooManyDeletions) {
+		t.Fatalf("expected ErrTooManyDeletions, got %v", err)
+	}
+	if len(client.PolicyIDs()) != 2 {
+		t.Fatalf("aborted prune deleted policies")
+	}
+
+	opts.Enabled = false
+	if orphans, err := Prune(ctx, client, inventory(t, client), nil, opts, Options{}, util.NewLogger()); err != nil || len(orphans) != 0 {
+		t.Fatalf("disabled prune found orphans: %v %v", orphans, err)
+	}
+}
+
+func TestApplyPlan_Deletes(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+	seedPolicies(client, "auto-alb-gone")
+
+	opts := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	plan, err := NewPlan(ctx, client, inventory(t, client), nil, "hash", Options{}, opts, logger)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Counts()[ActionDelete] != 1 || len(client.PolicyIDs()) != 1 {
+		t.Fatalf("expected one planned delete and no writes, got %v", plan.Counts())
+	}
+
+	if err := ApplyPlan(ctx, client, inventory(t, client), roundTrip(t, plan), "hash", nil, logger); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(client.PolicyIDs()) != 0 {
+		t.Fatalf("planned delete not applied")
+	}
+}
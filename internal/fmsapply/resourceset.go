@@ -0,0 +1,289 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// batchSize is the maximum number of items FMS accepts per Batch(Dis)associateResource call.
+const batchSize = 100
+
+// ErrUnmanagedResourceSet is returned when a policy would take over a resource set without
+// the ownership tag and adoption was not requested.
+var ErrUnmanagedResourceSet = errors.New("resource set is not managed by this tool")
+
+// ResourceSetChange is the plan for the resource set a policy is scoped to: the set to
+// create or reuse, and the members to associate and disassociate so that it holds exactly
+// the rendered resources.
+type ResourceSetChange struct {
+	Name string `json:"name"`
+	// ID and ARN are empty when the set is created.
+	ID  string `json:"id,omitempty"`
+	ARN string `json:"arn,omitempty"`
+	// Adopt is set when the live set lacks the ownership tag and is taken over.
+	Adopt        bool     `json:"adopt,omitempty"`
+	Associate    []string `json:"associate,omitempty"`
+	Disassociate []string `json:"disassociate,omitempty"`
+}
+
+// changed reports whether applying the plan writes anything.
+func (s *ResourceSetChange) changed() bool {
+	return s != nil && (s.ID == "" || s.Adopt || len(s.Associate) > 0 || len(s.Disassociate) > 0)
+}
+
+// id returns the set ID, or "" for a policy without a resource set.
+func (s *ResourceSetChange) id() string {
+	if s == nil {
+		return ""
+	}
+	return s.ID
+}
+
+// fields lists the planned set changes as field changes of the policy.
+func (s *ResourceSetChange) fields() []FieldChange {
+	if s == nil {
+		return nil
+	}
+	var fields []FieldChange
+	if s.ID == "" {
+		fields = append(fields, FieldChange{Field: resourceSetField, New: s.Name})
+	}
+	if s.Adopt {
+		fields = append(fields, FieldChange{Field: resourceSetField + ".tags." + TagManagedBy, New: ManagedByValue})
+	}
+	for _, arn := range s.Associate {
+		fields = append(fields, FieldChange{Field: resourceSetMembersField, New: arn})
+	}
+	for _, arn := range s.Disassociate {
+		fields = append(fields, FieldChange{Field: resourceSetMembersField, Old: arn})
+	}
+	return fields
+}
+
+const (
+	resourceSetField        = "resource_set"
+	resourceSetMembersField = resourceSetField + ".members"
+)
+
+// planResourceSet looks up the resource set named p.ResourceSet in inv and plans the
+// membership that makes it hold exactly p.Resources, so resources that were removed or
+// untagged leave the set. It writes nothing. A live set without the ownership tag is only
+// used with adopt.
+func planResourceSet(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, adopt bool) (*ResourceSetChange, error) {
+	set := &ResourceSetChange{Name: p.ResourceSet}
+	id, err := inv.resourceSetID(ctx, p.ResourceSet)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		set.Associate, _ = diffMembers(nil, p.Resources)
+		return set, nil
+	}
+
+	out, err := client.GetResourceSet(ctx, &fms.GetResourceSetInput{Identifier: aws.String(id)})
+	if err != nil {
+		return nil, fmt.Errorf("get resource set %s: %w", p.ResourceSet, err)
+	}
+	set.ID, set.ARN = id, aws.ToString(out.ResourceSetArn)
+	tags, err := fetchTags(ctx, client, set.ARN)
+	if err != nil {
+		return nil, err
+	}
+	if tags[TagManagedBy] != ManagedByValue {
+		if !adopt {
+			return nil, fmt.Errorf("%w: %s lacks the %s=%s tag; adopt it explicitly to use it",
+				ErrUnmanagedResourceSet, p.ResourceSet, TagManagedBy, ManagedByValue)
+		}
+		set.Adopt = true
+	}
+
+	current, err := listResourceSetMembers(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	set.Associate, set.Disassociate = diffMembers(current, p.Resources)
+	return set, nil
+}
+
+// applyResourceSet makes the changes planned in set: it creates the set, tagged as owned,
+// or tags an adopted one, and reconciles its membership. A created set's ID and ARN are
+// filled in and recorded in inv.
+func applyResourceSet(ctx context.Context, client API, inv *Inventory, p policy.RenderedPolicy, set *ResourceSetChange, logger *util.Logger) error {
+	owned := []fmstypes.Tag{{Key: aws.String(TagManagedBy), Value: aws.String(ManagedByValue)}}
+	switch {
+	case set.ID == "":
+		logger.Infof("creating resource set %s with %d resource(s)", set.Name, len(set.Associate))
+		out, err := client.PutResourceSet(ctx, &fms.PutResourceSetInput{
+			ResourceSet: &fmstypes.ResourceSet{
+				Name:             aws.String(set.Name),
+				Description:      aws.String(fmt.Sprintf("Resources scoped by FMS policy %s", p.Name)),
+				ResourceTypeList: []string{p.ResourceType},
+			},
+			TagList: owned,
+		})
+		if err != nil {
+			return fmt.Errorf("put resource set %s: %w", set.Name, err)
+		}
+		if out.ResourceSet == nil || out.ResourceSet.Id == nil {
+			return fmt.Errorf("resource set %s created without id", set.Name)
+		}
+		set.ID, set.ARN = *out.ResourceSet.Id, aws.ToString(out.ResourceSetArn)
+		inv.recordResourceSet(set.Name, set.ID)
+	case set.Adopt:
+		logger.Infof("adopting resource set %s", set.Name)
+		if _, err := client.TagResource(ctx, &fms.TagResourceInput{ResourceArn: aws.String(set.ARN), TagList: owned}); err != nil {
+			return fmt.Errorf("tag resource set %s: %w", set.Name, err)
+		}
+	}
+
+	if len(set.Associate) == 0 && len(set.Disassociate) == 0 {
+		return nil
+	}
+	logger.Infof("resource set %s: associating %d, disassociating %d resource(s)", set.Name, len(set.Associate), len(set.Disassociate))
+	for _, chunk := range chunk(set.Associate, batchSize) {
+		out, err := client.BatchAssociateResource(ctx, &fms.BatchAssociateResourceInput{
+			ResourceSetIdentifier: aws.String(set.ID),
+			Items:                 chunk,
+		})
+		if err != nil {
+			return fmt.Errorf("associate resources with %s: %w", set.Name, err)
+		}
+		if err := failedItemsError("associate", out.FailedItems); err != nil {
+			return fmt.Errorf("resource set %s: %w", set.Name, err)
+		}
+	}
+	for _, chunk := range chunk(set.Disassociate, batchSize) {
+		out, err := client.BatchDisassociateResource(ctx, &fms.BatchDisassociateResourceInput{
+			ResourceSetIdentifier: aws.String(set.ID),
+			Items:                 chunk,
+		})
+		if err != nil {
+			return fmt.Errorf("disassociate resources from %s: %w", set.Name, err)
+		}
+		if err := failedItemsError("disassociate", out.FailedItems); err != nil {
+			return fmt.Errorf("resource set %s: %w", set.Name, err)
+		}
+	}
+	return nil
+}
+
+// ownedResourceSet returns the resource set a policy about to be deleted was scoped to
+// by this tool: the set named like the policy, carrying the ownership tag, in the
+// policy's ResourceSetIds. It returns nil when there is none.
+func ownedResourceSet(ctx context.Context, inv *Inventory, live *livePolicy) (*ResourceSetChange, error) {
+	if len(live.Policy.ResourceSetIds) == 0 {
+		return nil, nil
+	}
+	name := aws.ToString(live.Policy.PolicyName)
+	id, err := inv.resourceSetID(ctx, name)
+	if err != nil || id == "" || !slices.Contains(live.Policy.ResourceSetIds, id) {
+		return nil, err
+	}
+	if err := inv.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	out, err := inv.client.GetResourceSet(ctx, &fms.GetResourceSetInput{Identifier: aws.String(id)})
+	if err != nil {
+		return nil, fmt.Errorf("get resource set %s: %w", name, err)
+	}
+	set := &ResourceSetChange{Name: name, ID: id, ARN: aws.ToString(out.ResourceSetArn)}
+	if err := inv.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	tags, err := fetchTags(ctx, inv.client, set.ARN)
+	if err != nil || tags[TagManagedBy] != ManagedByValue {
+		return nil, err
+	}
+	return set, nil
+}
+
+// deleteResourceSet deletes a resource set whose policy was deleted and drops it from inv.
+func deleteResourceSet(ctx context.Context, client API, inv *Inventory, set *ResourceSetChange) error {
+	if _, err := client.DeleteResourceSet(ctx, &fms.DeleteResourceSetInput{Identifier: aws.String(set.ID)}); err != nil {
+		return fmt.Errorf("delete resource set %s: %w", set.Name, err)
+	}
+	inv.removeResourceSet(set.Name)
+	return nil
+}
+
+func listResourceSetMembers(ctx context.Context, client API, setID string) ([]string, error) {
+	var (
+		members []string
+		next    *string
+	)
+	for {
+		out, err := client.ListResourceSetResources(ctx, &fms.ListResourceSetResourcesInput{
+			Identifier: aws.String(setID),
+			NextToken:  next,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list resource set %s resources: %w", setID, err)
+		}
+		for _, item := range out.Items {
+			if item.URI != nil {
+				members = append(members, *item.URI)
+			}
+		}
+		if out.NextToken == nil || *out.NextToken == "" {
+			return members, nil
+		}
+		next = out.NextToken
+	}
+}
+
+// diffMembers returns the sorted ARNs to add to and remove from a resource set.
+func diffMembers(current, desired []string) (toAdd, toRemove []string) {
+	have := make(map[string]bool, len(current))
+	for _, arn := range current {
+		have[arn] = true
+	}
+	want := make(map[string]bool, len(desired))
+	for _, arn := range desired {
+		want[arn] = true
+		if !have[arn] {
+			toAdd = append(toAdd, arn)
+		}
+	}
+	for _, arn := range current {
+		if !want[arn] {
+			toRemove = append(toRemove, arn)
+		}
+	}
+	sort.Strings(toAdd)
+	sort.Strings(toRemove)
+	return toAdd, toRemove
+}
+
+func chunk(items []string, size int) [][]string {
+	var out [][]string
+	for len(items) > size {
+		out = append(out, items[:size])
+		items = items[size:]
+	}
+	if len(items) > 0 {
+		out = append(out, items)
+	}
+	return out
+}
+
+func failedItemsError(op string, failed []fmstypes.FailedItem) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	reasons := make([]string, 0, len(failed))
+	for _, f := range failed {
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", aws.ToString(f.URI), f.Reason))
+	}
+	return fmt.Errorf("failed to %s %d resource(s): %s", op, len(failed), strings.Join(reasons, ", "))
+}
@@ -0,0 +1,252 @@
+package fmsapply
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+const (
+	albA = "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/a/1"
+	albB = "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/b/2"
+	albC = "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/c/3"
+)
+
+func resourceSetPolicy(arns ...string) policy.RenderedPolicy {
+	return policy.RenderedPolicy{
+		Name:               "auto-alb-edge-bot",
+		ResourceType:       "AWS::ElasticLoadBalancingV2::LoadBalancer",
+		ManagedServiceData: `{"type":"WAFV2"}`,
+		Resources:          arns,
+		ResourceSet:        "auto-alb-edge-bot",
+	}
+}
+
+func TestUpsertPolicy_ResourceSetScope(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	logger := util.NewLogger()
+
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA, albB), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if len(client.ResourceSets()) != 1 || len(client.PolicyIDs()) != 1 {
+		t.Fatalf("expected 1 resource set and 1 policy, got %d and %d", len(client.ResourceSets()), len(client.PolicyIDs()))
+	}
+
+	setID := aws.ToString(client.ResourceSets()[0].Id)
+	if tags, err := fetchTags(ctx, client, fmsfake.ResourceSetARN(setID)); err != nil || tags[TagManagedBy] != ManagedByValue {
+		t.Fatalf("resource set not tagged as owned: %v, %v", tags, err)
+	}
+	for _, id := range client.PolicyIDs() {
+		p, _ := client.Policy(id)
+		if !reflect.DeepEqual(p.ResourceSetIds, []string{setID}) {
+			t.Fatalf("policy not scoped to resource set: %v", p.ResourceSetIds)
+		}
+	}
+	if got := client.ResourceSetMembers(setID); !reflect.DeepEqual(got, []string{albA, albB}) {
+		t.Fatalf("unexpected members after create: %v", got)
+	}
+
+	// B was deleted or retagged, C joined: membership follows the rendered ARNs.
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA, albC), Options{}, logger); err != nil {
+		t.Fatalf("second upsert: %v", err)
+	}
+	if len(client.ResourceSets()) != 1 {
+		t.Fatalf("expected resource set to be reused, got %d", len(client.ResourceSets()))
+	}
+	if got := client.ResourceSetMembers(setID); !reflect.DeepEqual(got, []string{albA, albC}) {
+		t.Fatalf("unexpected members after reconcile: %v", got)
+	}
+}
+
+func TestUpsertPolicy_ResourceSetDryRunPlansMembership(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	logger := util.NewLogger()
+
+	change, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA), Options{DryRun: true}, logger)
+	if err != nil {
+		t.Fatalf("dry-run upsert: %v", err)
+	}
+	if len(client.ResourceSets()) != 0 || change.ResourceSet == nil || change.ResourceSet.ID != "" {
+		t.Fatalf("dry-run created a resource set: sets=%d change=%+v", len(client.ResourceSets()), change.ResourceSet)
+	}
+
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	calls := client.Calls(fmsfake.OpBatchAssociateResource)
+	change, err = UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albB), Options{DryRun: true}, logger)
+	if err != nil {
+		t.Fatalf("dry-run upsert: %v", err)
+	}
+	want := []FieldChange{{Field: "resource_set.members", New: albB}, {Field: "resource_set.members", Old: albA}}
+	if change.Action != ActionUpdate || !reflect.DeepEqual(change.Fields, want) {
+		t.Fatalf("expected the membership change in the plan, got %s", change)
+	}
+	if client.Calls(fmsfake.OpBatchAssociateResource) != calls {
+		t.Fatalf("dry-run associated resources")
+	}
+
+	// Applying only changes the membership; the policy itself is not written again.
+	puts := client.Calls(fmsfake.OpPutPolicy)
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albB), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	setID := aws.ToString(client.ResourceSets()[0].Id)
+	if got := client.ResourceSetMembers(setID); !reflect.DeepEqual(got, []string{albB}) || client.Calls(fmsfake.OpPutPolicy) != puts {
+		t.Fatalf("expected only the membership to change, got members %v and %d writes", got, client.Calls(fmsfake.OpPutPolicy)-puts)
+	}
+}
+
+func TestUpsertPolicy_ResourceSetOwnership(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+
+	// A set with the same name that this tool did not create is not taken over.
+	client := fmsfake.New()
+	out, err := client.PutResourceSet(ctx, &fms.PutResourceSetInput{ResourceSet: &fmstypes.ResourceSet{Name: aws.String("auto-alb-edge-bot")}})
+	if err != nil {
+		t.Fatalf("put resource set: %v", err)
+	}
+	setID := aws.ToString(out.ResourceSet.Id)
+	_, err = UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA), Options{}, logger)
+	if !errors.Is(err, ErrUnmanagedResourceSet) || len(client.ResourceSetMembers(setID)) != 0 || len(client.PolicyIDs()) != 0 {
+		t.Fatalf("expected ErrUnmanagedResourceSet without writes, got %v", err)
+	}
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA), Options{Adopt: true}, logger); err != nil {
+		t.Fatalf("adopting upsert: %v", err)
+	}
+	tags, err := fetchTags(ctx, client, fmsfake.ResourceSetARN(setID))
+	if err != nil || tags[TagManagedBy] != ManagedByValue || len(client.ResourceSetMembers(setID)) != 1 {
+		t.Fatalf("adopted set not tagged or reconciled: %v, %v", tags, err)
+	}
+
+	// A policy that fails the ownership check leaves its set alone.
+	client = fmsfake.New()
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	for _, id := range client.PolicyIDs() {
+		client.TagResource(ctx, &fms.TagResourceInput{ResourceArn: aws.String(fmsfake.PolicyARN(id)), TagList: []fmstypes.Tag{{Key: aws.String(TagManagedBy), Value: aws.String("someone-else")}}})
+	}
+	setID = aws.ToString(client.ResourceSets()[0].Id)
+	_, err = UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albB), Options{}, logger)
+	if !errors.Is(err, ErrUnmanagedPolicy) || !reflect.DeepEqual(client.ResourceSetMembers(setID), []string{albA}) {
+		t.Fatalf("expected ErrUnmanagedPolicy with the membership unchanged, got %v and %v", err, client.ResourceSetMembers(setID))
+	}
+}
+
+func TestCheckSafety_CountsResourceSetMembership(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	logger := util.NewLogger()
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA, albB), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	rendered := map[string]policy.RenderedPolicy{"auto-alb-edge-bot": resourceSetPolicy(albA, albC)}
+	plan, err := NewPlan(ctx, client, inventory(t, client), rendered, "", Options{}, PruneOptions{}, logger)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Counts()[ActionUpdate] != 1 {
+		t.Fatalf("expected the membership change to count as an update, got %v", plan.Counts())
+	}
+	violations := CheckSafety(plan, SafetyOptions{MaxUpdates: 0, MaxRuleSetChangePercent: 50})
+	if len(violations) != 1 || violations[0].Limit != "maxRuleSetChangePercent" {
+		t.Fatalf("expected the joining and leaving resources to exceed the rule-set limit, got %v", violations)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	items := make([]string, 0, 250)
+	for i := 0; i < 250; i++ {
+		items = append(items, "arn")
+	}
+	chunks := chunk(items, batchSize)
+	if len(chunks) != 3 || len(chunks[0]) != 100 || len(chunks[2]) != 50 {
+		t.Fatalf("unexpected chunking: %d chunks", len(chunks))
+	}
+}
+
+func TestUpsertPolicies_ListsResourceSetsOnce(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	rendered := map[string]policy.RenderedPolicy{}
+	for _, name := range []string{"auto-alb-a", "auto-alb-b", "auto-alb-c"} {
+		p := resourceSetPolicy(albA)
+		p.Name, p.ResourceSet = name, name
+		rendered[name] = p
+	}
+	inv := inventory(t, client)
+
+	if _, err := NewPlan(ctx, client, inv, rendered, "", Options{}, PruneOptions{}, util.NewLogger()); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if _, err := UpsertPolicies(ctx, client, inv, rendered, Options{}, ApplyOptions{}, util.NewLogger()); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if got := client.Calls(fmsfake.OpListResourceSets); got != 1 {
+		t.Fatalf("expected the resource sets to be listed once, got %d", got)
+	}
+	if len(client.ResourceSets()) != 3 {
+		t.Fatalf("expected 3 resource sets, got %d", len(client.ResourceSets()))
+	}
+
+	// The sets created by this run are found again without listing.
+	if _, err := UpsertPolicies(ctx, client, inv, rendered, Options{}, ApplyOptions{}, util.NewLogger()); err != nil {
+		t.Fatalf("second upsert: %v", err)
+	}
+	if client.Calls(fmsfake.OpListResourceSets) != 1 || len(client.ResourceSets()) != 3 {
+		t.Fatalf("second run listed %d times and left %d sets", client.Calls(fmsfake.OpListResourceSets), len(client.ResourceSets()))
+	}
+}
+
+func TestPrune_DeletesOwnedResourceSets(t *testing.T) {
+	ctx := context.Background()
+	client := fmsfake.New()
+	logger := util.NewLogger()
+	if _, err := UpsertPolicy(ctx, client, inventory(t, client), resourceSetPolicy(albA), Options{}, logger); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	// A set this tool does not own stays even when its policy is pruned.
+	foreign, err := client.PutResourceSet(ctx, &fms.PutResourceSetInput{ResourceSet: &fmstypes.ResourceSet{Name: aws.String("auto-alb-hand")}})
+	if err != nil {
+		t.Fatalf("seed set: %v", err)
+	}
+	client.AddPolicy(fmstypes.Policy{PolicyName: aws.String("auto-alb-hand"), ResourceSetIds: []string{*foreign.ResourceSet.Id}}, map[string]string{TagManagedBy: ManagedByValue})
+
+	opts := PruneOptions{Enabled: true, Prefix: "auto-", MaxDeletions: 5}
+	plan, err := NewPlan(ctx, client, inventory(t, client), nil, "", Options{}, opts, logger)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	var planned []string
+	for _, p := range plan.Policies {
+		if p.Change.ResourceSet != nil {
+			planned = append(planned, p.Policy.Name+" "+p.Change.ResourceSet.Name)
+		}
+	}
+	if !reflect.DeepEqual(planned, []string{"auto-alb-edge-bot auto-alb-edge-bot"}) {
+		t.Fatalf("unexpected resource set deletions in the plan: %v", planned)
+	}
+
+	if _, err := Prune(ctx, client, inventory(t, client), nil, opts, Options{}, logger); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	sets := client.ResourceSets()
+	if len(client.PolicyIDs()) != 0 || len(sets) != 1 || aws.ToString(sets[0].Name) != "auto-alb-hand" {
+		t.Fatalf("expected only the unowned set to remain, got %d policies and %v", len(client.PolicyIDs()), sets)
+	}
+}
@@ -0,0 +1,195 @@
+package fmsapply
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+)
+
+// RolloutStage is the state of a staged policy. Policies move from audit to enforce
+// once, and stay enforced afterwards:
+//
+//	audit --soak period passed--> held --compliance check passed--> enforce --> enforced
+//	audit --soak period passed, compliance check passed-----------> enforce
+type RolloutStage string
+
+const (
+	// StageAudit is a policy with remediation disabled whose soak period is running.
+	StageAudit RolloutStage = "audit"
+	// StageHeld is a policy whose soak period has passed but whose compliance check
+	// failed; it stays in audit mode.
+	StageHeld RolloutStage = "held"
+	// StageEnforce is a policy whose remediation is switched on by this change.
+	StageEnforce RolloutStage = "enforce"
+	// StageEnforced is a policy that already has remediation enabled.
+	StageEnforced RolloutStage = "enforced"
+)
+
+// RolloutStatus is the rollout state of a staged policy, as planned for this run.
+type RolloutStatus struct {
+	Stage RolloutStage `json:"stage"`
+	// StartedAt is when the policy was created in audit mode, from the RolloutStartedAt
+	// tag. Nil for enforced policies.
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// EnforceAfter is when the soak period ends. Nil for enforced policies.
+	EnforceAfter *time.Time `json:"enforce_after,omitempty"`
+	// Reason explains why a held policy is not enforced yet.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RemediationEnabled reports whether the policy is written with remediation on.
+func (s *RolloutStatus) RemediationEnabled() bool {
+	return s.Stage == StageEnforce || s.Stage == StageEnforced
+}
+
+// String renders the status for plan output, e.g. "audit until 2026-10-21T10:00:00Z".
+func (s *RolloutStatus) String() string {
+	switch s.Stage {
+	case StageAudit:
+		return fmt.Sprintf("%s until %s", s.Stage, s.EnforceAfter.Format(time.RFC3339))
+	case StageHeld:
+		return fmt.Sprintf("%s: %s", s.Stage, s.Reason)
+	}
+	return string(s.Stage)
+}
+
+// planRollout decides the rollout stage of a staged policy. A new policy starts in audit
+// mode at now. An audited policy is enforced once its soak period has passed and the
+// compliance check holds; one that is already enforced stays enforced. It returns nil for
+// policies without a staged rollout.
+func planRollout(ctx context.Context, inv *Inventory, r *policy.Rollout, existing *livePolicy, now time.Time) (*RolloutStatus, error) {
+	if r == nil {
+		return nil, nil
+	}
+	soak, err := time.ParseDuration(r.SoakPeriod)
+	if err != nil {
+		return nil, fmt.Errorf("rollout soak period: %w", err)
+	}
+
+	started := now
+	if existing != nil {
+		if existing.Policy.RemediationEnabled {
+			return &RolloutStatus{Stage: StageEnforced}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, existing.Tags[TagRolloutStarted]); err == nil {
+			started = t
+		}
+	}
+	enforceAfter := started.Add(soak)
+	status := &RolloutStatus{StartedAt: &started, EnforceAfter: &enforceAfter}
+
+	if existing == nil || now.Before(enforceAfter) {
+		status.Stage = StageAudit
+		return status, nil
+	}
+
+	reason, err := inv.complianceHold(ctx, aws.ToString(existing.Policy.PolicyId), r.MaxNonCompliantAccounts)
+	if err != nil {
+		return nil, err
+	}
+	status.Stage = StageEnforce
+	if reason != "" {
+		status.Stage = StageHeld
+		status.Reason = reason
+	}
+	return status, nil
+}
+
+// complianceHold checks the FMS compliance status of an audited policy. It returns why
+// the policy may not be enforced yet, or "" when it may: FMS must have evaluated it in at
+// least one account, no account may report dependent service issues, and with
+// maxNonCompliant set, at most that many accounts may report violations.
+func (inv *Inventory) complianceHold(ctx context.Context, policyID string, maxNonCompliant *int) (string, error) {
+	statuses, err := inv.complianceStatus(ctx, policyID)
+	if err != nil {
+		return "", err
+	}
+	var evaluated, nonCompliant int
+	var issues []string
+	for _, status := range statuses {
+		account := aws.ToString(status.MemberAccount)
+		for service := range status.IssueInfoMap {
+			issues = append(issues, account+"/"+service)
+		}
+		if len(status.EvaluationResults) == 0 {
+			continue
+		}
+		evaluated++
+		if nonCompliantStatus(status) {
+			nonCompliant++
+		}
+	}
+
+	switch {
+	case len(issues) > 0:
+		sort.Strings(issues)
+		return "dependent service issues in " + strings.Join(issues, ", "), nil
+	case evaluated == 0:
+		return "not evaluated by FMS yet", nil
+	case maxNonCompliant != nil && nonCompliant > *maxNonCompliant:
+		return fmt.Sprintf("%d non-compliant accounts exceed %d", nonCompliant, *maxNonCompliant), nil
+	}
+	return "", nil
+}
+
+// complianceStatus lists the per-account compliance status of a policy.
+func (inv *Inventory) complianceStatus(ctx context.Context, policyID string) ([]fmstypes.PolicyComplianceStatus, error) {
+	var out []fmstypes.PolicyComplianceStatus
+	pager := fms.NewListComplianceStatusPaginator(inv.client, &fms.ListComplianceStatusInput{PolicyId: aws.String(policyID)})
+	for pager.HasMorePages() {
+		if err := inv.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list compliance status for %s: %w", policyID, err)
+		}
+		out = append(out, page.PolicyComplianceStatusList...)
+	}
+	return out, nil
+}
+
+// nonCompliantStatus reports whether any evaluation result of the account is
+// non-compliant.
+func nonCompliantStatus(status fmstypes.PolicyComplianceStatus) bool {
+	for _, result := range status.EvaluationResults {
+		if result.ComplianceStatus == fmstypes.PolicyComplianceStatusTypeNonCompliant {
+			return true
+		}
+	}
+	return false
+}
+
+// RolloutSummary counts staged policies per stage, e.g. "rollout: 2 audit, 1 held,
+// 1 enforce, 3 enforced, next enforcement after 2026-10-21T10:00:00Z". It returns ""
+// when none of the changes has a staged rollout.
+func RolloutSummary(changes []Change) string {
+	counts := map[RolloutStage]int{}
+	var next time.Time
+	for _, c := range changes {
+		if c.Rollout == nil {
+			continue
+		}
+		counts[c.Rollout.Stage]++
+		if c.Rollout.Stage == StageAudit && (next.IsZero() || c.Rollout.EnforceAfter.Before(next)) {
+			next = *c.Rollout.EnforceAfter
+		}
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("rollout: %d audit, %d held, %d enforce, %d enforced",
+		counts[StageAudit], counts[StageHeld], counts[StageEnforce], counts[StageEnforced])
+	if !next.IsZero() {
+		s += ", next enforcement after " + next.Format(time.RFC3339)
+	}
+	return s
+}
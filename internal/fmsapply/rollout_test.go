@@ -0,0 +1,160 @@
+package fmsapply
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/fmsfake"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestUpsertPolicy_StagedRollout(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLogger()
+	client := fmsfake.New()
+
+	p := ownedTestPolicy()
+	p.Rollout = &policy.Rollout{SoakPeriod: "72h"}
+	created := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	upsert := func(now time.Time) Change {
+		t.Helper()
+		change, err := UpsertPolicy(ctx, client, inventory(t, client), p, Options{Now: now}, logger)
+		if err != nil {
+			t.Fatalf("upsert at %s: %v", now, err)
+		}
+		return change
+	}
+	live := func() (fmstypes.Policy, map[string]string) {
+		for _, id := range client.PolicyIDs() {
+			lp, _ := client.Policy(id)
+			return lp, client.Tags(id)
+		}
+		t.Fatalf("no policy created")
+		return fmstypes.Policy{}, nil
+	}
+
+	change := upsert(created)
+	if change.Action != ActionCreate || change.Rollout == nil || change.Rollout.Stage != StageAudit {
+		t.Fatalf("expected a create in audit mode, got %s", change)
+	}
+	lp, tags := live()
+	if lp.RemediationEnabled {
+		t.Fatalf("staged policy created with remediation enabled")
+	}
+	if tags[TagRolloutStarted] != "2026-10-01T12:00:00Z" {
+		t.Fatalf("unexpected rollout start tag %q", tags[TagRolloutStarted])
+	}
+
+	change = upsert(created.Add(24 * time.Hour))
+	if change.Action != ActionNoOp || change.Rollout.Stage != StageAudit {
+		t.Fatalf("expected a no-op while soaking, got %s", change)
+	}
+	if !strings.Contains(change.String(), "[rollout audit until 2026-10-04T12:00:00Z]") {
+		t.Fatalf("plan output does not show the rollout: %s", change)
+	}
+
+	// Soaked, but FMS has not evaluated the policy anywhere yet.
+	change = upsert(created.Add(73 * time.Hour))
+	if change.Action != ActionNoOp || change.Rollout.Stage != StageHeld || change.Rollout.Reason != "not evaluated by FMS yet" {
+		t.Fatalf("expected the policy to be held, got %s", change)
+	}
+
+	client.SetCompliance(aws.ToString(lp.PolicyId), fmstypes.PolicyComplianceStatus{
+		MemberAccount:     aws.String("111111111111"),
+		EvaluationResults: []fmstypes.EvaluationResult{{ComplianceStatus: fmstypes.PolicyComplianceStatusTypeNonCompliant, ViolatorCount: 2}},
+	})
+	change = upsert(created.Add(73 * time.Hour))
+	if change.Action != ActionUpdate || change.Rollout.Stage != StageEnforce {
+		t.Fatalf("expected remediation to be switched on, got %s", change)
+	}
+	if lp, _ = live(); !lp.RemediationEnabled {
+		t.Fatalf("enforce did not enable remediation")
+	}
+
+	change = upsert(created.Add(100 * time.Hour))
+	if change.Action != ActionNoOp || change.Rollout.Stage != StageEnforced {
+		t.Fatalf("expected an enforced no-op, got %s", change)
+	}
+}
+
+func TestComplianceHold(t *testing.T) {
+	evaluated := func(account string, status fmstypes.PolicyComplianceStatusType) fmstypes.PolicyComplianceStatus {
+		return fmstypes.PolicyComplianceStatus{
+			MemberAccount:     aws.String(account),
+			EvaluationResults: []fmstypes.EvaluationResult{{ComplianceStatus: status}},
+		}
+	}
+	one := 1
+	tests := []struct {
+		name     string
+		statuses []fmstypes.PolicyComplianceStatus
+		max      *int
+		want     string
+	}{
+		{name: "not evaluated", want: "not evaluated by FMS yet"},
+		{name: "compliant", statuses: []fmstypes.PolicyComplianceStatus{evaluated("111111111111", fmstypes.PolicyComplianceStatusTypeCompliant)}},
+		{
+			name: "dependent service issue",
+			statuses: []fmstypes.PolicyComplianceStatus{{
+				MemberAccount: aws.String("222222222222"),
+				IssueInfoMap:  map[string]string{"AWSCONFIG": "config is not enabled"},
+			}},
+			want: "dependent service issues in 222222222222/AWSCONFIG",
+		},
+		{
+			name: "within violation limit",
+			statuses: []fmstypes.PolicyComplianceStatus{
+				evaluated("111111111111", fmstypes.PolicyComplianceStatusTypeNonCompliant),
+				evaluated("222222222222", fmstypes.PolicyComplianceStatusTypeCompliant),
+			},
+			max: &one,
+		},
+		{
+			name: "over violation limit",
+			statuses: []fmstypes.PolicyComplianceStatus{
+				evaluated("111111111111", fmstypes.PolicyComplianceStatusTypeNonCompliant),
+				evaluated("222222222222", fmstypes.PolicyComplianceStatusTypeNonCompliant),
+			},
+			max:  &one,
+			want: "2 non-compliant accounts exceed 1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fmsfake.New()
+			client.SetCompliance("policy-1", tc.statuses...)
+			got, err := inventory(t, client).complianceHold(context.Background(), "policy-1", tc.max)
+			if err != nil {
+				t.Fatalf("compliance hold: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRolloutSummary(t *testing.T) {
+	soonest := time.Date(2026, 10, 4, 12, 0, 0, 0, time.UTC)
+	later := soonest.Add(time.Hour)
+	changes := []Change{
+		{Policy: "a", Rollout: &RolloutStatus{Stage: StageAudit, EnforceAfter: &later}},
+		{Policy: "b", Rollout: &RolloutStatus{Stage: StageAudit, EnforceAfter: &soonest}},
+		{Policy: "c", Rollout: &RolloutStatus{Stage: StageEnforced}},
+		{Policy: "d"},
+	}
+	want := "rollout: 2 audit, 0 held, 0 enforce, 1 enforced, next enforcement after 2026-10-04T12:00:00Z"
+	if got := RolloutSummary(changes); got != want {
+		t.Fatalf("unexpected summary %q", got)
+	}
+	if got := RolloutSummary(changes[3:]); got != "" {
+		t.Fatalf("expected no summary without staged policies, got %q", got)
+	}
+}
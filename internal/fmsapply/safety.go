@@ -0,0 +1,177 @@
+package fmsapply
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// ErrUnsafeChange is returned when a plan exceeds the safety limits and the run was not
+// forced.
+var ErrUnsafeChange = errors.New("plan exceeds safety limits")
+
+// defaultActionField is the diff field of a WAF policy's default action.
+const defaultActionField = "managed_service_data.defaultAction"
+
+// SafetyOptions bounds what one run may change. Zero limits are not enforced; a policy
+// created with, or changed to, a BLOCK default action always needs AcknowledgeBlock.
+type SafetyOptions struct {
+	MaxCreates              int
+	MaxUpdates              int
+	MaxDeletes              int
+	MaxRuleSetChangePercent float64
+	// AcknowledgeBlock allows policies whose default action becomes BLOCK.
+	AcknowledgeBlock bool
+	// Force runs the plan despite any violation; the violations are only logged.
+	Force bool
+}
+
+// SafetyOptionsFor derives the safety limits from the config. AcknowledgeBlock and Force
+// are per run and left unset.
+func SafetyOptionsFor(cfg *config.PolicyConfig) SafetyOptions {
+	return SafetyOptions{
+		MaxCreates:              cfg.Safety.MaxCreates,
+		MaxUpdates:              cfg.Safety.MaxUpdates,
+		MaxDeletes:              cfg.Safety.MaxDeletes,
+		MaxRuleSetChangePercent: cfg.Safety.MaxRuleSetChangePercent,
+	}
+}
+
+// SafetyViolation is one safety limit a plan exceeds.
+type SafetyViolation struct {
+	Limit  string
+	Detail string
+}
+
+func (v SafetyViolation) String() string {
+	return v.Limit + ": " + v.Detail
+}
+
+// CheckSafety lists the safety limits the plan exceeds. A resource counts as changing
+// rule set when the policy it is rendered into is updated with a different
+// managed_service_data.
+func CheckSafety(plan *Plan, opts SafetyOptions) []SafetyViolation {
+	counts := plan.Counts()
+	var violations []SafetyViolation
+	for _, limit := range []struct {
+		name   string
+		action Action
+		max    int
+	}{
+		{"maxCreates", ActionCreate, opts.MaxCreates},
+		{"maxUpdates", ActionUpdate, opts.MaxUpdates},
+		{"maxDeletes", ActionDelete, opts.MaxDeletes},
+	} {
+		if limit.max > 0 && counts[limit.action] > limit.max {
+			violations = append(violations, SafetyViolation{
+				Limit:  limit.name,
+				Detail: fmt.Sprintf("%d policies to %s exceed %d", counts[limit.action], limit.action, limit.max),
+			})
+		}
+	}
+
+	var resources, changed int
+	var blocking []string
+	for _, planned := range plan.Policies {
+		if planned.Change.Action == ActionDelete {
+			continue
+		}
+		resources += len(planned.Policy.Resources)
+		switch set := planned.Change.ResourceSet; {
+		case planned.Change.Action == ActionUpdate && changesServiceData(planned.Change):
+			changed += len(planned.Policy.Resources)
+		case set != nil && planned.Change.Action == ActionUpdate:
+			// Resources joining or leaving a policy's resource set change rule set too.
+			changed += len(set.Associate) + len(set.Disassociate)
+			resources += len(set.Disassociate)
+		}
+		if becomesBlocking(planned) {
+			blocking = append(blocking, planned.Policy.Name)
+		}
+	}
+	if opts.MaxRuleSetChangePercent > 0 && resources > 0 {
+		if share := float64(changed) * 100 / float64(resources); share > opts.MaxRuleSetChangePercent {
+			violations = append(violations, SafetyViolation{
+				Limit:  "maxRuleSetChangePercent",
+				Detail: fmt.Sprintf("%d of %d resources (%.1f%%) change rule set, more than %g%%", changed, resources, share, opts.MaxRuleSetChangePercent),
+			})
+		}
+	}
+	if len(blocking) > 0 && !opts.AcknowledgeBlock {
+		violations = append(violations, SafetyViolation{
+			Limit:  "defaultAction BLOCK",
+			Detail: fmt.Sprintf("%s would block by default; acknowledge it explicitly", strings.Join(blocking, ", ")),
+		})
+	}
+	return violations
+}
+
+// EnforceSafety checks the plan before anything is written. Violations abort the run
+// with an error wrapping ErrUnsafeChange that lists them, unless opts.Force is set, in
+// which case they are logged and the run goes on.
+func EnforceSafety(plan *Plan, opts SafetyOptions, logger *util.Logger) error {
+	violations := CheckSafety(plan, opts)
+	if len(violations) == 0 {
+		return nil
+	}
+	if opts.Force {
+		for _, v := range violations {
+			logger.Warnf("safety: forced past %s", v)
+		}
+		return nil
+	}
+	lines := make([]string, len(violations))
+	for i, v := range violations {
+		lines[i] = "  - " + v.String()
+	}
+	return fmt.Errorf("%w (force the run to proceed anyway):\n%s", ErrUnsafeChange, strings.Join(lines, "\n"))
+}
+
+func changesServiceData(c Change) bool {
+	for _, f := range c.Fields {
+		if f.Field == "managed_service_data" || strings.HasPrefix(f.Field, "managed_service_data.") {
+			return true
+		}
+	}
+	return false
+}
+
+// escalation says what a policy planned again after a token conflict changes beyond the
+// plan the safety checks saw, or "" when it changes nothing they would weigh differently.
+func escalation(checked, replanned PlannedPolicy) string {
+	switch {
+	case replanned.Change.Action == ActionUpdate && changesServiceData(replanned.Change) && !changesServiceData(checked.Change):
+		return "changes its rule set"
+	case becomesBlocking(replanned) && !becomesBlocking(checked):
+		return "makes it block by default"
+	}
+	return ""
+}
+
+// becomesBlocking reports whether a planned create or update leaves a WAF policy with a
+// BLOCK default action that it did not have before.
+func becomesBlocking(planned PlannedPolicy) bool {
+	var doc struct {
+		DefaultAction struct {
+			Type string `json:"type"`
+		} `json:"defaultAction"`
+	}
+	if err := json.Unmarshal([]byte(planned.Policy.ManagedServiceData), &doc); err != nil || !strings.EqualFold(doc.DefaultAction.Type, "BLOCK") {
+		return false
+	}
+	switch planned.Change.Action {
+	case ActionCreate:
+		return true
+	case ActionUpdate:
+		for _, f := range planned.Change.Fields {
+			if f.Field == "managed_service_data" || strings.HasPrefix(f.Field, defaultActionField) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package fmsapply
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func safetyPlan() *Plan {
+	planned := func(name string, action Action, msd string, resources int, fields ...FieldChange) PlannedPolicy {
+		p := policy.RenderedPolicy{Name: name, ManagedServiceData: msd}
+		for i := 0; i < resources; i++ {
+			p.Resources = append(p.Resources, name+"/"+string(rune('a'+i)))
+		}
+		return PlannedPolicy{Policy: p, Change: Change{Action: action, Policy: name, Fields: fields}}
+	}
+	allow := `{"type":"WAFV2","defaultAction":{"type":"ALLOW"}}`
+	block := `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`
+	return &Plan{Policies: []PlannedPolicy{
+		planned("auto-new", ActionCreate, allow, 1),
+		planned("auto-rules", ActionUpdate, allow, 2, FieldChange{Field: "managed_service_data.postProcessRuleGroups[0].ruleGroupArn", Old: `"a"`, New: `"b"`}),
+		planned("auto-block", ActionUpdate, block, 1, FieldChange{Field: "managed_service_data.defaultAction.type", Old: `"ALLOW"`, New: `"BLOCK"`}),
+		planned("auto-scope", ActionUpdate, block, 3, FieldChange{Field: "include_map"}),
+		planned("auto-same", ActionNoOp, allow, 3),
+		{Policy: policy.RenderedPolicy{Name: "auto-gone"}, Change: Change{Action: ActionDelete, Policy: "auto-gone"}},
+	}}
+}
+
+func TestCheckSafety(t *testing.T) {
+	tests := []struct {
+		name string
+		opts SafetyOptions
+		want []string
+	}{
+		{name: "no limits", opts: SafetyOptions{AcknowledgeBlock: true}},
+		{name: "limits not reached", opts: SafetyOptions{MaxCreates: 1, MaxUpdates: 3, MaxDeletes: 1, MaxRuleSetChangePercent: 30, AcknowledgeBlock: true}},
+		{
+			name: "limits exceeded",
+			opts: SafetyOptions{MaxCreates: 1, MaxUpdates: 2, MaxDeletes: 1, MaxRuleSetChangePercent: 25, AcknowledgeBlock: true},
+			want: []string{
+				"maxUpdates: 3 policies to update exceed 2",
+				"maxRuleSetChangePercent: 3 of 10 resources (30.0%) change rule set, more than 25%",
+			},
+		},
+		{
+			name: "unacknowledged block",
+			want: []string{"defaultAction BLOCK: auto-block would block by default; acknowledge it explicitly"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, v := range CheckSafety(safetyPlan(), tc.opts) {
+				got = append(got, v.String())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected violations:\n got %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckSafety_BlockingCreate(t *testing.T) {
+	plan := &Plan{Policies: []PlannedPolicy{{
+		Policy: policy.RenderedPolicy{Name: "auto-new", ManagedServiceData: `{"type":"WAFV2","defaultAction":{"type":"BLOCK"}}`},
+		Change: Change{Action: ActionCreate, Policy: "auto-new"},
+	}}}
+	if v := CheckSafety(plan, SafetyOptions{}); len(v) != 1 || v[0].Limit != "defaultAction BLOCK" {
+		t.Fatalf("expected a new blocking policy to need acknowledgement, got %v", v)
+	}
+}
+
+func TestEnforceSafety(t *testing.T) {
+	logger := util.NewLogger()
+	opts := SafetyOptions{MaxUpdates: 1}
+
+	err := EnforceSafety(safetyPlan(), opts, logger)
+	if !errors.Is(err, ErrUnsafeChange) {
+		t.Fatalf("expected ErrUnsafeChange, got %v", err)
+	}
+	for _, want := range []string{"maxUpdates: 3 policies to update exceed 1", "defaultAction BLOCK: auto-block"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("report is missing %q:\n%v", want, err)
+		}
+	}
+
+	opts.Force = true
+	if err := EnforceSafety(safetyPlan(), opts, logger); err != nil {
+		t.Fatalf("forced run failed: %v", err)
+	}
+}
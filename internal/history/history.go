@@ -0,0 +1,83 @@
+// Package history stores the versions of FMS policies the tool replaced, so a bad
+// update can be rolled back. Versions are kept per policy name and numbered from 1.
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrVersionNotFound is returned when a policy has no version with the requested number.
+var ErrVersionNotFound = errors.New("policy version not found")
+
+// Version is a snapshot of a live policy taken before the tool replaced it.
+type Version struct {
+	// Number is assigned by the store when the version is saved.
+	Number     int       `json:"version"`
+	PolicyName string    `json:"policy_name"`
+	PolicyID   string    `json:"policy_id"`
+	PolicyARN  string    `json:"policy_arn,omitempty"`
+	SavedAt    time.Time `json:"saved_at"`
+	// UpdateToken is the token the policy had when it was replaced; it is kept for
+	// reference and never reused, since every write changes it.
+	UpdateToken string `json:"update_token"`
+	// Tags are the policy's tags, including the ownership tags of the write that
+	// produced this version.
+	Tags   map[string]string `json:"tags,omitempty"`
+	Policy fmstypes.Policy   `json:"policy"`
+}
+
+// Store keeps policy versions.
+type Store interface {
+	// Save stores v as the next version of its policy and returns it with its number.
+	Save(ctx context.Context, v Version) (Version, error)
+	// List returns the versions of a policy, oldest first.
+	List(ctx context.Context, policyName string) ([]Version, error)
+	// Get returns one version of a policy, or an error wrapping ErrVersionNotFound.
+	Get(ctx context.Context, policyName string, number int) (Version, error)
+}
+
+// Open returns the store at location: an s3://bucket/prefix URI or a local directory.
+// An empty location returns a nil store, which disables the history.
+func Open(awsCfg aws.Config, location string) (Store, error) {
+	switch {
+	case location == "":
+		return nil, nil
+	case strings.HasPrefix(location, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid S3 URI %q (want s3://bucket/prefix)", location)
+		}
+		return NewS3Store(s3.NewFromConfig(awsCfg), bucket, prefix), nil
+	}
+	return NewLocalStore(location), nil
+}
+
+// policyDir is the directory, or key prefix, of a policy's versions. Policy names may
+// contain slashes and spaces, so they are escaped.
+func policyDir(policyName string) string {
+	return url.PathEscape(policyName)
+}
+
+// versionFile names a version, zero-padded so versions sort by name.
+func versionFile(number int) string {
+	return fmt.Sprintf("%06d.json", number)
+}
+
+// parseVersionFile returns the number of a version file name, or false for other files.
+func parseVersionFile(name string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+	if err != nil || !strings.HasSuffix(name, ".json") || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,142 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeS3 is an in-memory bucket that honours If-None-Match on PutObject.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.ToString(in.Key)
+	if _, ok := f.objects[key]; ok && aws.ToString(in.IfNoneMatch) == "*" {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(in.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+func TestStores(t *testing.T) {
+	s3client := &fakeS3{objects: map[string][]byte{}}
+	stores := map[string]Store{
+		"local": NewLocalStore(t.TempDir()),
+		"s3":    NewS3Store(s3client, "bucket", "/history/"),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			policyName := "auto-alb edge/1"
+
+			if versions, err := store.List(ctx, policyName); err != nil || len(versions) != 0 {
+				t.Fatalf("expected no versions, got %v: %v", versions, err)
+			}
+			for _, token := range []string{"token-1", "token-2"} {
+				if _, err := store.Save(ctx, Version{
+					PolicyName:  policyName,
+					PolicyID:    "policy-1",
+					UpdateToken: token,
+					Policy:      fmstypes.Policy{PolicyName: aws.String(policyName), RemediationEnabled: true},
+				}); err != nil {
+					t.Fatalf("save: %v", err)
+				}
+			}
+			// Another policy's versions are numbered separately.
+			if v, err := store.Save(ctx, Version{PolicyName: "auto-alb-other"}); err != nil || v.Number != 1 {
+				t.Fatalf("expected version 1 of another policy, got %d: %v", v.Number, err)
+			}
+
+			versions, err := store.List(ctx, policyName)
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if len(versions) != 2 || versions[0].Number != 1 || versions[1].Number != 2 || versions[1].UpdateToken != "token-2" {
+				t.Fatalf("unexpected versions %+v", versions)
+			}
+			v, err := store.Get(ctx, policyName, 1)
+			if err != nil || v.UpdateToken != "token-1" || !v.Policy.RemediationEnabled || aws.ToString(v.Policy.PolicyName) != policyName {
+				t.Fatalf("unexpected version 1 %+v: %v", v, err)
+			}
+			if _, err := store.Get(ctx, policyName, 3); !errors.Is(err, ErrVersionNotFound) {
+				t.Fatalf("expected ErrVersionNotFound, got %v", err)
+			}
+		})
+	}
+	if _, ok := s3client.objects["history/auto-alb%20edge%2F1/000001.json"]; !ok {
+		t.Fatalf("unexpected S3 layout: %v", s3client.objects)
+	}
+}
+
+func TestStores_ConcurrentSaves(t *testing.T) {
+	stores := map[string]Store{
+		"local": NewLocalStore(t.TempDir()),
+		"s3":    NewS3Store(&fakeS3{objects: map[string][]byte{}}, "bucket", ""),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := store.Save(context.Background(), Version{PolicyName: "auto-alb-a"}); err != nil {
+						t.Errorf("save: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			versions, err := store.List(context.Background(), "auto-alb-a")
+			if err != nil || len(versions) != 8 {
+				t.Fatalf("expected 8 versions, got %d: %v", len(versions), err)
+			}
+		})
+	}
+}
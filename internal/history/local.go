@@ -0,0 +1,125 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LocalStore keeps versions as JSON files in a directory, one subdirectory per policy.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore returns a store rooted at dir, which is created on the first save.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+var _ Store = (*LocalStore)(nil)
+
+// Save writes v as the next version. The file is written under a temporary name and
+// linked into place, so readers never see a partial version and concurrent saves of the
+// same policy never overwrite each other; the loser retries.
+func (s *LocalStore) Save(_ context.Context, v Version) (Version, error) {
+	dir := filepath.Join(s.dir, policyDir(v.PolicyName))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Version{}, fmt.Errorf("create history directory: %w", err)
+	}
+	for {
+		numbers, err := s.numbers(dir)
+		if err != nil {
+			return Version{}, err
+		}
+		v.Number = 1
+		if len(numbers) > 0 {
+			v.Number = numbers[len(numbers)-1] + 1
+		}
+		err = writeExclusive(dir, versionFile(v.Number), v)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return Version{}, fmt.Errorf("save version %d of %s: %w", v.Number, v.PolicyName, err)
+		}
+		return v, nil
+	}
+}
+
+// writeExclusive writes v as JSON to dir/name, failing with fs.ErrExist if it exists.
+func writeExclusive(dir, name string, v Version) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".version-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(tmp.Name(), filepath.Join(dir, name))
+}
+
+// List reads every version of a policy.
+func (s *LocalStore) List(ctx context.Context, policyName string) ([]Version, error) {
+	numbers, err := s.numbers(filepath.Join(s.dir, policyDir(policyName)))
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(numbers))
+	for _, n := range numbers {
+		v, err := s.Get(ctx, policyName, n)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// Get reads one version of a policy.
+func (s *LocalStore) Get(_ context.Context, policyName string, number int) (Version, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, policyDir(policyName), versionFile(number)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Version{}, fmt.Errorf("%w: %s version %d", ErrVersionNotFound, policyName, number)
+	}
+	if err != nil {
+		return Version{}, fmt.Errorf("read %s version %d: %w", policyName, number, err)
+	}
+	var v Version
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Version{}, fmt.Errorf("decode %s version %d: %w", policyName, number, err)
+	}
+	return v, nil
+}
+
+// numbers lists the version numbers stored in a policy directory, ascending.
+func (s *LocalStore) numbers(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list history directory: %w", err)
+	}
+	var numbers []int
+	for _, e := range entries {
+		if n, ok := parseVersionFile(e.Name()); ok && !e.IsDir() {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
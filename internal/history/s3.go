@@ -0,0 +1,143 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3API is the subset of the S3 client the store uses.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// S3Store keeps versions as JSON objects under <prefix>/<policy>/ in a bucket.
+type S3Store struct {
+	client S3API
+	bucket string
+	prefix string
+}
+
+// NewS3Store returns a store writing to bucket under prefix, which may be empty.
+func NewS3Store(client S3API, bucket, prefix string) *S3Store {
+	return &S3Store{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+var _ Store = (*S3Store)(nil)
+
+// Save writes v as the next version. The object is written with If-None-Match, so
+// concurrent saves of the same policy never overwrite each other; the loser retries.
+func (s *S3Store) Save(ctx context.Context, v Version) (Version, error) {
+	for {
+		numbers, err := s.numbers(ctx, v.PolicyName)
+		if err != nil {
+			return Version{}, err
+		}
+		v.Number = 1
+		if len(numbers) > 0 {
+			v.Number = numbers[len(numbers)-1] + 1
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return Version{}, fmt.Errorf("encode version: %w", err)
+		}
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(s.key(v.PolicyName, versionFile(v.Number))),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+			IfNoneMatch: aws.String("*"),
+		})
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+			continue
+		}
+		if err != nil {
+			return Version{}, fmt.Errorf("save version %d of %s: %w", v.Number, v.PolicyName, err)
+		}
+		return v, nil
+	}
+}
+
+// List reads every version of a policy.
+func (s *S3Store) List(ctx context.Context, policyName string) ([]Version, error) {
+	numbers, err := s.numbers(ctx, policyName)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(numbers))
+	for _, n := range numbers {
+		v, err := s.Get(ctx, policyName, n)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// Get reads one version of a policy.
+func (s *S3Store) Get(ctx context.Context, policyName string, number int) (Version, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(policyName, versionFile(number))),
+	})
+	var noKey *s3types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return Version{}, fmt.Errorf("%w: %s version %d", ErrVersionNotFound, policyName, number)
+	}
+	if err != nil {
+		return Version{}, fmt.Errorf("read %s version %d: %w", policyName, number, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return Version{}, fmt.Errorf("read %s version %d: %w", policyName, number, err)
+	}
+	var v Version
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Version{}, fmt.Errorf("decode %s version %d: %w", policyName, number, err)
+	}
+	return v, nil
+}
+
+// numbers lists the version numbers stored for a policy, ascending.
+func (s *S3Store) numbers(ctx context.Context, policyName string) ([]int, error) {
+	prefix := s.key(policyName, "")
+	var numbers []int
+	pager := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list versions of %s: %w", policyName, err)
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if n, ok := parseVersionFile(name); ok && !strings.Contains(name, "/") {
+				numbers = append(numbers, n)
+			}
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// key returns the object key of a file in a policy's directory; an empty file gives the
+// directory prefix, with a trailing slash.
+func (s *S3Store) key(policyName, file string) string {
+	return path.Join(s.prefix, policyDir(policyName)) + "/" + file
+}
@@ -0,0 +1,477 @@
+// Package importer bootstraps a policy-variants config from FMS WAF policies that
+// were created by hand, so they can be brought under tag-driven management.
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+)
+
+const (
+	// BaselineRuleSet names the primary rule set of policies that only use the
+	// resourceDefaults rule groups.
+	BaselineRuleSet = "baseline"
+	// NoneRuleSet is the single, empty secondary rule set of an imported config.
+	NoneRuleSet = "none"
+)
+
+// API is the subset of the FMS client the importer reads from.
+type API interface {
+	ListPolicies(ctx context.Context, params *fms.ListPoliciesInput, optFns ...func(*fms.Options)) (*fms.ListPoliciesOutput, error)
+	GetPolicy(ctx context.Context, params *fms.GetPolicyInput, optFns ...func(*fms.Options)) (*fms.GetPolicyOutput, error)
+}
+
+// resourceKeys maps FMS resource types onto the resourceDefaults keys used by discovery.
+var resourceKeys = map[string]struct{ key, scope string }{
+	"AWS::ElasticLoadBalancingV2::LoadBalancer": {key: "alb", scope: "REGIONAL"},
+	"AWS::CloudFront::Distribution":             {key: "cloudfront", scope: "CLOUDFRONT"},
+}
+
+// Report describes how the live policies map onto the generated config.
+type Report struct {
+	// Mappings lists, per imported policy, the tag values that reproduce it.
+	Mappings []Mapping
+	// Skipped lists policies that were not imported at all.
+	Skipped []Finding
+	// Unexpressible lists settings of imported policies the config model cannot reproduce.
+	Unexpressible []Finding
+}
+
+// Mapping ties an imported policy to its resourceDefaults entry and candidate tag values.
+type Mapping struct {
+	Policy           string
+	ResourceDefaults string
+	Primary          string
+	Secondary        string
+}
+
+// Finding is one policy setting that was skipped or cannot be expressed.
+type Finding struct {
+	Policy  string
+	Setting string
+	Detail  string
+}
+
+// FetchPolicies lists every FMS policy and fetches its full definition.
+func FetchPolicies(ctx context.Context, client API) ([]fmstypes.Policy, error) {
+	var out []fmstypes.Policy
+	pager := fms.NewListPoliciesPaginator(client, &fms.ListPoliciesInput{})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list policies: %w", err)
+		}
+		for _, summary := range page.PolicyList {
+			if summary.PolicyId == nil {
+				continue
+			}
+			gp, err := client.GetPolicy(ctx, &fms.GetPolicyInput{PolicyId: summary.PolicyId})
+			if err != nil {
+				return nil, fmt.Errorf("get policy %s: %w", aws.ToString(summary.PolicyName), err)
+			}
+			if gp.Policy != nil {
+				out = append(out, *gp.Policy)
+			}
+		}
+	}
+	return out, nil
+}
+
+// imported is a parsed WAFV2 policy.
+type imported struct {
+	name     string
+	key      string
+	defaults config.ResourceDefaults
+	pre      []config.RuleGroupConfig
+	post     []config.RuleGroupConfig
+}
+
+// Build generates a config that reproduces the WAFV2 policies. Rule groups shared by
+// every policy of a resource type become resourceDefaults; the remainder of each
+// policy becomes a primary rule set, deduplicated across policies, whose name is the
+// candidate tag value for the resources the policy protected.
+func Build(policies []fmstypes.Policy, tagKeys config.TagKeys) (*config.PolicyConfig, *Report, error) {
+	report := &Report{}
+
+	sorted := append([]fmstypes.Policy(nil), policies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return aws.ToString(sorted[i].PolicyName) < aws.ToString(sorted[j].PolicyName)
+	})
+
+	byKey := map[string][]imported{}
+	for _, p := range sorted {
+		imp, ok := parsePolicy(p, report)
+		if ok {
+			byKey[imp.key] = append(byKey[imp.key], imp)
+		}
+	}
+	if len(byKey) == 0 {
+		return nil, report, fmt.Errorf("no importable WAFV2 policies found")
+	}
+
+	cfg := &config.PolicyConfig{
+		ResourceDefaults: map[string]config.ResourceDefaults{},
+		TagKeys:          tagKeys,
+		RuleSets: config.RuleSets{
+			Primary:   map[string]config.RuleSet{},
+			Secondary: map[string]config.RuleSet{NoneRuleSet: {}},
+		},
+	}
+
+	ruleSetNames := map[string]string{} // rule set fingerprint -> name
+	usage := map[string]int{}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		group := byKey[key]
+		defaults := commonDefaults(group, report)
+		defaults.ManagedRuleGroups = commonPrefix(group)
+		defaults.PostProcessRuleGroups = commonSuffix(group)
+		cfg.ResourceDefaults[key] = defaults
+
+		for _, imp := range group {
+			rs := config.RuleSet{
+				RuleGroups:            imp.pre[len(defaults.ManagedRuleGroups):],
+				PostProcessRuleGroups: imp.post[:len(imp.post)-len(defaults.PostProcessRuleGroups)],
+			}
+			name := ruleSetName(cfg, ruleSetNames, rs, imp.name)
+			usage[name]++
+			report.Mappings = append(report.Mappings, Mapping{
+				Policy:           imp.name,
+				ResourceDefaults: key,
+				Primary:          name,
+				Secondary:        NoneRuleSet,
+			})
+		}
+	}
+
+	cfg.Defaults = config.RuleSetDefaults{Primary: mostUsed(usage), Secondary: NoneRuleSet}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, report, fmt.Errorf("generated config is invalid: %w", err)
+	}
+	return cfg, report, nil
+}
+
+// parsePolicy converts a live policy, recording anything it cannot carry over.
+func parsePolicy(p fmstypes.Policy, report *Report) (imported, bool) {
+	name := aws.ToString(p.PolicyName)
+	skip := func(setting, detail string) (imported, bool) {
+		report.Skipped = append(report.Skipped, Finding{Policy: name, Setting: setting, Detail: detail})
+		return imported{}, false
+	}
+
+	if p.SecurityServicePolicyData == nil || p.SecurityServicePolicyData.ManagedServiceData == nil {
+		return skip("managed_service_data", "policy has no managed service data")
+	}
+	if t := p.SecurityServicePolicyData.Type; t != fmstypes.SecurityServiceTypeWafv2 {
+		return skip("type", fmt.Sprintf("policy type %s is not imported", t))
+	}
+	resourceType := aws.ToString(p.ResourceType)
+	if len(p.ResourceTypeList) > 1 {
+		return skip("resourceTypeList", fmt.Sprintf("policy covers several resource types %v", p.ResourceTypeList))
+	}
+	if resourceType == "" && len(p.ResourceTypeList) == 1 {
+		resourceType = p.ResourceTypeList[0]
+	}
+	rk, ok := resourceKeys[resourceType]
+	if !ok {
+		return skip("resourceType", fmt.Sprintf("resource type %q is not discovered by this tool", resourceType))
+	}
+
+	unexpressible := func(setting, detail string) {
+		report.Unexpressible = append(report.Unexpressible, Finding{Policy: name, Setting: setting, Detail: detail})
+	}
+
+	raw := []byte(aws.ToString(p.SecurityServicePolicyData.ManagedServiceData))
+	var doc policy.WAFv2ServiceData
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return skip("managed_service_data", fmt.Sprintf("cannot parse: %v", err))
+	}
+	for _, f := range unknownFields(raw) {
+		unexpressible("managed_service_data."+f, "field is not part of the config model and was dropped")
+	}
+
+	if len(p.IncludeMap) > 0 || len(p.ExcludeMap) > 0 {
+		unexpressible("includeMap/excludeMap", "account and OU scope is set per deployment (OU_ID), not per policy")
+	}
+	if len(p.ResourceTags) > 0 {
+		unexpressible("resourceTags", "tag scope is derived from grouping, not copied")
+	}
+	if len(p.ResourceSetIds) > 0 {
+		unexpressible("resourceSetIds", "resource sets are managed through grouping.scopeBy")
+	}
+	if !p.RemediationEnabled {
+		unexpressible("remediationEnabled", "remediation is only disabled by a staged rollout; set rollout.mode staged to keep new policies in audit mode")
+	}
+	if p.DeleteUnusedFMManagedResources {
+		unexpressible("deleteUnusedFMManagedResources", "not configurable")
+	}
+
+	return imported{
+		name:     name,
+		key:      rk.key,
+		defaults: defaultsFromDocument(doc, resourceType, rk.scope),
+		pre:      fromWAFv2RuleGroups(doc.PreProcessRuleGroups),
+		post:     fromWAFv2RuleGroups(doc.PostProcessRuleGroups),
+	}, true
+}
+
+// defaultsFromDocument extracts everything except rule groups into ResourceDefaults.
+func defaultsFromDocument(doc policy.WAFv2ServiceData, resourceType, scope string) config.ResourceDefaults {
+	rd := config.ResourceDefaults{
+		ResourceType:                      resourceType,
+		Scope:                             scope,
+		DefaultAction:                     doc.DefaultAction.Type,
+		OverrideCustomerWebACLAssociation: doc.OverrideCustomerWebACLAssociation,
+		TokenDomains:                      doc.TokenDomains,
+	}
+	if cr := doc.DefaultAction.CustomResponse; cr != nil {
+		resp := &config.CustomResponse{ResponseCode: cr.ResponseCode, CustomResponseBodyKey: cr.CustomResponseBodyKey}
+		for _, h := range cr.ResponseHeaders {
+			if resp.ResponseHeaders == nil {
+				resp.ResponseHeaders = map[string]string{}
+			}
+			resp.ResponseHeaders[h.Name] = h.Value
+		}
+		rd.DefaultActionResponse = resp
+	}
+	if lc := doc.LoggingConfiguration; lc != nil {
+		logging := &config.LoggingConfig{LogDestinationConfigs: lc.LogDestinationConfigs}
+		for _, f := range lc.RedactedFields {
+			logging.RedactedFields = append(logging.RedactedFields, config.RedactedField{Type: f.RedactedFieldType, Value: f.RedactedFieldValue})
+		}
+		rd.Logging = logging
+	}
+	for key, body := range doc.CustomResponseBodies {
+		if rd.CustomResponseBodies == nil {
+			rd.CustomResponseBodies = map[string]config.CustomResponseBody{}
+		}
+		rd.CustomResponseBodies[key] = config.CustomResponseBody{ContentType: body.ContentType, Content: body.Content}
+	}
+	return rd
+}
+
+func fromWAFv2RuleGroups(groups []policy.WAFv2RuleGroup) []config.RuleGroupConfig {
+	out := make([]config.RuleGroupConfig, 0, len(groups))
+	for _, g := range groups {
+		rg := config.RuleGroupConfig{ARN: g.RuleGroupArn}
+		if id := g.ManagedRuleGroupIdentifier; id != nil {
+			rg.Vendor = id.VendorName
+			rg.Name = id.ManagedRuleGroupName
+			if id.VersionEnabled {
+				rg.Version = id.Version
+			}
+		}
+		if g.OverrideAction.Type != "" && g.OverrideAction.Type != "NONE" {
+			rg.OverrideAction = g.OverrideAction.Type
+		}
+		for _, r := range g.ExcludeRules {
+			rg.ExcludeRules = append(rg.ExcludeRules, r.Name)
+		}
+		for _, o := range g.RuleActionOverrides {
+			rg.RuleActionOverrides = append(rg.RuleActionOverrides, config.RuleActionOverride{
+				Name:   o.Name,
+				Action: actionName(o.ActionToUse),
+			})
+		}
+		out = append(out, rg)
+	}
+	return out
+}
+
+func actionName(a policy.WAFv2ActionToUse) string {
+	switch {
+	case a.Allow != nil:
+		return "ALLOW"
+	case a.Block != nil:
+		return "BLOCK"
+	case a.Count != nil:
+		return "COUNT"
+	case a.Captcha != nil:
+		return "CAPTCHA"
+	case a.Challenge != nil:
+		return "CHALLENGE"
+	}
+	return ""
+}
+
+// commonDefaults picks the non-rule-group settings shared by most policies of a type and
+// reports every policy that deviates from them.
+func commonDefaults(group []imported, report *Report) config.ResourceDefaults {
+	counts := map[string]int{}
+	byFingerprint := map[string]config.ResourceDefaults{}
+	best := ""
+	for _, imp := range group {
+		fp := fingerprint(imp.defaults)
+		counts[fp]++
+		byFingerprint[fp] = imp.defaults
+		if best == "" || counts[fp] > counts[best] {
+			best = fp
+		}
+	}
+
+	chosen := byFingerprint[best]
+	for _, imp := range group {
+		if fingerprint(imp.defaults) == best {
+			continue
+		}
+		report.Unexpressible = append(report.Unexpressible, Finding{
+			Policy:  imp.name,
+			Setting: "defaultAction/logging/customResponse/tokenDomains",
+			Detail:  fmt.Sprintf("differs from the other %s policies; the generated resourceDefaults use the most common settings", imp.key),
+		})
+	}
+	return chosen
+}
+
+// commonPrefix returns the leading pre-process rule groups shared by every policy.
+func commonPrefix(group []imported) []config.RuleGroupConfig {
+	prefix := group[0].pre
+	for _, imp := range group[1:] {
+		n := 0
+		for n < len(prefix) && n < len(imp.pre) && reflect.DeepEqual(prefix[n], imp.pre[n]) {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+// commonSuffix returns the trailing post-process rule groups shared by every policy.
+func commonSuffix(group []imported) []config.RuleGroupConfig {
+	suffix := group[0].post
+	for _, imp := range group[1:] {
+		n := 0
+		for n < len(suffix) && n < len(imp.post) &&
+			reflect.DeepEqual(suffix[len(suffix)-1-n], imp.post[len(imp.post)-1-n]) {
+			n++
+		}
+		suffix = suffix[len(suffix)-n:]
+	}
+	return suffix
+}
+
+// ruleSetName returns the name of an identical rule set already emitted, or registers rs
+// under a name derived from the policy it came from.
+func ruleSetName(cfg *config.PolicyConfig, names map[string]string, rs config.RuleSet, policyName string) string {
+	fp := fingerprint(rs)
+	if name, ok := names[fp]; ok {
+		return name
+	}
+
+	base := BaselineRuleSet
+	if len(rs.RuleGroups) > 0 || len(rs.PostProcessRuleGroups) > 0 {
+		base = strings.ToLower(strings.Trim(sanitize(policyName), "-"))
+	}
+	name := base
+	for i := 2; ; i++ {
+		if _, taken := cfg.RuleSets.Primary[name]; !taken {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	cfg.RuleSets.Primary[name] = rs
+	names[fp] = name
+	return name
+}
+
+func mostUsed(usage map[string]int) string {
+	best := ""
+	for name, n := range usage {
+		if best == "" || n > usage[best] || (n == usage[best] && name < best) {
+			best = name
+		}
+	}
+	return best
+}
+
+func fingerprint(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func sanitize(s string) string {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			out = append(out, r)
+		default:
+			out = append(out, '-')
+		}
+	}
+	return string(out)
+}
+
+var (
+	knownDocumentFields  = []string{"type", "defaultAction", "overrideCustomerWebACLAssociation", "preProcessRuleGroups", "postProcessRuleGroups", "loggingConfiguration", "customResponseBodies", "tokenDomains"}
+	knownRuleGroupFields = []string{"ruleGroupType", "ruleGroupArn", "managedRuleGroupIdentifier", "overrideAction", "excludeRules", "ruleActionOverrides"}
+	knownManagedFields   = []string{"vendorName", "managedRuleGroupName", "version", "versionEnabled"}
+)
+
+// unknownFields lists the keys of the document, its rule groups and their managed
+// identifiers that the typed model does not carry.
+func unknownFields(raw []byte) []string {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil
+	}
+
+	var out []string
+	for key := range doc {
+		if !contains(knownDocumentFields, key) {
+			out = append(out, key)
+		}
+	}
+	for _, list := range []string{"preProcessRuleGroups", "postProcessRuleGroups"} {
+		var groups []map[string]json.RawMessage
+		if err := json.Unmarshal(doc[list], &groups); err != nil {
+			continue
+		}
+		for i, g := range groups {
+			for key := range g {
+				if !contains(knownRuleGroupFields, key) {
+					out = append(out, fmt.Sprintf("%s[%d].%s", list, i, key))
+				}
+			}
+			var id map[string]json.RawMessage
+			if err := json.Unmarshal(g["managedRuleGroupIdentifier"], &id); err != nil {
+				continue
+			}
+			for key := range id {
+				if !contains(knownManagedFields, key) {
+					out = append(out, fmt.Sprintf("%s[%d].managedRuleGroupIdentifier.%s", list, i, key))
+				}
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/configs"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/policy"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func livePolicy(name, resourceType, msd string) fmstypes.Policy {
+	return fmstypes.Policy{
+		PolicyName:         aws.String(name),
+		ResourceType:       aws.String(resourceType),
+		RemediationEnabled: true,
+		SecurityServicePolicyData: &fmstypes.SecurityServicePolicyData{
+			Type:               fmstypes.SecurityServiceTypeWafv2,
+			ManagedServiceData: aws.String(msd),
+		},
+	}
+}
+
+func alb(id string, tags map[string]string) discovery.Resource {
+	return discovery.Resource{
+		ID:   "imp/" + id,
+		ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/imp/" + id,
+		Type: discovery.ResourceTypeALB,
+		Tags: tags,
+	}
+}
+
+// TestBuild_RoundTrip renders policies, imports them, and checks that the imported
+// config renders the same documents for the reported tag values.
+func TestBuild_RoundTrip(t *testing.T) {
+	logger := util.NewLogger()
+	source, err := config.LoadFromBytes(configs.EmbeddedPolicyVariants)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	resources := []discovery.Resource{
+		alb("a", map[string]string{"WafRulesetPrimary": "ou-shared-edge", "WafRulesetSecondary": "ou-shared-bot"}),
+		alb("b", map[string]string{"WafRulesetPrimary": "ou-shared-app", "WafRulesetSecondary": "ou-shared-anon"}),
+		alb("c", map[string]string{"WafRulesetPrimary": "ou-shared-edge", "WafRulesetSecondary": "ou-shared-bot"}),
+	}
+	rendered, err := policy.BuildPolicies(resources, source, policy.Options{}, logger)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	var live []fmstypes.Policy
+	for _, p := range rendered {
+		live = append(live, livePolicy(p.Name, p.ResourceType, p.ManagedServiceData))
+	}
+
+	cfg, report, err := Build(live, source.TagKeys)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(report.Skipped) != 0 || len(report.Unexpressible) != 0 {
+		t.Fatalf("unexpected findings: %+v", report)
+	}
+	if len(report.Mappings) != len(rendered) {
+		t.Fatalf("expected a mapping per policy, got %+v", report.Mappings)
+	}
+	if len(cfg.RuleSets.Primary) != 2 {
+		t.Fatalf("expected identical policies to share a rule set, got %v", cfg.RuleSets.Primary)
+	}
+	if got := cfg.ResourceDefaults["alb"].ManagedRuleGroups; len(got) != 1 || got[0].Name != "AWSManagedRulesCommonRuleSet" {
+		t.Fatalf("shared rule group not lifted into resourceDefaults: %+v", got)
+	}
+
+	data, err := MarshalConfig(cfg)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	reloaded, err := config.LoadFromBytes(data)
+	if err != nil {
+		t.Fatalf("generated YAML does not load: %v\n%s", err, data)
+	}
+
+	for _, m := range report.Mappings {
+		var res discovery.Resource
+		for _, r := range resources {
+			if rendered[m.Policy].Resources[0] == r.ARN {
+				res = r
+			}
+		}
+		res.Tags = map[string]string{
+			reloaded.TagKeys.Primary:   m.Primary,
+			reloaded.TagKeys.Secondary: m.Secondary,
+		}
+		again, err := policy.BuildPolicies([]discovery.Resource{res}, reloaded, policy.Options{}, logger)
+		if err != nil {
+			t.Fatalf("re-render %s: %v", m.Policy, err)
+		}
+		assertSameJSON(t, m.Policy, again[m.Policy].ManagedServiceData, rendered[m.Policy].ManagedServiceData)
+	}
+}
+
+func TestBuild_ReportsUnexpressibleSettings(t *testing.T) {
+	withExtras := livePolicy("hand-made", "AWS::ElasticLoadBalancingV2::LoadBalancer", `{
+		"type": "WAFV2",
+		"defaultAction": {"type": "ALLOW"},
+		"overrideCustomerWebACLAssociation": false,
+		"sampledRequestsEnabledForDefaultActions": true,
+		"preProcessRuleGroups": [{
+			"ruleGroupType": "ManagedRuleGroup",
+			"managedRuleGroupIdentifier": {"vendorName": "AWS", "managedRuleGroupName": "AWSManagedRulesATPRuleSet", "managedRuleGroupConfigs": []},
+			"overrideAction": {"type": "NONE"},
+			"excludeRules": []
+		}],
+		"postProcessRuleGroups": []
+	}`)
+	withExtras.IncludeMap = map[string][]string{"ACCOUNT": {"111111111111"}}
+
+	shield := livePolicy("shield", "AWS::CloudFront::Distribution", `{"type":"SHIELD_ADVANCED"}`)
+	shield.SecurityServicePolicyData.Type = fmstypes.SecurityServiceTypeShieldAdvanced
+
+	cfg, report, err := Build([]fmstypes.Policy{withExtras, shield}, config.TagKeys{Primary: "P", Secondary: "S"})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if cfg.Defaults.Primary != BaselineRuleSet {
+		t.Fatalf("single policy should map to the baseline rule set, got %q", cfg.Defaults.Primary)
+	}
+
+	if len(report.Skipped) != 1 || report.Skipped[0].Policy != "shield" {
+		t.Fatalf("expected the Shield policy to be skipped: %+v", report.Skipped)
+	}
+	var settings []string
+	for _, f := range report.Unexpressible {
+		settings = append(settings, f.Setting)
+	}
+	want := []string{
+		"managed_service_data.preProcessRuleGroups[0].managedRuleGroupIdentifier.managedRuleGroupConfigs",
+		"managed_service_data.sampledRequestsEnabledForDefaultActions",
+		"includeMap/excludeMap",
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Fatalf("unexpected findings:\n got %v\nwant %v", settings, want)
+	}
+
+	var out strings.Builder
+	if err := report.Write(&out, cfg.TagKeys); err != nil {
+		t.Fatalf("write report: %v", err)
+	}
+	if !strings.Contains(out.String(), "hand-made") || !strings.Contains(out.String(), "Skipped policies") {
+		t.Fatalf("report is missing sections:\n%s", out.String())
+	}
+}
+
+type pagedFMS struct {
+	pages    [][]fmstypes.PolicySummary
+	policies map[string]fmstypes.Policy // keyed by policy ID
+}
+
+func (f *pagedFMS) ListPolicies(_ context.Context, in *fms.ListPoliciesInput, _ ...func(*fms.Options)) (*fms.ListPoliciesOutput, error) {
+	page := 0
+	if in.NextToken != nil {
+		page, _ = strconv.Atoi(*in.NextToken)
+	}
+	out := &fms.ListPoliciesOutput{PolicyList: f.pages[page]}
+	if page+1 < len(f.pages) {
+		out.NextToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return out, nil
+}
+
+func (f *pagedFMS) GetPolicy(_ context.Context, in *fms.GetPolicyInput, _ ...func(*fms.Options)) (*fms.GetPolicyOutput, error) {
+	p := f.policies[aws.ToString(in.PolicyId)]
+	return &fms.GetPolicyOutput{Policy: &p}, nil
+}
+
+func TestFetchPolicies_FollowsPages(t *testing.T) {
+	client := &pagedFMS{
+		pages: [][]fmstypes.PolicySummary{
+			{{PolicyId: aws.String("p1"), PolicyName: aws.String("one")}},
+			{{PolicyId: aws.String("p2"), PolicyName: aws.String("two")}},
+		},
+		policies: map[string]fmstypes.Policy{
+			"p1": {PolicyName: aws.String("one")},
+			"p2": {PolicyName: aws.String("two")},
+		},
+	}
+	got, err := FetchPolicies(context.Background(), client)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(got) != 2 || aws.ToString(got[1].PolicyName) != "two" {
+		t.Fatalf("unexpected policies: %+v", got)
+	}
+}
+
+func assertSameJSON(t *testing.T, name, got, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("%s: decode rendered document: %v", name, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("%s: decode original document: %v", name, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("%s: imported config renders a different document\n got %s\nwant %s", name, got, want)
+	}
+}
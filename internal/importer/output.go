@@ -0,0 +1,103 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// MarshalConfig encodes cfg as YAML, leaving out empty and zero-valued settings so the
+// result reads like a hand-written policy-variants.yaml.
+func MarshalConfig(cfg *config.PolicyConfig) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		return nil, fmt.Errorf("encode config: %w", err)
+	}
+	prune(&node)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by `renderer import`; review before use.\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// prune removes mapping entries whose value is empty, false or zero. Entries of the
+// ruleSets maps are kept even when empty: their keys are the tag values.
+func prune(n *yaml.Node, path ...string) {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			prune(c, path...)
+		}
+	case yaml.MappingNode:
+		keepEmpty := len(path) == 2 && path[0] == "ruleSets"
+		kept := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			prune(value, append(path[:len(path):len(path)], key.Value)...)
+			if isEmptyNode(value) && !keepEmpty {
+				continue
+			}
+			kept = append(kept, key, value)
+		}
+		n.Content = kept
+	}
+}
+
+func isEmptyNode(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(n.Content) == 0
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!null":
+			return true
+		case "!!str":
+			return n.Value == ""
+		case "!!bool":
+			return n.Value == "false"
+		case "!!int":
+			return n.Value == "0"
+		}
+	}
+	return false
+}
+
+// Write prints the report: the tag values that reproduce each policy, the skipped
+// policies and the settings the generated config does not carry.
+func (r *Report) Write(w io.Writer, tagKeys config.TagKeys) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Imported policies (tag the protected resources with these values):\n")
+	fmt.Fprintf(tw, "POLICY\tRESOURCE DEFAULTS\t%s\t%s\n", tagKeys.Primary, tagKeys.Secondary)
+	for _, m := range r.Mappings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Policy, m.ResourceDefaults, m.Primary, m.Secondary)
+	}
+
+	if len(r.Skipped) > 0 {
+		fmt.Fprintf(tw, "\nSkipped policies:\n")
+		for _, f := range r.Skipped {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Policy, f.Setting, f.Detail)
+		}
+	}
+
+	if len(r.Unexpressible) > 0 {
+		fmt.Fprintf(tw, "\nSettings the config cannot express:\n")
+		for _, f := range r.Unexpressible {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Policy, f.Setting, f.Detail)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// NetworkFirewallServiceData is the managed_service_data document for FMS NETWORK_FIREWALL policies.
+type NetworkFirewallServiceData struct {
+	Type                                           string                           `json:"type"`
+	NetworkFirewallStatelessRuleGroupReferences    []NetworkFirewallRuleGroupRef    `json:"networkFirewallStatelessRuleGroupReferences"`
+	NetworkFirewallStatelessDefaultActions         []string                         `json:"networkFirewallStatelessDefaultActions"`
+	NetworkFirewallStatelessFragmentDefaultActions []string                         `json:"networkFirewallStatelessFragmentDefaultActions"`
+	NetworkFirewallStatelessCustomActions          []any                            `json:"networkFirewallStatelessCustomActions"`
+	NetworkFirewallStatefulRuleGroupReferences     []NetworkFirewallRuleGroupRef    `json:"networkFirewallStatefulRuleGroupReferences"`
+	NetworkFirewallStatefulDefaultActions          []string                         `json:"networkFirewallStatefulDefaultActions,omitempty"`
+	NetworkFirewallStatefulEngineOptions           *NetworkFirewallEngineOptions    `json:"networkFirewallStatefulEngineOptions,omitempty"`
+	NetworkFirewallOrchestrationConfig             *NetworkFirewallOrchestrationCfg `json:"networkFirewallOrchestrationConfig,omitempty"`
+}
+
+// NetworkFirewallRuleGroupRef references a rule group; Priority is omitted for stateful
+// groups evaluated in default action order.
+type NetworkFirewallRuleGroupRef struct {
+	ResourceARN string `json:"resourceARN"`
+	Priority    int    `json:"priority,omitempty"`
+}
+
+// NetworkFirewallEngineOptions selects the stateful rule evaluation order.
+type NetworkFirewallEngineOptions struct {
+	RuleOrder string `json:"ruleOrder"`
+}
+
+// NetworkFirewallOrchestrationCfg controls endpoint placement and route monitoring.
+type NetworkFirewallOrchestrationCfg struct {
+	SingleFirewallEndpointPerVPC bool     `json:"singleFirewallEndpointPerVPC"`
+	AllowedIPV4CidrList          []string `json:"allowedIPV4CidrList"`
+	RouteManagementAction        string   `json:"routeManagementAction,omitempty"`
+	RouteManagementTargetTypes   []string `json:"routeManagementTargetTypes,omitempty"`
+}
+
+// DNSFirewallServiceData is the managed_service_data document for FMS DNS_FIREWALL policies.
+type DNSFirewallServiceData struct {
+	Type                  string                 `json:"type"`
+	PreProcessRuleGroups  []DNSFirewallRuleGroup `json:"preProcessRuleGroups"`
+	PostProcessRuleGroups []DNSFirewallRuleGroup `json:"postProcessRuleGroups"`
+}
+
+// DNSFirewallRuleGroup associates a DNS Firewall rule group at a priority.
+type DNSFirewallRuleGroup struct {
+	RuleGroupID string `json:"ruleGroupId"`
+	Priority    int    `json:"priority"`
+}
+
+// forwardToStateful is the stateless default that hands packets to the stateful engine.
+const forwardToStateful = "aws:forward_to_sfe"
+
+func buildNetworkFirewallServiceData(nf config.NetworkFirewallConfig) NetworkFirewallServiceData {
+	doc := NetworkFirewallServiceData{
+		Type: config.PolicyTypeNetworkFirewall,
+		NetworkFirewallStatelessRuleGroupReferences:    toNetworkFirewallRefs(nf.StatelessRuleGroups),
+		NetworkFirewallStatelessDefaultActions:         orDefault(nf.StatelessDefaultActions, forwardToStateful),
+		NetworkFirewallStatelessFragmentDefaultActions: orDefault(nf.StatelessFragmentDefaultActions, forwardToStateful),
+		NetworkFirewallStatelessCustomActions:          []any{},
+		NetworkFirewallStatefulRuleGroupReferences:     toNetworkFirewallRefs(nf.StatefulRuleGroups),
+		NetworkFirewallStatefulDefaultActions:          nf.StatefulDefaultActions,
+	}
+	if nf.StatefulRuleOrder != "" {
+		doc.NetworkFirewallStatefulEngineOptions = &NetworkFirewallEngineOptions{RuleOrder: nf.StatefulRuleOrder}
+	}
+	if o := nf.Orchestration; o != nil {
+		cidrs := o.AllowedIPv4CidrList
+		if cidrs == nil {
+			cidrs = []string{}
+		}
+		doc.NetworkFirewallOrchestrationConfig = &NetworkFirewallOrchestrationCfg{
+			SingleFirewallEndpointPerVPC: o.SingleFirewallEndpointPerVPC,
+			AllowedIPV4CidrList:          cidrs,
+			RouteManagementAction:        o.RouteManagementAction,
+			RouteManagementTargetTypes:   o.RouteManagementTargetTypes,
+		}
+	}
+	return doc
+}
+
+func buildDNSFirewallServiceData(dns config.DNSFirewallConfig) DNSFirewallServiceData {
+	return DNSFirewallServiceData{
+		Type:                  config.PolicyTypeDNSFirewall,
+		PreProcessRuleGroups:  toDNSFirewallRuleGroups(dns.PreProcessRuleGroups),
+		PostProcessRuleGroups: toDNSFirewallRuleGroups(dns.PostProcessRuleGroups),
+	}
+}
+
+func toNetworkFirewallRefs(groups []config.FirewallRuleGroupRef) []NetworkFirewallRuleGroupRef {
+	out := make([]NetworkFirewallRuleGroupRef, 0, len(groups))
+	for _, rg := range groups {
+		out = append(out, NetworkFirewallRuleGroupRef{ResourceARN: rg.ARN, Priority: rg.Priority})
+	}
+	return out
+}
+
+func toDNSFirewallRuleGroups(groups []config.DNSFirewallRuleGroupRef) []DNSFirewallRuleGroup {
+	out := make([]DNSFirewallRuleGroup, 0, len(groups))
+	for _, rg := range groups {
+		out = append(out, DNSFirewallRuleGroup{RuleGroupID: rg.RuleGroupID, Priority: rg.Priority})
+	}
+	return out
+}
+
+func orDefault(values []string, def string) []string {
+	if len(values) == 0 {
+		return []string{def}
+	}
+	return values
+}
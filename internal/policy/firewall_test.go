@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+const firewallConfig = `
+resourceDefaults:
+  alb:
+    resourceType: "AWS::ElasticLoadBalancingV2::LoadBalancer"
+    scope: "REGIONAL"
+    defaultAction: "ALLOW"
+  vpc-nfw:
+    appliesTo: "vpc"
+    policyType: "NETWORK_FIREWALL"
+    resourceType: "AWS::EC2::VPC"
+    networkFirewall:
+      statelessRuleGroups:
+        - arn: "arn:aws:network-firewall:us-west-2:123456789012:stateless-rulegroup/baseline"
+          priority: 10
+      statefulRuleGroups:
+        - arn: "arn:aws:network-firewall:us-west-2:123456789012:stateful-rulegroup/domains"
+          priority: 1
+      statefulRuleOrder: "STRICT_ORDER"
+      statefulDefaultActions: ["aws:drop_established"]
+      orchestration:
+        singleFirewallEndpointPerVPC: true
+        allowedIPv4CidrList: ["10.255.0.0/28"]
+        routeManagementAction: "MONITOR"
+        routeManagementTargetTypes: ["InternetGateway"]
+  vpc-dns:
+    appliesTo: "vpc"
+    policyType: "DNS_FIREWALL"
+    resourceType: "AWS::EC2::VPC"
+    dnsFirewall:
+      preProcessRuleGroups:
+        - ruleGroupId: "rslvr-frg-1111111111111111"
+          priority: 10
+      postProcessRuleGroups:
+        - ruleGroupId: "rslvr-frg-2222222222222222"
+          priority: 9911
+tagKeys:
+  primary: "WafRulesetPrimary"
+  secondary: "WafRulesetSecondary"
+ruleSets:
+  primary:
+    edge: {}
+  secondary:
+    bot: {}
+defaults:
+  primary: "edge"
+  secondary: "bot"
+`
+
+func TestBuildPolicies_FirewallGolden(t *testing.T) {
+	cfg, err := config.LoadFromBytes([]byte(firewallConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	resources := []discovery.Resource{
+		{
+			ID:   "vpc-0abc",
+			ARN:  "arn:aws:ec2:us-west-2:123456789012:vpc/vpc-0abc",
+			Type: discovery.ResourceTypeVPC,
+			Tags: map[string]string{"WafRulesetPrimary": "edge"},
+		},
+	}
+
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 policies, got %d: %v", len(result), result)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		policy     string
+		policyType string
+	}{
+		{"vpc_network_firewall", "auto-vpc-nfw-vpc-0abc", config.PolicyTypeNetworkFirewall},
+		{"vpc_dns_firewall", "auto-vpc-dns-vpc-0abc", config.PolicyTypeDNSFirewall},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, ok := result[tc.policy]
+			if !ok {
+				t.Fatalf("policy %s not found", tc.policy)
+			}
+			if p.PolicyType != tc.policyType || p.ResourceType != "AWS::EC2::VPC" {
+				t.Fatalf("unexpected policy type %s / resource type %s", p.PolicyType, p.ResourceType)
+			}
+
+			var got bytes.Buffer
+			if err := json.Indent(&got, []byte(p.ManagedServiceData), "", "  "); err != nil {
+				t.Fatalf("indent managed_service_data: %v", err)
+			}
+			got.WriteByte('\n')
+			assertGolden(t, filepath.Join("testdata", "golden", tc.name+".json"), got.Bytes())
+		})
+	}
+}
+
+func TestBuildNetworkFirewallServiceData_Defaults(t *testing.T) {
+	doc := buildNetworkFirewallServiceData(config.NetworkFirewallConfig{
+		StatefulRuleGroups: []config.FirewallRuleGroupRef{{ARN: "arn:aws:network-firewall:us-west-2:123456789012:stateful-rulegroup/a"}},
+	})
+	if len(doc.NetworkFirewallStatelessDefaultActions) != 1 || doc.NetworkFirewallStatelessDefaultActions[0] != forwardToStateful {
+		t.Fatalf("stateless default actions should forward to the stateful engine: %v", doc.NetworkFirewallStatelessDefaultActions)
+	}
+	if doc.NetworkFirewallStatefulEngineOptions != nil || doc.NetworkFirewallStatefulRuleGroupReferences[0].Priority != 0 {
+		t.Fatalf("default action order must not carry engine options or priorities: %+v", doc)
+	}
+}
@@ -0,0 +1,210 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+// ruleSetGroup collects the resources that share one (resourceDefaults entry, rule-set combination).
+type ruleSetGroup struct {
+	// typeName is the resourceDefaults key the group renders.
+	typeName  string
+	resType   discovery.ResourceType
+	primary   string
+	secondary string
+	// fallback marks the group of resources that rely on the configured defaults.
+	fallback bool
+	// account and region are only set when the naming config includes them, which
+	// splits groups per account/region.
+	account string
+	region  string
+	arns    []string
+}
+
+// key identifies the group independently of how it is named.
+func (g *ruleSetGroup) key() string {
+	return fmt.Sprintf("%s|%s|%s|%t|%s|%s", g.typeName, g.primary, g.secondary, g.fallback, g.account, g.region)
+}
+
+// label identifies the group independently of its members.
+func (g *ruleSetGroup) label() string {
+	if g.fallback {
+		return g.typeName + " defaults"
+	}
+	return fmt.Sprintf("%s primary=%s secondary=%s", g.typeName, g.primary, g.secondary)
+}
+
+// source describes the group in collision errors.
+func (g *ruleSetGroup) source() string {
+	return fmt.Sprintf("%s (%d resource(s))", g.label(), len(g.arns))
+}
+
+func (g *ruleSetGroup) policyName(n config.Naming) string {
+	id := g.primary + "-" + g.secondary
+	if g.fallback {
+		id = "default"
+	}
+	return policyName(n, nameSource{
+		typeName: g.typeName,
+		id:       id,
+		arn:      g.arns[0],
+		hashKey:  g.key(),
+	})
+}
+
+// scopeTags returns the FMS ResourceTags for the group and whether they exclude.
+//
+// FMS only puts a resource in scope when it carries all of the listed tags, so
+// tagged groups include resources with both selector values, and the fallback group
+// excludes every resource that carries both selector keys (an empty value matches any).
+func (g *ruleSetGroup) scopeTags(keys config.TagKeys) ([]ResourceTag, bool) {
+	if g.fallback {
+		return []ResourceTag{{Key: keys.Primary}, {Key: keys.Secondary}}, true
+	}
+	return []ResourceTag{
+		{Key: keys.Primary, Value: g.primary},
+		{Key: keys.Secondary, Value: g.secondary},
+	}, false
+}
+
+// buildGrouped renders one policy per (resourceDefaults entry, primary, secondary) combination,
+// scoped by the selector tags instead of one policy per resource.
+func buildGrouped(
+	resources []discovery.Resource,
+	cfg *config.PolicyConfig,
+	tmpls *templateSet,
+	out *policySet,
+	logger *util.Logger,
+) error {
+	groups := make(map[string]*ruleSetGroup)
+	splitAccount, splitRegion := false, false
+	for _, c := range cfg.Naming.Components {
+		splitAccount = splitAccount || c == config.NameComponentAccount
+		splitRegion = splitRegion || c == config.NameComponentRegion
+	}
+
+	for _, res := range resources {
+		switch res.Type {
+		case discovery.ResourceTypeALB, discovery.ResourceTypeCloudFront, discovery.ResourceTypeVPC:
+		default:
+			logger.Warnf("unknown resource type %q, skipping", res.Type)
+			continue
+		}
+		entries := cfg.DefaultsFor(string(res.Type))
+		if len(entries) == 0 {
+			logger.Warnf("no resourceDefaults for '%s'; skipping resource %s", res.Type, res.ARN)
+			continue
+		}
+
+		primaryValue := selectRuleSetValue(res.Tags, cfg.TagKeys.Primary, cfg.Defaults.Primary, cfg.RuleSets.Primary, logger, res.ARN)
+		secondaryValue := selectRuleSetValue(res.Tags, cfg.TagKeys.Secondary, cfg.Defaults.Secondary, cfg.RuleSets.Secondary, logger, res.ARN)
+
+		primaryTag, hasPrimary := res.Tags[cfg.TagKeys.Primary]
+		secondaryTag, hasSecondary := res.Tags[cfg.TagKeys.Secondary]
+		primaryExplicit := hasPrimary && primaryTag == primaryValue
+		secondaryExplicit := hasSecondary && secondaryTag == secondaryValue
+
+		g := ruleSetGroup{resType: res.Type}
+		switch {
+		case primaryExplicit && secondaryExplicit:
+			g.primary, g.secondary = primaryValue, secondaryValue
+		case cfg.Grouping.Fallback == config.FallbackSkip:
+			logger.Warnf("resource %s relies on default rule sets and grouping.fallback is %s; skipping", res.ARN, config.FallbackSkip)
+			continue
+		case cfg.Grouping.ScopeBy == config.ScopeByResourceSet:
+			// Resource sets scope by ARN, so the effective combination needs no tag to match.
+			g.primary, g.secondary = primaryValue, secondaryValue
+		case hasPrimary && hasSecondary:
+			// Both keys are present, so the fallback policy excludes the resource, but the
+			// value combination has no tag-scoped policy either.
+			logger.Warnf("resource %s has selector tags %s=%s, %s=%s that are not configured; rule-set grouping leaves it without a policy",
+				res.ARN, cfg.TagKeys.Primary, primaryTag, cfg.TagKeys.Secondary, secondaryTag)
+			continue
+		default:
+			if primaryExplicit || secondaryExplicit {
+				logger.Warnf("resource %s has only one selector tag; rule-set grouping applies the default combination (primary=%s, secondary=%s)",
+					res.ARN, cfg.Defaults.Primary, cfg.Defaults.Secondary)
+			}
+			g.primary, g.secondary, g.fallback = cfg.Defaults.Primary, cfg.Defaults.Secondary, true
+		}
+
+		account, region := arnAccountRegion(res.ARN)
+		if splitAccount {
+			g.account = account
+		}
+		if splitRegion {
+			g.region = region
+		}
+
+		for _, entry := range entries {
+			eg := g
+			eg.typeName = entry
+			existing, ok := groups[eg.key()]
+			if !ok {
+				existing = &eg
+				groups[eg.key()] = existing
+			}
+			existing.arns = append(existing.arns, res.ARN)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		g := groups[key]
+		sort.Strings(g.arns)
+		name := g.policyName(cfg.Naming)
+		defaults := cfg.ResourceDefaults[g.typeName]
+		tags, exclude := g.scopeTags(cfg.TagKeys)
+
+		// Templates see the group's selector tags in place of a single resource's tags.
+		groupRes := discovery.Resource{ID: name, Type: g.resType, Tags: make(map[string]string, len(tags))}
+		if !g.fallback {
+			for _, t := range tags {
+				groupRes.Tags[t.Key] = t.Value
+			}
+		}
+
+		msd, ok, err := renderServiceData(tmpls, groupRes, defaults, cfg, g.primary, g.secondary)
+		if err != nil {
+			return fmt.Errorf("render managed_service_data for policy %s: %w", name, err)
+		}
+		if !ok {
+			continue
+		}
+
+		// The description depends only on the group key, so resources joining or leaving
+		// the group do not rewrite a policy whose scope is unchanged.
+		desc := fmt.Sprintf("Auto-generated %s policy (primary=%s, secondary=%s)", policyLabel(defaults), g.primary, g.secondary)
+		if g.fallback {
+			desc = fmt.Sprintf("Auto-generated %s policy using defaults (primary=%s, secondary=%s)", policyLabel(defaults), g.primary, g.secondary)
+		}
+
+		p := RenderedPolicy{
+			Name:                name,
+			Description:         desc,
+			PolicyType:          defaults.EffectivePolicyType(),
+			ResourceType:        defaults.ResourceType,
+			Scope:               defaults.Scope,
+			ManagedServiceData:  msd,
+			ResourceTags:        tags,
+			ExcludeResourceTags: exclude,
+			Resources:           g.arns,
+			Source:              g.label(),
+		}
+		applyScope(&p, effectiveScope(defaults, cfg.RuleSets.Primary[g.primary], cfg.RuleSets.Secondary[g.secondary]))
+		p.Rollout = stagedRollout(effectiveRollout(defaults, cfg.RuleSets.Primary[g.primary], cfg.RuleSets.Secondary[g.secondary]))
+		out.add(p, g.source())
+		logger.Infof("grouped %d resource(s) into policy %s", len(g.arns), name)
+	}
+
+	return nil
+}
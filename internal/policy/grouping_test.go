@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestBuildPolicies_RuleSetGrouping(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cfg.Grouping.Mode = config.GroupingRuleSet
+
+	alb := func(id string, tags map[string]string) discovery.Resource {
+		return discovery.Resource{
+			ID:   "grp/" + id,
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/grp/" + id,
+			Type: discovery.ResourceTypeALB,
+			Tags: tags,
+		}
+	}
+	tagged := map[string]string{
+		cfg.TagKeys.Primary:   "ou-shared-app",
+		cfg.TagKeys.Secondary: "ou-shared-anon",
+	}
+	resources := []discovery.Resource{
+		alb("a", tagged),
+		alb("b", tagged),
+		alb("c", map[string]string{}),
+		alb("d", map[string]string{cfg.TagKeys.Primary: "ou-shared-app"}),
+		alb("e", map[string]string{cfg.TagKeys.Primary: "unknown", cfg.TagKeys.Secondary: "ou-shared-bot"}),
+	}
+
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 policies, got %d: %v", len(result), result)
+	}
+
+	grouped, ok := result["auto-alb-ou-shared-app-ou-shared-anon"]
+	if !ok {
+		t.Fatalf("tag-scoped policy not found in result")
+	}
+	if want := []string{resources[0].ARN, resources[1].ARN}; !reflect.DeepEqual(grouped.Resources, want) {
+		t.Fatalf("unexpected grouped resources %v", grouped.Resources)
+	}
+	wantTags := []ResourceTag{
+		{Key: cfg.TagKeys.Primary, Value: "ou-shared-app"},
+		{Key: cfg.TagKeys.Secondary, Value: "ou-shared-anon"},
+	}
+	if grouped.ExcludeResourceTags || !reflect.DeepEqual(grouped.ResourceTags, wantTags) {
+		t.Fatalf("unexpected scope: exclude=%v tags=%v", grouped.ExcludeResourceTags, grouped.ResourceTags)
+	}
+
+	fallback, ok := result["auto-alb-default"]
+	if !ok {
+		t.Fatalf("fallback policy not found in result")
+	}
+	// The untagged and the partially tagged ALB share the default policy; the ALB with an
+	// unconfigured value on both keys is excluded by scope and reported instead.
+	if want := []string{resources[2].ARN, resources[3].ARN}; !reflect.DeepEqual(fallback.Resources, want) {
+		t.Fatalf("unexpected fallback resources %v", fallback.Resources)
+	}
+	wantFallbackTags := []ResourceTag{{Key: cfg.TagKeys.Primary}, {Key: cfg.TagKeys.Secondary}}
+	if !fallback.ExcludeResourceTags || !reflect.DeepEqual(fallback.ResourceTags, wantFallbackTags) {
+		t.Fatalf("unexpected fallback scope: exclude=%v tags=%v", fallback.ExcludeResourceTags, fallback.ResourceTags)
+	}
+
+	// A resource leaving the group only changes the group's resources, not its policy.
+	fewer, err := BuildPolicies(resources[1:], cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	smaller := fewer["auto-alb-ou-shared-app-ou-shared-anon"]
+	if smaller.Description != grouped.Description || smaller.ManagedServiceData != grouped.ManagedServiceData || len(smaller.Resources) != 1 {
+		t.Fatalf("group membership changed the policy: %q vs %q", smaller.Description, grouped.Description)
+	}
+}
+
+func TestBuildPolicies_RuleSetGroupingSkipFallback(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cfg.Grouping.Mode = config.GroupingRuleSet
+	cfg.Grouping.Fallback = config.FallbackSkip
+
+	resources := []discovery.Resource{
+		{
+			ID:   "grp/untagged",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/grp/untagged",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{},
+		},
+	}
+
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("expected no policies, got %v", result)
+	}
+}
+
+func TestBuildPolicies_ResourceSetScope(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cfg.Grouping.Mode = config.GroupingRuleSet
+	cfg.Grouping.ScopeBy = config.ScopeByResourceSet
+
+	resources := []discovery.Resource{
+		{
+			ID:   "grp/partial",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/grp/partial",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{cfg.TagKeys.Primary: "ou-shared-app"},
+		},
+		{
+			ID:   "grp/invalid",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/grp/invalid",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{cfg.TagKeys.Primary: "unknown", cfg.TagKeys.Secondary: "ou-shared-bot"},
+		},
+	}
+
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+
+	// Resource sets scope by ARN, so each resource lands in its effective combination.
+	partial, ok := result["auto-alb-ou-shared-app-ou-shared-bot"]
+	if !ok {
+		t.Fatalf("policy for partially tagged resource not found: %v", result)
+	}
+	invalid, ok := result["auto-alb-ou-shared-edge-ou-shared-bot"]
+	if !ok {
+		t.Fatalf("policy for unconfigured tag value not found: %v", result)
+	}
+	for _, p := range []RenderedPolicy{partial, invalid} {
+		if p.ResourceSet != p.Name || len(p.ResourceTags) != 0 || p.ExcludeResourceTags {
+			t.Fatalf("policy %s not scoped by resource set: %+v", p.Name, p)
+		}
+		if len(p.Resources) != 1 {
+			t.Fatalf("policy %s has unexpected resources %v", p.Name, p.Resources)
+		}
+	}
+}
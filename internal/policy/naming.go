@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+const (
+	// MaxPolicyNameLength is the FMS limit for policy names.
+	MaxPolicyNameLength = 128
+
+	defaultNamePrefix = "auto"
+	nameHashLength    = 8
+)
+
+// nameSource is everything a naming strategy may draw from.
+type nameSource struct {
+	// typeName is the resourceDefaults key the policy was rendered from.
+	typeName string
+	// id is the unsanitized identifier: the resource ID or the rule-set combination.
+	id string
+	// arn supplies the account and region components.
+	arn string
+	// hashKey is hashed when a hash suffix is needed; it must be stable for the policy.
+	hashKey string
+}
+
+// NamePrefix returns the start of every policy name rendered with n, including the
+// separating dash.
+func NamePrefix(n config.Naming) string {
+	if n.Prefix == "" {
+		return defaultNamePrefix + "-"
+	}
+	return n.Prefix + "-"
+}
+
+// policyName builds a policy name from the naming config. The result only contains
+// characters accepted by sanitizeName and never exceeds MaxPolicyNameLength; when the id
+// has to be cut to fit, a hash is appended even if naming.hash is off.
+func policyName(n config.Naming, src nameSource) string {
+	prefix := strings.TrimSuffix(NamePrefix(n), "-")
+	components := n.Components
+	if len(components) == 0 {
+		components = []string{config.NameComponentType, config.NameComponentID}
+	}
+
+	account, region := arnAccountRegion(src.arn)
+	id := sanitizeName(src.id)
+	if n.MaxIDLength > 0 && len(id) > n.MaxIDLength {
+		id = id[:n.MaxIDLength]
+	}
+	hash := ""
+	if n.Hash {
+		hash = shortHash(src.hashKey)
+	}
+
+	build := func(id, hash string) string {
+		parts := []string{prefix}
+		for _, c := range components {
+			switch c {
+			case config.NameComponentAccount:
+				parts = append(parts, account)
+			case config.NameComponentRegion:
+				parts = append(parts, region)
+			case config.NameComponentType:
+				parts = append(parts, src.typeName)
+			case config.NameComponentID:
+				if hash != "" {
+					id = strings.TrimRight(id, "-_") + "-" + hash
+				}
+				parts = append(parts, id)
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+
+	name := build(id, hash)
+	if len(name) <= MaxPolicyNameLength {
+		return name
+	}
+
+	// Too long: trim the id by the overflow and keep it unique with a hash.
+	if hash == "" {
+		hash = shortHash(src.hashKey)
+		name = build(id, hash)
+	}
+	if over := len(name) - MaxPolicyNameLength; over > 0 {
+		keep := len(id) - over
+		if keep < 0 {
+			keep = 0
+		}
+		name = build(id[:keep], hash)
+	}
+	if len(name) > MaxPolicyNameLength {
+		// Only reachable with an unusually long account/region/prefix combination.
+		name = name[:MaxPolicyNameLength]
+	}
+	return name
+}
+
+// arnAccountRegion returns the account and region fields of an ARN. Global services such
+// as CloudFront have no region, which is reported as "global".
+func arnAccountRegion(arn string) (string, string) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return "unknown", "unknown"
+	}
+	region, account := parts[3], parts[4]
+	if region == "" {
+		region = "global"
+	}
+	if account == "" {
+		account = "unknown"
+	}
+	return account, region
+}
+
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:nameHashLength]
+}
+
+// policySet accumulates rendered policies and remembers every source that claimed a
+// name, so two different resources or groups can never silently overwrite each other.
+type policySet struct {
+	policies map[string]RenderedPolicy
+	claims   map[string][]string
+}
+
+func newPolicySet() *policySet {
+	return &policySet{
+		policies: make(map[string]RenderedPolicy),
+		claims:   make(map[string][]string),
+	}
+}
+
+// add records p under its name. source identifies what produced the policy.
+func (s *policySet) add(p RenderedPolicy, source string) {
+	for _, existing := range s.claims[p.Name] {
+		if existing == source {
+			// The same resource listed twice is not a collision.
+			return
+		}
+	}
+	s.claims[p.Name] = append(s.claims[p.Name], source)
+	if _, ok := s.policies[p.Name]; !ok {
+		s.policies[p.Name] = p
+	}
+}
+
+// collisionError lists every name claimed by more than one source.
+func (s *policySet) collisionError() error {
+	var conflicts []string
+	for name, sources := range s.claims {
+		if len(sources) < 2 {
+			continue
+		}
+		sorted := append([]string(nil), sources...)
+		sort.Strings(sorted)
+		conflicts = append(conflicts, fmt.Sprintf("%s <- [%s]", name, strings.Join(sorted, ", ")))
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sort.Strings(conflicts)
+	return fmt.Errorf("policy name collision (enable naming.hash or adjust naming.components): %s", strings.Join(conflicts, "; "))
+}
@@ -0,0 +1,117 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func collidingResources() []discovery.Resource {
+	return []discovery.Resource{
+		{
+			ID:   "shop/api",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/shop/api",
+			Type: discovery.ResourceTypeALB,
+		},
+		{
+			ID:   "shop.api",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/shop.api/x",
+			Type: discovery.ResourceTypeALB,
+		},
+	}
+}
+
+func TestBuildPolicies_NameCollisionIsAnError(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	resources := collidingResources()
+
+	_, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err == nil {
+		t.Fatalf("expected a name collision error")
+	}
+	for _, want := range []string{"auto-alb-shop-api", resources[0].ARN, resources[1].ARN} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("collision error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestBuildPolicies_HashAvoidsCollision(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cfg.Naming.Hash = true
+
+	result, err := BuildPolicies(collidingResources(), cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 distinct policies, got %d", len(result))
+	}
+	for name := range result {
+		if !strings.HasPrefix(name, "auto-alb-shop-api-") || len(name) != len("auto-alb-shop-api-")+nameHashLength {
+			t.Fatalf("unexpected hashed name %q", name)
+		}
+	}
+}
+
+func TestPolicyName(t *testing.T) {
+	arn := "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/demo/abcd"
+	longID := strings.Repeat("very-long-load-balancer-name-", 10)
+
+	cases := []struct {
+		name   string
+		naming config.Naming
+		src    nameSource
+		want   string
+	}{
+		{
+			name: "default",
+			src:  nameSource{typeName: "alb", id: "demo/abcd", arn: arn, hashKey: arn},
+			want: "auto-alb-demo-abcd",
+		},
+		{
+			name: "account region type id",
+			naming: config.Naming{
+				Prefix:     "fms",
+				Components: []string{"account", "region", "type", "id"},
+			},
+			src:  nameSource{typeName: "alb", id: "demo/abcd", arn: arn, hashKey: arn},
+			want: "fms-123456789012-us-west-2-alb-demo-abcd",
+		},
+		{
+			name:   "truncated id with hash",
+			naming: config.Naming{MaxIDLength: 4, Hash: true},
+			src:    nameSource{typeName: "alb", id: "demo/abcd", arn: arn, hashKey: arn},
+			want:   "auto-alb-demo-" + shortHash(arn),
+		},
+		{
+			name: "cloudfront is global",
+			naming: config.Naming{
+				Components: []string{"region", "id"},
+			},
+			src:  nameSource{typeName: "cloudfront", id: "E123", arn: "arn:aws:cloudfront::123456789012:distribution/E123"},
+			want: "auto-global-E123",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policyName(tc.naming, tc.src); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("length bounded", func(t *testing.T) {
+		got := policyName(config.Naming{}, nameSource{typeName: "alb", id: longID, arn: arn, hashKey: arn})
+		if len(got) > MaxPolicyNameLength {
+			t.Fatalf("name has %d characters, limit is %d", len(got), MaxPolicyNameLength)
+		}
+		if !strings.HasSuffix(got, "-"+shortHash(arn)) {
+			t.Fatalf("truncated name %q lacks the uniqueness hash", got)
+		}
+	})
+}
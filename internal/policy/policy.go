@@ -1,15 +1,12 @@
 package policy
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"text/template"
 
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
-	"github.com/forkedpacket/aws-fms-secpolicy-learning/templates"
 )
 
 // RenderedPolicy is the JSON-friendly structure written to generated/policies.json.
@@ -21,90 +18,225 @@ type RenderedPolicy struct {
 	ResourceType       string `json:"resource_type"`
 	Scope              string `json:"scope"`
 	ManagedServiceData string `json:"managed_service_data"`
+
+	// PolicyType is the FMS security service type, e.g. "WAFV2" or "SHIELD_ADVANCED".
+	PolicyType string `json:"policy_type"`
+
+	// ResourceTypes is set when ResourceType is "ResourceTypeList" and the policy covers
+	// several FMS resource types.
+	ResourceTypes []string `json:"resource_types,omitempty"`
+
+	// ResourceTags narrows the FMS policy scope to resources carrying all of these tags.
+	// An empty Value matches any value for the key.
+	ResourceTags []ResourceTag `json:"resource_tags,omitempty"`
+	// ExcludeResourceTags turns ResourceTags into an exclusion list.
+	ExcludeResourceTags bool `json:"exclude_resource_tags,omitempty"`
+
+	// IncludeMap and ExcludeMap are the FMS account scope, keyed by ScopeAccount and
+	// ScopeOrgUnit. Both empty means the policy is scoped to the OU of the run.
+	IncludeMap map[string][]string `json:"include_map,omitempty"`
+	ExcludeMap map[string][]string `json:"exclude_map,omitempty"`
+
+	// Rollout is set when the policy is rolled out in stages: created with remediation
+	// disabled and enforced once the soak period and compliance check pass. Nil enables
+	// remediation immediately.
+	Rollout *Rollout `json:"rollout,omitempty"`
+
+	// RemediationDisabled writes the policy in audit mode. The config does not set it; it
+	// carries the setting of a stored policy version that is rolled back.
+	RemediationDisabled bool `json:"remediation_disabled,omitempty"`
+
+	// Resources lists the ARNs that were rendered into this policy.
+	Resources []string `json:"resources,omitempty"`
+
+	// ResourceSet names the FMS resource set that scopes this policy to exactly Resources.
+	// Empty when the policy is scoped by tags.
+	ResourceSet string `json:"resource_set,omitempty"`
+
+	// Source identifies what the policy was rendered from: the resourceDefaults key and
+	// resource ARN, the rule-set group, or the security group policy id.
+	Source string `json:"source,omitempty"`
+}
+
+// ResourceTag is a single key/value pair used to scope a policy.
+type ResourceTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Options carries render settings that come from the entrypoint rather than the policy config.
+type Options struct {
+	// TemplateDir points at a directory of user-supplied templates. When set, every
+	// resource type is rendered through a template: <type>.tmpl if present, then
+	// DefaultTemplate from the directory, then the embedded DefaultTemplate.
+	TemplateDir string
 }
 
 // BuildPolicies generates FMS policies from discovered resources and config.
-func BuildPolicies(resources []discovery.Resource, cfg *config.PolicyConfig, logger *util.Logger) (map[string]RenderedPolicy, error) {
-	// Parse the template once so every resource reuses the same compiled structure.
-	tmpl, err := template.New("fms_policy").
-		Funcs(template.FuncMap{
-			// joinStrings is a minimal helper; can add more as needed.
-			"joinStrings": func(sep string, elems []string) string {
-				var buf bytes.Buffer
-				for i, e := range elems {
-					if i > 0 {
-						buf.WriteString(sep)
-					}
-					buf.WriteString(e)
+func BuildPolicies(resources []discovery.Resource, cfg *config.PolicyConfig, opts Options, logger *util.Logger) (map[string]RenderedPolicy, error) {
+	tmpls := newTemplateSet(opts.TemplateDir)
+	set := newPolicySet()
+
+	if cfg.Grouping.Mode == config.GroupingRuleSet {
+		if err := buildGrouped(resources, cfg, tmpls, set, logger); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, r := range resources {
+			switch r.Type {
+			case discovery.ResourceTypeALB, discovery.ResourceTypeCloudFront, discovery.ResourceTypeVPC:
+				if err := buildForResource(r, cfg, tmpls, set, logger); err != nil {
+					return nil, err
 				}
-				return buf.String()
-			},
-		}).
-		ParseFS(templates.FS, "fms_policy.tmpl")
-	if err != nil {
-		return nil, fmt.Errorf("parse template: %w", err)
+			default:
+				logger.Warnf("unknown resource type %q, skipping", r.Type)
+			}
+		}
 	}
-	tmpl = tmpl.Lookup("fms_policy.tmpl")
-	if tmpl == nil {
-		return nil, fmt.Errorf("template fms_policy.tmpl not found after parsing")
+
+	if err := buildSecurityGroupPolicies(cfg, set); err != nil {
+		return nil, err
 	}
 
-	result := make(map[string]RenderedPolicy)
+	if err := set.collisionError(); err != nil {
+		return nil, err
+	}
+	result := set.policies
 
-	for _, r := range resources {
-		switch r.Type {
-		case discovery.ResourceTypeALB:
-			if err := buildForALB(r, cfg, tmpl, result, logger); err != nil {
-				return nil, err
+	if cfg.Grouping.ScopeBy == config.ScopeByResourceSet {
+		// Resource sets replace tag scoping: the set holds exactly the grouped ARNs.
+		// Policies without rendered resources, such as security group policies, keep their tags.
+		for name, p := range result {
+			if len(p.Resources) == 0 {
+				continue
 			}
-		default:
-			logger.Warnf("unknown resource type %q, skipping", r.Type)
+			p.ResourceSet = name
+			p.ResourceTags = nil
+			p.ExcludeResourceTags = false
+			result[name] = p
 		}
 	}
 
 	return result, nil
 }
 
-func buildForALB(
+func buildForResource(
 	res discovery.Resource,
 	cfg *config.PolicyConfig,
-	tmpl *template.Template,
-	out map[string]RenderedPolicy,
+	tmpls *templateSet,
+	out *policySet,
 	logger *util.Logger,
 ) error {
-	defaults, ok := cfg.ResourceDefaults["alb"]
-	if !ok {
-		logger.Warnf("no resourceDefaults for 'alb'; skipping resource %s", res.ARN)
+	keys := cfg.DefaultsFor(string(res.Type))
+	if len(keys) == 0 {
+		logger.Warnf("no resourceDefaults for '%s'; skipping resource %s", res.Type, res.ARN)
 		return nil
 	}
 
 	primaryValue := selectRuleSetValue(res.Tags, cfg.TagKeys.Primary, cfg.Defaults.Primary, cfg.RuleSets.Primary, logger, res.ARN)
 	secondaryValue := selectRuleSetValue(res.Tags, cfg.TagKeys.Secondary, cfg.Defaults.Secondary, cfg.RuleSets.Secondary, logger, res.ARN)
 
-	model := buildTemplateModel(defaults, cfg.RuleSets.Primary[primaryValue], cfg.RuleSets.Secondary[secondaryValue])
+	for _, key := range keys {
+		defaults := cfg.ResourceDefaults[key]
+		msd, ok, err := renderServiceData(tmpls, res, defaults, cfg, primaryValue, secondaryValue)
+		if err != nil {
+			return fmt.Errorf("render %s managed_service_data for resource %s: %w", key, res.ARN, err)
+		}
+		if !ok {
+			continue
+		}
+
+		name := policyName(cfg.Naming, nameSource{typeName: key, id: res.ID, arn: res.ARN, hashKey: res.ARN})
+		desc := fmt.Sprintf("Auto-generated %s policy (primary=%s, secondary=%s)", policyLabel(defaults), primaryValue, secondaryValue)
 
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, model); err != nil {
-		return fmt.Errorf("execute template: %w", err)
+		p := RenderedPolicy{
+			Name:               name,
+			Description:        desc,
+			PolicyType:         defaults.EffectivePolicyType(),
+			ResourceType:       defaults.ResourceType,
+			Scope:              defaults.Scope,
+			ManagedServiceData: msd, // JSON string
+			Resources:          []string{res.ARN},
+			Source:             key + " " + res.ARN,
+		}
+		applyScope(&p, effectiveScope(defaults, cfg.RuleSets.Primary[primaryValue], cfg.RuleSets.Secondary[secondaryValue]))
+		p.Rollout = stagedRollout(effectiveRollout(defaults, cfg.RuleSets.Primary[primaryValue], cfg.RuleSets.Secondary[secondaryValue]))
+		out.add(p, p.Source)
 	}
+	return nil
+}
 
-	// Validate JSON structure.
-	if !json.Valid(buf.Bytes()) {
-		return fmt.Errorf("rendered managed_service_data is not valid JSON for resource %s", res.ARN)
+// policyLabel names the security service in policy descriptions.
+func policyLabel(defaults config.ResourceDefaults) string {
+	switch defaults.EffectivePolicyType() {
+	case config.PolicyTypeShieldAdvanced:
+		return "Shield Advanced"
+	case config.PolicyTypeNetworkFirewall:
+		return "Network Firewall"
+	case config.PolicyTypeDNSFirewall:
+		return "DNS Firewall"
 	}
+	return "WAFv2"
+}
 
-	policyName := fmt.Sprintf("auto-alb-%s", sanitizeName(res.ID))
-	desc := fmt.Sprintf("Auto-generated WAFv2 policy (primary=%s, secondary=%s)", primaryValue, secondaryValue)
+// renderServiceData produces the managed_service_data JSON for the selected rule sets.
+// WAFv2 documents go through a template when one applies and the typed builder otherwise.
+// It reports false when the entry does not apply, i.e. a Shield Advanced entry whose
+// selected rule sets do not enable shieldAdvanced.
+func renderServiceData(
+	tmpls *templateSet,
+	res discovery.Resource,
+	defaults config.ResourceDefaults,
+	cfg *config.PolicyConfig,
+	primaryValue string,
+	secondaryValue string,
+) (string, bool, error) {
+	primary := cfg.RuleSets.Primary[primaryValue]
+	secondary := cfg.RuleSets.Secondary[secondaryValue]
 
-	p := RenderedPolicy{
-		Name:               policyName,
-		Description:        desc,
-		ResourceType:       defaults.ResourceType,
-		Scope:              defaults.Scope,
-		ManagedServiceData: buf.String(), // JSON string
+	switch defaults.EffectivePolicyType() {
+	case config.PolicyTypeShieldAdvanced:
+		shield := defaults.EffectiveShield(primary, secondary)
+		if shield == nil {
+			return "", false, nil
+		}
+		doc, err := buildShieldServiceData(*shield)
+		if err != nil {
+			return "", false, err
+		}
+		msd, err := marshalServiceData(doc)
+		return msd, err == nil, err
+	case config.PolicyTypeNetworkFirewall:
+		msd, err := marshalServiceData(buildNetworkFirewallServiceData(*defaults.NetworkFirewall))
+		return msd, err == nil, err
+	case config.PolicyTypeDNSFirewall:
+		msd, err := marshalServiceData(buildDNSFirewallServiceData(*defaults.DNSFirewall))
+		return msd, err == nil, err
 	}
-	out[policyName] = p
-	return nil
+
+	serviceData := buildWAFv2ServiceData(defaults, primary, secondary)
+
+	name, ok := tmpls.templateFor(res.Type, defaults)
+	if !ok {
+		msd, err := marshalServiceData(serviceData)
+		return msd, err == nil, err
+	}
+
+	model := buildTemplateModel(res, defaults, primary, secondary)
+	model.PrimaryRuleSet = primaryValue
+	model.SecondaryRuleSet = secondaryValue
+	model.ServiceData = serviceData
+	msd, err := tmpls.render(name, model)
+	return msd, err == nil, err
+}
+
+// marshalServiceData encodes a typed managed_service_data document.
+func marshalServiceData(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("marshal managed_service_data: %w", err)
+	}
+	return string(data), nil
 }
 
 func selectRuleSetValue(
@@ -143,13 +275,37 @@ func sanitizeName(s string) string {
 	return string(out)
 }
 
-// TemplateModel is fed into fms_policy.tmpl.
+// TemplateModel is fed into custom templates such as fms_policy.tmpl.
+//
+// See templates/README.md for the fields and helper functions available to templates.
 type TemplateModel struct {
 	Type            string              `json:"type"`
 	DefaultAction   string              `json:"defaultAction"`
 	Scope           string              `json:"scope"`
 	RuleGroups      []TemplateRuleGroup `json:"ruleGroups"`
+	PostRuleGroups  []TemplateRuleGroup `json:"postRuleGroups"`
 	OverrideDefault string              `json:"overrideDefault,omitempty"`
+
+	// Resource identifies the discovered resource being rendered.
+	Resource TemplateResource `json:"resource"`
+	// Tags and Attributes are copied from the discovered resource.
+	Tags       map[string]string `json:"tags"`
+	Attributes map[string]string `json:"attributes"`
+
+	// PrimaryRuleSet and SecondaryRuleSet are the selected rule set names.
+	PrimaryRuleSet   string `json:"primaryRuleSet"`
+	SecondaryRuleSet string `json:"secondaryRuleSet"`
+
+	// ServiceData is the document the typed builder would have produced;
+	// `{{ toJson .ServiceData }}` reproduces the default output.
+	ServiceData WAFv2ServiceData `json:"serviceData"`
+}
+
+// TemplateResource is the subset of discovery.Resource exposed to templates.
+type TemplateResource struct {
+	ID   string `json:"id"`
+	ARN  string `json:"arn"`
+	Type string `json:"type"`
 }
 
 type TemplateRuleGroup struct {
@@ -160,6 +316,7 @@ type TemplateRuleGroup struct {
 }
 
 func buildTemplateModel(
+	res discovery.Resource,
 	defaults config.ResourceDefaults,
 	primary config.RuleSet,
 	secondary config.RuleSet,
@@ -170,9 +327,40 @@ func buildTemplateModel(
 		primary.RuleGroups,
 		secondary.RuleGroups,
 	)
+	post := mergeRuleGroups(
+		primary.PostProcessRuleGroups,
+		secondary.PostProcessRuleGroups,
+		defaults.PostProcessRuleGroups,
+	)
+
+	tags := res.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	attrs := res.Attributes
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
 
-	ruleGroups := make([]TemplateRuleGroup, 0, len(merged))
-	for _, rg := range merged {
+	return TemplateModel{
+		Type:           "WAFV2",
+		DefaultAction:  defaults.EffectiveDefaultAction(),
+		Scope:          defaults.Scope,
+		RuleGroups:     toTemplateRuleGroups(merged),
+		PostRuleGroups: toTemplateRuleGroups(post),
+		Resource: TemplateResource{
+			ID:   res.ID,
+			ARN:  res.ARN,
+			Type: string(res.Type),
+		},
+		Tags:       tags,
+		Attributes: attrs,
+	}
+}
+
+func toTemplateRuleGroups(groups []config.RuleGroupConfig) []TemplateRuleGroup {
+	ruleGroups := make([]TemplateRuleGroup, 0, len(groups))
+	for _, rg := range groups {
 		t := TemplateRuleGroup{}
 		if rg.ARN != "" {
 			t.Type = "RuleGroup"
@@ -184,13 +372,7 @@ func buildTemplateModel(
 		}
 		ruleGroups = append(ruleGroups, t)
 	}
-
-	return TemplateModel{
-		Type:          "WAFV2",
-		DefaultAction: defaults.DefaultAction,
-		Scope:         defaults.Scope,
-		RuleGroups:    ruleGroups,
-	}
+	return ruleGroups
 }
 
 func mergeRuleGroups(groups ...[]config.RuleGroupConfig) []config.RuleGroupConfig {
@@ -2,6 +2,7 @@ package policy
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/forkedpacket/aws-fms-secpolicy-learning/configs"
@@ -36,7 +37,7 @@ func TestBuildPolicies_PrimarySecondarySelection(t *testing.T) {
 	}
 
 	logger := util.NewLogger()
-	result, err := BuildPolicies(resources, cfg, logger)
+	result, err := BuildPolicies(resources, cfg, Options{}, logger)
 	if err != nil {
 		t.Fatalf("build policies: %v", err)
 	}
@@ -86,7 +87,7 @@ func TestBuildPolicies_DefaultsUsedWhenTagsMissing(t *testing.T) {
 	}
 
 	logger := util.NewLogger()
-	result, err := BuildPolicies(resources, cfg, logger)
+	result, err := BuildPolicies(resources, cfg, Options{}, logger)
 	if err != nil {
 		t.Fatalf("build policies: %v", err)
 	}
@@ -125,3 +126,15 @@ func mustLoadConfig(t *testing.T) *config.PolicyConfig {
 	}
 	return cfg
 }
+
+func TestValidate_CanaryNeedsCoverageGapAccepted(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cfg.Canary = config.Canary{Accounts: []string{"111111111111"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "canary.acceptCoverageGap") {
+		t.Fatalf("expected canary.acceptCoverageGap to be required, got %v", err)
+	}
+	cfg.Canary.AcceptCoverageGap = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
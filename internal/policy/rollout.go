@@ -0,0 +1,39 @@
+package policy
+
+import (
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// Rollout carries the staged rollout settings of a policy.
+type Rollout struct {
+	// SoakPeriod is how long the policy stays in audit mode after creation, as a Go
+	// duration string.
+	SoakPeriod string `json:"soak_period"`
+	// MaxNonCompliantAccounts holds enforcement while more accounts report violations.
+	// Nil skips the violation count.
+	MaxNonCompliantAccounts *int `json:"max_non_compliant_accounts,omitempty"`
+}
+
+// effectiveRollout returns the rollout for a policy covering resources that select the
+// given rule sets: the secondary rule set's, else the primary's, else the entry's.
+func effectiveRollout(defaults config.ResourceDefaults, primary, secondary config.RuleSet) *config.Rollout {
+	switch {
+	case secondary.Rollout != nil:
+		return secondary.Rollout
+	case primary.Rollout != nil:
+		return primary.Rollout
+	}
+	return defaults.Rollout
+}
+
+// stagedRollout converts a staged rollout block into its rendered form. Immediate
+// rollouts render as nil.
+func stagedRollout(r *config.Rollout) *Rollout {
+	if r == nil || !r.Staged() {
+		return nil
+	}
+	return &Rollout{
+		SoakPeriod:              r.EffectiveSoakPeriod().String(),
+		MaxNonCompliantAccounts: r.MaxNonCompliantAccounts,
+	}
+}
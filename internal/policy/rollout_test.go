@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestBuildPolicies_Rollout(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	alb := cfg.ResourceDefaults["alb"]
+	alb.Rollout = &config.Rollout{Mode: config.RolloutStaged, SoakPeriod: "48h"}
+	cfg.ResourceDefaults["alb"] = alb
+	app := cfg.RuleSets.Primary["ou-shared-app"]
+	app.Rollout = &config.Rollout{Mode: config.RolloutImmediate}
+	cfg.RuleSets.Primary["ou-shared-app"] = app
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	resources := []discovery.Resource{
+		{
+			ID:   "edge/1",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/edge/1",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{cfg.TagKeys.Primary: "ou-shared-edge"},
+		},
+		{
+			ID:   "app/2",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/app/2",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{cfg.TagKeys.Primary: "ou-shared-app"},
+		},
+	}
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+
+	edge := result["auto-alb-edge-1"]
+	if edge.Rollout == nil || edge.Rollout.SoakPeriod != "48h0m0s" {
+		t.Fatalf("entry rollout not applied: %+v", edge.Rollout)
+	}
+	// The rule set's immediate rollout replaces the entry's staged one.
+	if r := result["auto-alb-app-2"].Rollout; r != nil {
+		t.Fatalf("expected an immediate rollout, got %+v", r)
+	}
+}
+
+func TestValidate_Rollout(t *testing.T) {
+	negative := -1
+	tests := []struct {
+		name    string
+		rollout config.Rollout
+		wantErr string
+	}{
+		{name: "staged defaults", rollout: config.Rollout{Mode: config.RolloutStaged}},
+		{name: "bad mode", rollout: config.Rollout{Mode: "canary"}, wantErr: "mode must be"},
+		{name: "bad soak period", rollout: config.Rollout{Mode: config.RolloutStaged, SoakPeriod: "3 days"}, wantErr: "not a duration"},
+		{name: "negative violation limit", rollout: config.Rollout{Mode: config.RolloutStaged, MaxNonCompliantAccounts: &negative}, wantErr: "must not be negative"},
+		{name: "soak period without staging", rollout: config.Rollout{SoakPeriod: "24h"}, wantErr: "require mode staged"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := mustLoadConfig(t)
+			bot := cfg.RuleSets.Secondary["ou-shared-bot"]
+			bot.Rollout = &tc.rollout
+			cfg.RuleSets.Secondary["ou-shared-bot"] = bot
+
+			err := cfg.Validate()
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package policy
+
+import (
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// Keys of RenderedPolicy.IncludeMap and ExcludeMap, as FMS expects them.
+const (
+	ScopeAccount = "ACCOUNT"
+	ScopeOrgUnit = "ORG_UNIT"
+)
+
+// effectiveScope returns the policyScope for a policy covering resources that select the
+// given rule sets: the secondary rule set's, else the primary's, else the entry's. Blocks
+// replace each other as a whole, so include and exclude lists never mix.
+func effectiveScope(defaults config.ResourceDefaults, primary, secondary config.RuleSet) *config.PolicyScope {
+	switch {
+	case secondary.PolicyScope != nil:
+		return secondary.PolicyScope
+	case primary.PolicyScope != nil:
+		return primary.PolicyScope
+	}
+	return defaults.PolicyScope
+}
+
+// applyScope sets the account scope and, when the scope has tags, the resource tags of p.
+func applyScope(p *RenderedPolicy, s *config.PolicyScope) {
+	if s == nil {
+		return
+	}
+	p.IncludeMap = scopeMap(s.IncludeAccounts, s.IncludeOUs)
+	p.ExcludeMap = scopeMap(s.ExcludeAccounts, s.ExcludeOUs)
+	if len(s.ResourceTags) > 0 {
+		p.ResourceTags = sortedResourceTags(s.ResourceTags)
+		p.ExcludeResourceTags = s.ExcludeResourceTags
+	}
+}
+
+func scopeMap(accounts, ous []string) map[string][]string {
+	if len(accounts)+len(ous) == 0 {
+		return nil
+	}
+	m := map[string][]string{}
+	if len(accounts) > 0 {
+		m[ScopeAccount] = accounts
+	}
+	if len(ous) > 0 {
+		m[ScopeOrgUnit] = ous
+	}
+	return m
+}
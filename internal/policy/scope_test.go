@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestBuildPolicies_PolicyScope(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	alb := cfg.ResourceDefaults["alb"]
+	alb.PolicyScope = &config.PolicyScope{
+		ExcludeAccounts:     []string{"111111111111"},
+		ResourceTags:        map[string]string{"fms": "off"},
+		ExcludeResourceTags: true,
+	}
+	cfg.ResourceDefaults["alb"] = alb
+	app := cfg.RuleSets.Primary["ou-shared-app"]
+	app.PolicyScope = &config.PolicyScope{IncludeOUs: []string{"ou-abcd-11111111"}}
+	cfg.RuleSets.Primary["ou-shared-app"] = app
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	resources := []discovery.Resource{
+		{
+			ID:   "edge/1",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/edge/1",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{cfg.TagKeys.Primary: "ou-shared-edge"},
+		},
+		{
+			ID:   "app/2",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/app/2",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{cfg.TagKeys.Primary: "ou-shared-app"},
+		},
+	}
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+
+	edge := result["auto-alb-edge-1"]
+	if edge.IncludeMap != nil || !reflect.DeepEqual(edge.ExcludeMap, map[string][]string{ScopeAccount: {"111111111111"}}) {
+		t.Fatalf("entry scope not applied: include=%v exclude=%v", edge.IncludeMap, edge.ExcludeMap)
+	}
+	if !edge.ExcludeResourceTags || !reflect.DeepEqual(edge.ResourceTags, []ResourceTag{{Key: "fms", Value: "off"}}) {
+		t.Fatalf("entry resource tags not applied: exclude=%v tags=%v", edge.ExcludeResourceTags, edge.ResourceTags)
+	}
+
+	// The rule set's block replaces the entry's as a whole.
+	appPolicy := result["auto-alb-app-2"]
+	if !reflect.DeepEqual(appPolicy.IncludeMap, map[string][]string{ScopeOrgUnit: {"ou-abcd-11111111"}}) ||
+		appPolicy.ExcludeMap != nil || appPolicy.ResourceTags != nil {
+		t.Fatalf("rule set scope not applied: %+v", appPolicy)
+	}
+}
+
+func TestValidate_PolicyScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   config.PolicyScope
+		mode    string
+		wantErr string
+	}{
+		{name: "valid", scope: config.PolicyScope{IncludeAccounts: []string{"123456789012"}, ResourceTags: map[string]string{"env": ""}}},
+		{name: "include and exclude", scope: config.PolicyScope{IncludeAccounts: []string{"123456789012"}, ExcludeOUs: []string{"ou-abcd-11111111"}}, wantErr: "not both"},
+		{name: "bad account", scope: config.PolicyScope{ExcludeAccounts: []string{"1234"}}, wantErr: "12-digit"},
+		{name: "bad ou", scope: config.PolicyScope{IncludeOUs: []string{"r-abcd"}}, wantErr: "not an OU id"},
+		{name: "exclude without tags", scope: config.PolicyScope{ExcludeResourceTags: true}, wantErr: "requires resourceTags"},
+		{name: "tags with rule-set grouping", scope: config.PolicyScope{ResourceTags: map[string]string{"env": "prod"}}, mode: config.GroupingRuleSet, wantErr: "not supported"},
+		{name: "accounts with rule-set grouping", scope: config.PolicyScope{IncludeOUs: []string{"ou-abcd-11111111"}}, mode: config.GroupingRuleSet},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := mustLoadConfig(t)
+			cfg.Grouping.Mode = tc.mode
+			edge := cfg.RuleSets.Secondary["ou-shared-bot"]
+			edge.PolicyScope = &tc.scope
+			cfg.RuleSets.Secondary["ou-shared-bot"] = edge
+
+			err := cfg.Validate()
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// resourceTypeList is the FMS ResourceType used when a policy covers several types.
+const resourceTypeList = "ResourceTypeList"
+
+// SecurityGroupsCommonServiceData is the managed_service_data document for
+// SECURITY_GROUPS_COMMON policies.
+type SecurityGroupsCommonServiceData struct {
+	Type                                     string             `json:"type"`
+	RevertManualSecurityGroupChanges         bool               `json:"revertManualSecurityGroupChanges"`
+	ExclusiveResourceSecurityGroupManagement bool               `json:"exclusiveResourceSecurityGroupManagement"`
+	ApplyToAllEC2InstanceENIs                bool               `json:"applyToAllEC2InstanceENIs"`
+	IncludeSharedVPC                         bool               `json:"includeSharedVPC"`
+	SecurityGroups                           []SecurityGroupRef `json:"securityGroups"`
+}
+
+// SecurityGroupsContentAuditServiceData is the managed_service_data document for
+// SECURITY_GROUPS_CONTENT_AUDIT policies.
+type SecurityGroupsContentAuditServiceData struct {
+	Type                string                       `json:"type"`
+	PreManagedOptions   []SecurityGroupManagedOption `json:"preManagedOptions,omitempty"`
+	SecurityGroups      []SecurityGroupRef           `json:"securityGroups,omitempty"`
+	SecurityGroupAction *SecurityGroupAction         `json:"securityGroupAction,omitempty"`
+}
+
+// SecurityGroupRef references a security group by id.
+type SecurityGroupRef struct {
+	ID string `json:"id"`
+}
+
+// SecurityGroupAction decides whether audited rules must match (ALLOW) or must not match (DENY).
+type SecurityGroupAction struct {
+	Type string `json:"type"`
+}
+
+// SecurityGroupManagedOption is one managed audit rule; exactly one field is set.
+type SecurityGroupManagedOption struct {
+	DenyProtocolAllValue *bool                   `json:"denyProtocolAllValue,omitempty"`
+	AuditSgDirection     *SecurityGroupDirection `json:"auditSgDirection,omitempty"`
+}
+
+// SecurityGroupDirection limits managed audit rules to a rule direction.
+type SecurityGroupDirection struct {
+	Type string `json:"type"`
+}
+
+// buildSecurityGroupPolicies renders securityGroupPolicies. They do not depend on
+// discovered resources: FMS selects the in-scope resources by their tags.
+func buildSecurityGroupPolicies(cfg *config.PolicyConfig, out *policySet) error {
+	ids := make([]string, 0, len(cfg.SecurityGroupPolicies))
+	for id := range cfg.SecurityGroupPolicies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		sg := cfg.SecurityGroupPolicies[id]
+
+		var doc any
+		desc := "Auto-generated security group common policy"
+		if sg.PolicyType == config.PolicyTypeSecurityGroupsContentAudit {
+			doc = buildSecurityGroupsContentAudit(sg)
+			desc = "Auto-generated security group content audit policy"
+		} else {
+			doc = buildSecurityGroupsCommon(sg)
+		}
+		msd, err := marshalServiceData(doc)
+		if err != nil {
+			return fmt.Errorf("render managed_service_data for security group policy %s: %w", id, err)
+		}
+
+		p := RenderedPolicy{
+			Name:                policyName(cfg.Naming, nameSource{typeName: "sg", id: id, hashKey: "sg|" + id}),
+			Description:         desc,
+			PolicyType:          sg.PolicyType,
+			ManagedServiceData:  msd,
+			ResourceTags:        sortedResourceTags(sg.ResourceTags),
+			ExcludeResourceTags: sg.ExcludeResourceTags,
+			Source:              "securityGroupPolicies " + id,
+		}
+		if types := sg.EffectiveResourceTypes(); len(types) == 1 {
+			p.ResourceType = types[0]
+		} else {
+			p.ResourceType = resourceTypeList
+			p.ResourceTypes = append([]string(nil), types...)
+		}
+		out.add(p, p.Source)
+	}
+	return nil
+}
+
+func buildSecurityGroupsCommon(sg config.SecurityGroupPolicy) SecurityGroupsCommonServiceData {
+	return SecurityGroupsCommonServiceData{
+		Type:                                     config.PolicyTypeSecurityGroupsCommon,
+		RevertManualSecurityGroupChanges:         sg.RevertManualSecurityGroupChanges,
+		ExclusiveResourceSecurityGroupManagement: sg.ExclusiveResourceSecurityGroupManagement,
+		ApplyToAllEC2InstanceENIs:                sg.ApplyToAllEC2InstanceENIs,
+		IncludeSharedVPC:                         sg.IncludeSharedVPC,
+		SecurityGroups:                           toSecurityGroupRefs(sg.SecurityGroups),
+	}
+}
+
+func buildSecurityGroupsContentAudit(sg config.SecurityGroupPolicy) SecurityGroupsContentAuditServiceData {
+	doc := SecurityGroupsContentAuditServiceData{
+		Type:           config.PolicyTypeSecurityGroupsContentAudit,
+		SecurityGroups: toSecurityGroupRefs(sg.SecurityGroups),
+	}
+
+	var audit config.SecurityGroupAudit
+	if sg.Audit != nil {
+		audit = *sg.Audit
+	}
+	if audit.DenyProtocolAllValue {
+		deny := true
+		doc.PreManagedOptions = append(doc.PreManagedOptions, SecurityGroupManagedOption{DenyProtocolAllValue: &deny})
+	}
+	if audit.Direction != "" {
+		doc.PreManagedOptions = append(doc.PreManagedOptions, SecurityGroupManagedOption{
+			AuditSgDirection: &SecurityGroupDirection{Type: audit.Direction},
+		})
+	}
+	if len(doc.SecurityGroups) > 0 {
+		action := audit.Action
+		if action == "" {
+			action = "ALLOW"
+		}
+		doc.SecurityGroupAction = &SecurityGroupAction{Type: action}
+	}
+	return doc
+}
+
+func toSecurityGroupRefs(ids []string) []SecurityGroupRef {
+	if len(ids) == 0 {
+		return nil
+	}
+	refs := make([]SecurityGroupRef, 0, len(ids))
+	for _, id := range ids {
+		refs = append(refs, SecurityGroupRef{ID: id})
+	}
+	return refs
+}
+
+// sortedResourceTags converts a tag map into a deterministic ResourceTags list.
+func sortedResourceTags(tags map[string]string) []ResourceTag {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]ResourceTag, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, ResourceTag{Key: k, Value: tags[k]})
+	}
+	return out
+}
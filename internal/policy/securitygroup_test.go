@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestBuildPolicies_SecurityGroupPolicies(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cfg.SecurityGroupPolicies = map[string]config.SecurityGroupPolicy{
+		"baseline-web": {
+			PolicyType:                       config.PolicyTypeSecurityGroupsCommon,
+			ResourceTags:                     map[string]string{"WafRulesetPrimary": "ou-shared-edge", "Tier": ""},
+			SecurityGroups:                   []string{"sg-0123456789abcdef0"},
+			RevertManualSecurityGroupChanges: true,
+			ApplyToAllEC2InstanceENIs:        true,
+		},
+		"no-open-ingress": {
+			PolicyType:     config.PolicyTypeSecurityGroupsContentAudit,
+			SecurityGroups: []string{"sg-0fedcba9876543210"},
+			Audit: &config.SecurityGroupAudit{
+				Action:               "DENY",
+				DenyProtocolAllValue: true,
+				Direction:            "INGRESS",
+			},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	// Security group policies render even when nothing was discovered.
+	result, err := BuildPolicies(nil, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 policies, got %d: %v", len(result), result)
+	}
+
+	common := result["auto-sg-baseline-web"]
+	if common.ResourceType != resourceTypeList ||
+		!reflect.DeepEqual(common.ResourceTypes, []string{"AWS::EC2::Instance", "AWS::EC2::NetworkInterface"}) {
+		t.Fatalf("unexpected common resource types: %s %v", common.ResourceType, common.ResourceTypes)
+	}
+	wantTags := []ResourceTag{{Key: "Tier"}, {Key: "WafRulesetPrimary", Value: "ou-shared-edge"}}
+	if !reflect.DeepEqual(common.ResourceTags, wantTags) {
+		t.Fatalf("unexpected common resource tags: %v", common.ResourceTags)
+	}
+
+	audit := result["auto-sg-no-open-ingress"]
+	if audit.ResourceType != "AWS::EC2::SecurityGroup" || len(audit.ResourceTypes) != 0 {
+		t.Fatalf("unexpected audit resource types: %s %v", audit.ResourceType, audit.ResourceTypes)
+	}
+
+	for golden, p := range map[string]RenderedPolicy{
+		"sg_common":        common,
+		"sg_content_audit": audit,
+	} {
+		var got bytes.Buffer
+		if err := json.Indent(&got, []byte(p.ManagedServiceData), "", "  "); err != nil {
+			t.Fatalf("indent managed_service_data: %v", err)
+		}
+		got.WriteByte('\n')
+		assertGolden(t, filepath.Join("testdata", "golden", golden+".json"), got.Bytes())
+	}
+}
+
+func TestValidate_SecurityGroupPoliciesNeedNoAccountOrRegion(t *testing.T) {
+	for _, comp := range []string{config.NameComponentAccount, config.NameComponentRegion} {
+		cfg := mustLoadConfig(t)
+		cfg.Naming.Components = []string{comp, config.NameComponentType, config.NameComponentID}
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("validate without security group policies: %v", err)
+		}
+		cfg.SecurityGroupPolicies = map[string]config.SecurityGroupPolicy{
+			"baseline-web": {
+				PolicyType:     config.PolicyTypeSecurityGroupsCommon,
+				SecurityGroups: []string{"sg-0123456789abcdef0"},
+			},
+		}
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), "naming.components must not include "+comp) {
+			t.Fatalf("expected naming.components to reject %s, got %v", comp, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// ShieldAdvancedServiceData is the managed_service_data document for FMS SHIELD_ADVANCED policies.
+type ShieldAdvancedServiceData struct {
+	Type                           string                   `json:"type"`
+	AutomaticResponseConfiguration *ShieldAutomaticResponse `json:"automaticResponseConfiguration,omitempty"`
+	OverrideCustomerWebACLClassic  bool                     `json:"overrideCustomerWebaclClassic"`
+}
+
+// ShieldAutomaticResponse configures automatic application-layer DDoS mitigation.
+type ShieldAutomaticResponse struct {
+	AutomaticResponseStatus string `json:"automaticResponseStatus"`
+	AutomaticResponseAction string `json:"automaticResponseAction,omitempty"`
+}
+
+// buildShieldServiceData converts merged Shield Advanced settings into the FMS document.
+func buildShieldServiceData(s config.ShieldAdvancedConfig) (ShieldAdvancedServiceData, error) {
+	doc := ShieldAdvancedServiceData{
+		Type:                          config.PolicyTypeShieldAdvanced,
+		OverrideCustomerWebACLClassic: s.OverrideCustomerWebACLClassic,
+	}
+	switch s.AutomaticResponse {
+	case "":
+	case "ENABLED":
+		if s.AutomaticResponseAction == "" {
+			return doc, fmt.Errorf("shieldAdvanced.automaticResponseAction is required when automaticResponse is ENABLED")
+		}
+		fallthrough
+	default:
+		doc.AutomaticResponseConfiguration = &ShieldAutomaticResponse{
+			AutomaticResponseStatus: s.AutomaticResponse,
+			AutomaticResponseAction: s.AutomaticResponseAction,
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,183 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+const shieldConfig = `
+resourceDefaults:
+  alb:
+    resourceType: "AWS::ElasticLoadBalancingV2::LoadBalancer"
+    scope: "REGIONAL"
+    defaultAction: "ALLOW"
+  alb-shield:
+    appliesTo: "alb"
+    policyType: "SHIELD_ADVANCED"
+    resourceType: "AWS::ElasticLoadBalancingV2::LoadBalancer"
+    shieldAdvanced:
+      automaticResponse: "ENABLED"
+      automaticResponseAction: "COUNT"
+  cloudfront-shield:
+    appliesTo: "cloudfront"
+    policyType: "SHIELD_ADVANCED"
+    resourceType: "AWS::CloudFront::Distribution"
+    shieldAdvanced:
+      automaticResponse: "ENABLED"
+      automaticResponseAction: "COUNT"
+      overrideCustomerWebACLClassic: true
+tagKeys:
+  primary: "WafRulesetPrimary"
+  secondary: "WafRulesetSecondary"
+ruleSets:
+  primary:
+    edge:
+      shieldAdvanced:
+        automaticResponseAction: "BLOCK"
+    internal: {}
+  secondary:
+    bot: {}
+defaults:
+  primary: "internal"
+  secondary: "bot"
+`
+
+func TestBuildPolicies_ShieldAdvanced(t *testing.T) {
+	cfg, err := config.LoadFromBytes([]byte(shieldConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	edgeTags := map[string]string{"WafRulesetPrimary": "edge", "WafRulesetSecondary": "bot"}
+	resources := []discovery.Resource{
+		{
+			ID:   "E2EXAMPLE",
+			ARN:  "arn:aws:cloudfront::123456789012:distribution/E2EXAMPLE",
+			Type: discovery.ResourceTypeCloudFront,
+			Tags: edgeTags,
+		},
+		{
+			ID:   "edge-alb/0123",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/edge-alb/0123",
+			Type: discovery.ResourceTypeALB,
+			Tags: edgeTags,
+		},
+		{
+			ID:   "internal-alb/4567",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/internal-alb/4567",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{},
+		},
+	}
+
+	result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+
+	// The edge ALB gets WAF and Shield policies; the internal ALB only opts into WAF.
+	wantTypes := map[string]string{
+		"auto-cloudfront-shield-E2EXAMPLE": config.PolicyTypeShieldAdvanced,
+		"auto-alb-edge-alb-0123":           config.PolicyTypeWAFV2,
+		"auto-alb-shield-edge-alb-0123":    config.PolicyTypeShieldAdvanced,
+		"auto-alb-internal-alb-4567":       config.PolicyTypeWAFV2,
+	}
+	if len(result) != len(wantTypes) {
+		t.Fatalf("expected %d policies, got %d: %v", len(wantTypes), len(result), result)
+	}
+	for name, want := range wantTypes {
+		p, ok := result[name]
+		if !ok {
+			t.Fatalf("policy %s not found", name)
+		}
+		if p.PolicyType != want {
+			t.Fatalf("policy %s has type %s, want %s", name, p.PolicyType, want)
+		}
+	}
+
+	var got bytes.Buffer
+	if err := json.Indent(&got, []byte(result["auto-cloudfront-shield-E2EXAMPLE"].ManagedServiceData), "", "  "); err != nil {
+		t.Fatalf("indent managed_service_data: %v", err)
+	}
+	got.WriteByte('\n')
+	assertGolden(t, filepath.Join("testdata", "golden", "cloudfront_shield.json"), got.Bytes())
+}
+
+func TestEffectiveShield(t *testing.T) {
+	defaults := config.ResourceDefaults{
+		ShieldAdvanced: &config.ShieldAdvancedConfig{AutomaticResponse: "ENABLED", AutomaticResponseAction: "COUNT"},
+	}
+	enabled := config.RuleSet{ShieldAdvanced: &config.ShieldAdvancedConfig{}}
+	block := config.RuleSet{ShieldAdvanced: &config.ShieldAdvancedConfig{AutomaticResponseAction: "BLOCK"}}
+	ignored := config.RuleSet{ShieldAdvanced: &config.ShieldAdvancedConfig{AutomaticResponse: "IGNORED"}}
+
+	if s := defaults.EffectiveShield(config.RuleSet{}, config.RuleSet{}); s != nil {
+		t.Fatalf("expected no Shield settings without an opted-in rule set, got %+v", s)
+	}
+	if s := defaults.EffectiveShield(enabled, config.RuleSet{}); s.AutomaticResponseAction != "COUNT" {
+		t.Fatalf("expected inherited COUNT, got %+v", s)
+	}
+	if s := defaults.EffectiveShield(ignored, block); s.AutomaticResponse != "IGNORED" || s.AutomaticResponseAction != "BLOCK" {
+		t.Fatalf("secondary should override primary, got %+v", s)
+	}
+
+	doc, err := buildShieldServiceData(*defaults.EffectiveShield(ignored, config.RuleSet{}))
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if doc.AutomaticResponseConfiguration.AutomaticResponseAction != "" {
+		t.Fatalf("IGNORED must not carry an action: %+v", doc.AutomaticResponseConfiguration)
+	}
+
+	if _, err := buildShieldServiceData(config.ShieldAdvancedConfig{AutomaticResponse: "ENABLED"}); err == nil {
+		t.Fatalf("expected an error for ENABLED without an action")
+	}
+}
+
+func TestValidate_ShieldEnabledNeedsAction(t *testing.T) {
+	shield := func(response, action string) *config.ShieldAdvancedConfig {
+		return &config.ShieldAdvancedConfig{AutomaticResponse: response, AutomaticResponseAction: action}
+	}
+	tests := []struct {
+		name             string
+		entry, edge, bot *config.ShieldAdvancedConfig
+		wantErr          string
+	}{
+		{name: "action inherited from the entry", entry: shield("ENABLED", "COUNT"), edge: shield("", "")},
+		{name: "action from the rule set", entry: shield("ENABLED", ""), edge: shield("", "BLOCK")},
+		{name: "entry enables without action", entry: shield("ENABLED", ""), edge: shield("", ""),
+			wantErr: "resourceDefaults[alb-shield].shieldAdvanced.automaticResponseAction is required"},
+		{name: "rule set enables without action", edge: shield("ENABLED", ""),
+			wantErr: "ruleSets.primary[edge].shieldAdvanced.automaticResponseAction is required"},
+		{name: "secondary re-enables after primary drops the action", entry: shield("ENABLED", "COUNT"), edge: shield("IGNORED", ""), bot: shield("ENABLED", ""),
+			wantErr: "ruleSets.secondary[bot].shieldAdvanced.automaticResponseAction is required"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.LoadFromBytes([]byte(shieldConfig))
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			entry := cfg.ResourceDefaults["alb-shield"]
+			entry.ShieldAdvanced = tc.entry
+			cfg.ResourceDefaults["alb-shield"] = entry
+			cfg.RuleSets.Primary["edge"] = config.RuleSet{ShieldAdvanced: tc.edge}
+			cfg.RuleSets.Secondary["bot"] = config.RuleSet{ShieldAdvanced: tc.bot}
+
+			err = cfg.Validate()
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
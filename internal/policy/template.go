@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/templates"
+)
+
+// DefaultTemplate is the template used when no per-resource-type template exists.
+const DefaultTemplate = "fms_policy.tmpl"
+
+// TemplateFuncs returns the helper functions available to every template.
+//
+//   - toJson v: encodes v as JSON; use it for every string taken from tags or config.
+//   - default def v: returns v, or def when v is empty.
+//   - lower s: lower-cases s.
+//   - hasTag tags key: reports whether the tag is present.
+//   - tag tags key: returns the tag value or "".
+//   - joinStrings sep elems: joins a string slice.
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"toJson": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+		"default": func(def, v any) any {
+			if isEmpty(v) {
+				return def
+			}
+			return v
+		},
+		"lower": strings.ToLower,
+		"hasTag": func(tags map[string]string, key string) bool {
+			_, ok := tags[key]
+			return ok
+		},
+		"tag": func(tags map[string]string, key string) string {
+			return tags[key]
+		},
+		// joinStrings is kept for templates written before toJson existed.
+		"joinStrings": func(sep string, elems []string) string {
+			return strings.Join(elems, sep)
+		},
+	}
+}
+
+func isEmpty(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
+
+// templateSet resolves and lazily parses templates so configs that only use
+// the typed builder never touch the template files.
+type templateSet struct {
+	// sources are searched in order; the user directory (if any) shadows the embedded FS.
+	sources []fs.FS
+	custom  bool
+	parsed  map[string]*template.Template
+}
+
+func newTemplateSet(dir string) *templateSet {
+	s := &templateSet{parsed: make(map[string]*template.Template)}
+	if dir != "" {
+		s.sources = append(s.sources, os.DirFS(dir))
+		s.custom = true
+	}
+	s.sources = append(s.sources, templates.FS)
+	return s
+}
+
+// templateFor decides whether a resource type renders through a template and which one.
+// An explicit resourceDefaults template always wins; with a template directory the
+// per-type file is preferred and DefaultTemplate is the fallback.
+func (s *templateSet) templateFor(resType discovery.ResourceType, defaults config.ResourceDefaults) (string, bool) {
+	if defaults.Template != "" {
+		return defaults.Template, true
+	}
+	if !s.custom {
+		return "", false
+	}
+	perType := string(resType) + ".tmpl"
+	if _, ok := s.find(perType); ok {
+		return perType, true
+	}
+	return DefaultTemplate, true
+}
+
+func (s *templateSet) find(name string) (fs.FS, bool) {
+	for _, fsys := range s.sources {
+		if _, err := fs.Stat(fsys, name); err == nil {
+			return fsys, true
+		}
+	}
+	return nil, false
+}
+
+func (s *templateSet) lookup(name string) (*template.Template, error) {
+	if t, ok := s.parsed[name]; ok {
+		return t, nil
+	}
+
+	fsys, ok := s.find(name)
+	if !ok {
+		return nil, fmt.Errorf("template %s not found", name)
+	}
+
+	tmpl, err := template.New(name).
+		Funcs(TemplateFuncs()).
+		Option("missingkey=zero").
+		ParseFS(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("parse template %s: %w", name, err)
+	}
+	tmpl = tmpl.Lookup(name)
+	if tmpl == nil {
+		return nil, fmt.Errorf("template %s not found after parsing", name)
+	}
+
+	s.parsed[name] = tmpl
+	return tmpl, nil
+}
+
+// render executes the named template and checks that the result is valid JSON.
+func (s *templateSet) render(name string, model TemplateModel) (string, error) {
+	tmpl, err := s.lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, model); err != nil {
+		return "", fmt.Errorf("execute template %s: %w", name, err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return "", fmt.Errorf("template %s did not produce valid JSON", name)
+	}
+	return buf.String(), nil
+}
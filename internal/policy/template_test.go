@@ -0,0 +1,129 @@
+package policy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+func TestBuildPolicies_TemplateDirPerResourceType(t *testing.T) {
+	cfg := mustLoadConfig(t)
+	cf := cfg.ResourceDefaults["alb"]
+	cf.ResourceType = "AWS::CloudFront::Distribution"
+	cf.Scope = "CLOUDFRONT"
+	cfg.ResourceDefaults["cloudfront"] = cf
+
+	dir := t.TempDir()
+	albTmpl := `{
+  "type": "WAFV2",
+  "defaultAction": {"type": {{ toJson .DefaultAction }}},
+  "env": {{ toJson (default "unknown" (tag .Tags "Env") | lower) }},
+  "hasOwner": {{ hasTag .Tags "Owner" }},
+  "dnsName": {{ toJson .Attributes.dnsName }},
+  "resourceArn": {{ toJson .Resource.ARN }},
+  "preProcessRuleGroups": {{ toJson .ServiceData.PreProcessRuleGroups }},
+  "postProcessRuleGroups": []
+}`
+	if err := os.WriteFile(filepath.Join(dir, "alb.tmpl"), []byte(albTmpl), 0o644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	resources := []discovery.Resource{
+		{
+			ID:   "tmpl-alb/1",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/tmpl-alb/1",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{
+				"Env":   `PROD"},"x":{"`,
+				"Owner": "team-a",
+			},
+			Attributes: map[string]string{"dnsName": "tmpl-alb-1.us-west-2.elb.amazonaws.com"},
+		},
+		{
+			ID:   "E123EXAMPLE",
+			ARN:  "arn:aws:cloudfront::123456789012:distribution/E123EXAMPLE",
+			Type: discovery.ResourceTypeCloudFront,
+			Tags: map[string]string{},
+		},
+	}
+
+	result, err := BuildPolicies(resources, cfg, Options{TemplateDir: dir}, util.NewLogger())
+	if err != nil {
+		t.Fatalf("build policies: %v", err)
+	}
+
+	alb, ok := result["auto-alb-tmpl-alb-1"]
+	if !ok {
+		t.Fatalf("alb policy not found in result")
+	}
+	var albDoc struct {
+		Env                  string            `json:"env"`
+		HasOwner             bool              `json:"hasOwner"`
+		DNSName              string            `json:"dnsName"`
+		ResourceArn          string            `json:"resourceArn"`
+		PreProcessRuleGroups []json.RawMessage `json:"preProcessRuleGroups"`
+	}
+	if err := json.Unmarshal([]byte(alb.ManagedServiceData), &albDoc); err != nil {
+		t.Fatalf("unmarshal alb managed_service_data: %v", err)
+	}
+	if albDoc.Env != `prod"},"x":{"` {
+		t.Fatalf("unexpected env %q", albDoc.Env)
+	}
+	if !albDoc.HasOwner {
+		t.Fatalf("expected hasOwner to be true")
+	}
+	if albDoc.DNSName != "tmpl-alb-1.us-west-2.elb.amazonaws.com" {
+		t.Fatalf("unexpected dnsName %q", albDoc.DNSName)
+	}
+	if albDoc.ResourceArn != resources[0].ARN {
+		t.Fatalf("unexpected resourceArn %q", albDoc.ResourceArn)
+	}
+	if len(albDoc.PreProcessRuleGroups) != 3 {
+		t.Fatalf("expected 3 rule groups, got %d", len(albDoc.PreProcessRuleGroups))
+	}
+
+	// No cloudfront.tmpl in the directory, so the embedded default template is used.
+	cfPolicy, ok := result["auto-cloudfront-E123EXAMPLE"]
+	if !ok {
+		t.Fatalf("cloudfront policy not found in result")
+	}
+	if cfPolicy.ResourceType != "AWS::CloudFront::Distribution" {
+		t.Fatalf("unexpected resource type %q", cfPolicy.ResourceType)
+	}
+	var cfDoc struct {
+		Type                 string            `json:"type"`
+		PreProcessRuleGroups []json.RawMessage `json:"preProcessRuleGroups"`
+	}
+	if err := json.Unmarshal([]byte(cfPolicy.ManagedServiceData), &cfDoc); err != nil {
+		t.Fatalf("unmarshal cloudfront managed_service_data: %v", err)
+	}
+	if cfDoc.Type != "WAFV2" || len(cfDoc.PreProcessRuleGroups) != 3 {
+		t.Fatalf("unexpected cloudfront document: %s", cfPolicy.ManagedServiceData)
+	}
+}
+
+func TestBuildPolicies_TemplateMustProduceJSON(t *testing.T) {
+	cfg := mustLoadConfig(t)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "alb.tmpl"), []byte(`{"env": "{{ tag .Tags "Env" }}"}`), 0o644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	resources := []discovery.Resource{
+		{
+			ID:   "bad-alb/1",
+			ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/bad-alb/1",
+			Type: discovery.ResourceTypeALB,
+			Tags: map[string]string{"Env": `"unquoted`},
+		},
+	}
+
+	if _, err := BuildPolicies(resources, cfg, Options{TemplateDir: dir}, util.NewLogger()); err == nil {
+		t.Fatalf("expected invalid JSON error")
+	}
+}
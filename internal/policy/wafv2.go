@@ -0,0 +1,222 @@
+package policy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+)
+
+// WAFv2ServiceData is the typed form of the FMS WAFV2 managed_service_data document.
+//
+// It is marshalled with encoding/json, so values taken from tags or config are
+// always escaped correctly.
+type WAFv2ServiceData struct {
+	Type                              string                       `json:"type"`
+	DefaultAction                     WAFv2DefaultAction           `json:"defaultAction"`
+	OverrideCustomerWebACLAssociation bool                         `json:"overrideCustomerWebACLAssociation"`
+	PreProcessRuleGroups              []WAFv2RuleGroup             `json:"preProcessRuleGroups"`
+	PostProcessRuleGroups             []WAFv2RuleGroup             `json:"postProcessRuleGroups"`
+	LoggingConfiguration              *WAFv2LoggingConfiguration   `json:"loggingConfiguration,omitempty"`
+	CustomResponseBodies              map[string]WAFv2ResponseBody `json:"customResponseBodies,omitempty"`
+	TokenDomains                      []string                     `json:"tokenDomains,omitempty"`
+}
+
+// WAFv2DefaultAction is the web ACL action for requests that match no rule.
+type WAFv2DefaultAction struct {
+	Type           string               `json:"type"`
+	CustomResponse *WAFv2CustomResponse `json:"customResponse,omitempty"`
+}
+
+// WAFv2CustomResponse customizes the response of a BLOCK action.
+type WAFv2CustomResponse struct {
+	ResponseCode          int           `json:"responseCode"`
+	CustomResponseBodyKey string        `json:"customResponseBodyKey,omitempty"`
+	ResponseHeaders       []WAFv2Header `json:"responseHeaders,omitempty"`
+}
+
+// WAFv2Header is a single HTTP header in a custom response.
+type WAFv2Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// WAFv2ResponseBody is a reusable custom response body.
+type WAFv2ResponseBody struct {
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"`
+}
+
+// WAFv2RuleGroup is one entry of preProcessRuleGroups/postProcessRuleGroups.
+type WAFv2RuleGroup struct {
+	RuleGroupType              string                           `json:"ruleGroupType"`
+	RuleGroupArn               string                           `json:"ruleGroupArn,omitempty"`
+	ManagedRuleGroupIdentifier *WAFv2ManagedRuleGroupIdentifier `json:"managedRuleGroupIdentifier,omitempty"`
+	OverrideAction             WAFv2OverrideAction              `json:"overrideAction"`
+	ExcludeRules               []WAFv2ExcludeRule               `json:"excludeRules"`
+	RuleActionOverrides        []WAFv2RuleActionOverride        `json:"ruleActionOverrides,omitempty"`
+}
+
+// WAFv2ManagedRuleGroupIdentifier names a vendor-managed rule group.
+type WAFv2ManagedRuleGroupIdentifier struct {
+	VendorName           string `json:"vendorName"`
+	ManagedRuleGroupName string `json:"managedRuleGroupName"`
+	Version              string `json:"version,omitempty"`
+	VersionEnabled       bool   `json:"versionEnabled,omitempty"`
+}
+
+// WAFv2OverrideAction is "NONE" or "COUNT".
+type WAFv2OverrideAction struct {
+	Type string `json:"type"`
+}
+
+// WAFv2ExcludeRule sets a single rule in a rule group to count.
+type WAFv2ExcludeRule struct {
+	Name string `json:"name"`
+}
+
+// WAFv2RuleActionOverride replaces the action of a single rule.
+type WAFv2RuleActionOverride struct {
+	Name        string           `json:"name"`
+	ActionToUse WAFv2ActionToUse `json:"actionToUse"`
+}
+
+// WAFv2ActionToUse serializes as an object with exactly one action key, e.g. {"count":{}}.
+type WAFv2ActionToUse struct {
+	Allow     *struct{} `json:"allow,omitempty"`
+	Block     *struct{} `json:"block,omitempty"`
+	Count     *struct{} `json:"count,omitempty"`
+	Captcha   *struct{} `json:"captcha,omitempty"`
+	Challenge *struct{} `json:"challenge,omitempty"`
+}
+
+// WAFv2LoggingConfiguration configures logging for FMS-managed web ACLs.
+type WAFv2LoggingConfiguration struct {
+	LogDestinationConfigs []string             `json:"logDestinationConfigs"`
+	RedactedFields        []WAFv2RedactedField `json:"redactedFields,omitempty"`
+}
+
+// WAFv2RedactedField removes a request component from the logs.
+type WAFv2RedactedField struct {
+	RedactedFieldType  string `json:"redactedFieldType"`
+	RedactedFieldValue string `json:"redactedFieldValue,omitempty"`
+}
+
+// buildWAFv2ServiceData merges the resource defaults with the selected rule sets
+// into the typed managed_service_data document.
+func buildWAFv2ServiceData(
+	defaults config.ResourceDefaults,
+	primary config.RuleSet,
+	secondary config.RuleSet,
+) WAFv2ServiceData {
+	pre := mergeRuleGroups(defaults.ManagedRuleGroups, primary.RuleGroups, secondary.RuleGroups)
+	post := mergeRuleGroups(primary.PostProcessRuleGroups, secondary.PostProcessRuleGroups, defaults.PostProcessRuleGroups)
+
+	data := WAFv2ServiceData{
+		Type:                              "WAFV2",
+		DefaultAction:                     WAFv2DefaultAction{Type: defaults.EffectiveDefaultAction()},
+		OverrideCustomerWebACLAssociation: defaults.OverrideCustomerWebACLAssociation,
+		PreProcessRuleGroups:              toWAFv2RuleGroups(pre),
+		PostProcessRuleGroups:             toWAFv2RuleGroups(post),
+		TokenDomains:                      defaults.TokenDomains,
+	}
+
+	if cr := defaults.DefaultActionResponse; cr != nil {
+		data.DefaultAction.CustomResponse = &WAFv2CustomResponse{
+			ResponseCode:          cr.ResponseCode,
+			CustomResponseBodyKey: cr.CustomResponseBodyKey,
+			ResponseHeaders:       toWAFv2Headers(cr.ResponseHeaders),
+		}
+	}
+
+	if lc := defaults.Logging; lc != nil {
+		logging := &WAFv2LoggingConfiguration{LogDestinationConfigs: lc.LogDestinationConfigs}
+		for _, f := range lc.RedactedFields {
+			logging.RedactedFields = append(logging.RedactedFields, WAFv2RedactedField{
+				RedactedFieldType:  f.Type,
+				RedactedFieldValue: f.Value,
+			})
+		}
+		data.LoggingConfiguration = logging
+	}
+
+	if len(defaults.CustomResponseBodies) > 0 {
+		data.CustomResponseBodies = make(map[string]WAFv2ResponseBody, len(defaults.CustomResponseBodies))
+		for key, body := range defaults.CustomResponseBodies {
+			data.CustomResponseBodies[key] = WAFv2ResponseBody{ContentType: body.ContentType, Content: body.Content}
+		}
+	}
+
+	return data
+}
+
+func toWAFv2RuleGroups(groups []config.RuleGroupConfig) []WAFv2RuleGroup {
+	out := make([]WAFv2RuleGroup, 0, len(groups))
+	for _, rg := range groups {
+		g := WAFv2RuleGroup{
+			OverrideAction: WAFv2OverrideAction{Type: "NONE"},
+			ExcludeRules:   make([]WAFv2ExcludeRule, 0, len(rg.ExcludeRules)),
+		}
+		if rg.OverrideAction != "" {
+			g.OverrideAction.Type = rg.OverrideAction
+		}
+		if rg.ARN != "" {
+			g.RuleGroupType = "RuleGroup"
+			g.RuleGroupArn = rg.ARN
+		} else {
+			g.RuleGroupType = "ManagedRuleGroup"
+			g.ManagedRuleGroupIdentifier = &WAFv2ManagedRuleGroupIdentifier{
+				VendorName:           rg.Vendor,
+				ManagedRuleGroupName: rg.Name,
+				Version:              rg.Version,
+				VersionEnabled:       rg.Version != "",
+			}
+		}
+		for _, name := range rg.ExcludeRules {
+			g.ExcludeRules = append(g.ExcludeRules, WAFv2ExcludeRule{Name: name})
+		}
+		for _, o := range rg.RuleActionOverrides {
+			g.RuleActionOverrides = append(g.RuleActionOverrides, WAFv2RuleActionOverride{
+				Name:        o.Name,
+				ActionToUse: toWAFv2ActionToUse(o.Action),
+			})
+		}
+		out = append(out, g)
+	}
+	return out
+}
+
+func toWAFv2ActionToUse(action string) WAFv2ActionToUse {
+	var a WAFv2ActionToUse
+	switch strings.ToUpper(action) {
+	case "ALLOW":
+		a.Allow = &struct{}{}
+	case "BLOCK":
+		a.Block = &struct{}{}
+	case "COUNT":
+		a.Count = &struct{}{}
+	case "CAPTCHA":
+		a.Captcha = &struct{}{}
+	case "CHALLENGE":
+		a.Challenge = &struct{}{}
+	}
+	return a
+}
+
+// toWAFv2Headers sorts headers by name so the rendered document is stable.
+func toWAFv2Headers(headers map[string]string) []WAFv2Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]WAFv2Header, 0, len(names))
+	for _, name := range names {
+		out = append(out, WAFv2Header{Name: name, Value: headers[name]})
+	}
+	return out
+}
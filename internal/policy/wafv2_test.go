@@ -0,0 +1,173 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/config"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/discovery"
+	"github.com/forkedpacket/aws-fms-secpolicy-learning/internal/util"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata/golden")
+
+func TestBuildPolicies_Golden(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		tags   map[string]string
+		mutate func(cfg *config.PolicyConfig)
+	}{
+		{
+			name:   "alb_embedded_defaults",
+			config: "",
+			tags:   map[string]string{},
+		},
+		{
+			name:   "alb_full",
+			config: "testdata/full-config.yaml",
+			tags: map[string]string{
+				"WafRulesetPrimary":   "edge",
+				"WafRulesetSecondary": "bot",
+			},
+		},
+		{
+			name:   "alb_custom_template",
+			config: "",
+			tags:   map[string]string{},
+			mutate: func(cfg *config.PolicyConfig) {
+				d := cfg.ResourceDefaults["alb"]
+				d.Template = "fms_policy.tmpl"
+				cfg.ResourceDefaults["alb"] = d
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := mustLoadConfig(t)
+			if tc.config != "" {
+				var err error
+				cfg, err = config.Load(tc.config)
+				if err != nil {
+					t.Fatalf("load config: %v", err)
+				}
+			}
+			if tc.mutate != nil {
+				tc.mutate(cfg)
+			}
+
+			resources := []discovery.Resource{
+				{
+					ID:   "golden-alb/0123",
+					ARN:  "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/golden-alb/0123",
+					Type: discovery.ResourceTypeALB,
+					Tags: tc.tags,
+				},
+			}
+
+			result, err := BuildPolicies(resources, cfg, Options{}, util.NewLogger())
+			if err != nil {
+				t.Fatalf("build policies: %v", err)
+			}
+			p, ok := result["auto-alb-golden-alb-0123"]
+			if !ok {
+				t.Fatalf("policy not found in result")
+			}
+
+			var got bytes.Buffer
+			if err := json.Indent(&got, []byte(p.ManagedServiceData), "", "  "); err != nil {
+				t.Fatalf("indent managed_service_data: %v", err)
+			}
+			got.WriteByte('\n')
+
+			assertGolden(t, filepath.Join("testdata", "golden", tc.name+".json"), got.Bytes())
+		})
+	}
+}
+
+func TestBuildWAFv2ServiceData_EscapesConfigStrings(t *testing.T) {
+	defaults := config.ResourceDefaults{
+		DefaultAction: "ALLOW",
+		ManagedRuleGroups: []config.RuleGroupConfig{
+			{ARN: `arn:aws:wafv2:::rulegroup/"},{"injected":"x`},
+		},
+	}
+
+	msd, err := marshalServiceData(buildWAFv2ServiceData(defaults, config.RuleSet{}, config.RuleSet{}))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var decoded WAFv2ServiceData
+	if err := json.Unmarshal([]byte(msd), &decoded); err != nil {
+		t.Fatalf("rendered document is not valid JSON: %v", err)
+	}
+	if len(decoded.PreProcessRuleGroups) != 1 {
+		t.Fatalf("expected 1 rule group, got %d", len(decoded.PreProcessRuleGroups))
+	}
+	if got := decoded.PreProcessRuleGroups[0].RuleGroupArn; got != defaults.ManagedRuleGroups[0].ARN {
+		t.Fatalf("rule group ARN was altered: %q", got)
+	}
+}
+
+// The baseline passed defaultAction through as written, so lower-case values still load.
+func TestValidate_DefaultActionIgnoresCase(t *testing.T) {
+	tests := []struct {
+		action  string
+		wantErr string
+	}{
+		{action: "BLOCK"},
+		{action: "allow"},
+		{action: "Block"},
+		{action: "", wantErr: "resourceDefaults[alb].defaultAction is required"},
+		{action: "deny", wantErr: "defaultAction must be ALLOW or BLOCK"},
+	}
+	for _, tc := range tests {
+		cfg := mustLoadConfig(t)
+		alb := cfg.ResourceDefaults["alb"]
+		alb.DefaultAction = tc.action
+		cfg.ResourceDefaults["alb"] = alb
+
+		err := cfg.Validate()
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Fatalf("%q: unexpected error: %v", tc.action, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Fatalf("%q: expected error containing %q, got %v", tc.action, tc.wantErr, err)
+		}
+		if tc.wantErr == "" {
+			data := buildWAFv2ServiceData(alb, config.RuleSet{}, config.RuleSet{})
+			if want := strings.ToUpper(tc.action); data.DefaultAction.Type != want {
+				t.Fatalf("%q: rendered default action %q, want %q", tc.action, data.DefaultAction.Type, want)
+			}
+		}
+	}
+}
+
+func assertGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("create golden dir: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("write golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s mismatch (run with -update to accept)\n--- got ---\n%s\n--- want ---\n%s", path, got, want)
+	}
+}
@@ -0,0 +1,292 @@
+// Package preflight checks, before a run discovers or writes anything, that it can
+// succeed: that the account is the FMS administrator, that the FMS policy quota has room
+// for the policies it creates, and that the role holds the permissions the run needs. Each failed check says how to
+// fix it, instead of the run failing halfway with an opaque put policy error.
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// ErrFailed is returned when a check fails.
+var ErrFailed = errors.New("preflight checks failed")
+
+// FMSAPI is the subset of the FMS client the checks read from.
+type FMSAPI interface {
+	GetAdminAccount(ctx context.Context, params *fms.GetAdminAccountInput, optFns ...func(*fms.Options)) (*fms.GetAdminAccountOutput, error)
+	ListPolicies(ctx context.Context, params *fms.ListPoliciesInput, optFns ...func(*fms.Options)) (*fms.ListPoliciesOutput, error)
+}
+
+// STSAPI is the subset of the STS client the checks read from.
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// IAMAPI is the subset of the IAM client the checks read from.
+type IAMAPI interface {
+	SimulatePrincipalPolicy(ctx context.Context, params *iam.SimulatePrincipalPolicyInput, optFns ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error)
+}
+
+// Clients are the AWS clients the checks call.
+type Clients struct {
+	FMS FMSAPI
+	STS STSAPI
+	IAM IAMAPI
+}
+
+// NewClients builds the clients from an AWS config.
+func NewClients(awsCfg aws.Config) Clients {
+	return Clients{
+		FMS: fms.NewFromConfig(awsCfg),
+		STS: sts.NewFromConfig(awsCfg),
+		IAM: iam.NewFromConfig(awsCfg),
+	}
+}
+
+// Options says what the run will use, which decides the permissions it needs.
+type Options struct {
+	// Region is the region of the run, used in the ARN of the SSM parameter.
+	Region string
+	// PolicyQuota is the number of FMS policies the administrator may have.
+	PolicyQuota int
+	// ConfigParam is the SSM parameter the config is read from, if any.
+	ConfigParam string
+	// HistoryLocation is the version store of replaced policies, if any. Only an S3
+	// location needs permissions.
+	HistoryLocation string
+}
+
+// Names of the checks, in the order they run.
+const (
+	CheckIdentity    = "identity"
+	CheckAdmin       = "fms-admin"
+	CheckQuota       = "policy-quota"
+	CheckPermissions = "permissions"
+)
+
+// Result is the outcome of one check. Detail says what was found, and for a failed check
+// how to fix it. A warning passes but may fail the run later, depending on what it plans.
+type Result struct {
+	Check   string `json:"check"`
+	OK      bool   `json:"ok"`
+	Warning bool   `json:"warning,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+// Report is the outcome of all checks.
+type Report struct {
+	Results []Result `json:"results"`
+	// PoliciesInUse and PolicyQuota are what the quota check found, for CheckCreates.
+	PoliciesInUse int `json:"policiesInUse"`
+	PolicyQuota   int `json:"policyQuota"`
+}
+
+// Err returns an error wrapping ErrFailed that lists the failed checks, or nil.
+func (r *Report) Err() error {
+	var failed []string
+	for _, res := range r.Results {
+		if !res.OK {
+			failed = append(failed, fmt.Sprintf("  - %s: %s", res.Check, res.Detail))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w:\n%s", ErrFailed, strings.Join(failed, "\n"))
+}
+
+// Write renders the report as a table.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, res := range r.Results {
+		status := "ok"
+		switch {
+		case !res.OK:
+			status = "FAIL"
+		case res.Warning:
+			status = "WARN"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", res.Check, status, res.Detail)
+	}
+	return tw.Flush()
+}
+
+// CheckCreates returns an error wrapping ErrFailed when creating creates policies would
+// exceed the policy quota the checks found. Updates and deletions need no room, so a full
+// quota only fails a run that creates policies. Deletions run after the upserts and free
+// no room for them.
+func (r *Report) CheckCreates(creates int) error {
+	if r.PolicyQuota <= 0 || creates == 0 || r.PoliciesInUse+creates <= r.PolicyQuota {
+		return nil
+	}
+	return fmt.Errorf("%w:\n  - %s: creating %d policies with %d of %d in use exceeds the quota; delete unused policies or request a Firewall Manager quota increase and set preflight.policyQuota",
+		ErrFailed, CheckQuota, creates, r.PoliciesInUse, r.PolicyQuota)
+}
+
+func (r *Report) add(check string, ok bool, format string, args ...any) {
+	r.Results = append(r.Results, Result{Check: check, OK: ok, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) warn(check string, format string, args ...any) {
+	r.Results = append(r.Results, Result{Check: check, OK: true, Warning: true, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Run runs the checks. A failed identity check skips the others, which need the caller's
+// account; the others all run, so one report lists every problem. Only errors of the
+// checks themselves are in the report; Run itself does not fail.
+func Run(ctx context.Context, clients Clients, opts Options) *Report {
+	report := &Report{}
+	identity, err := clients.STS.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		report.add(CheckIdentity, false, "get caller identity: %v; check the AWS credentials", err)
+		return report
+	}
+	account, callerARN := aws.ToString(identity.Account), aws.ToString(identity.Arn)
+	report.add(CheckIdentity, true, "%s", callerARN)
+
+	checkAdmin(ctx, clients.FMS, account, report)
+	checkQuota(ctx, clients.FMS, opts.PolicyQuota, report)
+	checkPermissions(ctx, clients.IAM, callerARN, opts, report)
+	return report
+}
+
+// checkAdmin verifies that the account is the FMS administrator and that FMS is ready to
+// use it.
+func checkAdmin(ctx context.Context, client FMSAPI, account string, report *Report) {
+	out, err := client.GetAdminAccount(ctx, &fms.GetAdminAccountInput{})
+	var notFound *fmstypes.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		report.add(CheckAdmin, false, "no FMS administrator is set; from the organization management account run `aws fms associate-admin-account --admin-account %s` in us-east-1", account)
+		return
+	case err != nil:
+		report.add(CheckAdmin, false, "get FMS administrator: %v; run in the FMS administrator account", err)
+		return
+	}
+	admin := aws.ToString(out.AdminAccount)
+	switch {
+	case admin != account:
+		report.add(CheckAdmin, false, "running in %s but the FMS administrator is %s; deploy to %s or make %s the administrator", account, admin, admin, account)
+	case out.RoleStatus != "" && out.RoleStatus != fmstypes.AccountRoleStatusReady:
+		report.add(CheckAdmin, false, "%s is the FMS administrator but its role status is %s; wait until it is READY", account, out.RoleStatus)
+	default:
+		report.add(CheckAdmin, true, "%s is the FMS administrator", account)
+	}
+}
+
+// checkQuota counts the policies in use. A full quota is only a warning: whether the run
+// fails depends on whether it creates policies, which Report.CheckCreates decides once the
+// run is planned.
+func checkQuota(ctx context.Context, client FMSAPI, quota int, report *Report) {
+	var count int
+	pager := fms.NewListPoliciesPaginator(client, &fms.ListPoliciesInput{})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			report.add(CheckQuota, false, "list policies: %v", err)
+			return
+		}
+		count += len(page.PolicyList)
+	}
+	report.PoliciesInUse, report.PolicyQuota = count, quota
+	if quota > 0 && count >= quota {
+		report.warn(CheckQuota, "%d of %d policies in use; runs that create policies will fail until unused policies are deleted or the Firewall Manager quota is raised (set preflight.policyQuota)", count, quota)
+		return
+	}
+	report.add(CheckQuota, true, "%d of %d policies in use", count, quota)
+}
+
+// checkPermissions simulates the required actions against the caller's policies and
+// lists the denied ones.
+func checkPermissions(ctx context.Context, client IAMAPI, callerARN string, opts Options, report *Report) {
+	principal, err := principalARN(callerARN)
+	if err != nil {
+		report.add(CheckPermissions, false, "%v", err)
+		return
+	}
+	if principal == "" {
+		report.add(CheckPermissions, true, "running as the account root user; permissions are not simulated")
+		return
+	}
+	// principalARN built the ARN, so it parses; it holds the caller's partition and account.
+	parsed, _ := arn.Parse(principal)
+	requirements := Requirements(parsed.Partition, parsed.AccountID, opts)
+
+	// A simulation applies every action to every resource, so actions are grouped by
+	// resource.
+	byResource := map[string][]string{}
+	for _, r := range requirements {
+		byResource[r.Resource] = append(byResource[r.Resource], r.Action)
+	}
+	resources := make([]string, 0, len(byResource))
+	for resource := range byResource {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	var denied []string
+	for _, resource := range resources {
+		in := &iam.SimulatePrincipalPolicyInput{PolicySourceArn: aws.String(principal), ActionNames: byResource[resource]}
+		if resource != "*" {
+			in.ResourceArns = []string{resource}
+		}
+		pager := iam.NewSimulatePrincipalPolicyPaginator(client, in)
+		for pager.HasMorePages() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				report.add(CheckPermissions, false, "simulate policy of %s: %v; grant the role iam:SimulatePrincipalPolicy on itself", principal, err)
+				return
+			}
+			for _, res := range page.EvaluationResults {
+				if res.EvalDecision == iamtypes.PolicyEvaluationDecisionTypeAllowed {
+					continue
+				}
+				action := aws.ToString(res.EvalActionName)
+				if resource != "*" {
+					action += " on " + resource
+				}
+				denied = append(denied, fmt.Sprintf("%s (%s)", action, res.EvalDecision))
+			}
+		}
+	}
+	if len(denied) > 0 {
+		report.add(CheckPermissions, false, "%s is denied %s; add them to the role's policy (terraform/main.tf)", principal, strings.Join(denied, ", "))
+		return
+	}
+	report.add(CheckPermissions, true, "%s holds the %d required permissions", principal, len(requirements))
+}
+
+// principalARN returns the IAM ARN the caller's policies are simulated for. An assumed
+// role session maps to its role; the role's path is not part of the session ARN, so
+// roles with a path other than / cannot be simulated. The root user returns "".
+func principalARN(callerARN string) (string, error) {
+	a, err := arn.Parse(callerARN)
+	if err != nil {
+		return "", fmt.Errorf("parse caller ARN %q: %w", callerARN, err)
+	}
+	switch {
+	case a.Service == "iam" && a.Resource == "root":
+		return "", nil
+	case a.Service == "iam":
+		return callerARN, nil
+	case a.Service == "sts" && strings.HasPrefix(a.Resource, "assumed-role/"):
+		role, _, _ := strings.Cut(strings.TrimPrefix(a.Resource, "assumed-role/"), "/")
+		return arn.ARN{Partition: a.Partition, Service: "iam", AccountID: a.AccountID, Resource: "role/" + role}.String(), nil
+	}
+	return "", fmt.Errorf("cannot simulate the policies of %s; run as an IAM role or user", callerARN)
+}
@@ -0,0 +1,302 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/fms"
+	fmstypes "github.com/aws/aws-sdk-go-v2/service/fms/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type fakeFMS struct {
+	admin    *fms.GetAdminAccountOutput
+	adminErr error
+	policies int
+}
+
+func (f *fakeFMS) GetAdminAccount(context.Context, *fms.GetAdminAccountInput, ...func(*fms.Options)) (*fms.GetAdminAccountOutput, error) {
+	return f.admin, f.adminErr
+}
+
+func (f *fakeFMS) ListPolicies(_ context.Context, in *fms.ListPoliciesInput, _ ...func(*fms.Options)) (*fms.ListPoliciesOutput, error) {
+	// Two policies per page, to cover the pagination.
+	start := 0
+	if in.NextToken != nil {
+		start = len(aws.ToString(in.NextToken))
+	}
+	out := &fms.ListPoliciesOutput{}
+	for i := start; i < f.policies && i < start+2; i++ {
+		out.PolicyList = append(out.PolicyList, fmstypes.PolicySummary{})
+	}
+	if start+2 < f.policies {
+		out.NextToken = aws.String(strings.Repeat("x", start+2))
+	}
+	return out, nil
+}
+
+type fakeSTS struct {
+	arn string
+	err error
+}
+
+func (f *fakeSTS) GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String("111111111111"), Arn: aws.String(f.arn)}, nil
+}
+
+// fakeIAM allows every action except those in denied.
+type fakeIAM struct {
+	denied    map[string]bool
+	err       error
+	principal string
+	calls     int
+}
+
+func (f *fakeIAM) SimulatePrincipalPolicy(_ context.Context, in *iam.SimulatePrincipalPolicyInput, _ ...func(*iam.Options)) (*iam.SimulatePrincipalPolicyOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.principal = aws.ToString(in.PolicySourceArn)
+	out := &iam.SimulatePrincipalPolicyOutput{}
+	for _, action := range in.ActionNames {
+		decision := iamtypes.PolicyEvaluationDecisionTypeAllowed
+		if f.denied[action] {
+			decision = iamtypes.PolicyEvaluationDecisionTypeImplicitDeny
+		}
+		out.EvaluationResults = append(out.EvaluationResults, iamtypes.EvaluationResult{EvalActionName: aws.String(action), EvalDecision: decision})
+	}
+	return out, nil
+}
+
+const roleSession = "arn:aws:sts::111111111111:assumed-role/fms-renderer-lambda-role/fms-renderer"
+
+func readyAdmin(account string) *fms.GetAdminAccountOutput {
+	return &fms.GetAdminAccountOutput{AdminAccount: aws.String(account), RoleStatus: fmstypes.AccountRoleStatusReady}
+}
+
+func TestRun(t *testing.T) {
+	opts := Options{Region: "us-east-1", PolicyQuota: 5, ConfigParam: "/fms/policy-variants", HistoryLocation: "s3://history/policy-history"}
+	for _, tc := range []struct {
+		name   string
+		fms    *fakeFMS
+		sts    *fakeSTS
+		iam    *fakeIAM
+		failed map[string]string // check -> substring of its detail
+		warned map[string]string
+	}{
+		{
+			name: "all pass",
+			fms:  &fakeFMS{admin: readyAdmin("111111111111"), policies: 3},
+			sts:  &fakeSTS{arn: roleSession},
+			iam:  &fakeIAM{},
+		},
+		{
+			name: "no administrator",
+			fms:  &fakeFMS{adminErr: &fmstypes.ResourceNotFoundException{}},
+			sts:  &fakeSTS{arn: roleSession},
+			iam:  &fakeIAM{},
+			failed: map[string]string{
+				CheckAdmin: "aws fms associate-admin-account --admin-account 111111111111",
+			},
+		},
+		{
+			name: "other administrator and full quota",
+			fms:  &fakeFMS{admin: readyAdmin("222222222222"), policies: 5},
+			sts:  &fakeSTS{arn: roleSession},
+			iam:  &fakeIAM{},
+			failed: map[string]string{
+				CheckAdmin: "the FMS administrator is 222222222222",
+			},
+			warned: map[string]string{
+				CheckQuota: "5 of 5 policies in use; runs that create policies will fail",
+			},
+		},
+		{
+			name: "role not ready",
+			fms:  &fakeFMS{admin: &fms.GetAdminAccountOutput{AdminAccount: aws.String("111111111111"), RoleStatus: fmstypes.AccountRoleStatusCreating}},
+			sts:  &fakeSTS{arn: roleSession},
+			iam:  &fakeIAM{},
+			failed: map[string]string{
+				CheckAdmin: "role status is CREATING",
+			},
+		},
+		{
+			name: "denied actions",
+			fms:  &fakeFMS{admin: readyAdmin("111111111111")},
+			sts:  &fakeSTS{arn: roleSession},
+			iam:  &fakeIAM{denied: map[string]bool{"fms:PutPolicy": true, "s3:PutObject": true}},
+			failed: map[string]string{
+				CheckPermissions: "denied fms:PutPolicy (implicitDeny), s3:PutObject on arn:aws:s3:::history/policy-history/* (implicitDeny)",
+			},
+		},
+		{
+			name: "simulation not allowed",
+			fms:  &fakeFMS{admin: readyAdmin("111111111111")},
+			sts:  &fakeSTS{arn: roleSession},
+			iam:  &fakeIAM{err: errors.New("AccessDenied")},
+			failed: map[string]string{
+				CheckPermissions: "grant the role iam:SimulatePrincipalPolicy",
+			},
+		},
+		{
+			name: "no credentials",
+			sts:  &fakeSTS{err: errors.New("no credentials")},
+			failed: map[string]string{
+				CheckIdentity: "check the AWS credentials",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report := Run(context.Background(), Clients{FMS: tc.fms, STS: tc.sts, IAM: tc.iam}, opts)
+			failed, warned := map[string]string{}, map[string]string{}
+			for _, r := range report.Results {
+				switch {
+				case !r.OK:
+					failed[r.Check] = r.Detail
+				case r.Warning:
+					warned[r.Check] = r.Detail
+				}
+			}
+			if len(warned) != len(tc.warned) {
+				t.Fatalf("unexpected warnings %v", warned)
+			}
+			for check, want := range tc.warned {
+				if !strings.Contains(warned[check], want) {
+					t.Fatalf("%s warning %q does not contain %q", check, warned[check], want)
+				}
+			}
+			if len(failed) != len(tc.failed) {
+				t.Fatalf("unexpected failed checks %v", failed)
+			}
+			for check, want := range tc.failed {
+				if !strings.Contains(failed[check], want) {
+					t.Fatalf("%s detail %q does not contain %q", check, failed[check], want)
+				}
+			}
+			if err := report.Err(); (err != nil) != (len(tc.failed) > 0) || (err != nil && !errors.Is(err, ErrFailed)) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tc.iam != nil && tc.iam.err == nil {
+				// One simulation each for "*", the parameter, the history objects and the bucket.
+				if tc.iam.principal != "arn:aws:iam::111111111111:role/fms-renderer-lambda-role" || tc.iam.calls != 4 {
+					t.Fatalf("simulated %d times as %q", tc.iam.calls, tc.iam.principal)
+				}
+			}
+		})
+	}
+}
+
+func TestReportCheckCreates(t *testing.T) {
+	for _, tc := range []struct {
+		inUse, quota, creates int
+		fail                  bool
+	}{
+		{inUse: 3, quota: 5, creates: 2},
+		{inUse: 3, quota: 5, creates: 3, fail: true},
+		// A full quota does not stop a run that only updates or prunes.
+		{inUse: 5, quota: 5, creates: 0},
+		{inUse: 5, quota: 5, creates: 1, fail: true},
+		{inUse: 60, quota: 0, creates: 1},
+	} {
+		report := &Report{PoliciesInUse: tc.inUse, PolicyQuota: tc.quota}
+		err := report.CheckCreates(tc.creates)
+		if (err != nil) != tc.fail || (err != nil && !errors.Is(err, ErrFailed)) {
+			t.Fatalf("CheckCreates(%d) with %d of %d in use = %v", tc.creates, tc.inUse, tc.quota, err)
+		}
+	}
+}
+
+func TestPrincipalARN(t *testing.T) {
+	for in, want := range map[string]string{
+		roleSession: "arn:aws:iam::111111111111:role/fms-renderer-lambda-role",
+		"arn:aws-us-gov:sts::111111111111:assumed-role/admin/jdoe": "arn:aws-us-gov:iam::111111111111:role/admin",
+		"arn:aws:iam::111111111111:user/ci":                        "arn:aws:iam::111111111111:user/ci",
+		"arn:aws:iam::111111111111:root":                           "",
+	} {
+		if got, err := principalARN(in); err != nil || got != want {
+			t.Fatalf("principalARN(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := principalARN("arn:aws:sts::111111111111:federated-user/bob"); err == nil {
+		t.Fatalf("expected an error for a federated user")
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	reqs := Requirements("aws", "111111111111", Options{Region: "eu-west-1", ConfigParam: "/fms/policy-variants", HistoryLocation: "s3://history"})
+	got := map[string]string{}
+	for _, r := range reqs[len(baseActions):] {
+		got[r.Action] = r.Resource
+	}
+	want := map[string]string{
+		"ssm:GetParameter": "arn:aws:ssm:eu-west-1:111111111111:parameter/fms/policy-variants",
+		"s3:GetObject":     "arn:aws:s3:::history/*",
+		"s3:PutObject":     "arn:aws:s3:::history/*",
+		"s3:ListBucket":    "arn:aws:s3:::history",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected requirements %v", got)
+	}
+	for action, resource := range want {
+		if got[action] != resource {
+			t.Fatalf("%s on %q, want %q", action, got[action], resource)
+		}
+	}
+	if reqs := Requirements("aws", "111111111111", Options{HistoryLocation: "/var/history"}); len(reqs) != len(baseActions) {
+		t.Fatalf("a local history needs no permissions, got %v", reqs[len(baseActions):])
+	}
+	gov := Requirements("aws-us-gov", "111111111111", Options{Region: "us-gov-west-1", ConfigParam: "cfg", HistoryLocation: "s3://history/runs/"})
+	for _, r := range gov[len(baseActions):] {
+		if !strings.HasPrefix(r.Resource, "arn:aws-us-gov:") {
+			t.Fatalf("%s on %q, want an aws-us-gov ARN", r.Action, r.Resource)
+		}
+	}
+	if got := gov[len(gov)-3].Resource; got != "arn:aws-us-gov:s3:::history/runs/*" {
+		t.Fatalf("objects ARN %q", got)
+	}
+}
+
+// TestBaseActionsMatchTerraform keeps baseActions in step with the statements of the
+// Lambda's inline policy that grant on "*": every granted action is listed and every
+// listed action is granted.
+func TestBaseActionsMatchTerraform(t *testing.T) {
+	data, err := os.ReadFile("../../terraform/main.tf")
+	if err != nil {
+		t.Fatalf("read terraform: %v", err)
+	}
+	statement := regexp.MustCompile(`sid\s*=\s*"(FMSPolicyUpdates|Discovery)"\s*effect\s*=\s*"Allow"\s*actions\s*=\s*\[([^\]]*)\]\s*resources\s*=\s*\["\*"\]`)
+	action := regexp.MustCompile(`"([a-z0-9-]+:[A-Za-z]+)"`)
+	granted := map[string]bool{}
+	statements := statement.FindAllStringSubmatch(string(data), -1)
+	if len(statements) != 2 {
+		t.Fatalf("found %d of the FMSPolicyUpdates and Discovery statements in terraform/main.tf", len(statements))
+	}
+	for _, m := range statements {
+		for _, a := range action.FindAllStringSubmatch(m[2], -1) {
+			granted[a[1]] = true
+		}
+	}
+	listed := map[string]bool{}
+	for _, a := range baseActions {
+		listed[a] = true
+		if !granted[a] {
+			t.Errorf("%s is in baseActions but not granted on \"*\" in terraform/main.tf", a)
+		}
+	}
+	for a := range granted {
+		if !listed[a] {
+			t.Errorf("%s is granted on \"*\" in terraform/main.tf but not in baseActions", a)
+		}
+	}
+}
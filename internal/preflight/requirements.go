@@ -0,0 +1,87 @@
+package preflight
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// Requirement is one action the run needs, on one resource ARN or "*".
+type Requirement struct {
+	Action   string
+	Resource string
+}
+
+// baseActions are the actions every run may call, as granted on "*" by the FMSPolicyUpdates
+// and Discovery statements of the Lambda's inline policy in terraform/main.tf.
+var baseActions = []string{
+	"fms:GetAdminAccount",
+	"fms:ListPolicies",
+	"fms:GetPolicy",
+	"fms:PutPolicy",
+	"fms:DeletePolicy",
+	"fms:ListComplianceStatus",
+	"fms:GetComplianceDetail",
+	"fms:GetViolationDetails",
+	"fms:ListTagsForResource",
+	"fms:TagResource",
+	"fms:UntagResource",
+	"fms:ListResourceSets",
+	"fms:GetResourceSet",
+	"fms:PutResourceSet",
+	"fms:DeleteResourceSet",
+	"fms:ListResourceSetResources",
+	"fms:BatchAssociateResource",
+	"fms:BatchDisassociateResource",
+	"elasticloadbalancing:DescribeLoadBalancers",
+	"elasticloadbalancing:DescribeTags",
+	"cloudfront:ListDistributions",
+	"cloudfront:ListTagsForResource",
+	"ec2:DescribeVpcs",
+	"organizations:ListAccountsForParent",
+	"sts:GetCallerIdentity",
+}
+
+// Requirements lists the actions a run in account needs: the base actions, reading the
+// SSM config parameter, and writing the S3 version store. Resource ARNs are in partition.
+func Requirements(partition, account string, opts Options) []Requirement {
+	reqs := make([]Requirement, 0, len(baseActions)+4)
+	for _, action := range baseActions {
+		reqs = append(reqs, Requirement{Action: action, Resource: "*"})
+	}
+	if opts.ConfigParam != "" {
+		reqs = append(reqs, Requirement{Action: "ssm:GetParameter", Resource: parameterARN(partition, account, opts.Region, opts.ConfigParam)})
+	}
+	if location, ok := strings.CutPrefix(opts.HistoryLocation, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(location, "/")
+		objects := bucket + "/*"
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			objects = bucket + "/" + prefix + "/*"
+		}
+		reqs = append(reqs,
+			Requirement{Action: "s3:GetObject", Resource: s3ARN(partition, objects)},
+			Requirement{Action: "s3:PutObject", Resource: s3ARN(partition, objects)},
+			Requirement{Action: "s3:ListBucket", Resource: s3ARN(partition, bucket)},
+		)
+	}
+	return reqs
+}
+
+// parameterARN returns the ARN of an SSM parameter given by name or ARN.
+func parameterARN(partition, account, region, param string) string {
+	if arn.IsARN(param) {
+		return param
+	}
+	return arn.ARN{
+		Partition: partition,
+		Service:   "ssm",
+		Region:    region,
+		AccountID: account,
+		Resource:  "parameter/" + strings.TrimPrefix(param, "/"),
+	}.String()
+}
+
+// s3ARN returns the ARN of an S3 bucket or object path; S3 ARNs have no region or account.
+func s3ARN(partition, resource string) string {
+	return arn.ARN{Partition: partition, Service: "s3", Resource: resource}.String()
+}
@@ -261,9 +261,24 @@ data "aws_iam_policy_document" "lambda_inline" {
     sid    = "FMSPolicyUpdates"
     effect = "Allow"
     actions = [
+      "fms:GetAdminAccount",
       "fms:ListPolicies",
       "fms:GetPolicy",
-      "fms:PutPolicy"
+      "fms:PutPolicy",
+      "fms:DeletePolicy",
+      "fms:ListComplianceStatus",
+      "fms:GetComplianceDetail",
+      "fms:GetViolationDetails",
+      "fms:ListTagsForResource",
+      "fms:TagResource",
+      "fms:UntagResource",
+      "fms:ListResourceSets",
+      "fms:GetResourceSet",
+      "fms:PutResourceSet",
+      "fms:DeleteResourceSet",
+      "fms:ListResourceSetResources",
+      "fms:BatchAssociateResource",
+      "fms:BatchDisassociateResource"
     ]
     resources = ["*"]
   }
@@ -274,12 +289,22 @@ data "aws_iam_policy_document" "lambda_inline" {
     actions = [
       "elasticloadbalancing:DescribeLoadBalancers",
       "elasticloadbalancing:DescribeTags",
+      "cloudfront:ListDistributions",
+      "cloudfront:ListTagsForResource",
+      "ec2:DescribeVpcs",
       "organizations:ListAccountsForParent",
       "sts:GetCallerIdentity"
     ]
     resources = ["*"]
   }
 
+  statement {
+    sid       = "PreflightPermissionCheck"
+    effect    = "Allow"
+    actions   = ["iam:SimulatePrincipalPolicy"]
+    resources = [aws_iam_role.lambda.arn]
+  }
+
   statement {
     sid    = "Logging"
     effect = "Allow"
@@ -299,6 +324,36 @@ data "aws_iam_policy_document" "lambda_inline" {
     ]
     resources = [aws_ssm_parameter.policy_variants.arn]
   }
+
+  dynamic "statement" {
+    for_each = var.plan_bucket == "" ? [] : [var.plan_bucket]
+    content {
+      sid       = "PlansFromS3"
+      effect    = "Allow"
+      actions   = ["s3:GetObject"]
+      resources = ["arn:aws:s3:::${statement.value}/*"]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.history_bucket == "" ? [] : [var.history_bucket]
+    content {
+      sid       = "PolicyHistoryObjects"
+      effect    = "Allow"
+      actions   = ["s3:GetObject", "s3:PutObject"]
+      resources = ["arn:aws:s3:::${statement.value}/policy-history/*"]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = var.history_bucket == "" ? [] : [var.history_bucket]
+    content {
+      sid       = "PolicyHistoryList"
+      effect    = "Allow"
+      actions   = ["s3:ListBucket"]
+      resources = ["arn:aws:s3:::${statement.value}"]
+    }
+  }
 }
 
 resource "aws_iam_role_policy" "lambda" {
@@ -333,6 +388,7 @@ resource "aws_lambda_function" "renderer" {
       DEFAULT_PRIMARY_RULES  = var.default_primary_rules
       DEFAULT_SECONDARY_RULES= var.default_secondary_rules
       CONFIG_SSM_PARAM       = var.config_ssm_param
+      POLICY_HISTORY         = var.history_bucket == "" ? "" : "s3://${var.history_bucket}/policy-history"
     }
   }
 
@@ -57,3 +57,15 @@ variable "config_ssm_param" {
   type        = string
   default     = "/aws-fms-secpolicy/policy-variants"
 }
+
+variable "plan_bucket" {
+  description = "S3 bucket the Lambda may read saved plans (planS3Uri) from; empty to disable"
+  type        = string
+  default     = ""
+}
+
+variable "history_bucket" {
+  description = "S3 bucket the Lambda saves replaced policy versions to (under policy-history/); empty keeps no history"
+  type        = string
+  default     = ""
+}